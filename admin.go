@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/admin"
+)
+
+// startAdminServer creates the admin API server and starts listening.
+func startAdminServer(env *env) (*admin.Server, error) {
+	srv, err := admin.New(&admin.Config{
+		Addr:     env.cfg.AdminAddr,
+		Token:    env.cfg.AdminToken,
+		Account:  env.cfg.StatsAccount(),
+		Protocol: env.cfg.Protocol,
+		Logger:   env.logger,
+	})
+	if err != nil {
+		env.logger.Error("creating admin api server failed", "error", err)
+		return nil, err
+	}
+
+	if err := srv.Start(); err != nil {
+		env.logger.Error("starting admin api server failed", "error", err, "address", env.cfg.AdminAddr)
+		return nil, err
+	}
+
+	return srv, nil
+}
+
+// shutdownAdminServer stops the admin API server, if it is running.
+func shutdownAdminServer(env *env) {
+	if env.admin == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := env.admin.Shutdown(ctx); err != nil {
+		env.logger.Warn("shutting down admin api server failed", "error", err)
+	}
+}
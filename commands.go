@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/iscan"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/stats"
+
+	flag "github.com/spf13/pflag"
+)
+
+// command is a subcommand that is run instead of the scanner process.
+type command struct {
+	name  string
+	args  string
+	short string
+	// run executes the command, args are the command line arguments
+	// following the command name, they must be parsed with fs.
+	run func(env *env, fs *flag.FlagSet, args []string) error
+}
+
+var commands = []*command{
+	{
+		name:  "fuzzy-add",
+		args:  "[--flag N] [--weight N] FILE...",
+		short: "add the hashes of the mail files to the rspamd fuzzy storage",
+		run:   runFuzzyAdd,
+	},
+	{
+		name:  "fuzzy-del",
+		args:  "[--flag N] FILE...",
+		short: "remove the hashes of the mail files from the rspamd fuzzy storage",
+		run:   runFuzzyDel,
+	},
+	{
+		name:  "stats",
+		args:  "[--format table|json] [--account NAME]",
+		short: "print the statistics of the last day, week and month",
+		run:   runStats,
+	},
+	{
+		name:  "replay",
+		args:  "[--format table|json] [--threshold N] MAILDIR|MBOX...",
+		short: "scan the mails of Maildirs and mbox files and compare the results with their folder names",
+		run:   runReplay,
+	},
+	{
+		name:  "learn-spam",
+		args:  "[--mailbox NAME] --uid UID...",
+		short: "learn the messages with the UIDs as spam, they are not moved",
+		run:   runLearnSpam,
+	},
+	{
+		name:  "learn-ham",
+		args:  "[--mailbox NAME] --uid UID...",
+		short: "learn the messages with the UIDs as ham, they are not moved",
+		run:   runLearnHam,
+	},
+	{
+		name:  "rescan",
+		args:  "[--mailbox NAME] [--format text|json] --uid UID...",
+		short: "scan the messages with the UIDs and move spam to the spam mailbox",
+		run:   runRescan,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [FLAGS] [COMMAND [ARGS]]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Without a command, the IMAP mailboxes are processed.\n\n")
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s%s\n", cmd.name, cmd.short)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand runs the subcommand args[0] and returns the exit code.
+func runCommand(env *env, args []string) int {
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+
+		if err := cmd.run(env, newCommandFlagSet(cmd), args[1:]); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return 0
+			}
+
+			env.logger.Error(cmd.name+" failed", "error", err)
+			return 1
+		}
+
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %q\n\n", args[0])
+	usage()
+	return 2
+}
+
+func newCommandFlagSet(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n\n%s\n\n", os.Args[0], cmd.name, cmd.args, cmd.short)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+func runFuzzyAdd(env *env, fs *flag.FlagSet, args []string) error {
+	fuzzyFlag := fs.Int("flag", env.cfg.FuzzyFlag, "fuzzy storage flag")
+	weight := fs.Int("weight", env.cfg.FuzzyWeight, "weight of the added hashes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return forEachMailFile(fs.Args(), env.logger, func(fd *os.File) error {
+		return env.rspamc.FuzzyAdd(context.Background(), fd, &rspamc.MailHeaders{}, *fuzzyFlag, *weight)
+	})
+}
+
+func runFuzzyDel(env *env, fs *flag.FlagSet, args []string) error {
+	fuzzyFlag := fs.Int("flag", env.cfg.FuzzyFlag, "fuzzy storage flag")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return forEachMailFile(fs.Args(), env.logger, func(fd *os.File) error {
+		return env.rspamc.FuzzyDel(context.Background(), fd, &rspamc.MailHeaders{}, *fuzzyFlag)
+	})
+}
+
+// statsPeriods are the time spans that the stats command prints.
+var statsPeriods = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"day", 24 * time.Hour},
+	{"week", 7 * 24 * time.Hour},
+	{"month", 30 * 24 * time.Hour},
+}
+
+func runStats(env *env, fs *flag.FlagSet, args []string) error {
+	format := fs.String("format", "table", `output format, "table" or "json"`)
+	account := fs.String("account", "", "only print the statistics of the account")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if env.cfg.StatsFile == "" {
+		return errors.New("StatsFile is not configured")
+	}
+
+	store, err := stats.Open(env.cfg.StatsFile, env.cfg.StatsAccount())
+	if err != nil {
+		return err
+	}
+
+	accounts := store.Accounts()
+	if *account != "" {
+		accounts = []string{*account}
+	}
+
+	now := time.Now()
+	result := map[string]map[string]*stats.Counters{}
+	for _, acc := range accounts {
+		result[acc] = map[string]*stats.Counters{}
+		for _, p := range statsPeriods {
+			result[acc][p.name] = store.Sum(acc, now.Add(-p.duration), now)
+		}
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+
+	case "table":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "ACCOUNT\tPERIOD\tSCANNED\tSPAM\tHAM\tLEARNED\tERRORS\tDUPLICATES\tBYTES\tDEGRADED\t")
+		for _, acc := range accounts {
+			for _, p := range statsPeriods {
+				c := result[acc][p.name]
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n",
+					acc, p.name, c.Scanned, c.Spam, c.Ham, c.Learned, c.Errors, c.Duplicates, c.Bytes, c.Degraded,
+				)
+			}
+		}
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("unsupported format: %q", *format)
+	}
+}
+
+func runReplay(env *env, fs *flag.FlagSet, args []string) error {
+	format := fs.String("format", "table", `output format, "table" or "json"`)
+	threshold := fs.Float32("threshold", env.cfg.SpamThreshold, "score from which mails are classified as spam")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return errors.New("no Maildir or mbox file specified")
+	}
+
+	r, err := iscan.NewReplayer(&iscan.ReplayConfig{
+		SpamTreshold:    *threshold,
+		RspamdDeliverTo: env.cfg.RspamdDeliverTo,
+		RspamdUser:      env.cfg.RspamdUser,
+		ScoreOverrides:  env.cfg.ScoreOverrides,
+		Logger:          env.logger,
+		Rspamc:          env.scanner,
+	})
+	if err != nil {
+		return err
+	}
+
+	report, err := r.Replay(context.Background(), fs.Args())
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+
+	case "table":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "SOURCE\tFOLDER\tLABEL\tSCORE\tACTION\tSPAM\tSUBJECT")
+		for _, res := range report.Results {
+			if res.Error != "" {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\t-\terror: %s\n", res.Source, res.Folder, res.Label, res.Error)
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%.2f\t%s\t%t\t%s\n",
+				res.Source, res.Folder, res.Label, res.Score, res.Action, res.IsSpam, res.Subject,
+			)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+
+		sum := report.Summary
+		fmt.Printf("\nThreshold: %g\n", report.Threshold)
+		tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "\tCLASSIFIED SPAM\tCLASSIFIED HAM\t")
+		fmt.Fprintf(tw, "LABELED SPAM\t%d\t%d\t\n", sum.TruePositives, sum.FalseNegatives)
+		fmt.Fprintf(tw, "LABELED HAM\t%d\t%d\t\n", sum.FalsePositives, sum.TrueNegatives)
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Printf("\nUnlabeled: %d, Errors: %d\n", sum.Unlabeled, sum.Errors)
+
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported format: %q", *format)
+	}
+}
+
+func runLearnSpam(env *env, fs *flag.FlagSet, args []string) error {
+	return runLearn(env, fs, args, env.cfg.InboxMailbox, true)
+}
+
+func runLearnHam(env *env, fs *flag.FlagSet, args []string) error {
+	return runLearn(env, fs, args, env.cfg.SpamMailbox, false)
+}
+
+func runLearn(env *env, fs *flag.FlagSet, args []string, defaultMailbox string, spam bool) error {
+	mailbox := fs.String("mailbox", defaultMailbox, "mailbox that contains the messages")
+	uidFlag := fs.UintSlice("uid", nil, "UID of a message, can be specified multiple times")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	uids, err := parseUIDs(*uidFlag)
+	if err != nil {
+		return err
+	}
+
+	clt, err := newCommandClient(env)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = clt.Stop() }()
+
+	class := "ham"
+	if spam {
+		class = "spam"
+	}
+
+	var errs []error
+	for _, uid := range uids {
+		if err := clt.LearnMessages(context.Background(), *mailbox, []uint32{uid}, spam); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Printf("learned message %d in %q as %s\n", uid, *mailbox, class)
+	}
+
+	return errors.Join(errs...)
+}
+
+func runRescan(env *env, fs *flag.FlagSet, args []string) error {
+	mailbox := fs.String("mailbox", env.cfg.InboxMailbox, "mailbox that contains the messages")
+	format := fs.String("format", "text", `output format, "text" or "json"`)
+	uidFlag := fs.UintSlice("uid", nil, "UID of a message, can be specified multiple times")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unsupported format: %q", *format)
+	}
+
+	uids, err := parseUIDs(*uidFlag)
+	if err != nil {
+		return err
+	}
+
+	clt, err := newCommandClient(env)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = clt.Stop() }()
+
+	// the results of the messages that were scanned before an error
+	// happened are printed too
+	results, scanErr := clt.RescanMessages(context.Background(), *mailbox, uids)
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+		return scanErr
+	}
+
+	for _, res := range results {
+		fmt.Printf("UID:     %d\n", res.UID)
+		fmt.Printf("Subject: %s\n", res.Subject)
+		fmt.Printf("Score:   %.2f\n", res.Result.Score)
+		fmt.Printf("Action:  %s\n", res.Result.Action)
+		if res.Spam && *mailbox != env.cfg.SpamMailbox && !env.flags.dryRun {
+			fmt.Printf("Spam:    true, moved to %q\n", env.cfg.SpamMailbox)
+		} else {
+			fmt.Printf("Spam:    %t\n", res.Spam)
+		}
+		fmt.Println("Symbols:")
+		for _, sym := range res.Result.SortedSymbols() {
+			fmt.Printf("  %s\n", sym)
+		}
+		fmt.Println()
+	}
+
+	return scanErr
+}
+
+// parseUIDs converts the values of the --uid flag to message UIDs.
+func parseUIDs(vals []uint) ([]uint32, error) {
+	if len(vals) == 0 {
+		return nil, errors.New("no --uid specified")
+	}
+
+	result := make([]uint32, 0, len(vals))
+	for _, v := range vals {
+		if v == 0 || v > math.MaxUint32 {
+			return nil, fmt.Errorf("invalid UID: %d", v)
+		}
+		result = append(result, uint32(v))
+	}
+
+	return result, nil
+}
+
+// newCommandClient returns a client for the commands that operate on
+// messages of the configured account.
+func newCommandClient(env *env) (*iscan.Client, error) {
+	switch env.cfg.Protocol {
+	case "imap", "jmap":
+		return newIscanClient(env)
+	default:
+		return nil, fmt.Errorf("the command is not supported with Protocol %q", env.cfg.Protocol)
+	}
+}
+
+// forEachMailFile opens every file in paths and calls fn with it.
+// "-" refers to stdin.
+func forEachMailFile(paths []string, logger *slog.Logger, fn func(*os.File) error) error {
+	var errs []error
+
+	if len(paths) == 0 {
+		return errors.New("no mail files specified")
+	}
+
+	for _, path := range paths {
+		if path == "-" {
+			if err := fn(os.Stdin); err != nil {
+				errs = append(errs, fmt.Errorf("stdin: %w", err))
+			}
+			continue
+		}
+
+		fd, err := os.Open(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		err = fn(fd)
+		_ = fd.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+
+		logger.Info("processed mail file", "filepath", path)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,418 @@
+// Package admin provides an HTTP API to trigger operations of the running
+// scanner and to query its status.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/iscan"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/notify"
+	"github.com/fho/rspamd-iscan/internal/stats"
+)
+
+// maxRequestBodySize is the max. size of request bodies.
+const maxRequestBodySize = 64 * 1024
+
+// Scanner is the scanner that the API operates on.
+// It can optionally implement [MailboxRescanner], [Learner], [CacheFlusher]
+// and [MailboxCreator], otherwise the corresponding endpoints respond with
+// status 501.
+type Scanner interface {
+	ScanNow(ctx context.Context) error
+}
+
+// MailboxRescanner scans all messages in a mailbox.
+type MailboxRescanner interface {
+	RescanMailbox(ctx context.Context, mailbox string) (*iscan.RescanResult, error)
+}
+
+// Learner learns a single message as spam or ham.
+type Learner interface {
+	LearnMessage(ctx context.Context, mailbox string, uid uint32, spam bool) error
+}
+
+// CacheFlusher removes all entries from the scan cache.
+type CacheFlusher interface {
+	FlushCache(ctx context.Context) (int, error)
+}
+
+// MailboxCreator creates the configured mailboxes that do not exist.
+type MailboxCreator interface {
+	CreateMailboxes(ctx context.Context) ([]string, error)
+}
+
+type Config struct {
+	// Addr is the TCP address that the server listens on.
+	Addr string
+	// Token must be sent by clients as bearer token.
+	Token    string
+	Account  string
+	Protocol string
+	Logger   *slog.Logger
+}
+
+// Server serves the admin API.
+// The scanner is exchanged via [Server.SetScanner] when it is recreated.
+// Server implements [iscan.Notifier] to record the results of the scan cycles.
+type Server struct {
+	token    string
+	account  string
+	protocol string
+	logger   *slog.Logger
+	srv      *http.Server
+
+	mu           sync.Mutex
+	scanner      Scanner
+	startedAt    time.Time
+	cycles       uint64
+	failedCycles uint64
+	lastCycleAt  time.Time
+	lastError    string
+	counters     stats.Counters
+	// rspamdUnavailable is true if the last scan cycle was degraded.
+	rspamdUnavailable bool
+}
+
+// Status is the response of the status endpoint.
+type Status struct {
+	Account        string    `json:"account"`
+	Protocol       string    `json:"protocol"`
+	StartedAt      time.Time `json:"started_at"`
+	ScannerRunning bool      `json:"scanner_running"`
+	Cycles         uint64    `json:"cycles"`
+	FailedCycles   uint64    `json:"failed_cycles"`
+	LastCycleAt    time.Time `json:"last_cycle_at,omitzero"`
+	// LastError is the error of the last scan cycle, it is empty if it
+	// succeeded.
+	LastError string `json:"last_error,omitempty"`
+	// RspamdUnavailable is true if messages were not scanned in the last
+	// scan cycle, because rspamd was unavailable.
+	RspamdUnavailable bool `json:"rspamd_unavailable"`
+	// Counters are the sums of the counters of all scan cycles since the
+	// process started.
+	Counters stats.Counters `json:"counters"`
+}
+
+type learnRequest struct {
+	Mailbox string `json:"mailbox"`
+	UID     uint32 `json:"uid"`
+	// Class is "spam" or "ham".
+	Class string `json:"class"`
+}
+
+type rescanRequest struct {
+	Mailbox string `json:"mailbox"`
+}
+
+func New(cfg *Config) (*Server, error) {
+	if cfg.Token == "" {
+		return nil, errors.New("token is empty")
+	}
+
+	s := &Server{
+		token:     cfg.Token,
+		account:   cfg.Account,
+		protocol:  cfg.Protocol,
+		logger:    log.Module(cfg.Logger, "admin"),
+		startedAt: time.Now(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/status", s.handleStatus)
+	mux.HandleFunc("POST /api/v1/scan", s.handleScan)
+	mux.HandleFunc("POST /api/v1/rescan", s.handleRescan)
+	mux.HandleFunc("POST /api/v1/learn", s.handleLearn)
+	mux.HandleFunc("POST /api/v1/cache/flush", s.handleCacheFlush)
+	mux.HandleFunc("POST /api/v1/mailboxes/create", s.handleCreateMailboxes)
+
+	s.srv = &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           s.authenticate(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          slog.NewLogLogger(s.logger.Handler(), slog.LevelWarn),
+	}
+
+	return s, nil
+}
+
+// Start listens on the configured address and serves requests in a
+// goroutine.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("admin api is listening", "address", ln.Addr().String())
+
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("serving admin api failed", "error", err, "event", "admin.serve_failed")
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown stops the server, it waits for active requests until ctx is
+// canceled.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// SetScanner sets the scanner that requests operate on, nil can be passed
+// while no scanner is running.
+func (s *Server) SetScanner(scanner Scanner) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scanner = scanner
+}
+
+// ScanCycleDone records the result of a scan cycle.
+func (s *Server) ScanCycleDone(_ context.Context, r *notify.CycleResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cycles++
+	s.lastCycleAt = time.Now()
+	s.counters.Add(&r.Counters)
+	s.rspamdUnavailable = r.Counters.Degraded > 0
+
+	if r.Err != nil {
+		s.failedCycles++
+		s.lastError = r.Err.Error()
+	} else {
+		s.lastError = ""
+	}
+}
+
+func (s *Server) getScanner() Scanner {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.scanner
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	want := []byte("Bearer " + s.token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			s.logger.Warn("rejected unauthenticated request",
+				"remote_addr", r.RemoteAddr, "path", r.URL.Path,
+				"event", "admin.unauthenticated")
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing bearer token"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	status := Status{
+		Account:           s.account,
+		Protocol:          s.protocol,
+		StartedAt:         s.startedAt,
+		ScannerRunning:    s.scanner != nil,
+		Cycles:            s.cycles,
+		FailedCycles:      s.failedCycles,
+		LastCycleAt:       s.lastCycleAt,
+		LastError:         s.lastError,
+		RspamdUnavailable: s.rspamdUnavailable,
+		Counters:          s.counters,
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, &status)
+}
+
+func (s *Server) handleScan(w http.ResponseWriter, r *http.Request) {
+	scanner := s.getScanner()
+	if scanner == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("scanner is not running"))
+		return
+	}
+
+	s.logger.Info("scan requested", "event", "admin.scan")
+
+	if err := scanner.ScanNow(r.Context()); err != nil {
+		s.writeOpError(w, "scan", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleRescan(w http.ResponseWriter, r *http.Request) {
+	var req rescanRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	if req.Mailbox == "" {
+		writeError(w, http.StatusBadRequest, errors.New("mailbox is empty"))
+		return
+	}
+
+	current := s.getScanner()
+	scanner, ok := current.(MailboxRescanner)
+	if !s.checkSupported(w, current, ok) {
+		return
+	}
+
+	s.logger.Info("rescan requested", "mailbox", req.Mailbox, "event", "admin.rescan")
+
+	result, err := scanner.RescanMailbox(r.Context(), req.Mailbox)
+	if err != nil {
+		s.writeOpError(w, "rescan", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleLearn(w http.ResponseWriter, r *http.Request) {
+	var req learnRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	if req.Mailbox == "" || req.UID == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("mailbox and uid must be set"))
+		return
+	}
+
+	if req.Class != "spam" && req.Class != "ham" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf(`class must be "spam" or "ham", got %q`, req.Class))
+		return
+	}
+
+	current := s.getScanner()
+	scanner, ok := current.(Learner)
+	if !s.checkSupported(w, current, ok) {
+		return
+	}
+
+	s.logger.Info("learning requested",
+		"mailbox", req.Mailbox, "mail.uid", req.UID, "class", req.Class,
+		"event", "admin.learn")
+
+	if err := scanner.LearnMessage(r.Context(), req.Mailbox, req.UID, req.Class == "spam"); err != nil {
+		s.writeOpError(w, "learn", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	current := s.getScanner()
+	scanner, ok := current.(CacheFlusher)
+	if !s.checkSupported(w, current, ok) {
+		return
+	}
+
+	s.logger.Info("cache flush requested", "event", "admin.cache_flush")
+
+	cnt, err := scanner.FlushCache(r.Context())
+	if err != nil {
+		s.writeOpError(w, "cache flush", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"flushed": cnt})
+}
+
+func (s *Server) handleCreateMailboxes(w http.ResponseWriter, r *http.Request) {
+	current := s.getScanner()
+	scanner, ok := current.(MailboxCreator)
+	if !s.checkSupported(w, current, ok) {
+		return
+	}
+
+	s.logger.Info("creating mailboxes requested", "event", "admin.create_mailboxes")
+
+	created, err := scanner.CreateMailboxes(r.Context())
+	if err != nil {
+		s.writeOpError(w, "creating mailboxes", err)
+		return
+	}
+
+	if created == nil {
+		created = []string{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]string{"created": created})
+}
+
+// checkSupported writes an error response and returns false if no scanner is
+// running or it does not support the operation.
+func (s *Server) checkSupported(w http.ResponseWriter, scanner Scanner, supported bool) bool {
+	if scanner == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("scanner is not running"))
+		return false
+	}
+
+	if !supported {
+		writeError(w, http.StatusNotImplemented, fmt.Errorf("operation is not supported with protocol %q", s.protocol))
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) writeOpError(w http.ResponseWriter, op string, err error) {
+	status := http.StatusInternalServerError
+
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+		status = http.StatusNotImplemented
+	case errors.Is(err, iscan.ErrMessageNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, iscan.ErrStopped):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusServiceUnavailable
+	}
+
+	s.logger.Warn(op+" failed", "error", err, "event", "admin.op_failed")
+	writeError(w, status, err)
+}
+
+// decodeRequest decodes the JSON request body into v.
+// If that fails, an error response is written and false is returned.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decoding request body failed: %w", err))
+		return false
+	}
+
+	return true
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
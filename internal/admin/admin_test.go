@@ -0,0 +1,169 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/iscan"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/notify"
+	"github.com/fho/rspamd-iscan/internal/stats"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+const testToken = "secret"
+
+type fakeScanner struct {
+	scans   int
+	learned []string
+}
+
+func (s *fakeScanner) ScanNow(context.Context) error {
+	s.scans++
+	return nil
+}
+
+func (s *fakeScanner) RescanMailbox(_ context.Context, mailbox string) (*iscan.RescanResult, error) {
+	return &iscan.RescanResult{Scanned: len(mailbox), Spam: 1}, nil
+}
+
+func (s *fakeScanner) LearnMessage(_ context.Context, mailbox string, uid uint32, spam bool) error {
+	if uid == 404 {
+		return fmt.Errorf("%w: uid %d", iscan.ErrMessageNotFound, uid)
+	}
+	s.learned = append(s.learned, fmt.Sprintf("%s/%d/%t", mailbox, uid, spam))
+	return nil
+}
+
+func (s *fakeScanner) CreateMailboxes(context.Context) ([]string, error) {
+	return []string{"Spam"}, nil
+}
+
+// scanOnly does not implement the optional interfaces.
+type scanOnly struct{}
+
+func (scanOnly) ScanNow(context.Context) error {
+	return errors.New("scan failed")
+}
+
+func newTestServer(t *testing.T) *Server {
+	srv, err := New(&Config{
+		Token:    testToken,
+		Account:  "rick@imap",
+		Protocol: "imap",
+		Logger:   log.SlogTestLogger(t),
+	})
+	assert.NoError(t, err)
+
+	return srv
+}
+
+func request(t *testing.T, srv *Server, method, path, body string) (int, map[string]any) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+
+	rec := httptest.NewRecorder()
+	srv.srv.Handler.ServeHTTP(rec, req)
+
+	var result map[string]any
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+
+	return rec.Code, result
+}
+
+func TestAuthentication(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, auth := range []string{"", "Bearer wrong", testToken} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/status", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+
+		rec := httptest.NewRecorder()
+		srv.srv.Handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+
+	_, err := New(&Config{})
+	assert.Error(t, err)
+}
+
+func TestOperations(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, _ := request(t, srv, http.MethodPost, "/api/v1/scan", "")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	var scanner fakeScanner
+	srv.SetScanner(&scanner)
+
+	code, _ = request(t, srv, http.MethodPost, "/api/v1/scan", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, scanner.scans)
+
+	code, res := request(t, srv, http.MethodPost, "/api/v1/rescan", `{"mailbox": "INBOX"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal[any](t, float64(5), res["scanned"])
+
+	code, _ = request(t, srv, http.MethodPost, "/api/v1/learn", `{"mailbox": "INBOX", "uid": 42, "class": "spam"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "INBOX/42/true", strings.Join(scanner.learned, ","))
+
+	code, _ = request(t, srv, http.MethodPost, "/api/v1/learn", `{"mailbox": "INBOX", "uid": 404, "class": "ham"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = request(t, srv, http.MethodPost, "/api/v1/learn", `{"mailbox": "INBOX", "uid": 42, "class": "eggs"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = request(t, srv, http.MethodPost, "/api/v1/cache/flush", "")
+	assert.Equal(t, http.StatusNotImplemented, code)
+
+	code, res = request(t, srv, http.MethodPost, "/api/v1/mailboxes/create", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[Spam]", fmt.Sprint(res["created"]))
+
+	srv.SetScanner(scanOnly{})
+
+	code, res = request(t, srv, http.MethodPost, "/api/v1/scan", "")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Equal[any](t, "scan failed", res["error"])
+
+	code, _ = request(t, srv, http.MethodPost, "/api/v1/rescan", `{"mailbox": "INBOX"}`)
+	assert.Equal(t, http.StatusNotImplemented, code)
+}
+
+func TestStatus(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.ScanCycleDone(context.Background(), &notify.CycleResult{
+		Counters: stats.Counters{Scanned: 2, Spam: 1, Ham: 1},
+	})
+	srv.ScanCycleDone(context.Background(), &notify.CycleResult{
+		Counters: stats.Counters{Errors: 1},
+		Err:      errors.New("connection refused"),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/status", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	srv.srv.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var status Status
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal(t, "rick@imap", status.Account)
+	assert.Equal(t, false, status.ScannerRunning)
+	assert.Equal(t, uint64(2), status.Cycles)
+	assert.Equal(t, uint64(1), status.FailedCycles)
+	assert.Equal(t, "connection refused", status.LastError)
+	assert.Equal(t, stats.Counters{Scanned: 2, Spam: 1, Ham: 1, Errors: 1}, status.Counters)
+}
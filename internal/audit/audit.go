@@ -0,0 +1,256 @@
+// Package audit writes an append-only log of the actions that are taken on
+// mails, one JSON object per line.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Actions that are recorded in the audit log.
+const (
+	// ActionMove is recorded when a message is moved to another mailbox.
+	ActionMove = "move"
+	// ActionUpload is recorded when a modified copy of a message, with
+	// the scan result headers, is uploaded to a mailbox.
+	ActionUpload = "upload"
+	// ActionFlag is recorded when keywords are added to a message that is
+	// left in its mailbox.
+	ActionFlag = "flag"
+	// ActionLearnSpam is recorded when a message is learned as spam.
+	ActionLearnSpam = "learn_spam"
+	// ActionLearnHam is recorded when a message is learned as ham.
+	ActionLearnHam = "learn_ham"
+	// ActionFuzzyAdd is recorded when the hashes of a message are added to
+	// the fuzzy storage.
+	ActionFuzzyAdd = "fuzzy_add"
+	// ActionDelete is recorded when a message is deleted permanently.
+	ActionDelete = "delete"
+)
+
+// Entry is a record of an action on a message.
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Account string    `json:"account,omitempty"`
+	Action  string    `json:"action"`
+	// Reason describes why the action was taken, e.g. "spam", "ham" or
+	// "allowlisted".
+	Reason string `json:"reason,omitempty"`
+	// Mailbox is the mailbox that contained the message.
+	Mailbox string `json:"mailbox"`
+	// Destination is the mailbox that the message was moved or uploaded
+	// to.
+	Destination string `json:"destination,omitempty"`
+	UID         uint32 `json:"uid"`
+	// Key identifies messages that have no stable UID, it is the unique-id
+	// listing of POP3 messages and the unique file name part of Maildir
+	// messages.
+	Key       string   `json:"key,omitempty"`
+	MessageID string   `json:"message_id,omitempty"`
+	Subject   string   `json:"subject,omitempty"`
+	Score     *float32 `json:"score,omitempty"`
+	// RspamdAction is the action that was recommended by rspamd.
+	RspamdAction string   `json:"rspamd_action,omitempty"`
+	Keywords     []string `json:"keywords,omitempty"`
+}
+
+type Config struct {
+	Path string
+	// Account is recorded in every entry, it is optional.
+	Account string
+	// MaxSize is the size in bytes after that the log file is rotated. If
+	// it is 0, the file is never rotated.
+	MaxSize int64
+	// MaxFiles is the number of rotated files that are kept, older files
+	// are deleted.
+	MaxFiles int
+	Logger   *slog.Logger
+}
+
+// Log is an append-only audit log file.
+// When the file exceeds [Config.MaxSize], it is renamed to PATH.1, existing
+// rotated files are renamed to PATH.2, PATH.3, etc.
+// A nil *Log is a disabled log, its methods do nothing.
+// It can be used concurrently.
+type Log struct {
+	path     string
+	account  string
+	maxSize  int64
+	maxFiles int
+	logger   *slog.Logger
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+// Open opens the audit log file at cfg.Path for appending, it is created if
+// it does not exist.
+func Open(cfg *Config) (*Log, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("path is empty")
+	}
+	if cfg.MaxSize < 0 {
+		return nil, errors.New("MaxSize must not be negative")
+	}
+	if cfg.MaxFiles < 0 {
+		return nil, errors.New("MaxFiles must not be negative")
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+
+	l := Log{
+		path:     cfg.Path,
+		account:  cfg.Account,
+		maxSize:  cfg.MaxSize,
+		maxFiles: cfg.MaxFiles,
+		logger:   logger,
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return &l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening audit log failed: %w", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("querying size of audit log failed: %w", err)
+	}
+
+	l.f = f
+	l.size = fi.Size()
+
+	return nil
+}
+
+// Record appends e to the log. If e.Time is zero, the current time is used.
+// Errors are logged, the action that is recorded already happened and can not
+// be undone.
+func (l *Log) Record(e *Entry) {
+	if l == nil {
+		return
+	}
+
+	if err := l.record(e); err != nil {
+		l.logger.Error("writing audit log entry failed",
+			"error", err,
+			"path", l.path,
+			"event", "audit.write_failed",
+		)
+	}
+}
+
+func (l *Log) record(e *Entry) error {
+	entry := *e
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.Account == "" {
+		entry.Account = l.account
+	}
+
+	buf, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return errors.New("audit log is closed")
+	}
+
+	if l.f == nil {
+		// a previous rotation failed
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(buf)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(buf)
+	l.size += int64(n)
+
+	return err
+}
+
+// rotate renames the current log file and opens a new one.
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		l.logger.Warn("closing audit log failed", "error", err, "path", l.path)
+	}
+	l.f = nil
+
+	if l.maxFiles == 0 {
+		if err := os.Remove(l.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removing audit log failed: %w", err)
+		}
+		return l.open()
+	}
+
+	for i := l.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(l.rotatedPath(i), l.rotatedPath(i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("rotating audit log failed: %w", err)
+		}
+	}
+
+	if err := os.Rename(l.path, l.rotatedPath(1)); err != nil {
+		return fmt.Errorf("rotating audit log failed: %w", err)
+	}
+
+	l.logger.Debug("rotated audit log", "path", l.path, "event", "audit.rotated")
+
+	return l.open()
+}
+
+func (l *Log) rotatedPath(n int) string {
+	return l.path + "." + strconv.Itoa(n)
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	if l.f == nil {
+		return nil
+	}
+
+	err := l.f.Close()
+	l.f = nil
+
+	return err
+}
@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func readEntries(t *testing.T, path string) []*Entry {
+	t.Helper()
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	var result []*Entry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e Entry
+		assert.NoError(t, json.Unmarshal(sc.Bytes(), &e))
+		result = append(result, &e)
+	}
+	assert.NoError(t, sc.Err())
+
+	return result
+}
+
+func TestRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	ts := time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC)
+	score := float32(12.5)
+
+	l, err := Open(&Config{Path: path, Account: "user@imap"})
+	assert.NoError(t, err)
+
+	l.Record(&Entry{
+		Time:         ts,
+		Action:       ActionUpload,
+		Reason:       "spam",
+		Mailbox:      "Unscanned",
+		Destination:  "Spam",
+		UID:          3,
+		MessageID:    "<1@example.com>",
+		Subject:      "hello",
+		Score:        &score,
+		RspamdAction: "reject",
+	})
+	assert.NoError(t, l.Close())
+
+	// entries are appended to the existing file
+	l, err = Open(&Config{Path: path})
+	assert.NoError(t, err)
+	l.Record(&Entry{Action: ActionLearnHam, Mailbox: "Ham", UID: 4})
+	assert.NoError(t, l.Close())
+
+	entries := readEntries(t, path)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, ts, entries[0].Time)
+	assert.Equal(t, "user@imap", entries[0].Account)
+	assert.Equal(t, "Spam", entries[0].Destination)
+	assert.Equal(t, score, *entries[0].Score)
+	assert.Equal(t, ActionLearnHam, entries[1].Action)
+	assert.Equal(t, uint32(4), entries[1].UID)
+	if entries[1].Time.IsZero() {
+		t.Error("time of entry is not set")
+	}
+
+	var disabled *Log
+	disabled.Record(&Entry{Action: ActionMove})
+	assert.NoError(t, disabled.Close())
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	l, err := Open(&Config{Path: path, MaxSize: 100, MaxFiles: 2})
+	assert.NoError(t, err)
+
+	for i := range 4 {
+		l.Record(&Entry{Action: ActionMove, Mailbox: "INBOX", UID: uint32(i + 1)})
+	}
+	assert.NoError(t, l.Close())
+
+	// every entry exceeds half of MaxSize, each one is in its own file,
+	// the oldest one was deleted
+	_, err = os.Stat(path + ".3")
+	assert.Error(t, err)
+
+	for path, uid := range map[string]uint32{path: 4, path + ".1": 3, path + ".2": 2} {
+		entries := readEntries(t, path)
+		assert.Equal(t, 1, len(entries))
+		assert.Equal(t, uid, entries[0].UID)
+	}
+}
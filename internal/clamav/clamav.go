@@ -0,0 +1,263 @@
+// Package clamav is a client for the ClamAV daemon (clamd). Messages are
+// scanned for malware via the INSTREAM command.
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+const (
+	// SymbolVirus is the name of the symbol that is added to the check
+	// result when malware was found, its options contain the names of the
+	// signatures that matched.
+	SymbolVirus = "CLAMAV_VIRUS"
+	// ActionReject is the action of check results of infected messages.
+	ActionReject = "reject"
+	actionNone   = "no action"
+
+	// DefaultScore is the score of infected messages, when no score is
+	// configured.
+	DefaultScore = 100
+
+	// unixSocketScheme is the prefix of addresses that refer to a unix
+	// socket.
+	unixSocketScheme = "unix://"
+	// chunkSize is the max. size of the chunks the message is streamed
+	// in.
+	chunkSize = 64 * 1024
+)
+
+// ErrUnavailable is wrapped by errors of requests that failed because clamd
+// could not be reached or did not respond in time.
+var ErrUnavailable = errors.New("clamd unavailable")
+
+type Config struct {
+	// Addr is the address of clamd, either "host:port" for a TCP
+	// connection, or "unix://" followed by the path of a unix socket, e.g.
+	// "unix:///run/clamav/clamd.ctl".
+	Addr string
+	// Timeout is the max. duration of a scan, if it is 0 scans do not
+	// time out.
+	Timeout time.Duration
+	// Score is the score of infected messages, if it is 0 [DefaultScore]
+	// is used.
+	Score  float32
+	Logger *slog.Logger
+}
+
+// Client scans messages with clamd. It implements the methods of an rspamd
+// client, infected messages are reported as check result with the
+// [SymbolVirus] symbol and the [ActionReject] action.
+type Client struct {
+	network string
+	addr    string
+	timeout time.Duration
+	score   float32
+	logger  *slog.Logger
+}
+
+func New(cfg *Config) *Client {
+	c := Client{
+		network: "tcp",
+		addr:    cfg.Addr,
+		timeout: cfg.Timeout,
+		score:   cfg.Score,
+		logger:  log.Module(cfg.Logger, "clamav").WithGroup("clamav"),
+	}
+
+	if path, ok := strings.CutPrefix(cfg.Addr, unixSocketScheme); ok {
+		c.network = "unix"
+		c.addr = path
+	}
+
+	if c.score == 0 {
+		c.score = DefaultScore
+	}
+
+	return &c
+}
+
+// Check streams msg to clamd. If malware is found the result contains the
+// [SymbolVirus] symbol with the configured score, otherwise it is empty.
+// Messages that exceed the StreamMaxLength of clamd are not scanned, an empty
+// result is returned for them.
+func (c *Client) Check(ctx context.Context, msg io.Reader, _ *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	reply, err := c.instream(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.parseReply(reply)
+}
+
+// Ham does nothing, clamd does not learn messages.
+func (*Client) Ham(context.Context, io.Reader, *rspamc.MailHeaders) error {
+	return nil
+}
+
+// Spam does nothing, clamd does not learn messages.
+func (*Client) Spam(context.Context, io.Reader, *rspamc.MailHeaders) error {
+	return nil
+}
+
+// instream sends msg with the INSTREAM command to clamd and returns its
+// reply.
+func (c *Client) instream(ctx context.Context, msg io.Reader) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	defer conn.Close()
+
+	// unblock reads and writes when ctx is canceled
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	reply, err := sendStream(conn, msg)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("%w: %w: %w", ErrUnavailable, ctx.Err(), err)
+		}
+		return "", err
+	}
+
+	return reply, nil
+}
+
+// sendStream writes the INSTREAM command followed by the chunks of msg to
+// conn and reads the reply.
+func sendStream(conn net.Conn, msg io.Reader) (string, error) {
+	r := bufio.NewReader(conn)
+
+	err := writeStream(conn, msg)
+	if err != nil {
+		if !errors.Is(err, ErrUnavailable) {
+			return "", err
+		}
+		// clamd closes the connection when the message exceeds its
+		// StreamMaxLength, after sending a reply
+		if reply, rerr := readReply(r); rerr == nil {
+			return reply, nil
+		}
+		return "", err
+	}
+
+	reply, err := readReply(r)
+	if err != nil {
+		return "", fmt.Errorf("%w: reading reply failed: %w", ErrUnavailable, err)
+	}
+
+	return reply, nil
+}
+
+func writeStream(conn net.Conn, msg io.Reader) error {
+	w := bufio.NewWriterSize(conn, chunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return fmt.Errorf("%w: sending command failed: %w", ErrUnavailable, err)
+	}
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, readErr := io.ReadFull(msg, buf)
+		if n > 0 {
+			if err := writeChunk(w, buf[:n]); err != nil {
+				return fmt.Errorf("%w: sending message failed: %w", ErrUnavailable, err)
+			}
+		}
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("reading message failed: %w", readErr)
+		}
+	}
+
+	// a zero-length chunk terminates the stream
+	if err := writeChunk(w, nil); err != nil {
+		return fmt.Errorf("%w: sending message failed: %w", ErrUnavailable, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("%w: sending message failed: %w", ErrUnavailable, err)
+	}
+
+	return nil
+}
+
+// readReply reads a null-terminated reply of clamd.
+func readReply(r *bufio.Reader) (string, error) {
+	reply, err := r.ReadBytes(0)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimSuffix(reply, []byte{0})), nil
+}
+
+func writeChunk(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// parseReply converts a reply of clamd to a check result, e.g.
+// "stream: OK" or "stream: Win.Test.EICAR_HDB-1 FOUND".
+func (c *Client) parseReply(reply string) (*rspamc.CheckResult, error) {
+	reply = strings.TrimSpace(reply)
+
+	if strings.HasPrefix(reply, "INSTREAM size limit exceeded") {
+		c.logger.Warn("message exceeds the StreamMaxLength of clamd, it is not scanned for malware",
+			"event", "clamav.size_limit_exceeded")
+		return &rspamc.CheckResult{Action: actionNone, IsSkipped: true}, nil
+	}
+
+	result, ok := strings.CutPrefix(reply, "stream: ")
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply from clamd: %q", reply)
+	}
+
+	if result == "OK" {
+		return &rspamc.CheckResult{Action: actionNone}, nil
+	}
+
+	if signature, ok := strings.CutSuffix(result, " FOUND"); ok {
+		c.logger.Debug("malware found", "signature", signature, "event", "clamav.malware_found")
+		return &rspamc.CheckResult{
+			Action: ActionReject,
+			Score:  c.score,
+			Symbols: map[string]*rspamc.Symbol{
+				SymbolVirus: {
+					Name:        SymbolVirus,
+					Score:       c.score,
+					Description: "Malware found by ClamAV",
+					Options:     []string{signature},
+				},
+			},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("clamd scan failed: %s", result)
+}
@@ -0,0 +1,154 @@
+package clamav
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+// fakeClamd accepts INSTREAM requests on ln and responds with the result of
+// replyFn for the received message.
+func fakeClamd(t *testing.T, ln net.Listener, replyFn func(msg string) string) {
+	t.Helper()
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					return
+				}
+
+				var msg strings.Builder
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&msg, r, int64(size)); err != nil {
+						return
+					}
+				}
+
+				_, _ = conn.Write([]byte(replyFn(msg.String()) + "\x00"))
+			}()
+		}
+	}()
+}
+
+func TestCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	fakeClamd(t, ln, func(msg string) string {
+		if strings.Contains(msg, "EICAR") {
+			return "stream: Win.Test.EICAR_HDB-1 FOUND"
+		}
+		return "stream: OK"
+	})
+
+	clt := New(&Config{Addr: ln.Addr().String(), Logger: log.SlogTestLogger(t)})
+
+	result, err := clt.Check(context.Background(), strings.NewReader("Subject: test\r\n\r\nbody"), &rspamc.MailHeaders{})
+	assert.NoError(t, err)
+	assert.Equal(t, actionNone, result.Action)
+	assert.Equal(t, 0, len(result.Symbols))
+
+	// the message is streamed in multiple chunks
+	msg := "Subject: virus\r\n\r\n" + strings.Repeat("a", 3*chunkSize) + "EICAR"
+	result, err = clt.Check(context.Background(), strings.NewReader(msg), &rspamc.MailHeaders{})
+	assert.NoError(t, err)
+	assert.Equal(t, ActionReject, result.Action)
+	assert.Equal(t, DefaultScore, result.Score)
+	assert.Equal(t, "CLAMAV_VIRUS(100)[Win.Test.EICAR_HDB-1]", result.Symbols[SymbolVirus].String())
+}
+
+func TestCheckViaUnixSocket(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "clamd.sock")
+	ln, err := net.Listen("unix", sockPath)
+	assert.NoError(t, err)
+	fakeClamd(t, ln, func(string) string { return "stream: Eicar-Signature FOUND" })
+
+	clt := New(&Config{Addr: "unix://" + sockPath, Score: 20, Logger: log.SlogTestLogger(t)})
+
+	result, err := clt.Check(context.Background(), strings.NewReader("body"), &rspamc.MailHeaders{})
+	assert.NoError(t, err)
+	assert.Equal(t, 20, result.Score)
+}
+
+func TestCheckErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	fakeClamd(t, ln, func(msg string) string {
+		switch msg {
+		case "large":
+			return "INSTREAM size limit exceeded. ERROR"
+		case "broken":
+			return "stream: Can't allocate memory ERROR"
+		default:
+			return "garbage"
+		}
+	})
+
+	clt := New(&Config{Addr: ln.Addr().String(), Logger: log.SlogTestLogger(t)})
+
+	// oversized messages are not scanned
+	result, err := clt.Check(context.Background(), strings.NewReader("large"), &rspamc.MailHeaders{})
+	assert.NoError(t, err)
+	assert.Equal(t, true, result.IsSkipped)
+	assert.Equal(t, actionNone, result.Action)
+
+	_, err = clt.Check(context.Background(), strings.NewReader("broken"), &rspamc.MailHeaders{})
+	assert.Error(t, err)
+
+	_, err = clt.Check(context.Background(), strings.NewReader("x"), &rspamc.MailHeaders{})
+	assert.Error(t, err)
+}
+
+func TestCheckUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	assert.NoError(t, ln.Close())
+
+	clt := New(&Config{Addr: addr, Logger: log.SlogTestLogger(t)})
+	_, err = clt.Check(context.Background(), strings.NewReader("body"), &rspamc.MailHeaders{})
+	assert.Equal(t, true, errors.Is(err, ErrUnavailable))
+
+	// a server that never responds
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+
+	clt = New(&Config{Addr: ln.Addr().String(), Timeout: 100 * time.Millisecond, Logger: log.SlogTestLogger(t)})
+	_, err = clt.Check(context.Background(), strings.NewReader("body"), &rspamc.MailHeaders{})
+	assert.Equal(t, true, errors.Is(err, ErrUnavailable))
+}
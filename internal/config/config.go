@@ -2,27 +2,182 @@ package config
 
 import (
 	"fmt"
+	"maps"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/pelletier/go-toml/v2"
 )
 
 type Config struct {
-	RspamdURL         string
-	RspamdPassword    string
-	ImapAddr          string
-	ImapUser          string
-	ImapPassword      string
-	InboxMailbox      string
-	SpamMailbox       string
-	ScanMailbox       string
-	HamMailbox        string
-	BackupMailbox     string
-	UndetectedMailbox string
-	SpamThreshold     float32
-	TempDir           string
-	KeepTempFiles     bool
+	RspamdURL               string
+	RspamdURLs              []string
+	RspamdControllerURLs    []string
+	RspamdHealthCheck       Duration
+	RspamdPassword          string
+	RspamdPasswordFile      string
+	RspamdPasswordCommand   string
+	RspamdDeliverTo         string
+	RspamdUser              string
+	RspamdRateLimit         float64
+	RspamdRateBurst         int
+	RspamdScanTimeout       Duration
+	RspamdLearnTimeout      Duration
+	RspamdCircuitBreaker    int
+	RspamdCircuitTimeout    Duration
+	ClamdAddr               string
+	ClamdTimeout            Duration
+	ClamdScore              float32
+	Protocol                string
+	ImapAddr                string
+	ImapUser                string
+	ImapPassword            string
+	ImapPasswordFile        string
+	ImapPasswordCommand     string
+	ImapCompress            bool
+	ImapPoolSize            int
+	ImapNotify              bool
+	Gmail                   bool
+	CreateMailboxes         bool
+	ImapConnectTimeout      Duration
+	ImapSelectTimeout       Duration
+	ImapFetchTimeout        Duration
+	JmapToken               string
+	JmapTokenFile           string
+	JmapTokenCommand        string
+	JmapStateFile           string
+	Pop3SpamAction          string
+	ForwardTo               []string
+	ForwardProtocol         string
+	ForwardAddr             string
+	ForwardUser             string
+	ForwardPassword         string
+	ForwardPasswordFile     string
+	ForwardPasswordCommand  string
+	ForwardAllowInsecure    bool
+	ForwardFrom             string
+	MaildirPath             string
+	MaildirSpamFolder       string
+	MaildirAddHeaders       bool
+	MaildirStateFile        string
+	InboxMailbox            string
+	SpamMailbox             string
+	ScanMailbox             string
+	HamMailbox              string
+	BackupMailbox           string
+	UndetectedMailbox       string
+	FuzzyMailbox            string
+	FuzzyFlag               int
+	FuzzyWeight             int
+	SpamThreshold           float32
+	MaxMessageSize          int64
+	OversizedAction         string
+	TooLargeMailbox         string
+	HeaderPreScan           bool
+	ScanResultSecret        string
+	ScanResultSecretFile    string
+	ScanResultSecretCommand string
+	ScannedKeyword          string
+	SpamLearnedKeyword      string
+	SpamFlags               []string
+	BorderlineFlags         []string
+	BorderlineThreshold     float32
+	ScanSearch              string
+	ScanFailedMailbox       string
+	ScanFailedKeyword       string
+	MaxScanAttempts         int
+	SpamRetention           Duration
+	ScanFailedRetention     Duration
+	LearnExpiredSpam        bool
+	AllowlistSenders        []string
+	BlocklistSenders        []string
+	DegradedFiltering       bool
+	ScoreOverrides          map[string]float32
+	SubjectTag              string
+	SubjectTagThreshold     float32
+	ApplyMilterHeaders      bool
+	DeduplicateMessages     bool
+	BackscatterMailbox      string
+	SpamArchiveMailbox      string
+	FolderPolicies          []*FolderPolicy
+	PartFilters             []*PartFilter
+	BackscatterFuzzy        bool
+	OwnSenders              []string
+	GreylistDelay           Duration
+	ScanCacheFile           string
+	ScanCacheTTL            Duration
+	StatsFile               string
+	AuditLog                string
+	AuditLogMaxSize         int64
+	AuditLogMaxFiles        int
+	NotifyErrorStreak       int
+	NotifyDigestInterval    Duration
+	Notifiers               []*Notifier
+	AdminAddr               string
+	AdminToken              string
+	AdminTokenFile          string
+	AdminTokenCommand       string
+	MinPollInterval         Duration
+	MaxPollInterval         Duration
+	PollJitter              Duration
+	ShutdownTimeout         Duration
+	TempDir                 string
+	KeepTempFiles           bool
+	SpoolThreshold          int64
+	MemoryBudget            int64
+	LogFormat               string
+	LogOutput               string
+	LogFileMaxSize          int64
+	LogFileMaxBackups       int
+	LogLevel                string
+	LogLevels               map[string]string
+	OTLPEndpoint            string
+	TraceServiceName        string
+}
+
+// Notifier is the configuration of a notification target.
+type Notifier struct {
+	// Type is "ntfy", "telegram", "email" or "exec".
+	Type string
+	// Events are the events that are sent to the notifier, all are sent
+	// when it is empty.
+	Events []string
+	// URL is the ntfy topic URL.
+	URL string
+	// Token is the ntfy access token or the Telegram bot token.
+	Token  string
+	ChatID string
+	// Addr, User, Password, AllowInsecure, From and To configure the SMTP
+	// delivery of "email" notifications.
+	Addr          string
+	User          string
+	Password      string
+	AllowInsecure bool
+	From          string
+	To            []string
+	// Command is run with the event as JSON on stdin for "exec"
+	// notifiers.
+	Command string
+}
+
+// FolderPolicy is the scan policy of the mailboxes that match Mailbox.
+type FolderPolicy struct {
+	// Mailbox is a pattern of mailbox names, e.g. "Shared/*".
+	Mailbox string
+	// Action is "move" or "tag".
+	Action        string
+	SpamThreshold float32
+	Keywords      []string
+}
+
+// PartFilter strips or truncates the MIME parts whose media type matches
+// ContentType before mails are sent to rspamd.
+type PartFilter struct {
+	ContentType string
+	MaxSize     int64
+	Truncate    bool
 }
 
 func (c *Config) String() string {
@@ -35,7 +190,15 @@ func (c *Config) String() string {
 	}
 
 	sb.WriteString("Configuration:\n")
-	printKv("Rspamd URL", c.RspamdURL)
+	if len(c.RspamdURLs) == 0 {
+		printKv("Rspamd URL", c.RspamdURL)
+	} else {
+		printKv("Rspamd URLs", strings.Join(c.RspamdURLs, ", "))
+		if len(c.RspamdControllerURLs) != 0 {
+			printKv("Rspamd Controller URLs", strings.Join(c.RspamdControllerURLs, ", "))
+		}
+		printKv("Rspamd Health Check", c.RspamdHealthCheck)
+	}
 
 	if c.RspamdPassword == "" {
 		printKv("Rspamd Password", unset)
@@ -43,8 +206,48 @@ func (c *Config) String() string {
 		printKv("Rspamd Password", hiddenPasswd)
 	}
 
+	printKv("Rspamd Deliver-To", c.RspamdDeliverTo)
+	if c.RspamdUser == "" {
+		printKv("Rspamd User", unset)
+	} else {
+		printKv("Rspamd User", c.RspamdUser)
+	}
+
+	if c.RspamdRateLimit == 0 {
+		printKv("Rspamd Rate Limit", "unlimited")
+	} else {
+		printKv("Rspamd Rate Limit", fmt.Sprintf("%g req/s, burst: %d", c.RspamdRateLimit, c.RspamdRateBurst))
+	}
+	printKv("Rspamd Scan Timeout", c.RspamdScanTimeout)
+	printKv("Rspamd Learn Timeout", c.RspamdLearnTimeout)
+	if c.RspamdCircuitBreaker < 0 {
+		printKv("Rspamd Circuit Breaker", "disabled")
+	} else {
+		printKv("Rspamd Circuit Breaker", fmt.Sprintf("%d failures, retry after: %s", c.RspamdCircuitBreaker, c.RspamdCircuitTimeout))
+	}
+	if c.ClamdAddr == "" {
+		printKv("Clamd Address", unset)
+	} else {
+		printKv("Clamd Address", c.ClamdAddr)
+		printKv("Clamd Timeout", c.ClamdTimeout)
+		printKv("Clamd Score", c.ClamdScore)
+	}
+
+	printKv("Protocol", c.Protocol)
 	printKv("IMAP Server Address", c.ImapAddr)
 	printKv("IMAP User", c.ImapUser)
+	printKv("IMAP Compression", c.ImapCompress)
+	if c.ImapPoolSize == 0 {
+		printKv("IMAP Connection Pool", "disabled")
+	} else {
+		printKv("IMAP Connection Pool", fmt.Sprintf("%d connections", c.ImapPoolSize))
+	}
+	printKv("IMAP NOTIFY", c.ImapNotify)
+	printKv("Gmail Mode", c.Gmail)
+	printKv("Create Mailboxes", c.CreateMailboxes)
+	printKv("IMAP Connect Timeout", c.ImapConnectTimeout)
+	printKv("IMAP Select Timeout", c.ImapSelectTimeout)
+	printKv("IMAP Fetch Timeout", c.ImapFetchTimeout)
 
 	if c.ImapPassword == "" {
 		printKv("IMAP Password", unset)
@@ -53,26 +256,340 @@ func (c *Config) String() string {
 	}
 
 	printKv("Spam Treshold", c.SpamThreshold)
+	if c.MaxMessageSize == 0 {
+		printKv("Max. Message Size", "unlimited")
+	} else {
+		printKv("Max. Message Size", c.MaxMessageSize)
+		printKv("Oversized Action", c.OversizedAction)
+		printKv("Too Large Mailbox", c.TooLargeMailbox)
+	}
+	printKv("Header Pre-Scan", c.HeaderPreScan)
+	if c.ScanResultSecret == "" {
+		printKv("Scan Result Secret", unset)
+	} else {
+		printKv("Scan Result Secret", hiddenPasswd)
+	}
+	if c.ScanSearch == "" {
+		printKv("Scan Search", unset)
+	} else {
+		printKv("Scan Search", c.ScanSearch)
+	}
+	if c.ScannedKeyword == "" {
+		printKv("Scanned Keyword", unset)
+	} else {
+		printKv("Scanned Keyword", c.ScannedKeyword)
+	}
+	if c.SpamLearnedKeyword == "" {
+		printKv("Spam Learned Keyword", unset)
+	} else {
+		printKv("Spam Learned Keyword", c.SpamLearnedKeyword)
+	}
+	if len(c.SpamFlags) != 0 {
+		printKv("Spam Flags", c.SpamFlags)
+	}
+	if len(c.BorderlineFlags) != 0 {
+		printKv("Borderline Flags", c.BorderlineFlags)
+		printKv("Borderline Threshold", c.BorderlineThreshold)
+	}
+	switch {
+	case c.ScanFailedMailbox != "":
+		printKv("Scan Failed Mailbox", c.ScanFailedMailbox)
+		printKv("Max. Scan Attempts", c.MaxScanAttempts)
+	case c.ScanFailedKeyword != "":
+		printKv("Scan Failed Keyword", c.ScanFailedKeyword)
+		printKv("Max. Scan Attempts", c.MaxScanAttempts)
+	default:
+		printKv("Scan Failed Mailbox", unset)
+	}
+	if c.SpamRetention == 0 {
+		printKv("Spam Retention", unset)
+	} else {
+		printKv("Spam Retention", c.SpamRetention)
+		printKv("Learn Expired Spam", c.LearnExpiredSpam)
+	}
+	if c.ScanFailedRetention != 0 {
+		printKv("Scan Failed Retention", c.ScanFailedRetention)
+	}
+	printKv("Allowlisted Senders", strings.Join(c.AllowlistSenders, ", "))
+	printKv("Blocklisted Senders", strings.Join(c.BlocklistSenders, ", "))
+	printKv("Degraded Filtering", c.DegradedFiltering)
+	overrides := make([]string, 0, len(c.ScoreOverrides))
+	for _, k := range slices.Sorted(maps.Keys(c.ScoreOverrides)) {
+		overrides = append(overrides, fmt.Sprintf("%s: %+.2f", k, c.ScoreOverrides[k]))
+	}
+	printKv("Score Overrides", strings.Join(overrides, ", "))
+	if c.SubjectTag == "" {
+		printKv("Subject Tag", unset)
+	} else {
+		printKv("Subject Tag", c.SubjectTag)
+		printKv("Subject Tag Threshold", c.SubjectTagThreshold)
+	}
+	printKv("Apply Milter Headers", c.ApplyMilterHeaders)
+	printKv("Deduplicate Messages", c.DeduplicateMessages)
+	if c.BackscatterMailbox == "" {
+		printKv("Backscatter Mailbox", unset)
+	} else {
+		printKv("Backscatter Mailbox", c.BackscatterMailbox)
+		printKv("Backscatter Fuzzy", c.BackscatterFuzzy)
+		printKv("Own Senders", strings.Join(c.OwnSenders, ", "))
+	}
+	if c.SpamArchiveMailbox == "" {
+		printKv("Spam Archive Mailbox", unset)
+	} else {
+		printKv("Spam Archive Mailbox", c.SpamArchiveMailbox)
+	}
+	printKv("Greylist Delay", c.GreylistDelay)
+	if len(c.FolderPolicies) == 0 {
+		printKv("Folder Policies", unset)
+	} else {
+		policies := make([]string, 0, len(c.FolderPolicies))
+		for _, p := range c.FolderPolicies {
+			policies = append(policies, p.Mailbox+": "+p.Action)
+		}
+		printKv("Folder Policies", strings.Join(policies, ", "))
+	}
+	if len(c.PartFilters) == 0 {
+		printKv("Part Filters", unset)
+	} else {
+		filters := make([]string, 0, len(c.PartFilters))
+		for _, f := range c.PartFilters {
+			action := "strip"
+			if f.Truncate {
+				action = "truncate"
+			}
+			filters = append(filters, fmt.Sprintf("%s > %d: %s", f.ContentType, f.MaxSize, action))
+		}
+		printKv("Part Filters", strings.Join(filters, ", "))
+	}
+	if c.ScanCacheFile == "" {
+		printKv("Scan Cache File", unset)
+	} else {
+		printKv("Scan Cache File", c.ScanCacheFile)
+		printKv("Scan Cache TTL", c.ScanCacheTTL)
+	}
+	if c.StatsFile == "" {
+		printKv("Statistics File", unset)
+	} else {
+		printKv("Statistics File", c.StatsFile)
+	}
+	if c.AuditLog == "" {
+		printKv("Audit Log", unset)
+	} else {
+		printKv("Audit Log", c.AuditLog)
+		printKv("Audit Log Max. Size", c.AuditLogMaxSize)
+		printKv("Audit Log Max. Files", c.AuditLogMaxFiles)
+	}
+	if len(c.Notifiers) == 0 {
+		printKv("Notifiers", unset)
+	} else {
+		types := make([]string, 0, len(c.Notifiers))
+		for _, n := range c.Notifiers {
+			types = append(types, n.Type)
+		}
+		printKv("Notifiers", strings.Join(types, ", "))
+		printKv("Notify Error Streak", c.NotifyErrorStreak)
+		printKv("Notify Digest Interval", c.NotifyDigestInterval)
+	}
+	if c.AdminToken == "" {
+		printKv("Admin API", unset)
+	} else {
+		printKv("Admin API", c.AdminAddr)
+	}
+	printKv("Min. Poll Interval", c.MinPollInterval)
+	printKv("Max. Poll Interval", c.MaxPollInterval)
+	printKv("Poll Jitter", c.PollJitter)
+	printKv("Shutdown Timeout", c.ShutdownTimeout)
 	printKv("Scan Mailbox", c.ScanMailbox)
 	printKv("Inbox Mailbox", c.InboxMailbox)
 	printKv("Spam Mailbox", c.SpamMailbox)
 	printKv("Undetected Mailbox", c.UndetectedMailbox)
 	printKv("Backup Mailbox", c.BackupMailbox)
+	printKv("Fuzzy Mailbox", c.FuzzyMailbox)
+	printKv("Fuzzy Flag", c.FuzzyFlag)
+	printKv("Fuzzy Weight", c.FuzzyWeight)
 	printKv("Temporary Directory", c.TempDir)
 	printKv("Keep Temporary Files", c.KeepTempFiles)
+	if c.SpoolThreshold == 0 {
+		printKv("Spool Threshold", unset)
+	} else {
+		printKv("Spool Threshold", c.SpoolThreshold)
+	}
+	if c.MemoryBudget == 0 {
+		printKv("Memory Budget", "unlimited")
+	} else {
+		printKv("Memory Budget", c.MemoryBudget)
+	}
+	if c.OTLPEndpoint == "" {
+		printKv("OTLP Endpoint", unset)
+	} else {
+		printKv("OTLP Endpoint", c.OTLPEndpoint)
+		printKv("Trace Service Name", c.TraceServiceName)
+	}
+	printKv("Log Format", c.LogFormat)
+	printKv("Log Output", c.LogOutput)
+	printKv("Log Level", c.LogLevel)
+	for _, module := range slices.Sorted(maps.Keys(c.LogLevels)) {
+		printKv("Log Level "+module, c.LogLevels[module])
+	}
 
 	sb.WriteRune('\n')
+	if c.Protocol == "pop3" {
+		fmt.Fprintf(&sb, "Mails in the POP3 maildrop of %q are scanned.\n", c.ImapUser)
+		switch c.Pop3SpamAction {
+		case "delete":
+			fmt.Fprintf(&sb, "Mails with a spam score of >=%f are deleted,\n", c.SpamThreshold)
+		case "keep":
+			fmt.Fprintf(&sb, "Mails with a spam score of >=%f are kept,\n", c.SpamThreshold)
+		}
+		if len(c.ForwardTo) != 0 {
+			fmt.Fprintf(&sb, "others are forwarded via %s to %v and deleted.\n", c.forwardServer(), c.ForwardTo)
+		} else {
+			sb.WriteString("others are kept.\n")
+		}
+
+		return sb.String()
+	}
+
+	if c.Protocol == "maildir" {
+		fmt.Fprintf(&sb, "Mails in the Maildir %q are scanned.\n", c.MaildirPath)
+		fmt.Fprintf(&sb, "Mails with a spam score of >=%f are moved to the folder %q,\n", c.SpamThreshold, c.MaildirSpamFolder)
+		sb.WriteString("others are kept.\n")
+		if c.MaildirAddHeaders {
+			sb.WriteString("X-Spam and scan result headers are added to the mails.\n")
+			if c.ApplyMilterHeaders {
+				sb.WriteString("Header modifications requested by rspamd are applied to the mails.\n")
+			}
+		}
+
+		return sb.String()
+	}
+
 	fmt.Fprintf(&sb, "Mails in %q are scanned and backuped to %q.\n", c.ScanMailbox, c.BackupMailbox)
 	fmt.Fprintf(&sb, "Mails with a spam score of >=%f are moved to %q,\n", c.SpamThreshold, c.SpamMailbox)
 	fmt.Fprintf(&sb, "others are moved to %q.\n", c.InboxMailbox)
+	if c.MaxMessageSize != 0 {
+		switch c.OversizedAction {
+		case "skip":
+			fmt.Fprintf(&sb, "Mails bigger than %d bytes are not scanned and kept in %q.\n", c.MaxMessageSize, c.ScanMailbox)
+		case "truncate":
+			fmt.Fprintf(&sb, "Of mails bigger than %d bytes only the beginning is scanned.\n", c.MaxMessageSize)
+		case "move":
+			fmt.Fprintf(&sb, "Mails bigger than %d bytes are not scanned and moved to %q.\n", c.MaxMessageSize, c.TooLargeMailbox)
+		}
+	}
+	if c.ScanSearch != "" {
+		fmt.Fprintf(&sb, "Only mails in %q that match %q are processed.\n", c.ScanMailbox, c.ScanSearch)
+	}
+	if c.ScannedKeyword != "" {
+		fmt.Fprintf(&sb, "Processed mails that are left in %q are flagged with %q and not scanned again.\n", c.ScanMailbox, c.ScannedKeyword)
+	}
+	if c.ScanFailedMailbox != "" {
+		fmt.Fprintf(&sb, "Mails whose scan failed %d times are moved to %q.\n", c.MaxScanAttempts, c.ScanFailedMailbox)
+	}
+	if c.ScanFailedKeyword != "" {
+		fmt.Fprintf(&sb, "Mails whose scan failed %d times are flagged with %q and not scanned again.\n", c.MaxScanAttempts, c.ScanFailedKeyword)
+	}
+	if c.SpamRetention != 0 {
+		if c.LearnExpiredSpam {
+			fmt.Fprintf(&sb, "Mails in %q that are older than %s are learned as Spam and deleted.\n", c.SpamMailbox, c.SpamRetention)
+		} else {
+			fmt.Fprintf(&sb, "Mails in %q that are older than %s are deleted.\n", c.SpamMailbox, c.SpamRetention)
+		}
+	}
+	if c.ScanFailedRetention != 0 {
+		fmt.Fprintf(&sb, "Mails in %q that are older than %s are deleted.\n", c.ScanFailedMailbox, c.ScanFailedRetention)
+	}
+	if len(c.AllowlistSenders) != 0 {
+		fmt.Fprintf(&sb, "Mails from allowlisted senders are moved unscanned to %q.\n", c.InboxMailbox)
+	}
+	if len(c.BlocklistSenders) != 0 {
+		fmt.Fprintf(&sb, "Mails from blocklisted senders are moved unscanned to %q.\n", c.SpamMailbox)
+	}
+	if c.RspamdCircuitBreaker > 0 {
+		fmt.Fprintf(&sb, "Mails are not scanned for %s after %d requests to rspamd in a row failed.\n", c.RspamdCircuitTimeout, c.RspamdCircuitBreaker)
+		if c.DegradedFiltering {
+			sb.WriteString("Mails from allowlisted and blocklisted senders are moved while rspamd is unavailable.\n")
+		}
+	}
+	if c.ClamdAddr != "" {
+		fmt.Fprintf(&sb, "Mails are scanned for malware by clamd before they are sent to rspamd, infected mails get a score of %g.\n", c.ClamdScore)
+	}
+	if len(c.PartFilters) != 0 {
+		fmt.Fprintf(&sb, "MIME parts matching %d filters are stripped or truncated before mails are sent to rspamd.\n", len(c.PartFilters))
+	}
+	if len(c.ScoreOverrides) != 0 {
+		fmt.Fprintf(&sb, "The rspamd score of mails from %d sender patterns is adjusted.\n", len(c.ScoreOverrides))
+	}
+	if c.SubjectTag != "" {
+		fmt.Fprintf(&sb, "Subjects of mails with the rewrite subject action are tagged with %q.\n", c.SubjectTag)
+	}
+	if c.ApplyMilterHeaders {
+		sb.WriteString("Header modifications requested by rspamd are applied to the mails.\n")
+	}
+	if c.GreylistDelay != 0 {
+		fmt.Fprintf(&sb, "Mails with a greylist or soft reject action are rescanned after %s.\n", c.GreylistDelay)
+	}
+	if c.ScanCacheFile != "" {
+		fmt.Fprintf(&sb, "Scan results are cached for %s, mails that reappear are not scanned again.\n", c.ScanCacheTTL)
+	}
+	if c.DeduplicateMessages {
+		sb.WriteString("Copies of the same mail are scanned only once.\n")
+	}
+	if c.SpoolThreshold != 0 {
+		fmt.Fprintf(&sb, "Fetched mails bigger than %d bytes are buffered in %q instead of in memory.\n", c.SpoolThreshold, c.TempDir)
+	}
+	if c.MemoryBudget != 0 {
+		fmt.Fprintf(&sb, "At most %d bytes of fetched mails are buffered in memory.\n", c.MemoryBudget)
+	}
+	if c.BackscatterMailbox != "" {
+		fmt.Fprintf(&sb, "Bounces of mails that were not sent by the own senders are moved unscanned to %q.\n", c.BackscatterMailbox)
+		if c.BackscatterFuzzy {
+			sb.WriteString("Backscatter bounces are added to the fuzzy storage.\n")
+		}
+	}
+	if c.SpamArchiveMailbox != "" {
+		fmt.Fprintf(&sb, "Copies of spam with the rspamd scan result attached are uploaded to %q.\n", c.SpamArchiveMailbox)
+	}
 	if c.UndetectedMailbox != "" {
 		fmt.Fprintf(&sb, "Mails in %q are learned as Spam and moved to %q.\n", c.UndetectedMailbox, c.SpamMailbox)
 	}
 	fmt.Fprintf(&sb, "Mails in %q are learned as Ham and moved to %q.\n", c.HamMailbox, c.InboxMailbox)
+	if c.SpamLearnedKeyword != "" {
+		fmt.Fprintf(&sb, "Mails that are moved to %q by the user are learned as Spam and flagged with %q.\n", c.SpamMailbox, c.SpamLearnedKeyword)
+	}
+	if len(c.SpamFlags) != 0 {
+		fmt.Fprintf(&sb, "Mails that are moved to %q are flagged with %v.\n", c.SpamMailbox, c.SpamFlags)
+	}
+	if len(c.BorderlineFlags) != 0 {
+		fmt.Fprintf(&sb, "Ham with a score >= %g is flagged with %v.\n", c.BorderlineThreshold, c.BorderlineFlags)
+	}
+	if c.FuzzyMailbox != "" {
+		fmt.Fprintf(&sb, "Mails in %q are added to the fuzzy storage and moved to %q.\n", c.FuzzyMailbox, c.SpamMailbox)
+	}
+	if len(c.ForwardTo) != 0 {
+		fmt.Fprintf(&sb, "Mails in %q that are not spam are forwarded via %s to %v.\n", c.ScanMailbox, c.forwardServer(), c.ForwardTo)
+	}
+	if c.AuditLog != "" {
+		fmt.Fprintf(&sb, "All modifications of mails and learned mails are recorded in %q.\n", c.AuditLog)
+	}
 
 	return sb.String()
 }
 
+// StatsAccount returns the name under which the statistics of the configured
+// account are recorded.
+func (c *Config) StatsAccount() string {
+	if c.Protocol == "maildir" {
+		return c.MaildirPath
+	}
+
+	return c.ImapUser + "@" + c.ImapAddr
+}
+
+func (c *Config) forwardServer() string {
+	return fmt.Sprintf("%s %q", strings.ToUpper(c.ForwardProtocol), c.ForwardAddr)
+}
+
 func FromFile(path string) (*Config, error) {
 	var result Config
 	buf, err := os.ReadFile(path)
@@ -88,6 +605,146 @@ func FromFile(path string) (*Config, error) {
 }
 
 func (c *Config) SetDefaults() {
+	if c.RspamdDeliverTo == "" {
+		c.RspamdDeliverTo = c.ImapUser
+	}
+
+	if c.Protocol == "" {
+		c.Protocol = "imap"
+	}
+
+	if c.Pop3SpamAction == "" {
+		c.Pop3SpamAction = "delete"
+	}
+
+	if c.ForwardProtocol == "" {
+		c.ForwardProtocol = "smtp"
+	}
+
+	if c.MaildirSpamFolder == "" {
+		c.MaildirSpamFolder = "Spam"
+	}
+
+	if c.OversizedAction == "" {
+		c.OversizedAction = "skip"
+	}
+
+	if c.RspamdRateLimit > 0 && c.RspamdRateBurst == 0 {
+		c.RspamdRateBurst = max(1, int(c.RspamdRateLimit))
+	}
+
+	if c.RspamdHealthCheck == 0 {
+		c.RspamdHealthCheck = Duration(10 * time.Second)
+	}
+
+	if c.RspamdScanTimeout == 0 {
+		c.RspamdScanTimeout = Duration(2 * time.Minute)
+	}
+
+	if c.RspamdLearnTimeout == 0 {
+		c.RspamdLearnTimeout = Duration(2 * time.Minute)
+	}
+
+	if c.RspamdCircuitBreaker == 0 {
+		c.RspamdCircuitBreaker = 5
+	}
+
+	if c.RspamdCircuitTimeout == 0 {
+		c.RspamdCircuitTimeout = Duration(time.Minute)
+	}
+
+	if c.ClamdTimeout == 0 {
+		c.ClamdTimeout = Duration(2 * time.Minute)
+	}
+
+	if c.ClamdScore == 0 {
+		c.ClamdScore = 100
+	}
+
+	if c.ImapConnectTimeout == 0 {
+		c.ImapConnectTimeout = Duration(2 * time.Minute)
+	}
+
+	if c.ImapSelectTimeout == 0 {
+		c.ImapSelectTimeout = Duration(time.Minute)
+	}
+
+	if c.ImapFetchTimeout == 0 {
+		c.ImapFetchTimeout = Duration(5 * time.Minute)
+	}
+
+	if c.FuzzyFlag == 0 {
+		c.FuzzyFlag = 1
+	}
+
+	if c.FuzzyWeight == 0 {
+		c.FuzzyWeight = 10
+	}
+
+	if c.MaxScanAttempts == 0 {
+		c.MaxScanAttempts = 3
+	}
+
+	if c.NotifyErrorStreak == 0 {
+		c.NotifyErrorStreak = 3
+	}
+
+	if c.AdminAddr == "" {
+		c.AdminAddr = "localhost:8025"
+	}
+
+	if c.ScanCacheTTL == 0 {
+		c.ScanCacheTTL = Duration(24 * time.Hour)
+	}
+
+	if c.MinPollInterval == 0 {
+		c.MinPollInterval = Duration(30 * time.Second)
+	}
+
+	if c.MaxPollInterval == 0 {
+		c.MaxPollInterval = Duration(30 * time.Minute)
+	}
+
+	if c.PollJitter == 0 {
+		c.PollJitter = Duration(10 * time.Second)
+	}
+
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = Duration(30 * time.Second)
+	}
+
+	if c.LogFormat == "" {
+		c.LogFormat = "text"
+	}
+
+	if c.LogOutput == "" {
+		c.LogOutput = "stderr"
+	}
+
+	if c.LogFileMaxSize == 0 {
+		c.LogFileMaxSize = 10 * 1024 * 1024
+	}
+
+	if c.LogFileMaxBackups == 0 {
+		c.LogFileMaxBackups = 5
+	}
+
+	if c.AuditLogMaxSize == 0 {
+		c.AuditLogMaxSize = 10 * 1024 * 1024
+	}
+
+	if c.AuditLogMaxFiles == 0 {
+		c.AuditLogMaxFiles = 5
+	}
+
+	if c.LogLevel == "" {
+		c.LogLevel = "debug"
+	}
+
+	if c.TraceServiceName == "" {
+		c.TraceServiceName = "rspamd-iscan"
+	}
+
 	if c.TempDir == "" {
 		c.TempDir = os.TempDir()
 	}
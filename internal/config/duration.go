@@ -0,0 +1,23 @@
+package config
+
+import "time"
+
+// Duration is a [time.Duration] that is specified as string in the config
+// file, e.g. "5m30s".
+type Duration time.Duration
+
+// UnmarshalText parses a duration string with [time.ParseDuration].
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// EnvPrefix is the prefix of the environment variables that override config
+// options.
+const EnvPrefix = "RSPAMD_ISCAN_"
+
+// EnvName returns the name of the environment variable that overrides the
+// config option field, e.g. "RSPAMD_ISCAN_IMAP_ADDR" for "ImapAddr".
+func EnvName(field string) string {
+	var sb strings.Builder
+	sb.WriteString(EnvPrefix)
+
+	r := []rune(field)
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) && isWordStart(r, i) {
+			sb.WriteRune('_')
+		}
+		sb.WriteRune(unicode.ToUpper(c))
+	}
+
+	return sb.String()
+}
+
+// isWordStart returns true if the upper case rune r[i] starts a new word.
+func isWordStart(r []rune, i int) bool {
+	if !unicode.IsUpper(r[i-1]) {
+		return true
+	}
+
+	// the last upper case letter of an acronym starts a new word when it
+	// is followed by a lower case letter, e.g. "OTLPEndpoint", except the
+	// plural "s" of the acronym ("URLs")
+	if i+1 >= len(r) || !unicode.IsLower(r[i+1]) {
+		return false
+	}
+
+	return r[i+1] != 's' || (i+2 < len(r) && !unicode.IsUpper(r[i+2]))
+}
+
+// ApplyEnv overrides the config options with the values of set environment
+// variables, their names are returned by [EnvName].
+// Strings are used as they are, durations, booleans and numbers are parsed
+// as in Go, lists and tables must be specified as TOML values, e.g.
+// '["a", "b"]'.
+// When a variable for a secret, its File or its Command variant is set, the
+// other variants from the config file are ignored.
+func (c *Config) ApplyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	set := map[string]bool{}
+
+	for i := range t.NumField() {
+		name := t.Field(i).Name
+		envName := EnvName(name)
+
+		val, exists := os.LookupEnv(envName)
+		if !exists {
+			continue
+		}
+
+		if err := setField(v.Field(i), val); err != nil {
+			return fmt.Errorf("%s: %w", envName, err)
+		}
+		set[name] = true
+	}
+
+	for _, s := range c.secrets() {
+		variants := []string{s.name, s.name + "File", s.name + "Command"}
+		if !set[variants[0]] && !set[variants[1]] && !set[variants[2]] {
+			continue
+		}
+
+		for _, field := range variants {
+			if !set[field] {
+				v.FieldByName(field).SetString("")
+			}
+		}
+	}
+
+	return nil
+}
+
+func setField(f reflect.Value, val string) error {
+	if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(val))
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(val)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(val, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+
+	case reflect.Slice, reflect.Map:
+		doc := reflect.New(reflect.StructOf([]reflect.StructField{{
+			Name: "V",
+			Type: f.Type(),
+			Tag:  `toml:"v"`,
+		}}))
+		if err := toml.Unmarshal([]byte("v = "+val), doc.Interface()); err != nil {
+			return fmt.Errorf("parsing TOML value failed: %w", err)
+		}
+		f.Set(doc.Elem().Field(0))
+
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+
+	return nil
+}
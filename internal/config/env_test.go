@@ -0,0 +1,60 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestEnvName(t *testing.T) {
+	for field, expected := range map[string]string{
+		"ImapAddr":             "RSPAMD_ISCAN_IMAP_ADDR",
+		"SpamThreshold":        "RSPAMD_ISCAN_SPAM_THRESHOLD",
+		"RspamdURLs":           "RSPAMD_ISCAN_RSPAMD_URLS",
+		"RspamdControllerURLs": "RSPAMD_ISCAN_RSPAMD_CONTROLLER_URLS",
+		"OTLPEndpoint":         "RSPAMD_ISCAN_OTLP_ENDPOINT",
+		"ScanCacheTTL":         "RSPAMD_ISCAN_SCAN_CACHE_TTL",
+		"Pop3SpamAction":       "RSPAMD_ISCAN_POP3_SPAM_ACTION",
+	} {
+		assert.Equal(t, expected, EnvName(field))
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("RSPAMD_ISCAN_IMAP_ADDR", "imap.example.com:993")
+	t.Setenv("RSPAMD_ISCAN_SPAM_THRESHOLD", "7.5")
+	t.Setenv("RSPAMD_ISCAN_HEADER_PRE_SCAN", "true")
+	t.Setenv("RSPAMD_ISCAN_MAX_SCAN_ATTEMPTS", "5")
+	t.Setenv("RSPAMD_ISCAN_GREYLIST_DELAY", "5m")
+	t.Setenv("RSPAMD_ISCAN_FORWARD_TO", `["a@example.com", "b@example.com"]`)
+	t.Setenv("RSPAMD_ISCAN_SCORE_OVERRIDES", `{ "example.com" = -5.0 }`)
+	t.Setenv("RSPAMD_ISCAN_IMAP_PASSWORD_FILE", "/run/secrets/imap")
+
+	cfg := Config{
+		ImapAddr:     "other:993",
+		ImapUser:     "rick",
+		ImapPassword: "zhora",
+	}
+	assert.NoError(t, cfg.ApplyEnv())
+
+	assert.Equal(t, "imap.example.com:993", cfg.ImapAddr)
+	assert.Equal(t, "rick", cfg.ImapUser)
+	assert.Equal(t, float32(7.5), cfg.SpamThreshold)
+	assert.Equal(t, true, cfg.HeaderPreScan)
+	assert.Equal(t, 5, cfg.MaxScanAttempts)
+	assert.Equal(t, Duration(5*time.Minute), cfg.GreylistDelay)
+	assert.Equal(t, 2, len(cfg.ForwardTo))
+	assert.Equal(t, "b@example.com", cfg.ForwardTo[1])
+	assert.Equal(t, float32(-5), cfg.ScoreOverrides["example.com"])
+	// the password from the file is replaced by the one from the env
+	assert.Equal(t, "", cfg.ImapPassword)
+	assert.Equal(t, "/run/secrets/imap", cfg.ImapPasswordFile)
+}
+
+func TestApplyEnvInvalidValue(t *testing.T) {
+	t.Setenv("RSPAMD_ISCAN_MAX_SCAN_ATTEMPTS", "many")
+
+	var cfg Config
+	assert.Error(t, cfg.ApplyEnv())
+}
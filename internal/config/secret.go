@@ -0,0 +1,135 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// secret is a config value that can be set directly, read from a file or
+// from the output of a command.
+type secret struct {
+	name    string
+	value   *string
+	file    string
+	command string
+}
+
+func (c *Config) secrets() []*secret {
+	return []*secret{
+		{"RspamdPassword", &c.RspamdPassword, c.RspamdPasswordFile, c.RspamdPasswordCommand},
+		{"ImapPassword", &c.ImapPassword, c.ImapPasswordFile, c.ImapPasswordCommand},
+		{"JmapToken", &c.JmapToken, c.JmapTokenFile, c.JmapTokenCommand},
+		{"ForwardPassword", &c.ForwardPassword, c.ForwardPasswordFile, c.ForwardPasswordCommand},
+		{"AdminToken", &c.AdminToken, c.AdminTokenFile, c.AdminTokenCommand},
+		{"ScanResultSecret", &c.ScanResultSecret, c.ScanResultSecretFile, c.ScanResultSecretCommand},
+	}
+}
+
+// ResolveSecrets sets the secrets to the content of their File or the output
+// of their Command setting, if one is set.
+// Environment variable references ("${NAME}") in the secrets and their File
+// and Command settings, and in the tokens and passwords of the notifiers are
+// expanded.
+func (c *Config) ResolveSecrets() error {
+	for _, s := range c.secrets() {
+		if err := s.resolve(); err != nil {
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+	}
+
+	for i, n := range c.Notifiers {
+		var err error
+
+		if n.Token, err = expandEnv(n.Token); err != nil {
+			return fmt.Errorf("Notifiers[%d].Token: %w", i, err)
+		}
+
+		if n.Password, err = expandEnv(n.Password); err != nil {
+			return fmt.Errorf("Notifiers[%d].Password: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *secret) resolve() error {
+	var cnt int
+	for _, v := range []string{*s.value, s.file, s.command} {
+		if v != "" {
+			cnt++
+		}
+	}
+	if cnt > 1 {
+		return fmt.Errorf("only one of %s, %sFile and %sCommand can be set", s.name, s.name, s.name)
+	}
+
+	switch {
+	case s.file != "":
+		path, err := expandEnv(s.file)
+		if err != nil {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading secret file failed: %w", err)
+		}
+
+		*s.value = strings.TrimRight(string(data), "\r\n")
+
+	case s.command != "":
+		cmdline, err := expandEnv(s.command)
+		if err != nil {
+			return err
+		}
+
+		var stderr bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", cmdline)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("running secret command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+
+		*s.value = strings.TrimRight(string(out), "\r\n")
+
+	default:
+		v, err := expandEnv(*s.value)
+		if err != nil {
+			return err
+		}
+
+		*s.value = v
+	}
+
+	if *s.value == "" && cnt > 0 {
+		return errors.New("secret is empty")
+	}
+
+	return nil
+}
+
+var envRefRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the "${NAME}" references in s with the values of the
+// environment variables. Other "$" characters are kept, an error is returned
+// if a referenced variable is not set.
+func expandEnv(s string) (string, error) {
+	var err error
+
+	result := envRefRe.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRefRe.FindStringSubmatch(ref)[1]
+		v, exists := os.LookupEnv(name)
+		if !exists && err == nil {
+			err = fmt.Errorf("environment variable %q is not set", name)
+		}
+		return v
+	})
+
+	return result, err
+}
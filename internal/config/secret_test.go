@@ -0,0 +1,41 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("ISCAN_TEST_DIR", dir)
+	t.Setenv("ISCAN_TEST_TOKEN", "tok$en")
+
+	path := filepath.Join(dir, "imap")
+	assert.NoError(t, os.WriteFile(path, []byte("from-file\n"), 0o600))
+
+	cfg := Config{
+		RspamdPassword:   "pre-${ISCAN_TEST_TOKEN}-$HOME",
+		ImapPasswordFile: "${ISCAN_TEST_DIR}/imap",
+		JmapTokenCommand: "echo from-command",
+	}
+	assert.NoError(t, cfg.ResolveSecrets())
+
+	assert.Equal(t, "pre-tok$en-$HOME", cfg.RspamdPassword)
+	assert.Equal(t, "from-file", cfg.ImapPassword)
+	assert.Equal(t, "from-command", cfg.JmapToken)
+	assert.Equal(t, "", cfg.ForwardPassword)
+}
+
+func TestResolveSecretsErrors(t *testing.T) {
+	for _, cfg := range []Config{
+		{ImapPassword: "x", ImapPasswordFile: "/dev/null"},
+		{ImapPasswordFile: filepath.Join(t.TempDir(), "missing")},
+		{ImapPasswordCommand: "exit 1"},
+		{ImapPassword: "${ISCAN_TEST_UNSET_VARIABLE}"},
+	} {
+		assert.Error(t, cfg.ResolveSecrets())
+	}
+}
@@ -0,0 +1,135 @@
+// Package forward delivers mails to other addresses via SMTP or LMTP.
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/textproto"
+	"slices"
+	"strings"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/smtpclt"
+)
+
+// HdrForwarded is added to forwarded mails, it contains the addresses that
+// the mail was forwarded to.
+// Mails that already have been forwarded to one of the recipients are not
+// forwarded again, to prevent mail loops.
+const HdrForwarded = "X-rspamd-iscan-Forwarded"
+
+// ErrLoop is returned when a mail is not forwarded because it was already
+// forwarded to one of the recipients.
+var ErrLoop = errors.New("mail has already been forwarded to the recipient, not forwarding it again")
+
+type Config struct {
+	// Address is the address of the SMTP or LMTP server that mails are
+	// delivered to, see [smtpclt.Config.Address].
+	Address string
+	// LMTP enables delivering via LMTP instead of SMTP.
+	LMTP bool
+	// User and Password are optional, when User is set the client
+	// authenticates with PLAIN auth.
+	User     string
+	Password string
+	// AllowInsecure enables delivering mails without encryption when the
+	// server does not support STARTTLS.
+	AllowInsecure bool
+	// From is the envelope sender, when it is empty the null sender is
+	// used.
+	From string
+	// To are the addresses that mails are forwarded to.
+	To     []string
+	Logger *slog.Logger
+}
+
+// Forwarder forwards mails to a fixed list of recipients.
+type Forwarder struct {
+	clt    *smtpclt.Client
+	from   string
+	to     []string
+	hdr    []byte
+	logger *slog.Logger
+}
+
+func New(cfg *Config) (*Forwarder, error) {
+	if len(cfg.To) == 0 {
+		return nil, fmt.Errorf("no forwarding recipients specified")
+	}
+
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("server address is empty")
+	}
+
+	hdr, err := mail.AsHeader(HdrForwarded, strings.Join(cfg.To, ", "))
+	if err != nil {
+		return nil, fmt.Errorf("invalid forwarding recipients: %w", err)
+	}
+
+	return &Forwarder{
+		clt: smtpclt.NewClient(&smtpclt.Config{
+			Address:       cfg.Address,
+			LMTP:          cfg.LMTP,
+			User:          cfg.User,
+			Password:      cfg.Password,
+			AllowInsecure: cfg.AllowInsecure,
+			Logger:        cfg.Logger,
+		}),
+		from:   cfg.From,
+		to:     cfg.To,
+		hdr:    hdr,
+		logger: log.Module(cfg.Logger, "forward"),
+	}, nil
+}
+
+// Forward delivers msg to the forwarding recipients.
+// The [HdrForwarded] header is prepended to msg. If the header of msg
+// shows that it has already been forwarded to one of the recipients, it is
+// not forwarded and [ErrLoop] is returned.
+func (f *Forwarder) Forward(ctx context.Context, msg io.Reader) error {
+	data, err := io.ReadAll(msg)
+	if err != nil {
+		return fmt.Errorf("reading message failed: %w", err)
+	}
+
+	if f.isLoop(data) {
+		return ErrLoop
+	}
+
+	r := io.MultiReader(bytes.NewReader(f.hdr), bytes.NewReader(data))
+	if err := f.clt.Send(ctx, f.from, f.to, r); err != nil {
+		return fmt.Errorf("forwarding mail failed: %w", err)
+	}
+
+	f.logger.Debug("forwarded message",
+		"to", f.to, "size", len(data), "event", "forward.sent")
+
+	return nil
+}
+
+// isLoop returns true if the [HdrForwarded] headers in data contain one of
+// the recipients.
+func (f *Forwarder) isLoop(data []byte) bool {
+	hdrs, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	if err != nil && len(hdrs) == 0 {
+		return false
+	}
+
+	for _, v := range hdrs.Values(HdrForwarded) {
+		for addr := range strings.SplitSeq(v, ",") {
+			if slices.ContainsFunc(f.to, func(to string) bool {
+				return strings.EqualFold(strings.TrimSpace(addr), to)
+			}) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
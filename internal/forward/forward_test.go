@@ -0,0 +1,66 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/smtpserver"
+)
+
+const testMail = "Subject: test\r\n\r\nbody\r\n"
+
+func TestForward(t *testing.T) {
+	srv := smtpserver.StartServer(t)
+
+	f, err := New(&Config{
+		Address:       srv.ListenAddr,
+		AllowInsecure: true,
+		From:          "catchall@example.com",
+		To:            []string{"rick@example.com"},
+		Logger:        log.SlogTestLogger(t),
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, f.Forward(context.Background(), strings.NewReader(testMail)))
+
+	mails := srv.Mails()
+	assert.Equal(t, 1, len(mails))
+	assert.Equal(t, "catchall@example.com", mails[0].From)
+	assert.Equal(t,
+		HdrForwarded+": rick@example.com\n"+strings.ReplaceAll(testMail, "\r\n", "\n"),
+		string(mails[0].Data),
+	)
+}
+
+func TestForward_LoopPrevention(t *testing.T) {
+	srv := smtpserver.StartLMTPServer(t)
+
+	f, err := New(&Config{
+		Address: srv.ListenAddr,
+		LMTP:    true,
+		To:      []string{"rick@example.com"},
+		Logger:  log.SlogTestLogger(t),
+	})
+	assert.NoError(t, err)
+
+	err = f.Forward(context.Background(),
+		strings.NewReader(HdrForwarded+": other@example.com, Rick@example.com\r\n"+testMail),
+	)
+	assert.Equal(t, ErrLoop, err)
+
+	// forwarded to other recipients before
+	err = f.Forward(context.Background(),
+		strings.NewReader(HdrForwarded+": other@example.com\r\n"+testMail),
+	)
+	assert.NoError(t, err)
+
+	mails := srv.Mails()
+	assert.Equal(t, 1, len(mails))
+	if !bytes.HasPrefix(mails[0].Data, []byte(HdrForwarded+": rick@example.com\n"+HdrForwarded+": other@example.com\n")) {
+		t.Errorf("unexpected forwarded mail: %q", mails[0].Data)
+	}
+}
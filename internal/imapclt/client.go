@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,11 +15,13 @@ import (
 	"github.com/emersion/go-imap/v2/imapclient"
 
 	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/spool"
 )
 
 const (
-	defChanBufSiz = 1
-	dialTimeout   = 120 * time.Second
+	defChanBufSiz         = 1
+	defaultConnectTimeout = 120 * time.Second
 )
 
 type Client struct {
@@ -26,11 +29,22 @@ type Client struct {
 	user          string
 	password      string
 	allowInsecure bool
+	compress      bool
 
-	clt    *imapclient.Client
+	connectTimeout time.Duration
+	selectTimeout  time.Duration
+	fetchTimeout   time.Duration
+	spool          *spool.Spool
+
+	clt *imapclient.Client
+	// cconn is the connection of clt when compress is enabled.
+	cconn  *compressConn
 	logger *slog.Logger
 
 	newMessagesCh chan<- *EventNewMessages
+	// knownMsgCount is the number of messages in the monitored mailbox
+	// that are not reported as new.
+	knownMsgCount uint32
 	mu            sync.Mutex
 }
 
@@ -44,22 +58,50 @@ type Config struct {
 	// AllowInsecure enables falling back to establishing the
 	// connection without encryption when the server does not support TLS
 	AllowInsecure bool
-	Logger        *slog.Logger
+	// Compress enables the IMAP COMPRESS extension, when the server
+	// supports it.
+	Compress bool
+	// ConnectTimeout is the max. duration of establishing the connection
+	// and of the login. If it is 0, 2min are used.
+	ConnectTimeout time.Duration
+	// SelectTimeout is the max. duration of selecting a mailbox.
+	SelectTimeout time.Duration
+	// FetchTimeout is the max. duration of receiving a message of a
+	// FETCH response.
+	// When SelectTimeout or FetchTimeout is exceeded, the connection is
+	// closed. They are disabled when they are 0.
+	FetchTimeout time.Duration
+	// Spool is optional, when it is set the fetched message data is
+	// buffered with it. Otherwise it is buffered in memory.
+	Spool  *spool.Spool
+	Logger *slog.Logger
 }
 
 type EventNewMessages struct {
+	// NewMsgCount is the number of messages in the mailbox that exceed
+	// the known message count passed to [Client.Monitor].
 	NewMsgCount uint32
 }
 
 // NewClient creates an new IMAP-Client.
 // [*Client.Connect] must be called before any other methods.
 func NewClient(cfg *Config) *Client {
+	connectTimeout := cfg.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+
 	return &Client{
-		address:       cfg.Address,
-		user:          cfg.User,
-		password:      cfg.Password,
-		allowInsecure: cfg.AllowInsecure,
-		logger:        log.EnsureLoggerInstance(cfg.Logger),
+		address:        cfg.Address,
+		user:           cfg.User,
+		password:       cfg.Password,
+		allowInsecure:  cfg.AllowInsecure,
+		compress:       cfg.Compress,
+		connectTimeout: connectTimeout,
+		selectTimeout:  cfg.SelectTimeout,
+		fetchTimeout:   cfg.FetchTimeout,
+		spool:          cfg.Spool,
+		logger:         log.Module(cfg.Logger, "imapclt"),
 	}
 }
 
@@ -69,48 +111,125 @@ func (c *Client) Connect() error {
 		UnilateralDataHandler: &imapclient.UnilateralDataHandler{
 			Mailbox: c.mailboxUpdateHandler,
 		},
-		Dialer: &net.Dialer{Timeout: dialTimeout},
+		Dialer:      &net.Dialer{Timeout: c.connectTimeout},
+		WordDecoder: mail.NewWordDecoder(),
 	})
 	if err != nil {
 		return fmt.Errorf("establishing imap server connection failed: %w", err)
 	}
 	c.clt = clt
 
-	if err := clt.Login(c.user, c.password).Wait(); err != nil {
+	err = c.withTimeout("LOGIN", c.connectTimeout, func() error {
+		return clt.Login(c.user, c.password).Wait()
+	})
+	if err != nil {
 		return fmt.Errorf("login at imap server failed: %w", err)
 	}
 
 	c.logger.Info("connection established, authentication succeeded",
 		"event", "imap.connection_established")
 
+	if c.compress {
+		c.enableCompression()
+	}
+
 	return nil
 }
 
+// enableCompression enables the COMPRESS extension if the server supports it.
+// If enabling it fails, the connection is used uncompressed.
+func (c *Client) enableCompression() {
+	if !c.clt.Caps().Has(CapCompressDeflate) {
+		c.logger.Info("server does not support compression, continuing without",
+			"event", "imap.compression_unsupported")
+		return
+	}
+
+	if err := c.cconn.startCompression(); err != nil {
+		c.logger.Warn("enabling compression failed, continuing without",
+			"error", err, "event", "imap.compression_failed")
+		return
+	}
+
+	c.logger.Debug("compression enabled", "event", "imap.compression_enabled")
+}
+
+// Close closes the connection. It can also be called when [Client.Connect]
+// failed.
 func (c *Client) Close() error {
+	if c.clt == nil {
+		return nil
+	}
+
 	return c.clt.Close()
 }
 
 func (c *Client) dial(address string, allowInsecure bool, opts *imapclient.Options) (*imapclient.Client, error) {
+	logger := c.logger.With("server", address).With("timeout", c.connectTimeout)
+
+	if c.compress {
+		conn, err := dialTLSMode(logger.With("compress", true), &compressDialer{dialer: opts.Dialer}, address, allowInsecure)
+		if err != nil {
+			return nil, err
+		}
+		c.cconn = conn
+
+		return imapclient.New(conn, opts), nil
+	}
+
+	return dialTLSMode(logger, &clientDialer{opts: opts}, address, allowInsecure)
+}
+
+// tlsDialer establishes connections with the TLS modes that [dialTLSMode]
+// selects.
+type tlsDialer[T any] interface {
+	dialTLS(address string) (T, error)
+	dialStartTLS(address string) (T, error)
+	dialInsecure(address string) (T, error)
+}
+
+// dialTLSMode establishes a connection to address with implicit TLS if the
+// port is the IMAPS port, otherwise with STARTTLS. If the server does not
+// support STARTTLS and allowInsecure is true, an unencrypted connection is
+// established.
+func dialTLSMode[T any](logger *slog.Logger, d tlsDialer[T], address string, allowInsecure bool) (T, error) {
 	_, port, err := net.SplitHostPort(address)
 	if err != nil {
-		return nil, err
+		var zero T
+		return zero, err
 	}
 
-	logger := c.logger.With("server", address).With("timeout", dialTimeout)
-
 	if port == "993" || port == "imaps" {
 		logger.Debug("connecting to imap server", "tlsmode", "implicit")
-		return imapclient.DialTLS(address, opts)
+		return d.dialTLS(address)
 	}
 
 	logger.Debug("connecting to imap server", "tlsmode", "explicit")
-	clt, err := imapclient.DialStartTLS(address, opts)
+	conn, err := d.dialStartTLS(address)
 	if err != nil && allowInsecure && isStartTLSNotSupportedErr(err) {
 		logger.Warn("establishing secure connection failed, connecting without encryption", "tlsmode", "none", "error", err)
-		return imapclient.DialInsecure(address, opts)
+		return d.dialInsecure(address)
 	}
 
-	return clt, err
+	return conn, err
+}
+
+// clientDialer establishes connections with the dial functions of
+// [imapclient].
+type clientDialer struct {
+	opts *imapclient.Options
+}
+
+func (d *clientDialer) dialTLS(address string) (*imapclient.Client, error) {
+	return imapclient.DialTLS(address, d.opts)
+}
+
+func (d *clientDialer) dialStartTLS(address string) (*imapclient.Client, error) {
+	return imapclient.DialStartTLS(address, d.opts)
+}
+
+func (d *clientDialer) dialInsecure(address string) (*imapclient.Client, error) {
+	return imapclient.DialInsecure(address, d.opts)
 }
 
 func isStartTLSNotSupportedErr(err error) bool {
@@ -139,12 +258,21 @@ func (c *Client) mailboxUpdateHandler(d *imapclient.UnilateralDataMailbox) {
 		return
 	}
 
-	sendEventNewMessages(c.newMessagesCh, *d.NumMessages)
+	sendEventNewMessages(c.newMessagesCh, newMsgCount(*d.NumMessages, c.knownMsgCount))
+}
+
+func newMsgCount(numMessages, knownMsgCount uint32) uint32 {
+	if numMessages <= knownMsgCount {
+		return 0
+	}
+
+	return numMessages - knownMsgCount
 }
 
 // Upload reads a message (mail) from file and appends it to an imap mailbox.
-// The internal date of the message is set to ts.
-func (c *Client) Upload(path, mailbox string, ts time.Time) error {
+// The internal date of the message is set to ts and its flags to flags.
+// The \Recent flag can not be set by clients, it is omitted.
+func (c *Client) Upload(path, mailbox string, ts time.Time, flags []string) error {
 	fi, err := os.Stat(path)
 	if err != nil {
 		return err
@@ -156,7 +284,15 @@ func (c *Client) Upload(path, mailbox string, ts time.Time) error {
 	}
 	defer fd.Close()
 
-	appendCmd := c.clt.Append(mailbox, fi.Size(), &imap.AppendOptions{Time: ts})
+	appendFlags := make([]imap.Flag, 0, len(flags))
+	for _, f := range flags {
+		if strings.EqualFold(f, `\Recent`) {
+			continue
+		}
+		appendFlags = append(appendFlags, imap.Flag(f))
+	}
+
+	appendCmd := c.clt.Append(mailbox, fi.Size(), &imap.AppendOptions{Time: ts, Flags: appendFlags})
 
 	_, err = io.Copy(appendCmd, fd)
 	if err != nil {
@@ -188,11 +324,14 @@ func (c *Client) Upload(path, mailbox string, ts time.Time) error {
 // When new messages are found an event is sent to ch.
 // Message delivery to ch must not block. If delievery would block the
 // message is discarded.
+// knownMsgCount is the number of messages in the mailbox that have already
+// been seen by the caller and are left in the mailbox, only messages
+// exceeding the count are reported as new.
 //
 // While Monitor is running, running other IMAP operations will block forever!
 // To issue other IMAP operations, the returned stop function must be called
 // before!
-func (c *Client) Monitor(mailbox string) (
+func (c *Client) Monitor(mailbox string, knownMsgCount uint32) (
 	_ <-chan *EventNewMessages, stop func() error, _ error,
 ) {
 	logger := c.logger.With("mailbox", mailbox)
@@ -200,25 +339,25 @@ func (c *Client) Monitor(mailbox string) (
 
 	ch := make(chan *EventNewMessages, defChanBufSiz)
 
-	d, err := c.clt.Select(mailbox, &imap.SelectOptions{ReadOnly: true}).Wait()
+	d, err := c.selectMailbox(mailbox, &imap.SelectOptions{ReadOnly: true})
 	if err != nil {
 		return nil, nil, fmt.Errorf("selecting mailbox %q failed: %w", mailbox, err)
 	}
 
-	if d.NumMessages != 0 {
+	if cnt := newMsgCount(d.NumMessages, knownMsgCount); cnt != 0 {
 		logger.Debug("mailbox has new message, skipping monitoring",
-			"count", d.NumMessages,
+			"count", cnt,
 		)
-		sendEventNewMessages(ch, d.NumMessages)
+		sendEventNewMessages(ch, cnt)
 		close(ch)
 		return ch, func() error { return nil }, nil
 	}
 
-	c.setNewMessagesCH(ch)
+	c.setNewMessagesCH(ch, knownMsgCount)
 
 	idlecmd, err := c.clt.Idle()
 	if err != nil {
-		c.setNewMessagesCH(nil)
+		c.setNewMessagesCH(nil, 0)
 		close(ch)
 		return nil, nil, err
 	}
@@ -226,7 +365,7 @@ func (c *Client) Monitor(mailbox string) (
 	return ch, func() error {
 		logger.Debug("stopping idle command")
 		err := errors.Join(idlecmd.Close(), idlecmd.Wait())
-		c.setNewMessagesCH(nil)
+		c.setNewMessagesCH(nil, 0)
 		close(ch)
 		return err
 	}, nil
@@ -249,27 +388,138 @@ func asUIDSet(uids []uint32) imap.UIDSet {
 }
 
 // Move moves the messages with the given uids to mailbox.
+//
+// When the server supports the MOVE extension, the messages are moved with
+// a UID MOVE command. Otherwise they are copied, flagged as \Deleted and
+// expunged.
+// In both cases the flags and the internal date of the messages are
+// preserved by the server.
+// The mailbox that contains the messages must be selected.
 func (c *Client) Move(uids []uint32, mailbox string) error {
 	if len(uids) == 0 {
 		return errors.New("no uids were given")
 	}
 
-	_, err := c.clt.Move(asUIDSet(uids), mailbox).Wait()
-	if err != nil {
-		return err
+	uidSet := asUIDSet(uids)
+	method := "move"
+
+	if c.clt.Caps().Has(imap.CapMove) {
+		if _, err := c.clt.Move(uidSet, mailbox).Wait(); err != nil {
+			return err
+		}
+	} else {
+		method = "copy"
+		if err := c.copyAndExpunge(uidSet, mailbox); err != nil {
+			return err
+		}
 	}
 
 	c.logger.Debug(
 		"moved imap messages",
 		lkMailbox, mailbox,
 		"count", len(uids),
+		"method", method,
 		"event", "imap.messages_moved",
 	)
-	return err
+	return nil
+}
+
+// copyAndExpunge copies the messages to mailbox, flags them as \Deleted and
+// expunges them from the selected mailbox.
+func (c *Client) copyAndExpunge(uidSet imap.UIDSet, mailbox string) error {
+	if _, err := c.clt.Copy(uidSet, mailbox).Wait(); err != nil {
+		return fmt.Errorf("copying messages failed: %w", err)
+	}
+
+	return c.expunge(uidSet)
+}
+
+// Delete flags the messages with the given uids in the selected mailbox as
+// \Deleted and expunges them, they are removed permanently.
+func (c *Client) Delete(uids []uint32) error {
+	if len(uids) == 0 {
+		return errors.New("no uids were given")
+	}
+
+	if err := c.expunge(asUIDSet(uids)); err != nil {
+		return err
+	}
+
+	c.logger.Debug(
+		"deleted imap messages",
+		"count", len(uids),
+		"event", "imap.messages_deleted",
+	)
+
+	return nil
+}
+
+// expunge flags the messages as \Deleted and expunges them from the selected
+// mailbox.
+// If the server does not support UID EXPUNGE (UIDPLUS extension), other
+// messages that are flagged as \Deleted are unflagged during the EXPUNGE to
+// prevent that they are removed.
+func (c *Client) expunge(uidSet imap.UIDSet) error {
+	if err := c.storeDeletedFlag(uidSet, imap.StoreFlagsAdd); err != nil {
+		return err
+	}
+
+	if c.clt.Caps().Has(imap.CapUIDPlus) {
+		if err := c.clt.UIDExpunge(uidSet).Close(); err != nil {
+			return fmt.Errorf("expunging messages failed: %w", err)
+		}
+		return nil
+	}
+
+	searchData, err := c.clt.UIDSearch(&imap.SearchCriteria{
+		Flag: []imap.Flag{imap.FlagDeleted},
+	}, nil).Wait()
+	if err != nil {
+		return fmt.Errorf("searching deleted messages failed: %w", err)
+	}
+
+	var otherUIDs imap.UIDSet
+	for _, uid := range searchData.AllUIDs() {
+		if !uidSet.Contains(uid) {
+			otherUIDs.AddNum(uid)
+		}
+	}
+
+	if len(otherUIDs) != 0 {
+		if err := c.storeDeletedFlag(otherUIDs, imap.StoreFlagsDel); err != nil {
+			return err
+		}
+	}
+
+	if err := c.clt.Expunge().Close(); err != nil {
+		return fmt.Errorf("expunging messages failed: %w", err)
+	}
+
+	if len(otherUIDs) != 0 {
+		if err := c.storeDeletedFlag(otherUIDs, imap.StoreFlagsAdd); err != nil {
+			return fmt.Errorf("restoring deleted flag of messages failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) storeDeletedFlag(uidSet imap.UIDSet, op imap.StoreFlagsOp) error {
+	err := c.clt.Store(uidSet, &imap.StoreFlags{
+		Op:     op,
+		Silent: true,
+		Flags:  []imap.Flag{imap.FlagDeleted},
+	}, nil).Close()
+	if err != nil {
+		return fmt.Errorf("storing deleted flag failed: %w", err)
+	}
+
+	return nil
 }
 
-func (c *Client) setNewMessagesCH(ch chan<- *EventNewMessages) {
+func (c *Client) setNewMessagesCH(ch chan<- *EventNewMessages, knownMsgCount uint32) {
 	c.mu.Lock()
 	c.newMessagesCh = ch
+	c.knownMsgCount = knownMsgCount
 	c.mu.Unlock()
 }
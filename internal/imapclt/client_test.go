@@ -1,10 +1,15 @@
 package imapclt
 
 import (
+	"context"
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/emersion/go-imap/v2"
+
 	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
 	"github.com/fho/rspamd-iscan/internal/testutils/mail"
 )
 
@@ -12,11 +17,11 @@ func TestMonitor(t *testing.T) {
 	srv, clt := startServerClient(t)
 	testMailPath := mail.TestHamMailPath(t)
 
-	ch, stopFn, err := clt.Monitor(srv.InboxMailBox)
+	ch, stopFn, err := clt.Monitor(srv.InboxMailBox, 0)
 	assert.NoError(t, err)
 
 	clt2 := newTestClient(t, srv)
-	assert.NoError(t, clt2.Upload(testMailPath, srv.InboxMailBox, time.Now()))
+	assert.NoError(t, clt2.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
 	_ = clt2.Close()
 
 	ev := <-ch
@@ -32,14 +37,160 @@ func TestMonitorChanIsNonBlocking(t *testing.T) {
 	testMailPath := mail.TestHamMailPath(t)
 	srv, clt := startServerClient(t)
 
-	_, stopFn, err := clt.Monitor(srv.InboxMailBox)
+	_, stopFn, err := clt.Monitor(srv.InboxMailBox, 0)
 	assert.NoError(t, err)
 
 	clt2 := newTestClient(t, srv)
-	assert.NoError(t, clt2.Upload(testMailPath, srv.InboxMailBox, time.Now()))
+	assert.NoError(t, clt2.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
 
-	assert.NoError(t, clt2.Upload(testMailPath, srv.InboxMailBox, time.Now()))
+	assert.NoError(t, clt2.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
 	clt2.Close()
 
 	assert.NoError(t, stopFn())
 }
+
+func TestMonitorIgnoresKnownMessages(t *testing.T) {
+	srv, clt := startServerClient(t)
+	testMailPath := mail.TestHamMailPath(t)
+
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+
+	ch, stopFn, err := clt.Monitor(srv.InboxMailBox, 1)
+	assert.NoError(t, err)
+
+	select {
+	case ev := <-ch:
+		t.Fatalf("got unexpected event for known message: %+v", ev)
+	default:
+	}
+
+	clt2 := newTestClient(t, srv)
+	assert.NoError(t, clt2.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+	_ = clt2.Close()
+
+	ev := <-ch
+	assert.Equal(t, 1, ev.NewMsgCount)
+
+	assert.NoError(t, stopFn())
+}
+
+func TestMoveWithoutMoveAndUIDPlus(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	clt := newTestClient(t, srv)
+
+	// the messages are copied, flagged as deleted and expunged, the
+	// deleted flag of other messages is removed during the EXPUNGE and
+	// restored afterwards
+	assert.Equal(t, false, clt.clt.Caps().Has(imap.CapMove))
+	assert.Equal(t, false, clt.clt.Caps().Has(imap.CapUIDPlus))
+
+	testMovePreservesFlagsAndDeletedMessages(t, srv, clt)
+}
+
+func TestMoveWithMoveAndUIDPlus(t *testing.T) {
+	srv := imapserver.StartServerWithCaps(t, imap.CapSet{
+		imap.CapIMAP4rev1: {},
+		imap.CapMove:      {},
+		imap.CapUIDPlus:   {},
+	})
+	clt := newTestClient(t, srv)
+
+	assert.Equal(t, true, clt.clt.Caps().Has(imap.CapMove))
+	assert.Equal(t, true, clt.clt.Caps().Has(imap.CapUIDPlus))
+
+	testMovePreservesFlagsAndDeletedMessages(t, srv, clt)
+}
+
+// testMovePreservesFlagsAndDeletedMessages moves and deletes messages from
+// the scan mailbox and checks that the flags of the moved message are
+// preserved and that a message that the user flagged as deleted is not
+// expunged.
+func testMovePreservesFlagsAndDeletedMessages(t *testing.T, srv *imapserver.Server, clt *Client) {
+	testMailPath := mail.TestHamMailPath(t)
+
+	for range 3 {
+		assert.NoError(t, clt.Upload(testMailPath, srv.ScanMailbox, time.Now(), nil))
+	}
+
+	var uids []uint32
+	for msg, err := range clt.Messages(context.Background(), srv.ScanMailbox, nil) {
+		assert.NoError(t, err)
+		uids = append(uids, msg.UID)
+	}
+	assert.Equal(t, 3, len(uids))
+
+	storeFlags := func(uid uint32, flags ...imap.Flag) {
+		t.Helper()
+		err := clt.clt.Store(imap.UIDSetNum(imap.UID(uid)), &imap.StoreFlags{
+			Op: imap.StoreFlagsAdd, Silent: true, Flags: flags,
+		}, nil).Close()
+		assert.NoError(t, err)
+	}
+	storeFlags(uids[0], imap.FlagSeen, imap.FlagFlagged, "$keyword")
+	// a message that was deleted by the user but is not expunged yet
+	storeFlags(uids[1], imap.FlagDeleted)
+
+	assert.NoError(t, clt.Move(uids[:1], srv.SpamMailbox))
+	assert.NoError(t, clt.Delete(uids[2:]))
+
+	flags := func(mailbox string) [][]imap.Flag {
+		t.Helper()
+		_, err := clt.clt.Select(mailbox, nil).Wait()
+		assert.NoError(t, err)
+
+		seqSet := imap.SeqSet{}
+		seqSet.AddRange(1, 0)
+		msgs, err := clt.clt.Fetch(seqSet, &imap.FetchOptions{Flags: true}).Collect()
+		assert.NoError(t, err)
+
+		result := make([][]imap.Flag, 0, len(msgs))
+		for _, msg := range msgs {
+			result = append(result, msg.Flags)
+		}
+		return result
+	}
+
+	spamFlags := flags(srv.SpamMailbox)
+	assert.Equal(t, 1, len(spamFlags))
+	for _, f := range []imap.Flag{imap.FlagSeen, imap.FlagFlagged, "$keyword"} {
+		if !slices.Contains(spamFlags[0], f) {
+			t.Errorf("flag %s is missing on moved message, flags: %v", f, spamFlags[0])
+		}
+	}
+	if slices.Contains(spamFlags[0], imap.FlagDeleted) {
+		t.Errorf("moved message is flagged as deleted")
+	}
+
+	scanFlags := flags(srv.ScanMailbox)
+	assert.Equal(t, 1, len(scanFlags))
+	if !slices.Contains(scanFlags[0], imap.FlagDeleted) {
+		t.Errorf("deleted flag of remaining message was not restored, flags: %v", scanFlags[0])
+	}
+}
+
+func TestCompressWithoutServerSupport(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	cfg := testClientCfg(t, srv)
+	cfg.Compress = true
+
+	clt := NewClient(cfg)
+
+	var err error
+	for range 9 {
+		if err = clt.Connect(); err == nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	t.Cleanup(func() { clt.Close() })
+
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), srv.InboxMailBox, time.Now(), nil))
+
+	cnt := 0
+	for _, err := range clt.Messages(context.Background(), srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		cnt++
+	}
+	assert.Equal(t, 1, cnt)
+}
@@ -0,0 +1,306 @@
+package imapclt
+
+import (
+	"bufio"
+	"compress/flate"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// CapCompressDeflate is the capability of servers that support the IMAP
+// COMPRESS extension with the DEFLATE algorithm (RFC 4978).
+const CapCompressDeflate = "COMPRESS=DEFLATE"
+
+// compressTag is the tag of the commands that are sent by compressConn.
+// It must differ from the tags used by [imapclient.Client].
+const compressTag = "ISCAN"
+
+// compressConn is a connection that supports enabling DEFLATE compression
+// after the connection was established (RFC 4978).
+// It sends the COMPRESS command itself, the response to the command is not
+// passed to the reader of the connection.
+//
+// Before compression is enabled, data is read line by line to detect the
+// response, compression must only be enabled while no other command is in
+// progress.
+type compressConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	// greeting is returned by Read before any data from the underlying
+	// connection.
+	greeting []byte
+	// line is the unread remainder of the last read line.
+	line []byte
+
+	mu         sync.Mutex
+	compressed bool
+	// waitCh is not nil while a response to the COMPRESS command is
+	// awaited, the result is sent to it.
+	waitCh chan error
+	fr     io.Reader
+	fw     *flate.Writer
+}
+
+func newCompressConn(conn net.Conn, br *bufio.Reader, greeting string) *compressConn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+
+	return &compressConn{
+		Conn:     conn,
+		br:       br,
+		greeting: []byte(greeting),
+	}
+}
+
+func (c *compressConn) Read(b []byte) (int, error) {
+	if len(c.greeting) > 0 {
+		n := copy(b, c.greeting)
+		c.greeting = c.greeting[n:]
+		return n, nil
+	}
+
+	for {
+		if len(c.line) > 0 {
+			n := copy(b, c.line)
+			c.line = c.line[n:]
+			return n, nil
+		}
+
+		c.mu.Lock()
+		compressed := c.compressed
+		c.mu.Unlock()
+
+		if compressed {
+			return c.fr.Read(b)
+		}
+
+		line, err := c.br.ReadBytes('\n')
+		if err != nil && len(line) == 0 {
+			return 0, err
+		}
+
+		if c.handleCompressResponse(line) {
+			continue
+		}
+
+		c.line = line
+	}
+}
+
+// handleCompressResponse returns true if line is the response to the
+// COMPRESS command. If the command succeeded compression is enabled.
+func (c *compressConn) handleCompressResponse(line []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.waitCh == nil || !strings.HasPrefix(string(line), compressTag+" ") {
+		return false
+	}
+
+	status, _, _ := strings.Cut(strings.TrimPrefix(string(line), compressTag+" "), " ")
+	if strings.EqualFold(status, "OK") {
+		c.fr = flate.NewReader(c.br)
+		// the error is always nil for valid compression levels
+		c.fw, _ = flate.NewWriter(c.Conn, flate.DefaultCompression)
+		c.compressed = true
+		c.waitCh <- nil
+	} else {
+		c.waitCh <- fmt.Errorf("server responded: %s", strings.TrimSpace(string(line)))
+	}
+	c.waitCh = nil
+
+	return true
+}
+
+func (c *compressConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.compressed {
+		return c.Conn.Write(b)
+	}
+
+	n, err := c.fw.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	return n, c.fw.Flush()
+}
+
+// startCompression sends the COMPRESS DEFLATE command and waits for the
+// response. The connection must be read concurrently.
+func (c *compressConn) startCompression() error {
+	c.mu.Lock()
+	if c.compressed {
+		c.mu.Unlock()
+		return errors.New("compression is already enabled")
+	}
+
+	waitCh := make(chan error, 1)
+	c.waitCh = waitCh
+
+	_, err := c.Conn.Write([]byte(compressTag + " COMPRESS DEFLATE\r\n"))
+	if err != nil {
+		c.waitCh = nil
+		c.mu.Unlock()
+		return err
+	}
+	c.mu.Unlock()
+
+	return <-waitCh
+}
+
+// compressDialer establishes connections that support enabling compression,
+// it is used with [dialTLSMode].
+// STARTTLS is negotiated by compressDialer itself, because the compression
+// layer must be above the TLS layer, which [imapclient.NewStartTLS] does not
+// allow.
+type compressDialer struct {
+	dialer *net.Dialer
+}
+
+func (d *compressDialer) dialTLS(address string) (*compressConn, error) {
+	conn, err := tls.DialWithDialer(d.dialer, "tcp", address, &tls.Config{NextProtos: []string{"imap"}})
+	if err != nil {
+		return nil, err
+	}
+
+	return newCompressConn(conn, nil, ""), nil
+}
+
+func (d *compressDialer) dialInsecure(address string) (*compressConn, error) {
+	conn, err := d.dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCompressConn(conn, nil, ""), nil
+}
+
+// dialStartTLS establishes a connection and negotiates STARTTLS. If the
+// server rejects the command, the status response is returned as
+// [*imap.Error].
+// The capabilities that the server announced before STARTTLS are discarded
+// (RFC 3501 6.2.1), they are requested again and announced in the greeting
+// that the connection returns.
+func (d *compressDialer) dialStartTLS(address string) (*compressConn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn, err := startTLS(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(tlsConn)
+	caps, err := taggedCommand(tlsConn, br, "CAPABILITY")
+	if err != nil {
+		_ = tlsConn.Close()
+		return nil, fmt.Errorf("requesting capabilities failed: %w", err)
+	}
+
+	greeting := "* OK TLS established\r\n"
+	for _, line := range caps {
+		if c, ok := strings.CutPrefix(line, "* CAPABILITY "); ok {
+			greeting = "* OK [CAPABILITY " + strings.TrimSpace(c) + "] TLS established\r\n"
+		}
+	}
+
+	return newCompressConn(tlsConn, br, greeting), nil
+}
+
+// startTLS reads the greeting from conn, sends the STARTTLS command and
+// establishes the TLS session.
+func startTLS(conn net.Conn, serverName string) (*tls.Conn, error) {
+	// the server must not send data after the response to STARTTLS until
+	// the TLS handshake was started, therefore nothing is lost when the
+	// buffered reader is discarded
+	br := bufio.NewReader(conn)
+
+	greeting, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading greeting failed: %w", err)
+	}
+
+	// per RFC 3501 7.1.4, PREAUTH is refused when using STARTTLS
+	if strings.HasPrefix(greeting, "* PREAUTH") {
+		return nil, errors.New("server sent PREAUTH on unencrypted connection")
+	}
+
+	if _, err := taggedCommand(conn, br, "STARTTLS"); err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("tls handshake failed: %w", err)
+	}
+
+	return tlsConn, nil
+}
+
+// taggedCommand sends cmd and returns the untagged responses that were
+// received before the tagged response. If the tagged response is not OK, it
+// is returned as [*imap.Error].
+func taggedCommand(w io.Writer, br *bufio.Reader, cmd string) ([]string, error) {
+	if _, err := io.WriteString(w, compressTag+" "+cmd+"\r\n"); err != nil {
+		return nil, err
+	}
+
+	var untagged []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("reading %s response failed: %w", cmd, err)
+		}
+
+		status, ok := strings.CutPrefix(line, compressTag+" ")
+		if !ok {
+			untagged = append(untagged, strings.TrimRight(line, "\r\n"))
+			continue
+		}
+
+		if err := statusError(strings.TrimSpace(status)); err != nil {
+			return nil, err
+		}
+
+		return untagged, nil
+	}
+}
+
+// statusError returns the tagged status response resp, without the tag, as
+// [*imap.Error]. If the status is OK, nil is returned.
+func statusError(resp string) error {
+	typ, text, _ := strings.Cut(resp, " ")
+	if strings.EqualFold(typ, string(imap.StatusResponseTypeOK)) {
+		return nil
+	}
+
+	imapErr := imap.Error{Type: imap.StatusResponseType(strings.ToUpper(typ)), Text: text}
+	if rest, ok := strings.CutPrefix(text, "["); ok {
+		if code, text, ok := strings.Cut(rest, "] "); ok {
+			imapErr.Code = imap.ResponseCode(code)
+			imapErr.Text = text
+		}
+	}
+
+	return &imapErr
+}
@@ -0,0 +1,181 @@
+package imapclt
+
+import (
+	"bufio"
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestCompressConn(t *testing.T) {
+	cltConn, srvConn := net.Pipe()
+	t.Cleanup(func() { _ = cltConn.Close(); _ = srvConn.Close() })
+
+	srvErrCh := make(chan error, 1)
+	go func() {
+		srvErrCh <- func() error {
+			br := bufio.NewReader(srvConn)
+			if _, err := io.WriteString(srvConn, "* OK ready\r\n"); err != nil {
+				return err
+			}
+
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if line != compressTag+" COMPRESS DEFLATE\r\n" {
+				t.Errorf("unexpected command: %q", line)
+			}
+
+			if _, err := io.WriteString(srvConn, "* 3 EXISTS\r\n"+compressTag+" OK DEFLATE active\r\n"); err != nil {
+				return err
+			}
+
+			fw, _ := flate.NewWriter(srvConn, flate.DefaultCompression)
+			if _, err := io.WriteString(fw, "* 4 EXISTS\r\n"); err != nil {
+				return err
+			}
+			if err := fw.Flush(); err != nil {
+				return err
+			}
+
+			line, err = bufio.NewReader(flate.NewReader(br)).ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if line != "T1 NOOP\r\n" {
+				t.Errorf("unexpected compressed command: %q", line)
+			}
+
+			return nil
+		}()
+	}()
+
+	conn := newCompressConn(cltConn, nil, "")
+	br := bufio.NewReader(conn)
+
+	readLine := func() string {
+		t.Helper()
+		line, err := br.ReadString('\n')
+		assert.NoError(t, err)
+		return line
+	}
+
+	assert.Equal(t, "* OK ready\r\n", readLine())
+
+	startErrCh := make(chan error, 1)
+	go func() { startErrCh <- conn.startCompression() }()
+
+	// the response to the COMPRESS command is not returned
+	assert.Equal(t, "* 3 EXISTS\r\n", readLine())
+	assert.Equal(t, "* 4 EXISTS\r\n", readLine())
+	assert.NoError(t, <-startErrCh)
+
+	_, err := io.WriteString(conn, "T1 NOOP\r\n")
+	assert.NoError(t, err)
+	assert.NoError(t, <-srvErrCh)
+}
+
+func TestCompressConnRejected(t *testing.T) {
+	cltConn, srvConn := net.Pipe()
+	t.Cleanup(func() { _ = cltConn.Close(); _ = srvConn.Close() })
+
+	go func() {
+		line, _ := bufio.NewReader(srvConn).ReadString('\n')
+		if strings.HasPrefix(line, compressTag+" ") {
+			_, _ = io.WriteString(srvConn, compressTag+" NO not supported\r\n* 1 EXISTS\r\n")
+		}
+	}()
+
+	conn := newCompressConn(cltConn, nil, "* OK greeting\r\n")
+	br := bufio.NewReader(conn)
+
+	line, err := br.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "* OK greeting\r\n", line)
+
+	startErrCh := make(chan error, 1)
+	go func() { startErrCh <- conn.startCompression() }()
+
+	line, err = br.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "* 1 EXISTS\r\n", line)
+	assert.Error(t, <-startErrCh)
+	assert.Equal(t, false, conn.compressed)
+}
+
+// startSTARTTLSServer starts a server that sends greeting and responds with
+// resp to the STARTTLS command.
+func startSTARTTLSServer(t *testing.T, greeting, resp string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+
+			go func() {
+				if _, err := io.WriteString(conn, greeting); err != nil {
+					return
+				}
+
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err == nil && line == compressTag+" STARTTLS\r\n" {
+					_, _ = io.WriteString(conn, compressTag+" "+resp+"\r\n")
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestDialTLSModeCompress(t *testing.T) {
+	const greeting = "* OK [CAPABILITY IMAP4rev1 STARTTLS COMPRESS=DEFLATE] ready\r\n"
+	logger := log.SlogTestLogger(t)
+	dialer := compressDialer{dialer: &net.Dialer{Timeout: 5 * time.Second}}
+
+	addr := startSTARTTLSServer(t, greeting, "NO STARTTLS not supported")
+
+	_, err := dialTLSMode(logger, &dialer, addr, false)
+	assert.Equal(t, true, isStartTLSNotSupportedErr(err))
+
+	// the connection is established again without encryption, the
+	// greeting and its capabilities are passed through
+	conn, err := dialTLSMode(logger, &dialer, addr, true)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, greeting, line)
+
+	// other failures do not cause a fallback to an insecure connection
+	addr = startSTARTTLSServer(t, greeting, "BAD [UNAVAILABLE] TLS temporarily unavailable")
+	_, err = dialTLSMode(logger, &dialer, addr, true)
+	var imapErr *imap.Error
+	if !errors.As(err, &imapErr) {
+		t.Fatalf("expected an imap error, got: %v", err)
+	}
+	assert.Equal(t, imap.StatusResponseTypeBad, imapErr.Type)
+	assert.Equal(t, imap.ResponseCode("UNAVAILABLE"), imapErr.Code)
+	assert.Equal(t, "TLS temporarily unavailable", imapErr.Text)
+
+	// PREAUTH is refused on unencrypted connections
+	addr = startSTARTTLSServer(t, "* PREAUTH ready\r\n", "OK begin TLS")
+	_, err = dialTLSMode(logger, &dialer, addr, true)
+	assert.Error(t, err)
+}
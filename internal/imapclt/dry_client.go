@@ -15,7 +15,7 @@ func NewDryClient(cfg *Config) *DryClient {
 }
 
 // Upload logs a debug message and returns nil
-func (c *DryClient) Upload(path, mailbox string, _ time.Time) error {
+func (c *DryClient) Upload(path, mailbox string, _ time.Time, _ []string) error {
 	c.logger.Debug("dry-client: skipping uploading mail to mailbox",
 		lkMailbox, mailbox, "filepath", path)
 	return nil
@@ -29,3 +29,28 @@ func (c *DryClient) Move(uids []uint32, mailbox string) error {
 	)
 	return nil
 }
+
+// Delete logs a debug message and returns nil
+func (c *DryClient) Delete(uids []uint32) error {
+	c.logger.Debug("dry-client: skipping deleting messages",
+		"count", len(uids),
+	)
+	return nil
+}
+
+// AddKeyword logs a debug message and returns nil
+func (c *DryClient) AddKeyword(uids []uint32, keyword string) error {
+	c.logger.Debug("dry-client: skipping adding keyword to messages",
+		"keyword", keyword,
+		"count", len(uids),
+	)
+	return nil
+}
+
+// CreateMailboxes logs a debug message and returns nil
+func (c *DryClient) CreateMailboxes(mailboxes []string) ([]string, error) {
+	c.logger.Debug("dry-client: skipping creating mailboxes",
+		"mailboxes", mailboxes,
+	)
+	return nil, nil
+}
@@ -0,0 +1,157 @@
+package imapclt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	netmail "net/mail"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+
+	"github.com/fho/rspamd-iscan/internal/mail"
+)
+
+// fetchWithHeaderEnvelope fetches the messages that are selected by opts and
+// are not in fetchedUIDs without their ENVELOPE and passes them to yield.
+// Their envelope is parsed from the header section of the fetched data.
+// It is used for messages whose ENVELOPE the server sent malformed, to scan
+// them anyways. Messages whose header section can not be parsed are skipped.
+func (c *Client) fetchWithHeaderEnvelope(
+	ctx context.Context,
+	opts *FetchOptions,
+	fetchedUIDs imap.UIDSet,
+	yield func(*Message, error) bool,
+) {
+	criteria := imap.SearchCriteria{}
+	switch numSet := opts.numSet().(type) {
+	case imap.UIDSet:
+		criteria.UID = []imap.UIDSet{numSet}
+	case imap.SeqSet:
+		criteria.SeqNum = []imap.SeqSet{numSet}
+	}
+
+	data, err := c.clt.UIDSearch(&criteria, nil).Wait()
+	if err != nil {
+		yield(nil, fmt.Errorf("searching messages with malformed ENVELOPE failed: %w", err))
+		return
+	}
+
+	var uids imap.UIDSet
+	for _, uid := range data.AllUIDs() {
+		if !fetchedUIDs.Contains(uid) {
+			uids.AddNum(uid)
+		}
+	}
+
+	if len(uids) == 0 {
+		return
+	}
+
+	logger := c.logger.With("uids", uids.String())
+	logger.Info("fetching messages with malformed ENVELOPE, parsing envelope from header",
+		"event", "imap.header_envelope_fetch")
+
+	bodySection := opts.bodySection()
+	fetchCmd := c.clt.Fetch(uids, &imap.FetchOptions{
+		UID:          true,
+		RFC822Size:   true,
+		InternalDate: true,
+		Flags:        true,
+		BodySection:  []*imap.FetchItemBodySection{bodySection},
+	})
+
+	canceled := false
+	for {
+		if err := ctx.Err(); err != nil {
+			canceled = !yield(nil, err)
+			break
+		}
+
+		msg, err := c.fetchNext(fetchCmd, bodySection, true)
+		if err != nil {
+			if isMalformedEnvelopeErr(err) {
+				logger.Warn("skipping message, parsing its header failed",
+					"error", err, "event", "imap.malformed_header")
+				continue
+			}
+
+			canceled = !yield(nil, err) || errors.Is(err, ErrTimeout)
+			break
+		}
+
+		if msg == nil {
+			break
+		}
+
+		canceled = !yield(msg, nil)
+		c.releaseMessage(msg)
+		if canceled {
+			break
+		}
+	}
+
+	if err := fetchCmd.Close(); err != nil {
+		if !canceled {
+			yield(nil, fmt.Errorf("releasing fetch command failed: %w", err))
+			return
+		}
+
+		logger.Warn("releasing fetch command failed", "error", err)
+	}
+}
+
+// HeaderEnvelope parses the envelope from the header section of the message
+// that r returns. Addresses that can not be parsed are omitted.
+func HeaderEnvelope(r io.Reader) (*Envelope, error) {
+	msg, err := netmail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	parser := netmail.AddressParser{WordDecoder: mail.NewWordDecoder()}
+	env := Envelope{
+		RawSubject: msg.Header.Get("Subject"),
+		RawFrom:    msg.Header.Get("From"),
+		// the ENVELOPE contains the id without angle brackets
+		MessageID: strings.Trim(strings.TrimSpace(msg.Header.Get("Message-Id")), "<>"),
+	}
+	env.Subject = mail.DecodeHeader(env.RawSubject)
+	env.Date, _ = msg.Header.Date()
+
+	for _, addr := range parseAddresses(&parser, env.RawFrom) {
+		env.From = append(env.From, addr.Address)
+		env.FromNames = append(env.FromNames, mail.NormalizeText(addr.Name))
+	}
+
+	for _, hdr := range []string{"To", "Cc", "Bcc"} {
+		for _, addr := range parseAddresses(&parser, msg.Header.Get(hdr)) {
+			env.Recipients = append(env.Recipients, addr.Address)
+		}
+	}
+
+	return &env, nil
+}
+
+// parseAddresses parses the address list s. If the list is malformed, the
+// addresses are parsed individually and the invalid ones are omitted.
+func parseAddresses(parser *netmail.AddressParser, s string) []*netmail.Address {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+
+	if list, err := parser.ParseList(s); err == nil {
+		return list
+	}
+
+	var result []*netmail.Address
+	for part := range strings.SplitSeq(s, ",") {
+		if addr, err := parser.Parse(part); err == nil {
+			result = append(result, addr)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,363 @@
+package imapclt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// capGmail is the capability of the Gmail IMAP extensions.
+const capGmail imap.Cap = "X-GM-EXT-1"
+
+// ErrGmailUnsupported is returned by [GmailClient.Connect] when the server
+// does not support the Gmail IMAP extensions.
+var ErrGmailUnsupported = errors.New("Gmail IMAP extensions are not supported")
+
+// gmailSystemLabels maps the special-use attributes of the Gmail mailboxes to
+// the labels that are applied to the messages in them.
+// Messages in the \All mailbox have no label for it.
+var gmailSystemLabels = map[imap.MailboxAttr]string{
+	imap.MailboxAttrAll:       "",
+	imap.MailboxAttrDrafts:    `\Draft`,
+	imap.MailboxAttrFlagged:   `\Starred`,
+	imap.MailboxAttrImportant: `\Important`,
+	imap.MailboxAttrJunk:      `\Spam`,
+	imap.MailboxAttrSent:      `\Sent`,
+	imap.MailboxAttrTrash:     `\Trash`,
+}
+
+// GmailClient is an IMAP client for Gmail accounts.
+// In Gmail mailboxes are views of labels, a message is stored once and is
+// contained in the mailboxes of all its labels.
+// Messages are moved by removing the label of the source mailbox and adding the
+// label of the destination mailbox, instead of copying and expunging them.
+// Messages are fetched with their Gmail message ID (X-GM-MSGID), it is the
+// same in all mailboxes.
+// The library used for the other operations does not support the Gmail
+// extensions, the X-GM commands are sent on their own connection.
+type GmailClient struct {
+	*Client
+
+	// labels maps the normalized names of the special-use mailboxes to
+	// their labels, it is set by [GmailClient.Connect].
+	labels map[string]string
+
+	mu  sync.Mutex
+	raw *gmailConn
+}
+
+type gmailConn struct {
+	*rawConn
+	// selected is the mailbox that is selected on the connection.
+	selected string
+}
+
+// NewGmailClient creates an new Gmail IMAP-Client.
+// [*GmailClient.Connect] must be called before any other methods.
+func NewGmailClient(cfg *Config) *GmailClient {
+	return &GmailClient{Client: NewClient(cfg)}
+}
+
+// Connect establishes the connections to the IMAP-Server.
+// If the server does not support the Gmail extensions, an error wrapping
+// [ErrGmailUnsupported] is returned.
+func (c *GmailClient) Connect() error {
+	if err := c.Client.Connect(); err != nil {
+		return err
+	}
+
+	if !c.clt.Caps().Has(capGmail) {
+		_ = c.Client.Close()
+		return ErrGmailUnsupported
+	}
+
+	list, err := c.clt.List("", "*", nil).Collect()
+	if err != nil {
+		_ = c.Client.Close()
+		return fmt.Errorf("listing mailboxes failed: %w", err)
+	}
+
+	labels := map[string]string{"INBOX": `\Inbox`}
+	for _, d := range list {
+		for _, attr := range d.Attrs {
+			if label, exists := gmailSystemLabels[canonicalAttr(attr)]; exists {
+				labels[normalizeMailbox(d.Mailbox)] = label
+			}
+		}
+	}
+
+	c.labels = labels
+	c.closeRaw()
+
+	return nil
+}
+
+// canonicalAttr returns attr with the case of the predefined attributes.
+func canonicalAttr(attr imap.MailboxAttr) imap.MailboxAttr {
+	for known := range gmailSystemLabels {
+		if strings.EqualFold(string(attr), string(known)) {
+			return known
+		}
+	}
+
+	return attr
+}
+
+// Close closes the connections.
+func (c *GmailClient) Close() error {
+	c.closeRaw()
+
+	return c.Client.Close()
+}
+
+func (c *GmailClient) closeRaw() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.raw != nil {
+		_ = c.raw.conn.Close()
+		c.raw = nil
+	}
+}
+
+// label returns the label of the messages in mailbox. It is empty for the
+// \All mailbox.
+func (c *GmailClient) label(mailbox string) string {
+	if label, exists := c.labels[normalizeMailbox(mailbox)]; exists {
+		return label
+	}
+
+	return mailbox
+}
+
+// withRaw calls fn with the connection for the X-GM commands, it is
+// established when it does not exist. When fn fails, the connection is closed
+// and reestablished by the next call.
+func (c *GmailClient) withRaw(fn func(*gmailConn) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.raw == nil {
+		rc, _, err := dialRaw(
+			c.logger.With("server", c.address),
+			c.address, c.user, c.password, c.allowInsecure, c.connectTimeout,
+		)
+		if err != nil {
+			return fmt.Errorf("establishing connection for Gmail commands failed: %w", err)
+		}
+		c.raw = &gmailConn{rawConn: rc}
+	}
+
+	if err := fn(c.raw); err != nil {
+		_ = c.raw.conn.Close()
+		c.raw = nil
+		return err
+	}
+
+	return nil
+}
+
+// Messages returns the messages like [Client.Messages], with their
+// [Message.GmailMsgID] set.
+// If fetching the Gmail message IDs fails, a warning is logged and the
+// messages are returned without them.
+func (c *GmailClient) Messages(ctx context.Context, mailbox string, opts *FetchOptions) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		var uids []uint32
+		if opts != nil {
+			uids = opts.UIDs
+		}
+
+		var ids map[uint32]uint64
+		err := c.withRaw(func(gc *gmailConn) error {
+			var err error
+			ids, err = gc.messageIDs(mailbox, uids)
+			return err
+		})
+		if err != nil {
+			c.logger.Warn("fetching Gmail message IDs failed",
+				lkMailbox, mailbox, "error", err, "event", "imap.gmail_msgid_failed")
+		}
+
+		for msg, err := range c.Client.Messages(ctx, mailbox, opts) {
+			if msg != nil {
+				msg.GmailMsgID = ids[msg.UID]
+			}
+			if !yield(msg, err) {
+				return
+			}
+		}
+	}
+}
+
+// Move moves the messages with the given uids from the selected mailbox to
+// mailbox, by adding the label of mailbox and removing the label of the
+// selected mailbox.
+// Moving messages to the \All mailbox only removes the label, messages in the
+// \All mailbox keep their other labels.
+func (c *GmailClient) Move(uids []uint32, mailbox string) error {
+	if len(uids) == 0 {
+		return errors.New("no uids were given")
+	}
+
+	selected := c.clt.Mailbox()
+	if selected == nil {
+		return errors.New("no mailbox is selected")
+	}
+
+	add, remove := c.label(mailbox), c.label(selected.Name)
+	if add == remove {
+		return nil
+	}
+
+	err := c.withRaw(func(gc *gmailConn) error {
+		// the label is added first, the messages must not be only in
+		// the \All mailbox when the removal fails
+		if add != "" {
+			if err := gc.storeLabels(selected.Name, uids, "+", add); err != nil {
+				return fmt.Errorf("adding label %s failed: %w", add, err)
+			}
+		}
+		if remove != "" {
+			if err := gc.storeLabels(selected.Name, uids, "-", remove); err != nil {
+				return fmt.Errorf("removing label %s failed: %w", remove, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.logger.Debug(
+		"moved imap messages",
+		lkMailbox, mailbox,
+		"count", len(uids),
+		"method", "label",
+		"event", "imap.messages_moved",
+	)
+
+	return nil
+}
+
+// ListMailboxes returns the names of the selectable mailboxes like
+// [Client.ListMailboxes], without the special-use mailboxes. They contain
+// copies of the messages in other mailboxes, e.g. \All contains all messages.
+func (c *GmailClient) ListMailboxes() ([]string, error) {
+	mailboxes, err := c.Client.ListMailboxes()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(mailboxes, func(name string) bool {
+		_, isSpecial := c.labels[name]
+		return isSpecial && name != "INBOX"
+	}), nil
+}
+
+// selectMailbox selects mailbox on the connection, if it is not selected.
+func (gc *gmailConn) selectMailbox(mailbox string) error {
+	if gc.selected == mailbox {
+		return nil
+	}
+
+	arg, err := quote(mailbox)
+	if err != nil {
+		return fmt.Errorf("mailbox %q: %w", mailbox, err)
+	}
+
+	if _, err := gc.command("SELECT " + arg); err != nil {
+		return fmt.Errorf("selecting mailbox %q failed: %w", mailbox, err)
+	}
+	gc.selected = mailbox
+
+	return nil
+}
+
+// messageIDs returns the Gmail message IDs of the messages with uids in
+// mailbox, by UID. If uids is empty, the IDs of all messages are returned.
+func (gc *gmailConn) messageIDs(mailbox string, uids []uint32) (map[uint32]uint64, error) {
+	if err := gc.selectMailbox(mailbox); err != nil {
+		return nil, err
+	}
+
+	set := "1:*"
+	if len(uids) != 0 {
+		set = asUIDSet(uids).String()
+	}
+
+	untagged, err := gc.command("UID FETCH " + set + " (X-GM-MSGID)")
+	if err != nil {
+		return nil, fmt.Errorf("fetching message IDs failed: %w", err)
+	}
+
+	result := make(map[uint32]uint64, len(untagged))
+	for _, line := range untagged {
+		uid, id, ok := parseGmailMsgID(line)
+		if ok {
+			result[uid] = id
+		}
+	}
+
+	return result, nil
+}
+
+// storeLabels adds (op "+") or removes (op "-") label to or from the messages
+// with uids in mailbox.
+func (gc *gmailConn) storeLabels(mailbox string, uids []uint32, op, label string) error {
+	if err := gc.selectMailbox(mailbox); err != nil {
+		return err
+	}
+
+	arg := label
+	// system labels are sent as atoms, other labels are mailbox names
+	if !strings.HasPrefix(label, `\`) {
+		var err error
+		if arg, err = quote(label); err != nil {
+			return fmt.Errorf("label %q: %w", label, err)
+		}
+	}
+
+	_, err := gc.command(fmt.Sprintf("UID STORE %s %sX-GM-LABELS.SILENT (%s)", asUIDSet(uids), op, arg))
+	return err
+}
+
+// parseGmailMsgID parses the UID and the X-GM-MSGID items of the FETCH response
+// line.
+func parseGmailMsgID(line string) (uint32, uint64, bool) {
+	_, items, found := strings.Cut(line, " FETCH (")
+	if !found || !strings.HasPrefix(line, "* ") {
+		return 0, 0, false
+	}
+
+	var uid uint32
+	var id uint64
+	// the items are not parsed as pairs, unsolicited items can contain
+	// lists, e.g. FLAGS
+	fields := strings.Fields(strings.TrimSuffix(items, ")"))
+	for i := 0; i+1 < len(fields); i++ {
+		switch strings.ToUpper(fields[i]) {
+		case "UID":
+			n, err := strconv.ParseUint(fields[i+1], 10, 32)
+			if err != nil {
+				return 0, 0, false
+			}
+			uid = uint32(n)
+		case "X-GM-MSGID":
+			n, err := strconv.ParseUint(fields[i+1], 10, 64)
+			if err != nil {
+				return 0, 0, false
+			}
+			id = n
+		}
+	}
+
+	return uid, id, uid != 0 && id != 0
+}
@@ -0,0 +1,137 @@
+package imapclt
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+// startGmailServer starts a server that logs in the client and then expects
+// the commands in order, each key of responses is answered with its value
+// followed by an OK response.
+func startGmailServer(t *testing.T, cmds []string, responses map[string]string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	// the client connects again after STARTTLS was rejected, the
+	// connections are served one after another
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+		respond := func(s string) bool {
+			_, err := io.WriteString(conn, s)
+			return err == nil
+		}
+
+		if !respond("* OK Gimap ready\r\n") {
+			return
+		}
+
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			cmd := strings.TrimPrefix(strings.TrimSpace(line), rawTag+" ")
+			switch {
+			case cmd == "STARTTLS":
+				respond(rawTag + " NO STARTTLS not supported\r\n")
+				continue
+			case strings.HasPrefix(cmd, "LOGIN "):
+				respond(rawTag + " OK logged in\r\n")
+				continue
+			case cmd == "CAPABILITY":
+				respond("* CAPABILITY IMAP4rev1 X-GM-EXT-1\r\n" + rawTag + " OK done\r\n")
+				continue
+			}
+
+			if len(cmds) == 0 || cmd != cmds[0] {
+				t.Errorf("unexpected command: %q, expected: %q", cmd, cmds)
+				respond(rawTag + " BAD unexpected command\r\n")
+				continue
+			}
+			cmds = cmds[1:]
+
+			respond(responses[cmd] + rawTag + " OK done\r\n")
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			serve(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestGmailConn(t *testing.T) {
+	addr := startGmailServer(t,
+		[]string{
+			`SELECT "INBOX"`,
+			`UID FETCH 1:3,7 (X-GM-MSGID)`,
+			`UID STORE 1,7 +X-GM-LABELS.SILENT (\Spam)`,
+			`UID STORE 1,7 -X-GM-LABELS.SILENT (\Inbox)`,
+			`SELECT "Work/Pro \"jects\""`,
+			`UID STORE 2 +X-GM-LABELS.SILENT ("Work/Pro \"jects\"")`,
+		},
+		map[string]string{
+			`UID FETCH 1:3,7 (X-GM-MSGID)`: "* 1 FETCH (X-GM-MSGID 1278455344230334865 UID 1)\r\n" +
+				"* 2 FETCH (UID 2 X-GM-MSGID 1278455344230334866)\r\n" +
+				"* 3 FETCH (UID 3)\r\n" +
+				"* 4 FETCH (FLAGS (\\Seen \\Answered) UID 7 X-GM-MSGID 1278455344230334867)\r\n",
+		},
+	)
+
+	rc, caps, err := dialRaw(log.SlogTestLogger(t), addr, "user", "pass", true, 5*time.Second)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = rc.conn.Close() })
+	assert.Equal(t, true, hasCap(caps, capGmail))
+
+	gc := gmailConn{rawConn: rc}
+
+	ids, err := gc.messageIDs("INBOX", []uint32{1, 2, 3, 7})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(ids))
+	assert.Equal(t, uint64(1278455344230334865), ids[1])
+	assert.Equal(t, uint64(1278455344230334866), ids[2])
+	assert.Equal(t, uint64(1278455344230334867), ids[7])
+
+	// the mailbox is already selected
+	assert.NoError(t, gc.storeLabels("INBOX", []uint32{1, 7}, "+", `\Spam`))
+	assert.NoError(t, gc.storeLabels("INBOX", []uint32{1, 7}, "-", `\Inbox`))
+
+	assert.NoError(t, gc.storeLabels(`Work/Pro "jects"`, []uint32{2}, "+", `Work/Pro "jects"`))
+}
+
+func TestParseGmailMsgID(t *testing.T) {
+	for _, line := range []string{
+		"* 1 FETCH (UID 5)",
+		"* 1 FETCH (X-GM-MSGID abc UID 5)",
+		"* STATUS INBOX (MESSAGES 1)",
+		"* 1 FETCH (UID 5 X-GM-MSGID 0)",
+	} {
+		_, _, ok := parseGmailMsgID(line)
+		assert.Equal(t, false, ok)
+	}
+
+	uid, id, ok := parseGmailMsgID("* 12 FETCH (x-gm-msgid 42 UID 9)")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, uint32(9), uid)
+	assert.Equal(t, uint64(42), id)
+}
@@ -0,0 +1,196 @@
+package imapclt
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// CreateMailboxes creates and subscribes the mailboxes that do not exist.
+// Missing parent mailboxes are created too, the hierarchy is separated by the
+// delimiter of the server.
+// If the server has a personal namespace with a prefix, e.g. "INBOX.",
+// mailboxes outside of it are not created and an error is returned.
+// It returns the names of the created mailboxes.
+func (c *Client) CreateMailboxes(mailboxes []string) ([]string, error) {
+	list, err := c.clt.List("", "*", nil).Collect()
+	if err != nil {
+		return nil, fmt.Errorf("listing mailboxes failed: %w", err)
+	}
+
+	var delim rune
+	existing := make(map[string]struct{}, len(list)+1)
+	existing["INBOX"] = struct{}{}
+	for _, d := range list {
+		existing[normalizeMailbox(d.Mailbox)] = struct{}{}
+		if d.Delim != 0 {
+			delim = d.Delim
+		}
+	}
+
+	prefix, err := c.personalNamespace()
+	if err != nil {
+		return nil, err
+	}
+
+	var created []string
+	for _, mailbox := range mailboxes {
+		if _, exists := existing[normalizeMailbox(mailbox)]; exists {
+			continue
+		}
+
+		if prefix != "" && !strings.HasPrefix(mailbox, prefix) {
+			return created, fmt.Errorf(
+				"mailbox %q is outside of the personal namespace of the server, it must start with %q, e.g. %q",
+				mailbox, prefix, prefix+mailbox,
+			)
+		}
+
+		for _, name := range withParents(mailbox, delim) {
+			if _, exists := existing[normalizeMailbox(name)]; exists {
+				continue
+			}
+
+			if err := c.createMailbox(name); err != nil {
+				return created, err
+			}
+
+			existing[normalizeMailbox(name)] = struct{}{}
+			created = append(created, name)
+		}
+	}
+
+	return created, nil
+}
+
+func (c *Client) createMailbox(name string) error {
+	if err := c.clt.Create(name, nil).Wait(); err != nil {
+		return fmt.Errorf("creating mailbox %q failed: %w", name, err)
+	}
+
+	// the mailbox can be used without subscription, it is only not shown
+	// by some clients
+	if err := c.clt.Subscribe(name).Wait(); err != nil {
+		c.logger.Warn("subscribing mailbox failed", lkMailbox, name, "error", err)
+	}
+
+	c.logger.Info("created mailbox", lkMailbox, name, "event", "imap.mailbox_created")
+
+	return nil
+}
+
+// Namespaces are the prefixes of the namespaces of the server (RFC 2342).
+type Namespaces struct {
+	// Personal are the namespaces of the mailboxes of the user.
+	Personal []string
+	// Other are the namespaces of the mailboxes of other users, that
+	// the user was granted access to.
+	Other []string
+	// Shared are the namespaces of the mailboxes that are shared by all
+	// users.
+	Shared []string
+}
+
+// All returns the prefixes of all namespaces.
+func (n *Namespaces) All() []string {
+	return slices.Concat(n.Personal, n.Other, n.Shared)
+}
+
+// Namespaces returns the namespaces of the server. If the server does not
+// support the NAMESPACE extension, a personal namespace with an empty prefix
+// is returned.
+func (c *Client) Namespaces() (*Namespaces, error) {
+	if !c.clt.Caps().Has(imap.CapNamespace) {
+		return &Namespaces{Personal: []string{""}}, nil
+	}
+
+	ns, err := c.clt.Namespace().Wait()
+	if err != nil {
+		return nil, fmt.Errorf("querying namespaces failed: %w", err)
+	}
+
+	prefixes := func(descs []imap.NamespaceDescriptor) []string {
+		result := make([]string, 0, len(descs))
+		for _, d := range descs {
+			result = append(result, d.Prefix)
+		}
+		return result
+	}
+
+	return &Namespaces{
+		Personal: prefixes(ns.Personal),
+		Other:    prefixes(ns.Other),
+		Shared:   prefixes(ns.Shared),
+	}, nil
+}
+
+// personalNamespace returns the prefix of the first personal namespace. It is
+// empty if the server does not support the NAMESPACE extension.
+func (c *Client) personalNamespace() (string, error) {
+	ns, err := c.Namespaces()
+	if err != nil {
+		return "", err
+	}
+
+	if len(ns.Personal) == 0 {
+		return "", nil
+	}
+
+	return ns.Personal[0], nil
+}
+
+// ListMailboxes returns the names of the selectable mailboxes in all
+// namespaces, including the ones of other users and shared mailboxes.
+func (c *Client) ListMailboxes() ([]string, error) {
+	ns, err := c.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	seen := map[string]struct{}{}
+	for _, prefix := range ns.All() {
+		list, err := c.clt.List("", prefix+"*", nil).Collect()
+		if err != nil {
+			return nil, fmt.Errorf("listing mailboxes in namespace %q failed: %w", prefix, err)
+		}
+
+		for _, d := range list {
+			if slices.Contains(d.Attrs, imap.MailboxAttrNoSelect) ||
+				slices.Contains(d.Attrs, imap.MailboxAttrNonExistent) {
+				continue
+			}
+
+			name := normalizeMailbox(d.Mailbox)
+			if _, exists := seen[name]; exists {
+				continue
+			}
+			seen[name] = struct{}{}
+			result = append(result, name)
+		}
+	}
+
+	return result, nil
+}
+
+// withParents returns the names of the parent mailboxes of mailbox, from the
+// top level downwards, followed by mailbox.
+func withParents(mailbox string, delim rune) []string {
+	if delim == 0 {
+		return []string{mailbox}
+	}
+
+	var result []string
+	parts := strings.Split(mailbox, string(delim))
+	for i := range parts {
+		name := strings.Join(parts[:i+1], string(delim))
+		if name == "" || strings.HasSuffix(name, string(delim)) {
+			continue
+		}
+		result = append(result, name)
+	}
+
+	return result
+}
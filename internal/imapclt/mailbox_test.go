@@ -0,0 +1,52 @@
+package imapclt
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestCreateMailboxes(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	created, err := clt.CreateMailboxes([]string{srv.SpamMailbox, "inbox", "Junk/Spam", "Quarantine"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Junk,Junk/Spam,Quarantine", strings.Join(created, ","))
+
+	list, err := clt.clt.List("", "*", nil).Collect()
+	assert.NoError(t, err)
+	for _, name := range []string{"Junk", "Junk/Spam", "Quarantine"} {
+		if !slices.ContainsFunc(list, func(d *imap.ListData) bool { return d.Mailbox == name }) {
+			t.Errorf("mailbox %q was not created", name)
+		}
+	}
+
+	created, err = clt.CreateMailboxes([]string{"Junk/Spam", "Quarantine"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(created))
+}
+
+func TestListMailboxes(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	_, err := clt.CreateMailboxes([]string{"Shared/support"})
+	assert.NoError(t, err)
+
+	list, err := clt.ListMailboxes()
+	assert.NoError(t, err)
+
+	for _, name := range []string{"INBOX", srv.ScanMailbox, "Shared", "Shared/support"} {
+		if !slices.Contains(list, name) {
+			t.Errorf("mailbox %q is missing in %v", name, list)
+		}
+	}
+}
+
+func TestWithParents(t *testing.T) {
+	assert.Equal(t, "a,a.b,a.b.c", strings.Join(withParents("a.b.c", '.'), ","))
+	assert.Equal(t, "a/b", strings.Join(withParents("a/b", 0), ","))
+}
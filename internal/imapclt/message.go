@@ -1,34 +1,141 @@
 package imapclt
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"iter"
+	netmail "net/mail"
 	"slices"
 	"strings"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
+
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/spool"
 )
 
 type Message struct {
 	UID      uint32
 	Message  io.Reader
 	Envelope Envelope
+	// Size is the size of the complete message in bytes.
+	Size int64
+	// Truncated is true if only the first [FetchOptions.MaxBodySize]
+	// bytes of the message were fetched.
+	Truncated bool
+	// InternalDate is the date when the message was received by the
+	// server.
+	InternalDate time.Time
+	// Flags are the flags and keywords of the message, e.g. "\\Seen".
+	Flags []string
+	// GmailMsgID is the Gmail message ID (X-GM-MSGID), it is only set
+	// by [GmailClient].
+	GmailMsgID uint64
+	// POP3UID is the unique-id listing (UIDL) of the message, it is only
+	// set by the POP3 client. UID is then the message number, which is
+	// only valid during the session in that the message was fetched.
+	POP3UID string
+
+	// body is the buffer that Message reads from.
+	body *spool.Buffer
+}
+
+// releaseMessage releases the buffer of the message body, msg.Message can
+// not be read afterwards.
+func (c *Client) releaseMessage(msg *Message) {
+	if msg.body == nil {
+		return
+	}
+
+	if err := msg.body.Close(); err != nil {
+		c.logger.Warn("releasing message buffer failed", "error", err, "event", "spool.release_failed")
+	}
+}
+
+// FetchOptions specifies which messages and which data of them is fetched.
+type FetchOptions struct {
+	// MaxBodySize is the max. number of bytes of a message that are
+	// fetched. Messages that are bigger are truncated.
+	// If it is 0, messages are fetched completely.
+	MaxBodySize int64
+	// HeaderOnly specifies that only the header section of the messages is
+	// fetched instead of the whole message.
+	HeaderOnly bool
+	// UIDs limits the fetched messages to the ones with the given UIDs.
+	// If it is empty all messages in the mailbox are fetched.
+	UIDs []uint32
+}
+
+func (o *FetchOptions) bodySection() *imap.FetchItemBodySection {
+	if o.HeaderOnly {
+		return &imap.FetchItemBodySection{Peek: true, Specifier: imap.PartSpecifierHeader}
+	}
+
+	if o.MaxBodySize > 0 {
+		return &imap.FetchItemBodySection{
+			Peek:    true,
+			Partial: &imap.SectionPartial{Size: o.MaxBodySize},
+		}
+	}
+
+	return &imap.FetchItemBodySection{Peek: true}
+}
+
+func (o *FetchOptions) numSet() imap.NumSet {
+	if len(o.UIDs) != 0 {
+		return asUIDSet(o.UIDs)
+	}
+
+	n := imap.SeqSet{}
+	n.AddRange(1, 0)
+
+	return n
 }
 
 type Envelope struct {
-	Date    time.Time
+	Date time.Time
+	// Subject is the human-readable subject, RFC 2047 encoded-words
+	// are decoded and it is normalized with [mail.NormalizeText].
 	Subject string
-	From    []string
+	// RawSubject is the unfolded body of the Subject header of the
+	// message. It is empty if the header section of the fetched message
+	// data can not be parsed.
+	RawSubject string
+	// From are the addresses of the From header.
+	From []string
+	// FromNames are the decoded display names of the From addresses,
+	// in the same order. They are empty for addresses without one.
+	FromNames []string
+	// RawFrom is the unfolded body of the From header of the message,
+	// like RawSubject.
+	RawFrom string
 	// Recipients are the To, Cc and Bcc addresses
 	Recipients []string
 	MessageID  string
 }
 
+// RawHeaderFields returns the unfolded bodies of the Subject and From header
+// of the message in data. data can be truncated, if its header section can not
+// be parsed empty strings are returned.
+func RawHeaderFields(data []byte) (subject, from string) {
+	return rawHeaderFields(bytes.NewReader(data))
+}
+
+func rawHeaderFields(r io.Reader) (subject, from string) {
+	msg, err := netmail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return "", ""
+	}
+
+	return msg.Header.Get("Subject"), msg.Header.Get("From")
+}
+
 var errMalformedEnvelope = errors.New("malformed IMAP ENVELOPE")
 
 func isMalformedEnvelopeErr(err error) bool {
@@ -49,10 +156,30 @@ func isMalformedEnvelopeErr(err error) bool {
 // Messages returns an iterator over the messages in mailbox.
 // When an error happens a nil message and an error is passed via the yield
 // function.
-func (c *Client) Messages(mailbox string) iter.Seq2[*Message, error] {
+// The data of a message can only be read until the yield function returns.
+// When ctx is canceled, the iteration stops before the next message and
+// ctx.Err() is passed via the yield function. The data of the remaining
+// messages is still received and discarded, the IMAP protocol does not
+// support aborting a FETCH command.
+// When receiving a message exceeds the FetchTimeout, an error wrapping
+// [ErrTimeout] is passed via the yield function and the iteration stops.
+// When the server sends a malformed ENVELOPE for messages, they are fetched
+// again without it after the other messages and their envelope is parsed from
+// their header section, see [Client.fetchWithHeaderEnvelope].
+// opts can be nil.
+func (c *Client) Messages(ctx context.Context, mailbox string, opts *FetchOptions) iter.Seq2[*Message, error] {
+	if opts == nil {
+		opts = &FetchOptions{}
+	}
+
 	return func(yield func(*Message, error) bool) {
 		logger := c.logger.With(lkMailbox, mailbox)
-		mbox, err := c.clt.Select(mailbox, &imap.SelectOptions{}).Wait()
+		if err := ctx.Err(); err != nil {
+			yield(nil, err)
+			return
+		}
+
+		mbox, err := c.selectMailbox(mailbox, &imap.SelectOptions{})
 		if err != nil {
 			yield(nil, fmt.Errorf("selecting mailbox failed: %w", err))
 			return
@@ -70,26 +197,39 @@ func (c *Client) Messages(mailbox string) iter.Seq2[*Message, error] {
 			"count", mbox.NumMessages,
 		)
 
-		n := imap.SeqSet{}
-		n.AddRange(1, 0)
+		bodySection := opts.bodySection()
 
-		fetchCmd := c.clt.Fetch(n, &imap.FetchOptions{
-			Envelope:    true,
-			UID:         true,
-			BodySection: []*imap.FetchItemBodySection{{Peek: true}},
+		fetchCmd := c.clt.Fetch(opts.numSet(), &imap.FetchOptions{
+			Envelope:     true,
+			UID:          true,
+			RFC822Size:   true,
+			InternalDate: true,
+			Flags:        true,
+			BodySection:  []*imap.FetchItemBodySection{bodySection},
 		})
 
-		var canceled bool
+		var canceled, malformed bool
+		var fetchedUIDs imap.UIDSet
 		for {
-			msg, err := c.fetchNext(fetchCmd)
+			if err := ctx.Err(); err != nil {
+				logger.Debug("fetching messages aborted", "error", err, "event", "imap.fetch_aborted")
+				canceled = !yield(nil, err)
+				break
+			}
+
+			msg, err := c.fetchNext(fetchCmd, bodySection, false)
 			if err != nil {
 				// Critical: malformed ENVELOPEs must not crash the service.
 				if isMalformedEnvelopeErr(err) {
-					logger.Warn("skipping message due to malformed ENVELOPE", "error", err)
+					logger.Warn("malformed ENVELOPE, fetching message again without it",
+						"error", err, "event", "imap.malformed_envelope")
+					malformed = true
 					continue
 				}
 
-				canceled = !yield(nil, err)
+				// after a timeout the connection is closed,
+				// the iteration can not continue
+				canceled = !yield(nil, err) || errors.Is(err, ErrTimeout)
 				break
 			}
 
@@ -97,7 +237,9 @@ func (c *Client) Messages(mailbox string) iter.Seq2[*Message, error] {
 				break
 			}
 
+			fetchedUIDs.AddNum(imap.UID(msg.UID))
 			canceled = !yield(msg, nil)
+			c.releaseMessage(msg)
 			if canceled {
 				break
 			}
@@ -105,80 +247,211 @@ func (c *Client) Messages(mailbox string) iter.Seq2[*Message, error] {
 
 		err = fetchCmd.Close()
 		if err != nil {
-			// go-imapwire sometimes reports ENVELOPE parse errors here; ignore them.
+			// go-imapwire sometimes reports ENVELOPE parse errors here
 			if isMalformedEnvelopeErr(err) {
-				logger.Warn("releasing fetch command failed (malformed ENVELOPE; ignored)", "error", err)
+				logger.Warn("releasing fetch command failed (malformed ENVELOPE), fetching remaining messages without it",
+					"error", err, "event", "imap.malformed_envelope")
+				malformed = true
+			} else {
 				if !canceled {
-					yield(nil, fmt.Errorf("releasing fetch command failed (malformed ENVELOPE): %w", err))
+					yield(nil, fmt.Errorf("releasing fetch command failed: %w", err))
+					return
 				}
-				return
-			}
 
-			if !canceled {
-				yield(nil, fmt.Errorf("releasing fetch command failed: %w", err))
-				return
+				logger.Warn("releasing fetch command failed", "error", err)
 			}
+		}
 
-			logger.Warn("releasing fetch command failed", "error", err)
+		if malformed && !canceled {
+			c.fetchWithHeaderEnvelope(ctx, opts, fetchedUIDs, yield)
 		}
 	}
 }
 
 // fetchNext calls Next() and returns the message as [Message].
 // When there is no next message nil,nil is returned.
-func (c *Client) fetchNext(fetchCmd *imapclient.FetchCommand) (*Message, error) {
-	msgData := fetchCmd.Next()
-	if msgData == nil {
-		return nil, nil
-	}
+// If headerEnv is true, the envelope is parsed from the fetched body section
+// instead of the ENVELOPE.
+// The body section is buffered with the spool of the client, the buffer must
+// be released with [Client.releaseMessage].
+func (c *Client) fetchNext(fetchCmd *imapclient.FetchCommand, bodySection *imap.FetchItemBodySection, headerEnv bool) (*Message, error) {
+	var msg *fetchedMessage
+	err := c.withTimeout("FETCH", c.fetchTimeout, func() error {
+		msgData := fetchCmd.Next()
+		if msgData == nil {
+			return nil
+		}
 
-	msg, err := msgData.Collect()
+		var err error
+		msg, err = c.collect(msgData)
+		return err
+	})
 	if err != nil {
+		if errors.Is(err, ErrTimeout) {
+			return nil, err
+		}
 		// May include ENVELOPE parse errors; caller decides whether to skip.
 		return nil, fmt.Errorf("collecting message failed: %w", err)
 	}
 
+	if msg == nil {
+		return nil, nil
+	}
+
+	result, err := c.toMessage(msg, bodySection, headerEnv)
+	if err != nil {
+		if msg.body != nil {
+			_ = msg.body.Close()
+		}
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (c *Client) toMessage(msg *fetchedMessage, bodySection *imap.FetchItemBodySection, headerEnv bool) (*Message, error) {
 	if msg.UID == 0 {
 		return nil, fmt.Errorf("message uid is 0")
 	}
-	if msg.Envelope == nil {
+
+	if msg.Envelope == nil && !headerEnv {
 		// Return a sentinel so the caller can skip instead of terminating.
 		return nil, fmt.Errorf("%w: uid=%d", errMalformedEnvelope, msg.UID)
 	}
 
-	logger := c.logger.With(
-		"mail.subject", msg.Envelope.Subject,
-		"mail.uid", msg.UID,
-	)
-	logger.Debug("fetched message")
-
-	body := msg.FindBodySection(&imap.FetchItemBodySection{})
-	if body == nil {
+	if msg.body == nil {
 		return nil, errors.New("message is missing body section")
 	}
 
-	if len(body) == 0 {
+	if msg.body.Size() == 0 {
 		return nil, errors.New("message data reader is empty")
 	}
 
+	var env *Envelope
+	if headerEnv {
+		var err error
+		env, err = HeaderEnvelope(msg.body.Reader())
+		if err != nil {
+			return nil, fmt.Errorf("%w: uid=%d: parsing header section failed: %w", errMalformedEnvelope, msg.UID, err)
+		}
+	} else {
+		env = imapEnvelope(msg.Envelope, msg.body.Reader())
+	}
+
+	logger := c.logger.With(
+		"mail.subject", env.Subject,
+		"mail.uid", msg.UID,
+	)
+	logger.Debug("fetched message", "spooled", msg.body.Spooled())
+
 	return &Message{
-		UID: uint32(msg.UID),
-		// TODO: Can we stream the body instead of
-		// storing it in memory?
-		Message: bytes.NewReader(body),
-		Envelope: Envelope{
-			Date:    msg.Envelope.Date,
-			Subject: msg.Envelope.Subject,
-			From:    addressesToStrings(msg.Envelope.From),
-			Recipients: slices.Concat(
-				addressesToStrings(msg.Envelope.To),
-				addressesToStrings(msg.Envelope.Cc),
-				addressesToStrings(msg.Envelope.Cc),
-			),
-		},
+		UID:          uint32(msg.UID),
+		Size:         msg.RFC822Size,
+		Truncated:    bodySection.Partial != nil && msg.RFC822Size > bodySection.Partial.Size,
+		InternalDate: msg.InternalDate,
+		Flags:        flagsToStrings(msg.Flags),
+		Message:      msg.body.Reader(),
+		Envelope:     *env,
+		body:         msg.body,
 	}, nil
 }
 
+// fetchedMessage is the data of a message in a FETCH response.
+type fetchedMessage struct {
+	UID          imap.UID
+	Envelope     *imap.Envelope
+	RFC822Size   int64
+	InternalDate time.Time
+	Flags        []imap.Flag
+	// body is the first body section.
+	body *spool.Buffer
+}
+
+// collect receives the data of a message. Unlike
+// [imapclient.FetchMessageData.Collect], the body section is buffered with the
+// spool of the client instead of in memory.
+func (c *Client) collect(msgData *imapclient.FetchMessageData) (*fetchedMessage, error) {
+	var msg fetchedMessage
+
+	for {
+		item := msgData.Next()
+		if item == nil {
+			break
+		}
+
+		switch item := item.(type) {
+		case imapclient.FetchItemDataUID:
+			msg.UID = item.UID
+		case imapclient.FetchItemDataEnvelope:
+			msg.Envelope = item.Envelope
+		case imapclient.FetchItemDataRFC822Size:
+			msg.RFC822Size = item.Size
+		case imapclient.FetchItemDataInternalDate:
+			msg.InternalDate = item.Time
+		case imapclient.FetchItemDataFlags:
+			msg.Flags = item.Flags
+		case imapclient.FetchItemDataBodySection:
+			if item.Literal == nil || msg.body != nil {
+				continue
+			}
+
+			body, err := c.spool.Buffer(item.Literal, item.Literal.Size())
+			if err != nil {
+				// discard the remaining items
+				for msgData.Next() != nil {
+				}
+				return nil, fmt.Errorf("buffering message body failed: %w", err)
+			}
+			msg.body = body
+		}
+	}
+
+	return &msg, nil
+}
+
+// imapEnvelope converts the ENVELOPE of the message with the given body section
+// data to an [Envelope].
+func imapEnvelope(e *imap.Envelope, body io.Reader) *Envelope {
+	rawSubject, rawFrom := rawHeaderFields(body)
+
+	return &Envelope{
+		Date: e.Date,
+		// encoded-words were decoded by imapclient with the
+		// WordDecoder passed in the options
+		Subject:    mail.NormalizeText(e.Subject),
+		RawSubject: rawSubject,
+		From:       addressesToStrings(e.From),
+		FromNames:  addressNames(e.From),
+		RawFrom:    rawFrom,
+		Recipients: slices.Concat(
+			addressesToStrings(e.To),
+			addressesToStrings(e.Cc),
+			addressesToStrings(e.Bcc),
+		),
+		MessageID: e.MessageID,
+	}
+}
+
+func flagsToStrings(flags []imap.Flag) []string {
+	result := make([]string, 0, len(flags))
+
+	for _, f := range flags {
+		result = append(result, string(f))
+	}
+
+	return result
+}
+
+func addressNames(addrs []imap.Address) []string {
+	result := make([]string, 0, len(addrs))
+
+	for _, addr := range addrs {
+		result = append(result, mail.NormalizeText(addr.Name))
+	}
+
+	return result
+}
+
 func addressesToStrings(addrs []imap.Address) []string {
 	result := make([]string, 0, len(addrs))
 
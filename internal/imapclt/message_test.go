@@ -1,13 +1,19 @@
 package imapclt
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/emersion/go-imap/v2"
+
 	"github.com/fho/rspamd-iscan/internal/testutils/assert"
 	"github.com/fho/rspamd-iscan/internal/testutils/mail"
 )
@@ -22,12 +28,12 @@ func TestMessages(t *testing.T) {
 	testMailPath := mail.TestHamMailPath(t)
 	srv, clt := startServerClient(t)
 
-	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now()))
-	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now()))
-	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now()))
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
 
 	cnt := 0
-	for msg, err := range clt.Messages(srv.InboxMailBox) {
+	for msg, err := range clt.Messages(context.Background(), srv.InboxMailBox, nil) {
 		assert.NoError(t, err)
 		if msg.UID == 0 {
 			t.Error("msg.uid is 0")
@@ -44,11 +50,82 @@ func TestMessages(t *testing.T) {
 		assert.Equal(t, testMailRecipient, msg.Envelope.Recipients[0])
 		assert.Equal(t, 1, len(msg.Envelope.From))
 		assert.Equal(t, testMailSender, msg.Envelope.From[0])
+		assert.Equal(t, int64(len(expectedMail)), msg.Size)
+		assert.Equal(t, false, msg.Truncated)
 		cnt++
 	}
 	assert.Equal(t, 3, cnt)
 }
 
+func TestMessagesDecodesEnvelope(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	path := filepath.Join(t.TempDir(), "mail.eml")
+	data := "From: =?UTF-8?Q?F=C3=A9lix?= <felix@example.com>\r\n" +
+		"To: rick@example.com\r\n" +
+		"Cc: morty@example.com\r\n" +
+		"Bcc: summer@example.com\r\n" +
+		"Subject: =?windows-1252?Q?Gewinn_=80?=\r\n" +
+		"\r\nbody\r\n"
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	assert.NoError(t, clt.Upload(path, srv.InboxMailBox, time.Now(), nil))
+
+	cnt := 0
+	for msg, err := range clt.Messages(context.Background(), srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+
+		assert.Equal(t, "Gewinn €", msg.Envelope.Subject)
+		assert.Equal(t, "=?windows-1252?Q?Gewinn_=80?=", msg.Envelope.RawSubject)
+		assert.Equal(t, "Félix", strings.Join(msg.Envelope.FromNames, ","))
+		assert.Equal(t, "=?UTF-8?Q?F=C3=A9lix?= <felix@example.com>", msg.Envelope.RawFrom)
+		assert.Equal(t, "rick@example.com,morty@example.com,summer@example.com",
+			strings.Join(msg.Envelope.Recipients, ","))
+		cnt++
+	}
+	assert.Equal(t, 1, cnt)
+}
+
+func TestUploadSetsDateAndFlags(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	date := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	flags := []string{"$Important", `\Seen`}
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), srv.InboxMailBox, date, append(flags, `\Recent`)))
+
+	cnt := 0
+	for msg, err := range clt.Messages(context.Background(), srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		assert.Equal(t, true, msg.InternalDate.Equal(date))
+		// the server returns the flags in random order
+		slices.Sort(msg.Flags)
+		assert.Equal(t, strings.Join(flags, ","), strings.Join(msg.Flags, ","))
+		cnt++
+	}
+	assert.Equal(t, 1, cnt)
+}
+
+func TestMessagesMaxBodySize(t *testing.T) {
+	const maxSize = 20
+	testMailPath := mail.TestHamMailPath(t)
+	srv, clt := startServerClient(t)
+
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+
+	cnt := 0
+	for msg, err := range clt.Messages(context.Background(), srv.InboxMailBox, &FetchOptions{MaxBodySize: maxSize}) {
+		assert.NoError(t, err)
+		body, err := io.ReadAll(msg.Message)
+		assert.NoError(t, err)
+
+		expectedMail := testMailData(t)
+		assert.Equal(t, string(expectedMail[:maxSize]), string(body))
+		assert.Equal(t, int64(len(expectedMail)), msg.Size)
+		assert.Equal(t, true, msg.Truncated)
+		cnt++
+	}
+	assert.Equal(t, 1, cnt)
+}
+
 func TestIsMalformedEnvelopeErr(t *testing.T) {
 	t.Run("wrapped sentinel", func(t *testing.T) {
 		err := fmt.Errorf("x: %w", errMalformedEnvelope)
@@ -67,3 +144,91 @@ func TestIsMalformedEnvelopeErr(t *testing.T) {
 		}
 	})
 }
+
+func TestMessagesHeaderOnlyByUID(t *testing.T) {
+	testMailPath := mail.TestHamMailPath(t)
+	srv, clt := startServerClient(t)
+
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+
+	var uids []uint32
+	for msg, err := range clt.Messages(context.Background(), srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		uids = append(uids, msg.UID)
+	}
+	assert.Equal(t, 2, len(uids))
+
+	cnt := 0
+	opts := FetchOptions{HeaderOnly: true, UIDs: uids[1:]}
+	for msg, err := range clt.Messages(context.Background(), srv.InboxMailBox, &opts) {
+		assert.NoError(t, err)
+		assert.Equal(t, uids[1], msg.UID)
+
+		hdr, err := io.ReadAll(msg.Message)
+		assert.NoError(t, err)
+
+		expectedMail := string(testMailData(t))
+		expectedHdr := expectedMail[:strings.Index(expectedMail, "\r\n\r\n")+4]
+		assert.Equal(t, expectedHdr, string(hdr))
+		assert.Equal(t, int64(len(expectedMail)), msg.Size)
+		cnt++
+	}
+	assert.Equal(t, 1, cnt)
+}
+
+func TestHeaderEnvelope(t *testing.T) {
+	data := "Date: Mon, 2 Jun 2025 10:00:00 +0200\r\n" +
+		"From: =?UTF-8?Q?F=C3=A9lix?= <felix@example.com>\r\n" +
+		"To: rick@example.com, <invalid, morty@example.com\r\n" +
+		"Message-ID: <123@example.com>\r\n" +
+		"Subject: =?UTF-8?B?R3LDvMOfZQ==?=\r\n" +
+		"\r\nbody\r\n"
+
+	env, err := HeaderEnvelope(strings.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, "Grüße", env.Subject)
+	assert.Equal(t, "felix@example.com", strings.Join(env.From, ","))
+	assert.Equal(t, "Félix", strings.Join(env.FromNames, ","))
+	assert.Equal(t, "rick@example.com,morty@example.com", strings.Join(env.Recipients, ","))
+	assert.Equal(t, "123@example.com", env.MessageID)
+	assert.Equal(t, time.Date(2025, 6, 2, 8, 0, 0, 0, time.UTC), env.Date.UTC())
+
+	_, err = HeaderEnvelope(strings.NewReader("no header section"))
+	assert.Error(t, err)
+}
+
+func TestFetchWithHeaderEnvelope(t *testing.T) {
+	testMailPath := mail.TestHamMailPath(t)
+	srv, clt := startServerClient(t)
+
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+
+	var fetched imap.UIDSet
+	for msg, err := range clt.Messages(context.Background(), srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		fetched.AddNum(imap.UID(msg.UID))
+		break
+	}
+
+	// simulates that the server sent a malformed ENVELOPE for the 2.
+	// message, the mailbox is still selected
+	var msgs []*Message
+	clt.fetchWithHeaderEnvelope(context.Background(), &FetchOptions{}, fetched,
+		func(msg *Message, err error) bool {
+			assert.NoError(t, err)
+			msgs = append(msgs, msg)
+			return true
+		})
+
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, false, fetched.Contains(imap.UID(msgs[0].UID)))
+	assert.Equal(t, testMailSubject, msgs[0].Envelope.Subject)
+	assert.Equal(t, testMailSender, strings.Join(msgs[0].Envelope.From, ","))
+	assert.Equal(t, testMailRecipient, strings.Join(msgs[0].Envelope.Recipients, ","))
+
+	body, err := io.ReadAll(msgs[0].Message)
+	assert.NoError(t, err)
+	assert.Equal(t, string(testMailData(t)), string(body))
+}
@@ -0,0 +1,380 @@
+package imapclt
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+)
+
+// notifyKeepaliveInterval is the interval in that a NOOP command is sent on
+// the NOTIFY connection to prevent that the server closes it as inactive.
+const notifyKeepaliveInterval = 15 * time.Minute
+
+// ErrNotifyUnsupported is returned by [Notify] when the server does not
+// support the NOTIFY extension for the mailboxes.
+var ErrNotifyUnsupported = errors.New("NOTIFY is not supported")
+
+type NotifierConfig struct {
+	// Address, User, Password, AllowInsecure and ConnectTimeout are the
+	// same as in [Config].
+	Address        string
+	User           string
+	Password       string
+	AllowInsecure  bool
+	ConnectTimeout time.Duration
+	Logger         *slog.Logger
+}
+
+// EventMailboxChanged is sent when new messages arrived in a mailbox.
+type EventMailboxChanged struct {
+	Mailbox string
+}
+
+// Notifier receives notifications about new messages in multiple mailboxes
+// via the IMAP NOTIFY extension (RFC 5465).
+// It uses its own connection, the library used for the other operations does
+// not support NOTIFY, the connection is only used for receiving
+// notifications.
+type Notifier struct {
+	*rawConn
+	logger *slog.Logger
+
+	// mailboxes maps the normalized mailbox names to the names passed to
+	// [Notify].
+	mailboxes map[string]string
+	// msgCounts are the last known number of messages in the mailboxes.
+	msgCounts map[string]uint32
+
+	ch   chan *EventMailboxChanged
+	done chan struct{}
+
+	closeOnce sync.Once
+	err       error
+}
+
+// Notify establishes a connection and requests notifications about new
+// messages in mailboxes. Events for them are sent to the channel returned by
+// [Notifier.Events].
+// If the server does not support NOTIFY, an error wrapping
+// [ErrNotifyUnsupported] is returned.
+func Notify(cfg *NotifierConfig, mailboxes []string) (*Notifier, error) {
+	if len(mailboxes) == 0 {
+		return nil, errors.New("no mailboxes passed")
+	}
+
+	connectTimeout := cfg.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+
+	n := Notifier{
+		logger:    log.Module(cfg.Logger, "imapclt").With("server", cfg.Address),
+		mailboxes: make(map[string]string, len(mailboxes)),
+		msgCounts: make(map[string]uint32, len(mailboxes)),
+		ch:        make(chan *EventMailboxChanged, len(mailboxes)),
+		done:      make(chan struct{}),
+	}
+
+	mailboxArgs := make([]string, 0, len(mailboxes))
+	for _, mb := range mailboxes {
+		arg, err := quote(mb)
+		if err != nil {
+			return nil, fmt.Errorf("%w: mailbox %q: %w", ErrNotifyUnsupported, mb, err)
+		}
+		mailboxArgs = append(mailboxArgs, arg)
+		n.mailboxes[normalizeMailbox(mb)] = mb
+	}
+
+	rc, caps, err := dialRaw(n.logger, cfg.Address, cfg.User, cfg.Password, cfg.AllowInsecure, connectTimeout)
+	if err != nil {
+		if errors.Is(err, errUnsupportedChars) {
+			return nil, fmt.Errorf("%w: %w", ErrNotifyUnsupported, err)
+		}
+		return nil, err
+	}
+	n.rawConn = rc
+
+	if !hasCap(caps, imap.CapNotify) {
+		_ = rc.conn.Close()
+		return nil, ErrNotifyUnsupported
+	}
+
+	if err := n.setup(connectTimeout, mailboxArgs); err != nil {
+		_ = rc.conn.Close()
+		return nil, err
+	}
+
+	n.logger.Info("watching mailboxes for changes with NOTIFY",
+		"mailboxes", mailboxes, "event", "imap.notify_started")
+
+	go n.keepalive()
+	go n.receive()
+
+	return &n, nil
+}
+
+func (n *Notifier) setup(timeout time.Duration, mailboxArgs []string) error {
+	if err := n.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	// STATUS requests the current state of the mailboxes, it is used as
+	// the initial message counts
+	untagged, err := n.command(fmt.Sprintf(
+		"NOTIFY SET STATUS (mailboxes %s) (MessageNew MessageExpunge)",
+		strings.Join(mailboxArgs, " "),
+	))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNotifyUnsupported, err)
+	}
+	for _, line := range untagged {
+		n.handleUntagged(line, false)
+	}
+
+	return n.conn.SetDeadline(time.Time{})
+}
+
+// literalSize returns the size of the literal that line announces.
+func literalSize(line string) (int64, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+
+	start := strings.LastIndexByte(line, '{')
+	if start == -1 {
+		return 0, false
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSuffix(line[start+1:len(line)-1], "+"), 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+
+	return size, true
+}
+
+func (n *Notifier) keepalive() {
+	ticker := time.NewTicker(notifyKeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// the response is discarded by receive
+			if err := n.write("NOOP"); err != nil {
+				n.logger.Debug("sending NOOP failed", "error", err)
+				return
+			}
+		case <-n.done:
+			return
+		}
+	}
+}
+
+func (n *Notifier) receive() {
+	defer close(n.ch)
+
+	for {
+		line, err := n.readLine()
+		if err != nil {
+			n.terminate(err)
+			return
+		}
+
+		if strings.HasPrefix(line, "* BYE") {
+			n.terminate(fmt.Errorf("server closed the connection: %s", line))
+			return
+		}
+
+		if strings.Contains(strings.ToUpper(line), "[NOTIFICATIONOVERFLOW]") {
+			// the server stopped sending notifications, the
+			// mailboxes might have changed
+			for _, mb := range n.mailboxes {
+				n.send(mb)
+			}
+			n.terminate(errors.New("server stopped sending notifications: " + line))
+			return
+		}
+
+		n.handleUntagged(line, true)
+	}
+}
+
+// handleUntagged records the message count of STATUS responses and, if notify
+// is true, sends an event when it increased.
+func (n *Notifier) handleUntagged(line string, notify bool) {
+	rest, ok := strings.CutPrefix(line, "* STATUS ")
+	if !ok {
+		return
+	}
+
+	name, attrs, ok := parseAstring(rest)
+	if !ok {
+		n.logger.Debug("ignoring unparsable STATUS response", "response", line)
+		return
+	}
+
+	mailbox, watched := n.mailboxes[normalizeMailbox(name)]
+	if !watched {
+		return
+	}
+
+	count, hasCount := statusMessages(attrs)
+	prev, known := n.msgCounts[mailbox]
+	if hasCount {
+		n.msgCounts[mailbox] = count
+	}
+
+	if !notify || (hasCount && known && count <= prev) {
+		return
+	}
+
+	n.logger.Debug("received mailbox change notification",
+		lkMailbox, mailbox, "num_messages", count)
+	n.send(mailbox)
+}
+
+func (n *Notifier) send(mailbox string) {
+	select {
+	case n.ch <- &EventMailboxChanged{Mailbox: mailbox}:
+	default:
+		n.logger.Debug("discarding mailbox change event, channel is full", lkMailbox, mailbox)
+	}
+}
+
+func (n *Notifier) terminate(err error) {
+	n.closeOnce.Do(func() {
+		n.err = err
+		close(n.done)
+		_ = n.conn.Close()
+	})
+}
+
+// Events returns the channel of mailbox change events. Deliveries to the
+// channel do not block, events are discarded when it is full.
+// The channel is closed when the connection terminated, [Notifier.Err] then
+// returns the reason.
+func (n *Notifier) Events() <-chan *EventMailboxChanged {
+	return n.ch
+}
+
+// Err returns the error that terminated the connection. It must only be
+// called after the events channel was closed.
+func (n *Notifier) Err() error {
+	return n.err
+}
+
+// Close closes the connection.
+func (n *Notifier) Close() error {
+	var err error
+
+	n.closeOnce.Do(func() {
+		close(n.done)
+		err = n.conn.Close()
+	})
+
+	return err
+}
+
+// normalizeMailbox returns name, INBOX is case-insensitive and returned
+// uppercase.
+func normalizeMailbox(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+
+	return name
+}
+
+// quote returns s as IMAP quoted string.
+func quote(s string) (string, error) {
+	for _, r := range s {
+		if r == '\r' || r == '\n' || r == 0 || r > 0x7e {
+			return "", errUnsupportedChars
+		}
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`, nil
+}
+
+// parseAstring parses the astring at the beginning of s and returns it and the
+// remainder of s.
+func parseAstring(s string) (value, rest string, ok bool) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		var sb strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+				if i < len(s) {
+					sb.WriteByte(s[i])
+				}
+			case '"':
+				return sb.String(), strings.TrimSpace(s[i+1:]), true
+			default:
+				sb.WriteByte(s[i])
+			}
+		}
+		return "", "", false
+
+	case strings.HasPrefix(s, "{"):
+		header, data, found := strings.Cut(s, "\r\n")
+		if !found {
+			return "", "", false
+		}
+		size, ok := literalSize(header)
+		if !ok || int64(len(data)) < size {
+			return "", "", false
+		}
+		return data[:size], strings.TrimSpace(data[size:]), true
+
+	default:
+		value, rest, _ = strings.Cut(s, " ")
+		return value, strings.TrimSpace(rest), value != ""
+	}
+}
+
+// statusMessages returns the value of the MESSAGES item of the STATUS
+// attribute list attrs.
+func statusMessages(attrs string) (uint32, bool) {
+	fields := strings.Fields(strings.Trim(attrs, "()"))
+	for i := 0; i+1 < len(fields); i += 2 {
+		if !strings.EqualFold(fields[i], "MESSAGES") {
+			continue
+		}
+
+		n, err := strconv.ParseUint(fields[i+1], 10, 32)
+		if err != nil {
+			return 0, false
+		}
+		return uint32(n), true
+	}
+
+	return 0, false
+}
+
+func hasCap(untagged []string, c imap.Cap) bool {
+	for _, line := range untagged {
+		caps, ok := strings.CutPrefix(line, "* CAPABILITY ")
+		if !ok {
+			continue
+		}
+
+		for _, f := range strings.Fields(caps) {
+			if strings.EqualFold(f, string(c)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,135 @@
+package imapclt
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+// startNotifyServer starts a server that answers the commands sent by
+// [Notify], caps are the announced capabilities. After NOTIFY succeeded, the
+// lines sent to notifications are written to the connection.
+func startNotifyServer(t *testing.T, caps string, notifications <-chan string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	// the client connects again after STARTTLS was rejected, the
+	// connections are served one after another
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+		respond := func(s string) bool {
+			_, err := io.WriteString(conn, s)
+			return err == nil
+		}
+
+		if !respond("* OK ready\r\n") {
+			return
+		}
+
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			cmd := strings.TrimPrefix(strings.TrimSpace(line), rawTag+" ")
+			switch {
+			case cmd == "STARTTLS":
+				respond(rawTag + " NO STARTTLS not supported\r\n")
+			case strings.HasPrefix(cmd, "LOGIN "):
+				if cmd != `LOGIN "user" "pass\"word"` {
+					t.Errorf("unexpected login command: %q", cmd)
+				}
+				respond(rawTag + " OK logged in\r\n")
+			case cmd == "CAPABILITY":
+				respond("* CAPABILITY " + caps + "\r\n" + rawTag + " OK done\r\n")
+			case strings.HasPrefix(cmd, "NOTIFY "):
+				if cmd != `NOTIFY SET STATUS (mailboxes "Ham" "INBOX") (MessageNew MessageExpunge)` {
+					t.Errorf("unexpected notify command: %q", cmd)
+				}
+				respond("* STATUS Ham (MESSAGES 1)\r\n" + rawTag + " OK done\r\n")
+
+				for n := range notifications {
+					if !respond(n) {
+						return
+					}
+				}
+				return
+			default:
+				respond(rawTag + " BAD unknown command\r\n")
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			serve(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func newTestNotifierConfig(t *testing.T, addr string) *NotifierConfig {
+	return &NotifierConfig{
+		Address:        addr,
+		User:           "user",
+		Password:       `pass"word`,
+		AllowInsecure:  true,
+		ConnectTimeout: 5 * time.Second,
+		Logger:         log.SlogTestLogger(t),
+	}
+}
+
+func TestNotify(t *testing.T) {
+	notifications := make(chan string, 5)
+	addr := startNotifyServer(t, "IMAP4rev1 NOTIFY", notifications)
+
+	n, err := Notify(newTestNotifierConfig(t, addr), []string{"Ham", "INBOX"})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = n.Close() })
+
+	// not watched, the message count of Ham did not increase, new
+	// messages in Ham and in inbox
+	notifications <- "* STATUS Other (MESSAGES 5)\r\n"
+	notifications <- "* STATUS \"Ham\" (MESSAGES 1 UIDNEXT 3)\r\n"
+	notifications <- "* STATUS \"Ham\" (MESSAGES 2 UIDNEXT 4)\r\n"
+	notifications <- "* STATUS {5}\r\ninbox (MESSAGES 1)\r\n"
+	close(notifications)
+
+	var events []string
+	for ev := range n.Events() {
+		events = append(events, ev.Mailbox)
+	}
+
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "Ham", events[0])
+	assert.Equal(t, "INBOX", events[1])
+	// the server closed the connection
+	assert.Error(t, n.Err())
+}
+
+func TestNotify_Unsupported(t *testing.T) {
+	addr := startNotifyServer(t, "IMAP4rev1 IDLE", nil)
+
+	_, err := Notify(newTestNotifierConfig(t, addr), []string{"Ham", "INBOX"})
+	if !errors.Is(err, ErrNotifyUnsupported) {
+		t.Fatalf("expected ErrNotifyUnsupported, got: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package imapclt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+)
+
+// ErrPoolClosed is returned by [Pool.Checkout] after the pool was closed.
+var ErrPoolClosed = errors.New("connection pool is closed")
+
+// Conn is a connection that is managed by a [Pool].
+type Conn interface {
+	Connect() error
+	Close() error
+}
+
+type PoolConfig[C Conn] struct {
+	// Size is the max. number of connections that are open at the same
+	// time.
+	Size int
+	// IdleTimeout is the duration after which idle connections are
+	// closed instead of being reused. Servers terminate connections that
+	// are idle for too long. If it is 0, idle connections are not closed.
+	IdleTimeout time.Duration
+	// New returns a new unconnected connection.
+	New    func() C
+	Logger *slog.Logger
+}
+
+type idleConn[C Conn] struct {
+	conn  C
+	since time.Time
+}
+
+// Pool manages a set of connections to the same server, to run operations on
+// them concurrently.
+// Connections are established when they are checked out and no idle
+// connection is available.
+type Pool[C Conn] struct {
+	newConn     func() C
+	idleTimeout time.Duration
+	logger      *slog.Logger
+
+	// slots contains an element per open connection, idle or checked
+	// out.
+	slots chan struct{}
+	// idle contains the connections that can be reused, it has the
+	// capacity of slots, sending to it never blocks.
+	idle chan idleConn[C]
+
+	// mu serializes returning connections and closing the pool.
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewPool[C Conn](cfg *PoolConfig[C]) *Pool[C] {
+	size := max(cfg.Size, 1)
+
+	return &Pool[C]{
+		newConn:     cfg.New,
+		idleTimeout: cfg.IdleTimeout,
+		logger:      log.Module(cfg.Logger, "imapclt.pool"),
+		slots:       make(chan struct{}, size),
+		idle:        make(chan idleConn[C], size),
+	}
+}
+
+// Checkout returns an idle connection or establishes a new one.
+// If all connections are in use, it blocks until one is returned via
+// [Pool.Release] or [Pool.Discard], or ctx is canceled.
+// The returned connection must be used by one goroutine at a time.
+func (p *Pool[C]) Checkout(ctx context.Context) (C, error) {
+	var zero C
+
+	for {
+		if p.isClosed() {
+			return zero, ErrPoolClosed
+		}
+
+		// idle connections are preferred over establishing new ones
+		select {
+		case ic := <-p.idle:
+			if conn, ok := p.reuse(ic); ok {
+				return conn, nil
+			}
+			continue
+		default:
+		}
+
+		select {
+		case ic := <-p.idle:
+			if conn, ok := p.reuse(ic); ok {
+				return conn, nil
+			}
+		case p.slots <- struct{}{}:
+			return p.connect()
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		}
+	}
+}
+
+func (p *Pool[C]) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closed
+}
+
+// connect establishes a new connection, a slot must have been acquired for
+// it.
+func (p *Pool[C]) connect() (C, error) {
+	var zero C
+
+	conn := p.newConn()
+	if err := conn.Connect(); err != nil {
+		_ = conn.Close()
+		<-p.slots
+		return zero, fmt.Errorf("establishing pooled connection failed: %w", err)
+	}
+
+	p.logger.Debug("established pooled connection", "event", "imap.pool_connection_established")
+
+	return conn, nil
+}
+
+// reuse returns the connection of ic, if it did not exceed the idle timeout.
+// Otherwise it is closed and false is returned.
+func (p *Pool[C]) reuse(ic idleConn[C]) (C, bool) {
+	var zero C
+
+	if p.idleTimeout > 0 && time.Since(ic.since) > p.idleTimeout {
+		p.logger.Debug("closing pooled connection, idle timeout exceeded",
+			"idle_since", ic.since)
+		_ = ic.conn.Close()
+		<-p.slots
+		return zero, false
+	}
+
+	return ic.conn, true
+}
+
+// Release returns a connection that was checked out to the pool.
+// If the pool is closed, the connection is closed.
+func (p *Pool[C]) Release(conn C) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		_ = conn.Close()
+		<-p.slots
+		return
+	}
+
+	p.idle <- idleConn[C]{conn: conn, since: time.Now()}
+}
+
+// Discard closes a connection that was checked out, instead of returning it
+// to the pool. It must be called instead of [Pool.Release] when an operation
+// on the connection failed and it might be in an undefined state.
+func (p *Pool[C]) Discard(conn C) {
+	_ = conn.Close()
+	<-p.slots
+}
+
+// Close closes all idle connections. Connections that are checked out are
+// closed when they are released.
+func (p *Pool[C]) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+
+	var errs []error
+	for {
+		select {
+		case ic := <-p.idle:
+			errs = append(errs, ic.conn.Close())
+			<-p.slots
+		default:
+			return errors.Join(errs...)
+		}
+	}
+}
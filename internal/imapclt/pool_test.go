@@ -0,0 +1,135 @@
+package imapclt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+)
+
+type fakeConn struct {
+	connectErr error
+	closed     bool
+}
+
+func (c *fakeConn) Connect() error { return c.connectErr }
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestPoolCheckout(t *testing.T) {
+	var connectErr error
+	var created []*fakeConn
+	pool := NewPool(&PoolConfig[*fakeConn]{
+		Size: 1,
+		New: func() *fakeConn {
+			c := fakeConn{connectErr: connectErr}
+			created = append(created, &c)
+			return &c
+		},
+		Logger: log.SlogTestLogger(t),
+	})
+
+	conn, err := pool.Checkout(context.Background())
+	assert.NoError(t, err)
+
+	// all connections are checked out
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = pool.Checkout(ctx)
+	assert.Equal(t, true, errors.Is(err, context.DeadlineExceeded))
+
+	// a waiting checkout gets the released connection
+	checkedOut := make(chan *fakeConn)
+	go func() {
+		conn, err := pool.Checkout(context.Background())
+		assert.NoError(t, err)
+		checkedOut <- conn
+	}()
+	time.Sleep(10 * time.Millisecond)
+	pool.Release(conn)
+	conn2 := <-checkedOut
+	assert.Equal(t, conn, conn2)
+	assert.Equal(t, 1, len(created))
+
+	// the slot of a discarded connection is freed
+	pool.Discard(conn2)
+	assert.Equal(t, true, conn2.closed)
+
+	connectErr = errors.New("connection refused")
+	_, err = pool.Checkout(context.Background())
+	assert.Error(t, err)
+
+	connectErr = nil
+	conn, err = pool.Checkout(context.Background())
+	assert.NoError(t, err)
+	pool.Release(conn)
+
+	assert.NoError(t, pool.Close())
+	assert.Equal(t, true, conn.closed)
+
+	_, err = pool.Checkout(context.Background())
+	assert.Equal(t, true, errors.Is(err, ErrPoolClosed))
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	pool := NewPool(&PoolConfig[*fakeConn]{
+		Size:        1,
+		IdleTimeout: time.Millisecond,
+		New:         func() *fakeConn { return &fakeConn{} },
+		Logger:      log.SlogTestLogger(t),
+	})
+
+	conn, err := pool.Checkout(context.Background())
+	assert.NoError(t, err)
+	pool.Release(conn)
+
+	time.Sleep(5 * time.Millisecond)
+
+	conn2, err := pool.Checkout(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, true, conn.closed)
+	assert.Equal(t, false, conn2 == conn)
+}
+
+func TestPoolConcurrentConnections(t *testing.T) {
+	srv, clt := startServerClient(t)
+	testMailPath := mail.TestHamMailPath(t)
+
+	pool := NewPool(&PoolConfig[*Client]{
+		Size:   2,
+		New:    func() *Client { return NewClient(testClientCfg(t, srv)) },
+		Logger: log.SlogTestLogger(t),
+	})
+	t.Cleanup(func() { _ = pool.Close() })
+
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+
+	fetchClt, err := pool.Checkout(context.Background())
+	assert.NoError(t, err)
+	moveClt, err := pool.Checkout(context.Background())
+	assert.NoError(t, err)
+
+	// a message can be moved on one connection, while a fetch on another
+	// is in progress
+	for msg, err := range fetchClt.Messages(context.Background(), srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+
+		_, err := moveClt.Search(srv.InboxMailBox, &SearchCriteria{})
+		assert.NoError(t, err)
+		assert.NoError(t, moveClt.Move([]uint32{msg.UID}, srv.ScanMailbox))
+	}
+
+	pool.Release(fetchClt)
+	pool.Release(moveClt)
+
+	res, err := clt.Search(srv.ScanMailbox, &SearchCriteria{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res.UIDs))
+}
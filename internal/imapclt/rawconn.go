@@ -0,0 +1,152 @@
+package imapclt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rawTag is the tag of the commands that are sent on a [rawConn].
+const rawTag = "ISCAN"
+
+// errUnsupportedChars is returned by [quote] for strings that can not be sent
+// as quoted string.
+var errUnsupportedChars = errors.New("contains characters that are not supported")
+
+// rawConn is a connection on that commands are sent as protocol lines.
+// It is used for extensions that the library used for the other operations does
+// not support. Commands are sent one at a time, they are not pipelined.
+type rawConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// dialRaw establishes a connection to address and logs in. It returns the
+// untagged responses of the CAPABILITY command that is sent after the login.
+func dialRaw(
+	logger *slog.Logger, address, user, password string, allowInsecure bool, timeout time.Duration,
+) (*rawConn, []string, error) {
+	if timeout == 0 {
+		timeout = defaultConnectTimeout
+	}
+
+	quotedUser, err := quote(user)
+	if err != nil {
+		return nil, nil, fmt.Errorf("user: %w", err)
+	}
+	quotedPassword, err := quote(password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("password: %w", err)
+	}
+
+	conn, err := dialTLSMode(logger, &compressDialer{dialer: &net.Dialer{Timeout: timeout}}, address, allowInsecure)
+	if err != nil {
+		return nil, nil, fmt.Errorf("establishing imap server connection failed: %w", err)
+	}
+
+	rc := rawConn{conn: conn, br: bufio.NewReader(conn)}
+
+	caps, err := rc.login(timeout, quotedUser, quotedPassword)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	return &rc, caps, nil
+}
+
+func (rc *rawConn) login(timeout time.Duration, user, password string) ([]string, error) {
+	if err := rc.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	greeting, err := rc.readLine()
+	if err != nil {
+		return nil, fmt.Errorf("reading greeting failed: %w", err)
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		return nil, fmt.Errorf("unexpected greeting: %s", greeting)
+	}
+
+	if !strings.HasPrefix(greeting, "* PREAUTH") {
+		if _, err := rc.command("LOGIN " + user + " " + password); err != nil {
+			return nil, fmt.Errorf("login at imap server failed: %w", err)
+		}
+	}
+
+	untagged, err := rc.command("CAPABILITY")
+	if err != nil {
+		return nil, fmt.Errorf("requesting capabilities failed: %w", err)
+	}
+
+	return untagged, rc.conn.SetDeadline(time.Time{})
+}
+
+// command sends the command cmd and returns the untagged responses that were
+// received before the tagged response. If the tagged response is not OK, an
+// error is returned.
+func (rc *rawConn) command(cmd string) ([]string, error) {
+	if err := rc.write(cmd); err != nil {
+		return nil, err
+	}
+
+	var untagged []string
+	for {
+		line, err := rc.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		status, ok := strings.CutPrefix(line, rawTag+" ")
+		if !ok {
+			untagged = append(untagged, line)
+			continue
+		}
+
+		if code, _, _ := strings.Cut(status, " "); !strings.EqualFold(code, "OK") {
+			return nil, fmt.Errorf("server responded: %s", status)
+		}
+
+		return untagged, nil
+	}
+}
+
+func (rc *rawConn) write(cmd string) error {
+	rc.writeMu.Lock()
+	defer rc.writeMu.Unlock()
+
+	_, err := io.WriteString(rc.conn, rawTag+" "+cmd+"\r\n")
+	return err
+}
+
+// readLine reads a response line without the terminating CRLF. Literals are
+// included in the line.
+func (rc *rawConn) readLine() (string, error) {
+	var sb strings.Builder
+
+	for {
+		line, err := rc.br.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		sb.WriteString(line)
+
+		size, ok := literalSize(line)
+		if !ok {
+			return sb.String(), nil
+		}
+
+		sb.WriteString("\r\n")
+		if _, err := io.CopyN(&sb, rc.br, size); err != nil {
+			return "", err
+		}
+	}
+}
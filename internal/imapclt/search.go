@@ -0,0 +1,321 @@
+package imapclt
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// ErrKeywordNotPermitted is returned when a keyword can not be stored
+// permanently in the selected mailbox.
+var ErrKeywordNotPermitted = errors.New("keyword is not permitted by the server (PERMANENTFLAGS)")
+
+// SearchCriteria specifies which messages are returned by [Client.Search].
+// Messages must match all specified criteria.
+type SearchCriteria struct {
+	// Flags matches messages that have all of the flags or keywords.
+	Flags []string
+	// NotFlags matches messages that have none of the flags or keywords.
+	NotFlags []string
+	// MaxAge matches messages whose internal date is not older than
+	// MaxAge days, it is rounded up to full days.
+	MaxAge time.Duration
+	// MinAge matches messages whose internal date is older than MinAge
+	// days, it is rounded up to full days.
+	MinAge time.Duration
+	// Larger and Smaller match messages that are bigger, respectively
+	// smaller, than the given number of bytes.
+	Larger  int64
+	Smaller int64
+	// Headers matches messages that contain the values in the header
+	// fields. The keys are the header field names.
+	Headers map[string]string
+}
+
+// IsEmpty returns true if no criteria is specified, all messages match.
+func (sc *SearchCriteria) IsEmpty() bool {
+	return sc == nil || (len(sc.Flags) == 0 && len(sc.NotFlags) == 0 &&
+		sc.MaxAge == 0 && sc.MinAge == 0 && sc.Larger == 0 && sc.Smaller == 0 &&
+		len(sc.Headers) == 0)
+}
+
+func (sc *SearchCriteria) toIMAP(now time.Time) *imap.SearchCriteria {
+	var result imap.SearchCriteria
+
+	for _, f := range sc.Flags {
+		result.Flag = append(result.Flag, imap.Flag(f))
+	}
+
+	for _, f := range sc.NotFlags {
+		result.NotFlag = append(result.NotFlag, imap.Flag(f))
+	}
+
+	if sc.MaxAge > 0 {
+		// SINCE only considers the date, the time is ignored
+		result.Since = now.Add(-sc.MaxAge)
+	}
+
+	if sc.MinAge > 0 {
+		// BEFORE matches dates that are earlier than the date
+		result.Before = now.Add(-sc.MinAge)
+	}
+
+	result.Larger = sc.Larger
+	result.Smaller = sc.Smaller
+
+	for _, k := range slices.Sorted(maps.Keys(sc.Headers)) {
+		result.Header = append(result.Header, imap.SearchCriteriaHeaderField{
+			Key: k, Value: sc.Headers[k],
+		})
+	}
+
+	return &result
+}
+
+// ParseSearchCriteria parses a space separated list of search keys.
+// The following keys are supported, they are case-insensitive:
+//
+//	SEEN, UNSEEN, FLAGGED, UNFLAGGED, ANSWERED, UNANSWERED,
+//	KEYWORD <keyword>, UNKEYWORD <keyword>, NOT KEYWORD <keyword>,
+//	SINCE <duration>, LARGER <bytes>, SMALLER <bytes>,
+//	FROM <string>, TO <string>, SUBJECT <string>
+//
+// The duration of SINCE is relative to the time of the search, it is a Go
+// duration or a number of days with the suffix "d", e.g. "7d".
+// Strings that contain spaces can be enclosed in double quotes.
+func ParseSearchCriteria(s string) (*SearchCriteria, error) {
+	var result SearchCriteria
+
+	tokens, err := searchTokens(s)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		key := strings.ToUpper(tokens[i])
+
+		arg := func() (string, error) {
+			i++
+			if i >= len(tokens) {
+				return "", fmt.Errorf("%s: argument is missing", key)
+			}
+			return tokens[i], nil
+		}
+
+		switch key {
+		case "ALL":
+		case "SEEN", "FLAGGED", "ANSWERED":
+			result.Flags = append(result.Flags, `\`+titleCase(key))
+		case "UNSEEN", "UNFLAGGED", "UNANSWERED":
+			result.NotFlags = append(result.NotFlags, `\`+titleCase(strings.TrimPrefix(key, "UN")))
+		case "KEYWORD", "UNKEYWORD", "NOT":
+			if key == "NOT" {
+				kw, err := arg()
+				if err != nil {
+					return nil, err
+				}
+				if !strings.EqualFold(kw, "KEYWORD") {
+					return nil, fmt.Errorf("NOT is only supported in combination with KEYWORD, got: %q", kw)
+				}
+				key = "UNKEYWORD"
+			}
+
+			kw, err := arg()
+			if err != nil {
+				return nil, err
+			}
+
+			if key == "KEYWORD" {
+				result.Flags = append(result.Flags, kw)
+			} else {
+				result.NotFlags = append(result.NotFlags, kw)
+			}
+		case "SINCE":
+			v, err := arg()
+			if err != nil {
+				return nil, err
+			}
+
+			d, err := parseAge(v)
+			if err != nil {
+				return nil, fmt.Errorf("SINCE: %w", err)
+			}
+			result.MaxAge = d
+		case "LARGER", "SMALLER":
+			v, err := arg()
+			if err != nil {
+				return nil, err
+			}
+
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s: invalid size: %q", key, v)
+			}
+
+			if key == "LARGER" {
+				result.Larger = n
+			} else {
+				result.Smaller = n
+			}
+		case "FROM", "TO", "SUBJECT":
+			v, err := arg()
+			if err != nil {
+				return nil, err
+			}
+
+			if result.Headers == nil {
+				result.Headers = map[string]string{}
+			}
+			result.Headers[titleCase(key)] = v
+		default:
+			return nil, fmt.Errorf("unsupported search key: %q", tokens[i])
+		}
+	}
+
+	return &result, nil
+}
+
+// searchTokens splits s at spaces, double quoted strings are one token.
+func searchTokens(s string) ([]string, error) {
+	var tokens []string
+
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return tokens, nil
+		}
+
+		if s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end == -1 {
+				return nil, errors.New("unterminated quoted string")
+			}
+			tokens = append(tokens, s[1:end+1])
+			s = s[end+2:]
+			continue
+		}
+
+		end := strings.IndexAny(s, " \t")
+		if end == -1 {
+			end = len(s)
+		}
+		tokens = append(tokens, s[:end])
+		s = s[end:]
+	}
+}
+
+// parseAge parses a Go duration or a number of days with the suffix "d".
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid number of days: %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be >0: %q", s)
+	}
+
+	return d, nil
+}
+
+func titleCase(s string) string {
+	return strings.ToUpper(s[:1]) + strings.ToLower(s[1:])
+}
+
+// SearchResult is the result of [Client.Search].
+type SearchResult struct {
+	// UIDs are the UIDs of the matching messages.
+	UIDs []uint32
+	// NumMessages is the number of all messages in the mailbox.
+	NumMessages uint32
+}
+
+// Search selects mailbox and returns the UIDs of the messages that match
+// criteria.
+func (c *Client) Search(mailbox string, criteria *SearchCriteria) (*SearchResult, error) {
+	mbox, err := c.selectMailbox(mailbox, &imap.SelectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("selecting mailbox failed: %w", err)
+	}
+
+	result := SearchResult{NumMessages: mbox.NumMessages}
+	if mbox.NumMessages == 0 {
+		return &result, nil
+	}
+
+	data, err := c.clt.UIDSearch(criteria.toIMAP(time.Now()), nil).Wait()
+	if err != nil {
+		return nil, fmt.Errorf("searching messages failed: %w", err)
+	}
+
+	for _, uid := range data.AllUIDs() {
+		result.UIDs = append(result.UIDs, uint32(uid))
+	}
+
+	c.logger.Debug("searched messages",
+		lkMailbox, mailbox,
+		"count", len(result.UIDs),
+		"event", "imap.messages_searched",
+	)
+
+	return &result, nil
+}
+
+// AddKeyword adds keyword to the flags of the messages with the given uids in
+// the selected mailbox.
+// If the mailbox does not permit storing the keyword permanently,
+// [ErrKeywordNotPermitted] is returned.
+func (c *Client) AddKeyword(uids []uint32, keyword string) error {
+	if len(uids) == 0 {
+		return errors.New("no uids were given")
+	}
+
+	mbox := c.clt.Mailbox()
+	if mbox == nil {
+		return errors.New("no mailbox is selected")
+	}
+
+	if !keywordPermitted(mbox.PermanentFlags, keyword) {
+		return ErrKeywordNotPermitted
+	}
+
+	err := c.clt.Store(asUIDSet(uids), &imap.StoreFlags{
+		Op:     imap.StoreFlagsAdd,
+		Silent: true,
+		Flags:  []imap.Flag{imap.Flag(keyword)},
+	}, nil).Close()
+	if err != nil {
+		return fmt.Errorf("storing keyword failed: %w", err)
+	}
+
+	c.logger.Debug("added keyword to messages",
+		lkMailbox, mbox.Name,
+		"keyword", keyword,
+		"count", len(uids),
+		"event", "imap.keyword_added",
+	)
+
+	return nil
+}
+
+// keywordPermitted returns true if permanentFlags allows to store keyword
+// permanently.
+func keywordPermitted(permanentFlags []imap.Flag, keyword string) bool {
+	return slices.ContainsFunc(permanentFlags, func(f imap.Flag) bool {
+		return f == imap.FlagWildcard || strings.EqualFold(string(f), keyword)
+	})
+}
@@ -0,0 +1,125 @@
+package imapclt
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+)
+
+func TestSearchNotKeyword(t *testing.T) {
+	const keyword = "$rspamdiscanscanned"
+	testMailPath := mail.TestHamMailPath(t)
+	srv, clt := startServerClient(t)
+
+	for range 3 {
+		assert.NoError(t, clt.Upload(testMailPath, srv.ScanMailbox, time.Now(), nil))
+	}
+
+	criteria := SearchCriteria{NotFlags: []string{keyword}}
+
+	res, err := clt.Search(srv.ScanMailbox, &criteria)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(res.UIDs))
+	assert.Equal(t, 3, res.NumMessages)
+
+	assert.NoError(t, clt.AddKeyword(res.UIDs[:1], keyword))
+
+	res2, err := clt.Search(srv.ScanMailbox, &criteria)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res2.UIDs))
+	assert.Equal(t, 3, res2.NumMessages)
+	if slices.Contains(res2.UIDs, res.UIDs[0]) {
+		t.Errorf("search result contains message with keyword")
+	}
+}
+
+func TestSearchMinAgeAndDelete(t *testing.T) {
+	testMailPath := mail.TestHamMailPath(t)
+	srv, clt := startServerClient(t)
+
+	assert.NoError(t, clt.Upload(testMailPath, srv.ScanMailbox, time.Now().Add(-10*24*time.Hour), nil))
+	assert.NoError(t, clt.Upload(testMailPath, srv.ScanMailbox, time.Now(), nil))
+
+	res, err := clt.Search(srv.ScanMailbox, &SearchCriteria{MinAge: 5 * 24 * time.Hour})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res.UIDs))
+	assert.Equal(t, 2, res.NumMessages)
+
+	assert.NoError(t, clt.Delete(res.UIDs))
+
+	res2, err := clt.Search(srv.ScanMailbox, &SearchCriteria{NotFlags: []string{"$x"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res2.UIDs))
+	assert.Equal(t, 1, res2.NumMessages)
+	if slices.Contains(res2.UIDs, res.UIDs[0]) {
+		t.Errorf("deleted message was not expunged")
+	}
+}
+
+func TestSearchEmptyMailbox(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	res, err := clt.Search(srv.ScanMailbox, &SearchCriteria{NotFlags: []string{"$x"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(res.UIDs))
+	assert.Equal(t, 0, res.NumMessages)
+}
+
+func TestKeywordPermitted(t *testing.T) {
+	assert.Equal(t, true, keywordPermitted([]imap.Flag{imap.FlagSeen, imap.FlagWildcard}, "$Scanned"))
+	assert.Equal(t, true, keywordPermitted([]imap.Flag{"$scanned"}, "$Scanned"))
+	assert.Equal(t, false, keywordPermitted([]imap.Flag{imap.FlagSeen, imap.FlagDeleted}, "$Scanned"))
+}
+
+func TestParseSearchCriteria(t *testing.T) {
+	sc, err := ParseSearchCriteria(`unseen FLAGGED NOT KEYWORD $Scanned KEYWORD $Todo SINCE 7d LARGER 10 SMALLER 2000 SUBJECT "hello world"`)
+	assert.NoError(t, err)
+
+	assert.Equal(t, `\Flagged,$Todo`, strings.Join(sc.Flags, ","))
+	assert.Equal(t, `\Seen,$Scanned`, strings.Join(sc.NotFlags, ","))
+	assert.Equal(t, 7*24*time.Hour, sc.MaxAge)
+	assert.Equal(t, 10, sc.Larger)
+	assert.Equal(t, 2000, sc.Smaller)
+	assert.Equal(t, "hello world", sc.Headers["Subject"])
+
+	sc, err = ParseSearchCriteria("SINCE 36h")
+	assert.NoError(t, err)
+	assert.Equal(t, 36*time.Hour, sc.MaxAge)
+
+	sc, err = ParseSearchCriteria("")
+	assert.NoError(t, err)
+	assert.Equal(t, true, sc.IsEmpty())
+
+	for _, s := range []string{"SINCE", "SINCE -1d", "LARGER x", "NOT SEEN", "BODY x", `SUBJECT "x`} {
+		_, err := ParseSearchCriteria(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestSearchUnseen(t *testing.T) {
+	testMailPath := mail.TestHamMailPath(t)
+	srv, clt := startServerClient(t)
+
+	assert.NoError(t, clt.Upload(testMailPath, srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.Upload(testMailPath, srv.ScanMailbox, time.Now(), nil))
+
+	criteria, err := ParseSearchCriteria("UNSEEN SINCE 1d")
+	assert.NoError(t, err)
+
+	res, err := clt.Search(srv.ScanMailbox, criteria)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res.UIDs))
+
+	assert.NoError(t, clt.AddKeyword(res.UIDs[:1], `\Seen`))
+
+	res, err = clt.Search(srv.ScanMailbox, criteria)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res.UIDs))
+	assert.Equal(t, 2, res.NumMessages)
+}
@@ -0,0 +1,52 @@
+package imapclt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// ErrTimeout is wrapped by the errors of operations that did not finish
+// within their timeout.
+var ErrTimeout = errors.New("timed out")
+
+// withTimeout runs fn. If fn does not return within timeout, the connection
+// is closed to abort it and an error wrapping [ErrTimeout] is returned.
+// The client can not be used anymore afterwards.
+// If timeout is <=0, fn is run without a timeout.
+func (c *Client) withTimeout(op string, timeout time.Duration, fn func() error) error {
+	if timeout <= 0 {
+		return fn()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stop := context.AfterFunc(ctx, func() {
+		c.logger.Warn("imap operation timed out, closing connection",
+			"operation", op, "timeout", timeout, "event", "imap.timeout")
+		_ = c.Close()
+	})
+
+	err := fn()
+	if !stop() {
+		return fmt.Errorf("%s %w after %s", op, ErrTimeout, timeout)
+	}
+
+	return err
+}
+
+func (c *Client) selectMailbox(mailbox string, opts *imap.SelectOptions) (*imap.SelectData, error) {
+	var data *imap.SelectData
+
+	err := c.withTimeout("SELECT", c.selectTimeout, func() error {
+		var err error
+		data, err = c.clt.Select(mailbox, opts).Wait()
+		return err
+	})
+
+	return data, err
+}
@@ -0,0 +1,109 @@
+package imapclt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+)
+
+// startStallingProxy starts a proxy to target, that stops forwarding the
+// responses of the server after the client sent a command containing stallOn.
+func startStallingProxy(t *testing.T, target, stallOn string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			cltConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			srvConn, err := net.Dial("tcp", target)
+			if err != nil {
+				_ = cltConn.Close()
+				continue
+			}
+			t.Cleanup(func() { _ = cltConn.Close(); _ = srvConn.Close() })
+
+			var stalled atomic.Bool
+			go func() {
+				buf := make([]byte, 4096)
+				for {
+					n, err := cltConn.Read(buf)
+					if err != nil {
+						_ = srvConn.Close()
+						return
+					}
+					if bytes.Contains(buf[:n], []byte(stallOn)) {
+						stalled.Store(true)
+					}
+					if _, err := srvConn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+
+			go func() {
+				buf := make([]byte, 4096)
+				for {
+					n, err := srvConn.Read(buf)
+					if err != nil {
+						_ = cltConn.Close()
+						return
+					}
+					if stalled.Load() {
+						continue
+					}
+					if _, err := cltConn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestMessagesTimeout(t *testing.T) {
+	for _, stallOn := range []string{"SELECT", "FETCH"} {
+		t.Run(stallOn, func(t *testing.T) {
+			srv := imapserver.StartServer(t)
+			clt := newTestClient(t, srv)
+			assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), srv.InboxMailBox, time.Now(), nil))
+
+			cfg := testClientCfg(t, srv)
+			cfg.Address = startStallingProxy(t, srv.ListenAddr, stallOn)
+			cfg.SelectTimeout = 200 * time.Millisecond
+			cfg.FetchTimeout = 200 * time.Millisecond
+
+			proxiedClt := NewClient(cfg)
+			assert.NoError(t, proxiedClt.Connect())
+			t.Cleanup(func() { _ = proxiedClt.Close() })
+
+			var errs []error
+			for _, err := range proxiedClt.Messages(context.Background(), srv.InboxMailBox, nil) {
+				errs = append(errs, err)
+			}
+
+			assert.Equal(t, 1, len(errs))
+			if !errors.Is(errs[0], ErrTimeout) {
+				t.Fatalf("expected a timeout error, got: %v", errs[0])
+			}
+
+			// the connection was closed
+			_, err := proxiedClt.Search(srv.InboxMailBox, &SearchCriteria{})
+			assert.Error(t, err)
+		})
+	}
+}
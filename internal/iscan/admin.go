@@ -0,0 +1,244 @@
+package iscan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/stats"
+)
+
+var (
+	// ErrStopped is returned by operations that are requested after the
+	// scanner was stopped.
+	ErrStopped = errors.New("scanner is stopped")
+	// ErrMessageNotFound is returned when a message does not exist.
+	ErrMessageNotFound = errors.New("message not found")
+)
+
+// adminOp is an operation that is requested via the admin API.
+// It is run by the Monitor loop of the scanner, to not access the mailboxes
+// concurrently.
+type adminOp struct {
+	fn   func(ctx context.Context) error
+	done chan error
+}
+
+// run runs the operation and passes its result to the waiting requester.
+func (op *adminOp) run(ctx context.Context) {
+	op.done <- op.fn(ctx)
+}
+
+// runAdminOp passes fn to the Monitor loop via ops and waits until it was run.
+// stopCtx is the context that is canceled when the scanner is stopped.
+// If ctx is canceled while fn is running, fn is not aborted.
+func runAdminOp(ctx, stopCtx context.Context, ops chan<- *adminOp, fn func(context.Context) error) error {
+	op := adminOp{fn: fn, done: make(chan error, 1)}
+
+	select {
+	case ops <- &op:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stopCtx.Done():
+		return ErrStopped
+	}
+
+	select {
+	case err := <-op.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ScanNow processes the mailboxes immediately, like it happens when the poll
+// interval expired.
+// It blocks until the processing finished, [Client.Monitor] must be running.
+func (c *Client) ScanNow(ctx context.Context) error {
+	return runAdminOp(ctx, c.ctx, c.ops, func(context.Context) error {
+		return c.runOnce()
+	})
+}
+
+// RescanResult is the result of [Client.RescanMailbox].
+type RescanResult struct {
+	Scanned int `json:"scanned"`
+	Spam    int `json:"spam"`
+}
+
+// RescanMailbox scans all messages in mailbox and moves the spam to the spam
+// mailbox. Other messages are left unmodified in mailbox.
+// [Client.Monitor] must be running.
+func (c *Client) RescanMailbox(ctx context.Context, mailbox string) (*RescanResult, error) {
+	var result *RescanResult
+
+	err := runAdminOp(ctx, c.ctx, c.ops, func(ctx context.Context) error {
+		var err error
+		result, err = c.rescanMailbox(ctx, mailbox, nil, nil)
+		return err
+	})
+
+	return result, err
+}
+
+// rescanMailbox scans the messages in mailbox and moves the spam to the spam
+// mailbox. If uids is not empty, only the messages with the uids are scanned.
+// onScanned is optional, it is called for every scanned message.
+func (c *Client) rescanMailbox(ctx context.Context, mailbox string, uids []uint32, onScanned func(*scannedMail)) (_ *RescanResult, err error) {
+	var result RescanResult
+	var spamUIDs []uint32
+	var spam []*audit.Entry
+	var errs []error
+
+	counters := stats.Counters{}
+	defer func() {
+		if err != nil {
+			counters.Errors++
+		}
+		recordStats(c.logger, c.stats, &counters)
+	}()
+
+	logger := c.logger.With("mailbox.source", mailbox)
+	logger.Info("rescanning mailbox", "event", "iscan.mailbox_rescan")
+
+	fetchOpts := imapclt.FetchOptions{UIDs: uids, MaxBodySize: c.maxMessageSize}
+	for msg, err := range c.clt.Messages(ctx, mailbox, &fetchOpts) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("fetching messages from %s failed: %w", mailbox, err))
+			break
+		}
+
+		sm, err := c.downloadAndScan(ctx, msg, nil)
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+		c.removeTempFile(sm.Path)
+		if onScanned != nil {
+			onScanned(sm)
+		}
+
+		counters.Scanned++
+		counters.Bytes += uint64(sm.Size)
+		if c.isSpam(sm.CheckResult) {
+			counters.Spam++
+			spamUIDs = append(spamUIDs, sm.UID)
+
+			e := c.scannedAuditEntry(sm)
+			e.Mailbox = mailbox
+			spam = append(spam, e)
+		} else {
+			counters.Ham++
+		}
+	}
+
+	result.Scanned = int(counters.Scanned)
+
+	// the spam that was found before an error happened is moved anyways
+	if len(spamUIDs) > 0 && mailbox != c.spamMailbox {
+		if err := c.move(ctx, c.clt, spamUIDs, c.spamMailbox); err != nil {
+			errs = append(errs, fmt.Errorf("moving spam to %s failed: %w", c.spamMailbox, err))
+		} else {
+			c.recordAudit(audit.ActionMove, c.spamMailbox, spam)
+			result.Spam = len(spamUIDs)
+			logger.Info("moved spam found by rescan",
+				"count", len(spamUIDs), "mailbox.destination", c.spamMailbox)
+		}
+	}
+
+	return &result, errors.Join(errs...)
+}
+
+// LearnMessage sends the message with uid in mailbox to rspamd to learn it as
+// spam or ham. The message is not moved.
+// [Client.Monitor] must be running.
+func (c *Client) LearnMessage(ctx context.Context, mailbox string, uid uint32, spam bool) error {
+	return runAdminOp(ctx, c.ctx, c.ops, func(ctx context.Context) error {
+		return c.learnMessage(ctx, mailbox, uid, spam)
+	})
+}
+
+func (c *Client) learnMessage(ctx context.Context, mailbox string, uid uint32, spam bool) (err error) {
+	learnFn, action := c.rspamc.Ham, audit.ActionLearnHam
+	if spam {
+		learnFn, action = c.rspamc.Spam, audit.ActionLearnSpam
+	}
+
+	counters := stats.Counters{}
+	defer func() {
+		if err != nil {
+			counters.Errors++
+		}
+		recordStats(c.logger, c.stats, &counters)
+	}()
+
+	found := false
+	fetchOpts := imapclt.FetchOptions{UIDs: []uint32{uid}}
+	for msg, err := range c.clt.Messages(ctx, mailbox, &fetchOpts) {
+		if err != nil {
+			return fmt.Errorf("fetching message from %s failed: %w", mailbox, err)
+		}
+		found = true
+
+		r := countingReader{r: msg.Message}
+		err = learnFn(ctx, &r, c.rspamcHdrs(&msg.Envelope, netip.Addr{}))
+		counters.Bytes += r.n
+		if err != nil {
+			return fmt.Errorf("learning message failed: %w", err)
+		}
+
+		counters.Learned++
+		c.recordAudit(action, "", []*audit.Entry{newAuditEntry(mailbox, msg.UID, &msg.Envelope, reasonAdmin)})
+		c.logger.Info("learned message",
+			"mail.subject", msg.Envelope.Subject, "mail.uid", msg.UID,
+			"mailbox.source", mailbox, "spam", spam,
+			"event", "rspamd.msg_learned",
+		)
+	}
+
+	if !found {
+		return fmt.Errorf("%w: uid %d in %s", ErrMessageNotFound, uid, mailbox)
+	}
+
+	return nil
+}
+
+// FlushCache removes all entries from the scan cache and returns their number.
+// If the scan cache is disabled, an error wrapping [errors.ErrUnsupported] is
+// returned.
+// [Client.Monitor] must be running.
+func (c *Client) FlushCache(ctx context.Context) (int, error) {
+	if c.cache == nil {
+		return 0, fmt.Errorf("scan cache is disabled: %w", errors.ErrUnsupported)
+	}
+
+	var cnt int
+	err := runAdminOp(ctx, c.ctx, c.ops, func(context.Context) error {
+		cnt = c.cache.flush()
+		return c.cache.save(time.Now())
+	})
+
+	return cnt, err
+}
+
+// ScanNow processes the maildrop immediately.
+// It blocks until the processing finished, [POP3Scanner.Monitor] must be
+// running.
+func (s *POP3Scanner) ScanNow(ctx context.Context) error {
+	return runAdminOp(ctx, s.ctx, s.ops, func(context.Context) error {
+		return s.ProcessMaildrop()
+	})
+}
+
+// ScanNow processes the Maildir immediately.
+// It blocks until the processing finished, [MaildirScanner.Monitor] must be
+// running.
+func (s *MaildirScanner) ScanNow(ctx context.Context) error {
+	return runAdminOp(ctx, s.ctx, s.ops, func(context.Context) error {
+		return s.ProcessMaildir()
+	})
+}
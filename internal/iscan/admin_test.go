@@ -0,0 +1,61 @@
+package iscan
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+)
+
+func TestAdminOps(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	runErrChan := make(chan error, 1)
+	go func() {
+		runErrChan <- clt.Monitor()
+	}()
+
+	clt2 := newTestClient(t, srv)
+	err := clt2.clt.Upload(mail.TestHamMailPath(t), srv.InboxMailBox, time.Now(), nil)
+	assert.NoError(t, err)
+	err = clt2.clt.Upload(mail.TestSpamMailPath(t), srv.InboxMailBox, time.Now(), nil)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	assert.NoError(t, clt.ScanNow(ctx))
+
+	res, err := clt.RescanMailbox(ctx, srv.InboxMailBox)
+	assert.NoError(t, err)
+	assert.Equal(t, RescanResult{Scanned: 2, Spam: 1}, *res)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt2.clt, srv.SpamMailbox, "Test spam mail (GTUBE)"))
+	assert.Equal(t, 0, mailboxContainsMailCnt(t, clt2.clt, srv.InboxMailBox, "Test spam mail (GTUBE)"))
+
+	var uid uint32
+	for msg, err := range clt2.clt.Messages(ctx, srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		uid = msg.UID
+	}
+	assert.NoError(t, clt.LearnMessage(ctx, srv.InboxMailBox, uid, false))
+
+	err = clt.LearnMessage(ctx, srv.InboxMailBox, uid+100, true)
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected ErrMessageNotFound, got: %v", err)
+	}
+
+	_, err = clt.FlushCache(ctx)
+	if !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported, got: %v", err)
+	}
+
+	assert.NoError(t, clt.Stop())
+	assert.NoError(t, <-runErrChan)
+
+	if err := clt.ScanNow(ctx); !errors.Is(err, ErrStopped) {
+		t.Errorf("expected ErrStopped, got: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package iscan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/trace"
+)
+
+const spamArchiveReportName = "rspamd-result.json"
+
+// archiveSpam uploads a copy of the spam mail with its scan result attached
+// to the [Client.spamArchiveMailbox].
+// The copy is flagged as seen, to not show up as unread mail.
+func (c *Client) archiveSpam(ctx context.Context, sm *scannedMail) (err error) {
+	_, span := c.tracer.Start(ctx, "imap.archive",
+		trace.String("mailbox.destination", c.spamArchiveMailbox),
+		trace.Int("mail.uid", int64(sm.UID)),
+	)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	report, err := json.MarshalIndent(sm.CheckResult, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding scan result failed: %w", err)
+	}
+
+	in, err := os.Open(sm.Path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(c.tempDir, "rspamd-iscan-archive-")
+	if err != nil {
+		return fmt.Errorf("creating temporary file failed: %w", err)
+	}
+	defer c.removeTempFile(out.Name())
+
+	err = mail.WrapWithAttachment(in, out, spamArchiveReportName, "application/json", report)
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("closing file failed: %w", err)
+	}
+
+	ts := sm.InternalDate
+	if ts.IsZero() {
+		ts = sm.Envelope.Date
+	}
+
+	if err := c.clt.Upload(out.Name(), c.spamArchiveMailbox, ts, []string{`\Seen`}); err != nil {
+		return err
+	}
+
+	c.recordAudit(audit.ActionUpload, c.spamArchiveMailbox, []*audit.Entry{c.scannedAuditEntry(sm)})
+
+	return nil
+}
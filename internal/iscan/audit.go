@@ -0,0 +1,97 @@
+package iscan
+
+import (
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// Reasons of the actions that are recorded in the audit log.
+const (
+	reasonSpam        = "spam"
+	reasonHam         = "ham"
+	reasonTooLarge    = "too_large"
+	reasonAllowlisted = "allowlisted"
+	reasonBlocklisted = "blocklisted"
+	reasonPrescanned  = "prescanned"
+	reasonBackscatter = "backscatter"
+	reasonScanFailed  = "scan_failed"
+	reasonExpired     = "expired"
+	// reasonReplaced is the reason for moving an original message to the
+	// backup mailbox, after it was scanned.
+	reasonReplaced = "replaced"
+	reasonLearned  = "learned"
+	// reasonAdmin is the reason for actions requested via the admin API.
+	reasonAdmin = "admin"
+	// reasonForwarded is the reason for deleting a POP3 message after it
+	// was forwarded.
+	reasonForwarded = "forwarded"
+)
+
+func newAuditEntry(mailbox string, uid uint32, env *imapclt.Envelope, reason string) *audit.Entry {
+	return &audit.Entry{
+		Reason:    reason,
+		Mailbox:   mailbox,
+		UID:       uid,
+		MessageID: env.MessageID,
+		Subject:   env.Subject,
+	}
+}
+
+// scannedAuditEntry returns an audit log entry for mail that contains its
+// scan result.
+func (c *Client) scannedAuditEntry(mail *scannedMail) *audit.Entry {
+	reason := reasonHam
+	if c.isSpam(mail.CheckResult) {
+		reason = reasonSpam
+	}
+
+	e := newAuditEntry(c.scanMailbox, mail.UID, mail.Envelope, reason)
+	e.Score = &mail.CheckResult.Score
+	e.RspamdAction = mail.CheckResult.Action
+
+	return e
+}
+
+// keyAuditEntry returns an audit log entry with the scan result for a
+// message that is identified by key instead of a UID, see [audit.Entry.Key].
+func keyAuditEntry(mailbox, key string, env *imapclt.Envelope, result *rspamc.CheckResult, isSpam bool) *audit.Entry {
+	reason := reasonHam
+	if isSpam {
+		reason = reasonSpam
+	}
+
+	e := newAuditEntry(mailbox, 0, env, reason)
+	e.Key = key
+	e.Score = &result.Score
+	e.RspamdAction = result.Action
+
+	return e
+}
+
+// recordAudit records action for the messages of entries in the audit log.
+// destination is the mailbox that the messages were moved or uploaded to,
+// keywords are the keywords that were added to them.
+func (c *Client) recordAudit(action, destination string, entries []*audit.Entry, keywords ...string) {
+	recordAudit(c.audit, action, destination, entries, keywords...)
+}
+
+// recordAudit records action for the messages of entries in l, see
+// [Client.recordAudit]. If l is nil, nothing is recorded.
+func recordAudit(l *audit.Log, action, destination string, entries []*audit.Entry, keywords ...string) {
+	if l == nil {
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		e := *entry
+		e.Time = now
+		e.Action = action
+		e.Destination = destination
+		e.Keywords = keywords
+		l.Record(&e)
+	}
+}
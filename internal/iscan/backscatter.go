@@ -0,0 +1,94 @@
+package iscan
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/mail"
+)
+
+// maxBounceSize is the max. number of bytes of a message that are parsed to
+// detect if it is a bounce.
+const maxBounceSize = 1024 * 1024
+
+// handleBackscatter checks if msg is a bounce of a message that was not sent
+// from one of the own sender addresses. Such bounces are misdirected
+// (backscatter), the forged sender address of spam was an own address.
+// Backscatter is recorded in sc to be moved to the backscatter mailbox and
+// added to the fuzzy storage if enabled. Then true is returned.
+// Only the first maxBounceSize bytes of msg are parsed, msg.Message is
+// replaced with a reader that returns the same data.
+func (c *Client) handleBackscatter(ctx context.Context, sc *scanCycle, msg *imapclt.Message) (bool, error) {
+	if c.backscatterMailbox == "" {
+		return false, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(msg.Message, maxBounceSize))
+	if err != nil {
+		return false, fmt.Errorf("reading message failed: %w", err)
+	}
+	msg.Message = io.MultiReader(bytes.NewReader(data), msg.Message)
+
+	logger := c.logger.With("mail.subject", msg.Envelope.Subject, "mail.uid", msg.UID)
+
+	if !c.isBackscatter(logger, data) {
+		return false, nil
+	}
+
+	if c.backscatterFuzzy {
+		err := c.rspamc.FuzzyAdd(ctx, msg.Message,
+			c.rspamcHdrs(&msg.Envelope, netip.Addr{}),
+			c.fuzzyFlag, c.fuzzyWeight,
+		)
+		if err != nil {
+			// the message is moved anyways, to not scan it again
+			logger.Warn("adding backscatter to fuzzy storage failed",
+				"error", err, "event", "rspamd.fuzzy_add_failed")
+		} else {
+			logger.Debug("added backscatter to fuzzy storage", "event", "rspamd.fuzzy_added")
+		}
+	}
+
+	sc.move(c.backscatterMailbox, newAuditEntry(c.scanMailbox, msg.UID, &msg.Envelope, reasonBackscatter))
+
+	return true, nil
+}
+
+func (c *Client) isBackscatter(logger *slog.Logger, data []byte) bool {
+	bounce, err := mail.ParseBounce(bytes.NewReader(data))
+	if err != nil {
+		logger.Debug("parsing message for bounce detection failed", "error", err)
+		return false
+	}
+
+	if bounce == nil {
+		return false
+	}
+
+	logger = logger.With(
+		"bounce.reason", bounce.Reason,
+		"bounce.original_from", bounce.OriginalFrom,
+		"bounce.original_message_id", bounce.OriginalMessageID,
+	)
+
+	// without the original message it is unknown who sent it
+	if len(bounce.OriginalFrom) == 0 {
+		logger.Debug("message is a bounce, original sender is unknown, scanning it")
+		return false
+	}
+
+	if p, matched := matchSender(c.ownSenders, bounce.OriginalFrom); matched {
+		logger.Debug("message is a bounce of an own message, scanning it", "pattern", p)
+		return false
+	}
+
+	logger.Info("message is a bounce of a message that was not sent by us, moving it without scanning",
+		"mailbox.destination", c.backscatterMailbox, "event", "iscan.backscatter")
+
+	return true
+}
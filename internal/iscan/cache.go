@@ -0,0 +1,165 @@
+package iscan
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/fsutil"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// scanCache stores the rspamd check results of messages, keyed by their
+// Message-ID and body hash, to prevent that a message that reappears is
+// scanned again.
+// The cache is persisted in a JSON file.
+// A nil *scanCache is a disabled cache.
+// It is safe for concurrent use, mailboxes can be scanned in parallel.
+type scanCache struct {
+	path string
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*scanCacheEntry
+	dirty   bool
+
+	hits   uint64
+	misses uint64
+}
+
+type scanCacheEntry struct {
+	Result    *rspamc.CheckResult `json:"result"`
+	ScannedAt time.Time           `json:"scanned_at"`
+}
+
+func newScanCache(path string, ttl time.Duration) *scanCache {
+	return &scanCache{
+		path:    path,
+		ttl:     ttl,
+		entries: map[string]*scanCacheEntry{},
+	}
+}
+
+// load reads the cache entries from the cache file.
+// If the file does not exist, the cache stays empty.
+func (c *scanCache) load() error {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return fmt.Errorf("decoding %q failed: %w", c.path, err)
+	}
+
+	return nil
+}
+
+// scanCacheKey returns the cache key for a message.
+func scanCacheKey(messageID string, bodyHash []byte) string {
+	h := sha256.New()
+	h.Write([]byte(messageID))
+	h.Write([]byte{0})
+	h.Write(bodyHash)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the cached check result for key if it exists and is not
+// expired.
+func (c *scanCache) get(key string, now time.Time) (*rspamc.CheckResult, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, exists := c.entries[key]
+	if !exists || now.Sub(e.ScannedAt) >= c.ttl {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	return e.Result, true
+}
+
+func (c *scanCache) add(key string, result *rspamc.CheckResult, now time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = &scanCacheEntry{Result: result, ScannedAt: now}
+	c.dirty = true
+}
+
+// flush removes all entries and returns their number.
+func (c *scanCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cnt := len(c.entries)
+	c.entries = map[string]*scanCacheEntry{}
+	c.dirty = true
+
+	return cnt
+}
+
+// stats returns the number of cache hits, misses and entries.
+func (c *scanCache) stats() (hits, misses uint64, entries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hits, c.misses, len(c.entries)
+}
+
+// save removes expired entries and writes the cache to its file, if it was
+// modified.
+func (c *scanCache) save(now time.Time) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, e := range c.entries {
+		if now.Sub(e.ScannedAt) >= c.ttl {
+			delete(c.entries, k)
+			c.dirty = true
+		}
+	}
+
+	if !c.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+
+	if err := fsutil.WriteFileAtomic(c.path, data); err != nil {
+		return err
+	}
+
+	c.dirty = false
+
+	return nil
+}
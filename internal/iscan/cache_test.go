@@ -0,0 +1,54 @@
+package iscan
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestScanCacheExpiry(t *testing.T) {
+	now := time.Now()
+	c := newScanCache(filepath.Join(t.TempDir(), "cache.json"), time.Hour)
+	key := scanCacheKey("<1@example.com>", []byte("hash"))
+
+	_, exists := c.get(key, now)
+	assert.Equal(t, false, exists)
+
+	c.add(key, &rspamc.CheckResult{Score: 5}, now)
+
+	result, exists := c.get(key, now.Add(time.Minute))
+	assert.Equal(t, true, exists)
+	assert.Equal(t, 5, result.Score)
+
+	_, exists = c.get(key, now.Add(time.Hour))
+	assert.Equal(t, false, exists)
+
+	assert.Equal(t, 1, c.hits)
+	assert.Equal(t, 2, c.misses)
+}
+
+func TestScanCacheSaveLoad(t *testing.T) {
+	now := time.Now()
+	path := filepath.Join(t.TempDir(), "cache.json")
+	c := newScanCache(path, time.Hour)
+
+	c.add("current", &rspamc.CheckResult{Score: 1}, now)
+	c.add("expired", &rspamc.CheckResult{Score: 2}, now.Add(-2*time.Hour))
+	assert.NoError(t, c.save(now))
+
+	loaded := newScanCache(path, time.Hour)
+	assert.NoError(t, loaded.load())
+	assert.Equal(t, 1, len(loaded.entries))
+
+	_, exists := loaded.get("current", now)
+	assert.Equal(t, true, exists)
+}
+
+func TestScanCacheLoadMissingFile(t *testing.T) {
+	c := newScanCache(filepath.Join(t.TempDir(), "cache.json"), time.Hour)
+	assert.NoError(t, c.load())
+	assert.Equal(t, 0, len(c.entries))
+}
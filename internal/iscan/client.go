@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net/netip"
 	"os"
 	"slices"
 	"strconv"
@@ -14,31 +15,62 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/fho/rspamd-iscan/internal/audit"
 	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/jmapclt"
 	"github.com/fho/rspamd-iscan/internal/log"
 	"github.com/fho/rspamd-iscan/internal/mail"
 	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/spool"
+	"github.com/fho/rspamd-iscan/internal/stats"
+	"github.com/fho/rspamd-iscan/internal/trace"
 )
 
 const (
 	hdrPrefix      = "X-rspamd-iscan-"
 	hdrRspamdScore = hdrPrefix + "Score"
+	// hdrRspamdAuth lists the symbols of the DKIM, SPF and DMARC checks.
+	hdrRspamdAuth = hdrPrefix + "Auth"
+	// hdrSignature contains the signature of the score header, see
+	// [scanResultSignature].
+	hdrSignature = hdrPrefix + "Signature"
+)
+
+const (
+	actionGreylist   = "greylist"
+	actionSoftReject = "soft reject"
 )
 
 type RspamdClient interface {
-	Check(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error)
-	Spam(context.Context, io.Reader, *rspamc.MailHeaders) error
-	Ham(context.Context, io.Reader, *rspamc.MailHeaders) error
+	Scanner
+	FuzzyAdd(ctx context.Context, msg io.Reader, hdrs *rspamc.MailHeaders, flag, weight int) error
+	FuzzyDel(ctx context.Context, msg io.Reader, hdrs *rspamc.MailHeaders, flag int) error
 }
 
 type Client struct {
-	clt    IMAPClient
-	rspamc RspamdClient
-	logger *slog.Logger
-
-	stopCh   chan struct{}
-	stopOnce sync.Once
-	wgRun    sync.WaitGroup
+	clt IMAPClient
+	// pool provides the connections that the learn mailboxes are
+	// processed on, concurrently to the scanMailbox on clt. It is nil if
+	// the mailboxes are processed sequentially on clt.
+	pool *imapclt.Pool[IMAPClient]
+	// notifyCfg is the configuration of the NOTIFY connection, it is nil
+	// if NOTIFY is not used.
+	notifyCfg *imapclt.NotifierConfig
+	rspamc    RspamdClient
+	forwarder Forwarder
+	logger    *slog.Logger
+	tracer    *trace.Tracer
+
+	// ctx is canceled by [Client.Stop], it is passed to all operations to
+	// abort them on shutdown.
+	ctx             context.Context
+	cancel          context.CancelFunc
+	stopOnce        sync.Once
+	wgRun           sync.WaitGroup
+	shutdownTimeout time.Duration
+	// ops receives the operations that are requested via the admin API,
+	// they are run by [Client.Monitor].
+	ops chan *adminOp
 
 	scanMailbox       string
 	inboxMailbox      string
@@ -46,17 +78,118 @@ type Client struct {
 	hamMailbox        string
 	backupMailbox     string
 	undetectedMailbox string
+	fuzzyMailbox      string
 	spamTreshold      float32
 	dryMode           bool
 
+	rspamdDeliverTo string
+	rspamdUser      string
+
+	maxMessageSize  int64
+	oversizedAction OversizedAction
+	tooLargeMailbox string
+
+	headerPreScan bool
+	// scanResultKey is the key that the scan result headers are signed
+	// with. If it is empty, they are not signed and the headers of
+	// messages are not trusted in the pre-scan.
+	scanResultKey []byte
+	// scannedKeyword is the keyword that scanned messages that are left in
+	// the scanMailbox are flagged with. If it is empty, messages are not
+	// flagged.
+	scannedKeyword string
+	// folderPolicies define how the messages in other mailboxes than the
+	// scanMailbox are scanned.
+	folderPolicies []*FolderPolicy
+	// scanPolicy is the folder policy that applies to the messages in
+	// the scanMailbox, it is nil if none matches.
+	scanPolicy *FolderPolicy
+	// scanSearch restricts which messages in the scanMailbox are
+	// processed.
+	scanSearch imapclt.SearchCriteria
+	allowlist  []senderPattern
+	blocklist  []senderPattern
+	// degradedFiltering enables processing allowlisted and blocklisted
+	// messages while rspamd is unavailable.
+	degradedFiltering bool
+	// scoreOverrides are applied to the rspamd scores, ordered by
+	// specificity.
+	scoreOverrides []scoreOverride
+	partFilters    []*mail.PartFilter
+	// subjectTagger is nil if subject tagging is disabled.
+	subjectTagger *subjectTagger
+	milter        bool
+	// deduplicate enables scanning copies of the same message in a scan
+	// cycle only once.
+	deduplicate bool
+	// backscatterMailbox is the mailbox that bounces of messages that
+	// were not sent from one of the ownSenders are moved to. If it is
+	// empty, bounces are scanned like other messages.
+	backscatterMailbox string
+	backscatterFuzzy   bool
+	ownSenders         []senderPattern
+	// spamArchiveMailbox is the mailbox that copies of spam messages with
+	// the scan result attached are uploaded to. If it is empty, spam is
+	// not archived.
+	spamArchiveMailbox string
+	// gmail is true when the mailboxes are accessed in Gmail mode, see
+	// [Config.Gmail].
+	gmail bool
+
+	spamRetention       time.Duration
+	scanFailedRetention time.Duration
+	learnExpiredSpam    bool
+	// nextRetentionAt is the time when the mailboxes are checked for
+	// expired messages next.
+	nextRetentionAt time.Time
+
+	// spamLearnedKeyword is the keyword that messages in the spamMailbox
+	// are flagged with, when the scanner moved them there or they were
+	// learned as spam. If it is empty, messages that are moved to the
+	// spamMailbox by the user are not learned.
+	spamLearnedKeyword string
+	// spamFlags are added to messages that are moved or uploaded to the
+	// spamMailbox, borderlineFlags to scanned ham with a score >=
+	// borderlineThreshold.
+	spamFlags           []string
+	borderlineFlags     []string
+	borderlineThreshold float32
+
+	// scanFailedMailbox and scanFailedKeyword are the mailbox that
+	// messages are moved to, respectively the keyword that they are
+	// flagged with, after their scan failed maxScanAttempts times.
+	scanFailedMailbox string
+	scanFailedKeyword string
+	maxScanAttempts   int
+	failures          *failureCounter
+
+	fuzzyFlag   int
+	fuzzyWeight int
+
 	tempDir       string
 	keepTempFiles bool
 
-	learnInterval time.Duration
+	poll *pollScheduler
+
+	// greylistDelay is the duration after which messages with a greylist
+	// or soft reject action are rescanned. If it is 0, messages are not
+	// deferred.
+	greylistDelay time.Duration
+	deferred      *deferralQueue
+	// keptMsgCount is the number of messages that were processed and left
+	// in the scanMailbox by the last [Client.ProcessScanBox] run. Messages
+	// that were not reached because the run was aborted are not included,
+	// they are reported as new messages by [IMAPClient.Monitor].
+	keptMsgCount uint32
+
+	cache    *scanCache
+	stats    *stats.Store
+	audit    *audit.Log
+	notifier Notifier
 
 	// cntProcessedMails counts the number of emails that have been processed
-	// in the [Client.scanMailbox], [Client.hamMailbox] and [Client.
-	// spamMailbox].
+	// in the [Client.scanMailbox], [Client.hamMailbox], [Client.
+	// spamMailbox] and [Client.fuzzyMailbox].
 	// It is only used in tests.
 	cntProcessedMails atomic.Uint64
 }
@@ -66,6 +199,15 @@ type scannedMail struct {
 	UID         uint32
 	Envelope    *imapclt.Envelope
 	CheckResult *rspamc.CheckResult
+	// Truncated is true if only the beginning of the mail was
+	// downloaded and scanned.
+	Truncated bool
+	// Size is the number of bytes that were downloaded.
+	Size int64
+	// InternalDate and Flags are the ones of the original message, they
+	// are set when the local copy is uploaded.
+	InternalDate time.Time
+	Flags        []string
 }
 
 type learnFn func(context.Context, io.Reader, *rspamc.MailHeaders) error
@@ -75,83 +217,309 @@ func NewClient(cfg *Config) (*Client, error) {
 		return nil, err
 	}
 
+	allowlist, err := parseSenderPatterns(cfg.AllowlistSenders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AllowlistSenders: %w", err)
+	}
+
+	blocklist, err := parseSenderPatterns(cfg.BlocklistSenders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BlocklistSenders: %w", err)
+	}
+
+	scoreOverrides, err := parseScoreOverrides(cfg.ScoreOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ScoreOverrides: %w", err)
+	}
+
+	scanSearch, err := imapclt.ParseSearchCriteria(cfg.ScanSearch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ScanSearch: %w", err)
+	}
+
+	ownSenders, err := parseSenderPatterns(cfg.OwnSenders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OwnSenders: %w", err)
+	}
+
+	var tagger *subjectTagger
+	if cfg.SubjectTag != "" {
+		tagger, err = newSubjectTagger(cfg.SubjectTag, cfg.SubjectTagThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SubjectTag: %w", err)
+		}
+	}
+
 	c := &Client{
-		logger:            log.EnsureLoggerInstance(cfg.Logger),
-		inboxMailbox:      cfg.InboxMailbox,
-		scanMailbox:       cfg.ScanMailbox,
-		spamMailbox:       cfg.SpamMailboxName,
-		hamMailbox:        cfg.HamMailbox,
-		undetectedMailbox: cfg.UndetectedMailboxName,
-		rspamc:            cfg.Rspamc,
-		spamTreshold:      cfg.SpamTreshold,
-		learnInterval:     30 * time.Minute,
-		backupMailbox:     cfg.BackupMailbox,
-		tempDir:           cfg.TempDir,
-		keepTempFiles:     cfg.KeepTempFiles,
-		stopCh:            make(chan struct{}),
-		dryMode:           cfg.DryRun,
+		logger:              log.Module(cfg.Logger, "iscan"),
+		tracer:              cfg.Tracer,
+		inboxMailbox:        cfg.InboxMailbox,
+		scanMailbox:         cfg.ScanMailbox,
+		spamMailbox:         cfg.SpamMailboxName,
+		hamMailbox:          cfg.HamMailbox,
+		undetectedMailbox:   cfg.UndetectedMailboxName,
+		fuzzyMailbox:        cfg.FuzzyMailbox,
+		fuzzyFlag:           cfg.FuzzyFlag,
+		fuzzyWeight:         cfg.FuzzyWeight,
+		rspamc:              cfg.Rspamc,
+		forwarder:           cfg.Forwarder,
+		stats:               cfg.Stats,
+		audit:               cfg.Audit,
+		notifier:            cfg.Notifier,
+		spamTreshold:        cfg.SpamTreshold,
+		poll:                newPollScheduler(cfg.MinPollInterval, cfg.MaxPollInterval, cfg.PollJitter),
+		greylistDelay:       cfg.GreylistDelay,
+		deferred:            newDeferralQueue(),
+		backupMailbox:       cfg.BackupMailbox,
+		tempDir:             cfg.TempDir,
+		keepTempFiles:       cfg.KeepTempFiles,
+		shutdownTimeout:     shutdownTimeoutOrDefault(cfg.ShutdownTimeout),
+		dryMode:             cfg.DryRun,
+		rspamdDeliverTo:     cfg.RspamdDeliverTo,
+		rspamdUser:          cfg.RspamdUser,
+		maxMessageSize:      cfg.MaxMessageSize,
+		oversizedAction:     cfg.OversizedAction,
+		tooLargeMailbox:     cfg.TooLargeMailbox,
+		headerPreScan:       cfg.HeaderPreScan,
+		scanResultKey:       []byte(cfg.ScanResultSecret),
+		scannedKeyword:      cfg.ScannedKeyword,
+		folderPolicies:      folderPolicies(cfg.FolderPolicies, cfg.SpamTreshold),
+		scanSearch:          *scanSearch,
+		allowlist:           allowlist,
+		blocklist:           blocklist,
+		degradedFiltering:   cfg.DegradedFiltering,
+		scoreOverrides:      scoreOverrides,
+		partFilters:         cfg.PartFilters,
+		subjectTagger:       tagger,
+		milter:              cfg.ApplyMilterHeaders,
+		deduplicate:         cfg.DeduplicateMessages,
+		backscatterMailbox:  cfg.BackscatterMailbox,
+		backscatterFuzzy:    cfg.BackscatterFuzzy,
+		ownSenders:          ownSenders,
+		spamArchiveMailbox:  cfg.SpamArchiveMailbox,
+		gmail:               cfg.Gmail,
+		spamRetention:       cfg.SpamRetention,
+		scanFailedRetention: cfg.ScanFailedRetention,
+		learnExpiredSpam:    cfg.LearnExpiredSpam,
+		spamLearnedKeyword:  cfg.SpamLearnedKeyword,
+		spamFlags:           cfg.SpamFlags,
+		borderlineFlags:     cfg.BorderlineFlags,
+		borderlineThreshold: cfg.BorderlineThreshold,
+		scanFailedMailbox:   cfg.ScanFailedMailbox,
+		scanFailedKeyword:   cfg.ScanFailedKeyword,
+		maxScanAttempts:     cfg.MaxScanAttempts,
+		failures:            newFailureCounter(),
+		ops:                 make(chan *adminOp),
 	}
 
-	imapCfg := imapclt.Config{
-		Address:       cfg.ServerAddr,
-		User:          cfg.User,
-		Password:      cfg.Password,
-		AllowInsecure: cfg.AllowInsecureIMAPConnection,
-		Logger:        c.logger,
+	c.scanPolicy = c.scanMailboxPolicy()
+	if c.scanPolicy != nil {
+		c.spamTreshold = c.scanPolicy.SpamThreshold
+	}
+
+	if cfg.ScanCacheFile != "" {
+		c.cache = newScanCache(cfg.ScanCacheFile, cfg.ScanCacheTTL)
+		if err := c.cache.load(); err != nil {
+			c.logger.Warn("loading scan cache failed, starting with an empty cache",
+				"error", err, "path", cfg.ScanCacheFile, "event", "cache.load_failed")
+			c.cache = newScanCache(cfg.ScanCacheFile, cfg.ScanCacheTTL)
+		}
 	}
 
 	if cfg.DryRun {
-		c.clt = imapclt.NewDryClient(&imapCfg)
-	} else {
-		c.clt = imapclt.NewClient(&imapCfg)
+		// mails would be forwarded again on every run
+		c.forwarder = nil
+	}
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	var sp *spool.Spool
+	if cfg.SpoolThreshold > 0 || cfg.MemoryBudget > 0 {
+		sp, err = spool.New(&spool.Config{
+			Dir:       cfg.TempDir,
+			Threshold: cfg.SpoolThreshold,
+			Budget:    cfg.MemoryBudget,
+			Logger:    cfg.Logger,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("creating spool failed: %w", err)
+		}
 	}
 
+	c.clt = newMailClient(cfg, sp)
+
 	if err := c.clt.Connect(); err != nil {
 		return nil, err
 	}
 
+	if cfg.CreateMailboxes {
+		if _, err := c.createMailboxes(); err != nil {
+			_ = c.clt.Close()
+			return nil, fmt.Errorf("creating missing mailboxes failed: %w", err)
+		}
+	}
+
+	if cfg.IMAPPoolSize > 0 {
+		c.pool = imapclt.NewPool(&imapclt.PoolConfig[IMAPClient]{
+			Size:        cfg.IMAPPoolSize,
+			IdleTimeout: poolIdleTimeout,
+			New:         func() IMAPClient { return newMailClient(cfg, sp) },
+			Logger:      cfg.Logger,
+		})
+	}
+
+	if cfg.IMAPNotify && cfg.Protocol != ProtocolJMAP {
+		c.notifyCfg = &imapclt.NotifierConfig{
+			Address:        cfg.ServerAddr,
+			User:           cfg.User,
+			Password:       cfg.Password,
+			AllowInsecure:  cfg.AllowInsecureIMAPConnection,
+			ConnectTimeout: cfg.IMAPConnectTimeout,
+			Logger:         cfg.Logger,
+		}
+	}
+
 	return c, nil
 }
 
+// newMailClient returns the client for the mailboxes.
+// IMAP clients buffer the fetched messages with sp.
+func newMailClient(cfg *Config, sp *spool.Spool) IMAPClient {
+	if cfg.Protocol == ProtocolJMAP {
+		jmapCfg := jmapclt.Config{
+			SessionURL: cfg.ServerAddr,
+			User:       cfg.User,
+			Password:   cfg.Password,
+			Token:      cfg.JMAPToken,
+			StateFile:  cfg.JMAPStateFile,
+			Logger:     cfg.Logger,
+		}
+
+		if cfg.DryRun {
+			return jmapclt.NewDryClient(&jmapCfg)
+		}
+		return jmapclt.NewClient(&jmapCfg)
+	}
+
+	imapCfg := imapclt.Config{
+		Address:        cfg.ServerAddr,
+		User:           cfg.User,
+		Password:       cfg.Password,
+		AllowInsecure:  cfg.AllowInsecureIMAPConnection,
+		Compress:       cfg.IMAPCompression,
+		ConnectTimeout: cfg.IMAPConnectTimeout,
+		SelectTimeout:  cfg.IMAPSelectTimeout,
+		FetchTimeout:   cfg.IMAPFetchTimeout,
+		Spool:          sp,
+		Logger:         cfg.Logger,
+	}
+
+	switch {
+	case cfg.DryRun:
+		return imapclt.NewDryClient(&imapCfg)
+	case cfg.Gmail:
+		return imapclt.NewGmailClient(&imapCfg)
+	}
+	return imapclt.NewClient(&imapCfg)
+}
+
 func (c *Client) ProcessHam() error {
+	return c.processHam(c.clt)
+}
+
+func (c *Client) processHam(clt IMAPClient) error {
 	if c.hamMailbox == "" {
 		return nil
 	}
 
-	return c.learn(c.hamMailbox, c.inboxMailbox, c.rspamc.Ham)
+	return c.learn(c.ctx, clt, c.hamMailbox, c.inboxMailbox, audit.ActionLearnHam, c.rspamc.Ham)
 }
 
 func (c *Client) ProcessSpam() error {
+	return c.processSpam(c.clt)
+}
+
+func (c *Client) processSpam(clt IMAPClient) error {
 	if c.undetectedMailbox == "" {
 		return nil
 	}
 
-	return c.learn(c.undetectedMailbox, c.spamMailbox, c.rspamc.Spam)
+	return c.learn(c.ctx, clt, c.undetectedMailbox, c.spamMailbox, audit.ActionLearnSpam, c.rspamc.Spam)
+}
+
+// ProcessFuzzy adds the hashes of all mails in the fuzzy mailbox to the rspamd
+// fuzzy storage and moves them to the spam mailbox.
+func (c *Client) ProcessFuzzy() error {
+	return c.processFuzzy(c.clt)
+}
+
+func (c *Client) processFuzzy(clt IMAPClient) error {
+	if c.fuzzyMailbox == "" {
+		return nil
+	}
+
+	return c.learn(c.ctx, clt, c.fuzzyMailbox, c.spamMailbox, audit.ActionFuzzyAdd, c.fuzzyAdd)
+}
+
+func (c *Client) fuzzyAdd(ctx context.Context, msg io.Reader, hdrs *rspamc.MailHeaders) error {
+	return c.rspamc.FuzzyAdd(ctx, msg, hdrs, c.fuzzyFlag, c.fuzzyWeight)
 }
 
-func (c *Client) learn(srcMailbox, destMailbox string, learnFn learnFn) error {
+// learn passes all messages in srcMailbox to learnFn and moves them to
+// destMailbox afterwards. action is recorded in the audit log for every
+// learned message.
+func (c *Client) learn(ctx context.Context, clt IMAPClient, srcMailbox, destMailbox, action string, learnFn learnFn) (err error) {
 	//nolint:prealloc // number of mails is unknown before iterating
 	var learnedMsgUIDs []uint32
+	var learned []*audit.Entry
+	var bytesRead uint64
+
+	ctx, span := c.tracer.Start(ctx, "iscan.learn", trace.String("mailbox.source", srcMailbox))
+	defer func() {
+		span.SetAttributes(trace.Int("mail.count", int64(len(learnedMsgUIDs))))
+		span.SetError(err)
+		span.End()
+
+		counters := stats.Counters{Learned: uint64(len(learnedMsgUIDs)), Bytes: bytesRead}
+		if err != nil {
+			counters.Errors++
+		}
+		recordStats(c.logger, c.stats, &counters)
+	}()
 
 	logger := c.logger.With("mailbox.source", srcMailbox)
 
 	logger.Info("checking mailbox for new messages to learn")
 
-	for msg, err := range c.clt.Messages(srcMailbox) {
+	for msg, err := range clt.Messages(ctx, srcMailbox, nil) {
 		if err != nil {
+			if ctx.Err() != nil {
+				// move the messages that were already learned
+				break
+			}
 			return fmt.Errorf("fetching messages from imap mailbox failed: %w", err)
 		}
 
 		logger := c.logger.With("mail.subject", msg.Envelope.Subject, "mail.uid", msg.UID)
 		logger.Debug("fetched message")
 
+		_, learnSpan := c.tracer.Start(ctx, "rspamd.learn", trace.Int("mail.uid", int64(msg.UID)))
+		r := countingReader{r: msg.Message}
 		// TODO: retry Check if it failed with a temporary error
 		err = learnFn(
-			context.TODO(),
-			msg.Message,
-			envelopeToRspamcHdrs(&msg.Envelope),
+			ctx,
+			&r,
+			c.rspamcHdrs(&msg.Envelope, netip.Addr{}),
 		)
+		bytesRead += r.n
+		learnSpan.SetError(err)
+		learnSpan.End()
 		if err != nil {
+			if ctx.Err() != nil {
+				logger.Info("learning message was aborted", "error", err,
+					"event", "rspamd.msg_learn_aborted")
+				break
+			}
 			logger.Warn("learning message failed", "error", err,
 				"event", "rspamd.msg_learn_failed")
 			return nil
@@ -159,16 +527,20 @@ func (c *Client) learn(srcMailbox, destMailbox string, learnFn learnFn) error {
 
 		logger.Info("learned message", "event", "rspamd.msg_learned")
 		learnedMsgUIDs = append(learnedMsgUIDs, msg.UID)
+		learned = append(learned, newAuditEntry(srcMailbox, msg.UID, &msg.Envelope, reasonLearned))
 	}
 
+	c.recordAudit(action, "", learned)
+
 	if len(learnedMsgUIDs) == 0 {
 		return nil
 	}
 
-	err := c.clt.Move(learnedMsgUIDs, destMailbox)
+	err = c.move(ctx, clt, learnedMsgUIDs, destMailbox)
 	if err != nil {
 		return fmt.Errorf("moving messages after learning failed: %w", err)
 	}
+	c.recordAudit(audit.ActionMove, destMailbox, learned)
 
 	c.cntProcessedMails.Add(uint64(len(learnedMsgUIDs)))
 
@@ -179,7 +551,9 @@ func asHdrMap(prefix string, scores map[string]*rspamc.Symbol, skipZeroScores bo
 	result := make([]*mail.Header, 0, len(scores))
 
 	for _, v := range scores {
-		if skipZeroScores && v.Score == 0 {
+		// the results of the authentication checks are also
+		// interesting when they do not influence the score
+		if skipZeroScores && v.Score == 0 && !rspamc.IsAuthSymbol(v.Name) {
 			continue
 		}
 
@@ -192,25 +566,75 @@ func asHdrMap(prefix string, scores map[string]*rspamc.Symbol, skipZeroScores bo
 	return result
 }
 
-func addScanResultHeaders(mailFilepath string, result *rspamc.CheckResult) error {
-	var hdrsData []byte
+// addScanResultHeaders adds the scan result headers to the mail at
+// mailFilepath. When [Client.scanResultKey] is set, the score is signed.
+func (c *Client) addScanResultHeaders(mailFilepath, messageID string, result *rspamc.CheckResult) error {
+	// TODO: instead of adding a header line per symbol, add a multiline
+	// header with all symbols
+	hdrs := scanResultHeaders(result)
+	if len(c.scanResultKey) > 0 {
+		hdrs = append(hdrs, &mail.Header{
+			Name: hdrSignature,
+			Body: scanResultSignature(c.scanResultKey, messageID, fmt.Sprint(result.Score)),
+		})
+		sortHeaders(hdrs)
+	}
+
+	hdrsData, err := mail.AsHeaders(hdrs)
+	if err != nil {
+		return err
+	}
+
+	return mail.AddHeaders(mailFilepath, hdrsData)
+}
 
+// scanResultHeaders returns the headers that are added to scanned mails.
+func scanResultHeaders(result *rspamc.CheckResult) []*mail.Header {
 	hdrs := asHdrMap(hdrPrefix+"Symbol-", result.Symbols, true)
 	hdrs = append(hdrs, &mail.Header{
 		Name: hdrRspamdScore,
 		Body: fmt.Sprint(result.Score),
 	})
 
+	if auth := result.AuthSymbols(); len(auth) > 0 {
+		names := make([]string, 0, len(auth))
+		for _, sym := range auth {
+			names = append(names, sym.Name)
+		}
+
+		hdrs = append(hdrs, &mail.Header{
+			Name: hdrRspamdAuth,
+			Body: strings.Join(names, ", "),
+		})
+	}
+
 	sortHeaders(hdrs)
 
-	// TODO: instead of adding a header line per symbol, add a multiline
-	// header with all symbols
-	hdrsData, err := mail.AsHeaders(hdrs)
-	if err != nil {
-		return err
+	return hdrs
+}
+
+// logScanResult logs the result of a scan. The results of the DKIM, SPF and
+// DMARC checks are logged at info level, all symbols at debug level.
+func logScanResult(logger *slog.Logger, result *rspamc.CheckResult, isSpam bool) {
+	logger.Info("message scanned",
+		"scan.score", result.Score,
+		"scan.IsSpam", isSpam,
+		"scan.auth", symbolStrings(result.AuthSymbols()),
+	)
+
+	logger.Debug("scan result symbols",
+		"scan.action", result.Action,
+		"scan.symbols", symbolStrings(result.SortedSymbols()),
+	)
+}
+
+func symbolStrings(symbols []*rspamc.Symbol) []string {
+	result := make([]string, 0, len(symbols))
+	for _, sym := range symbols {
+		result = append(result, sym.String())
 	}
 
-	return mail.AddHeaders(mailFilepath, hdrsData)
+	return result
 }
 
 func sortHeaders(hdrs []*mail.Header) {
@@ -236,12 +660,22 @@ func (c *Client) isSpam(r *rspamc.CheckResult) bool {
 	return r.Score >= c.spamTreshold
 }
 
+// isDeferrable returns true if the verdict for a message with the scan result
+// r must be postponed, because rspamd asked to try again later.
+func (c *Client) isDeferrable(r *rspamc.CheckResult) bool {
+	if c.greylistDelay == 0 {
+		return false
+	}
+
+	return r.Action == actionGreylist || r.Action == actionSoftReject
+}
+
 // replaceWithModifiedMails uploads mails to the spam or inbox mailbox, depending on their
 // spam score.
 // The original email is moved to the backup mailbox.
 // It returns an UIDSet of all successfully uploaded mails.
 // When errors happen, an error **and** a non-empty UIDSet can be returned.
-func (c *Client) replaceWithModifiedMails(mails []*scannedMail) error {
+func (c *Client) replaceWithModifiedMails(ctx context.Context, mails []*scannedMail) error {
 	var errs []error
 
 	for _, mail := range mails {
@@ -252,10 +686,31 @@ func (c *Client) replaceWithModifiedMails(mails []*scannedMail) error {
 			"mail.uid", mail.UID,
 		)
 
+		// in Gmail an uploaded copy would be a separate message in the
+		// conversation, the label of the original is changed instead
+		if mail.Truncated || c.gmail {
+			if err := c.moveOriginal(ctx, mail); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		if c.spamArchiveMailbox != "" && c.isSpam(mail.CheckResult) {
+			// the original is kept in the backup mailbox, the mail
+			// is processed anyways
+			if err := c.archiveSpam(ctx, mail); err != nil {
+				logger.Warn("archiving spam failed",
+					"error", err,
+					"mailbox.destination", c.spamArchiveMailbox,
+					"event", "imap.msg_archive_failed",
+				)
+			}
+		}
+
 		// TODO: support deleting emails from the mailbox, when backupMailbox is
 		// empty instead of keeping a copy of the original, deleting
 		// must happen after appendMail!
-		err := c.clt.Move([]uint32{mail.UID}, c.backupMailbox)
+		err := c.move(ctx, c.clt, []uint32{mail.UID}, c.backupMailbox)
 		if err != nil {
 			errs = append(errs, fmt.Errorf(
 				"moving mail (%d) (%s) to backup mailbox %s failed: %w",
@@ -265,13 +720,17 @@ func (c *Client) replaceWithModifiedMails(mails []*scannedMail) error {
 			continue
 		}
 
-		if c.isSpam(mail.CheckResult) {
-			mbox = c.spamMailbox
-		} else {
-			mbox = c.inboxMailbox
-		}
+		c.recordAudit(audit.ActionMove, c.backupMailbox, []*audit.Entry{
+			newAuditEntry(c.scanMailbox, mail.UID, mail.Envelope, reasonReplaced),
+		})
+
+		// the original is not scanned again, the mail is only
+		// forwarded once
+		c.forwardClean(ctx, mail)
+
+		mbox = c.scanDestination(mail.CheckResult)
 
-		err = c.clt.Upload(mail.Path, mbox, mail.Envelope.Date)
+		err = c.upload(ctx, mail, mbox)
 		if err != nil {
 			errs = append(errs, fmt.Errorf(
 				"uploading email %q (%s) (%s) to %s failed: %w",
@@ -285,6 +744,7 @@ func (c *Client) replaceWithModifiedMails(mails []*scannedMail) error {
 
 			continue
 		}
+		c.recordAudit(audit.ActionUpload, mbox, []*audit.Entry{c.scannedAuditEntry(mail)})
 
 		if c.keepTempFiles {
 			continue
@@ -309,7 +769,123 @@ func (c *Client) replaceWithModifiedMails(mails []*scannedMail) error {
 	return errors.Join(errs...)
 }
 
-func (c *Client) downloadAndScan(msg *imapclt.Message) (*scannedMail, error) {
+// deferVerdict postpones the verdict for the scanned mail sm and leaves it in the
+// scanMailbox until it is rescanned after [Client.greylistDelay].
+func (c *Client) deferVerdict(sm *scannedMail) {
+	c.deferred.add(sm.UID, time.Now().Add(c.greylistDelay))
+
+	c.logger.Info("deferring verdict, message is rescanned later",
+		"mail.subject", sm.Envelope.Subject,
+		"mail.uid", sm.UID,
+		"scan.action", sm.CheckResult.Action,
+		"delay", c.greylistDelay,
+		"event", "rspamd.msg_deferred",
+	)
+
+	c.removeTempFile(sm.Path)
+}
+
+// moveOriginal moves the original of a scanned mail unmodified to the spam or
+// inbox mailbox. It is used for mails that were only partially scanned, the
+// local copy is incomplete and can not replace the original mail, and in
+// Gmail mode.
+func (c *Client) moveOriginal(ctx context.Context, mail *scannedMail) error {
+	mbox := c.scanDestination(mail.CheckResult)
+
+	defer c.removeTempFile(mail.Path)
+
+	if c.isBorderline(mail.CheckResult) {
+		c.addFlags(c.clt, []uint32{mail.UID}, c.borderlineFlags)
+	}
+	c.addFlags(c.clt, []uint32{mail.UID}, c.policyKeywords(mail.CheckResult))
+
+	err := c.move(ctx, c.clt, []uint32{mail.UID}, mbox)
+	if err != nil {
+		return fmt.Errorf(
+			"moving scanned mail (%d) (%s) to %s failed: %w",
+			mail.UID, mail.Envelope.Subject, mbox, err,
+		)
+	}
+	c.recordAudit(audit.ActionMove, mbox, []*audit.Entry{c.scannedAuditEntry(mail)})
+
+	c.forwardClean(ctx, mail)
+
+	c.logger.Info("moved scanned message without adding scan result headers",
+		"mail.truncated", mail.Truncated,
+		"mail.subject", mail.Envelope.Subject,
+		"mail.uid", mail.UID,
+		"mailbox.destination", mbox,
+	)
+
+	return nil
+}
+
+// removeTempFile deletes the file at path, unless [Client.keepTempFiles] is
+// enabled.
+func (c *Client) removeTempFile(path string) {
+	if c.keepTempFiles {
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		c.logger.Warn(
+			"deleting email file failed",
+			"error", err,
+			"event", "imap.msg_delete_failed",
+			"filepath", path,
+		)
+	}
+}
+
+// move moves the messages with the given uids to mailbox via clt.
+// The messages are flagged with the [Client.destinationFlags] of mailbox
+// before.
+func (c *Client) move(ctx context.Context, clt IMAPClient, uids []uint32, mailbox string) error {
+	_, span := c.tracer.Start(ctx, "imap.move",
+		trace.String("mailbox.destination", mailbox),
+		trace.Int("mail.count", int64(len(uids))),
+	)
+	defer span.End()
+
+	c.addFlags(clt, uids, c.destinationFlags(mailbox))
+
+	err := clt.Move(uids, mailbox)
+	span.SetError(err)
+
+	return err
+}
+
+// upload uploads the local copy of mail to mailbox.
+// The internal date and flags of the original message are preserved, the
+// [Client.destinationFlags] of mailbox and the borderline flags are added.
+func (c *Client) upload(ctx context.Context, mail *scannedMail, mailbox string) error {
+	_, span := c.tracer.Start(ctx, "imap.upload",
+		trace.String("mailbox.destination", mailbox),
+		trace.Int("mail.uid", int64(mail.UID)),
+	)
+	defer span.End()
+
+	ts := mail.InternalDate
+	if ts.IsZero() {
+		ts = mail.Envelope.Date
+	}
+
+	flags := appendFlags(slices.Clone(mail.Flags), c.destinationFlags(mailbox)...)
+	if c.isBorderline(mail.CheckResult) {
+		flags = appendFlags(flags, c.borderlineFlags...)
+	}
+	flags = appendFlags(flags, c.policyKeywords(mail.CheckResult)...)
+
+	err := c.clt.Upload(mail.Path, mailbox, ts, flags)
+	span.SetError(err)
+
+	return err
+}
+
+// downloadAndScan stores msg in a temporary file and scans it.
+// If dups is not nil, the result of a copy of msg that was scanned before is
+// reused.
+func (c *Client) downloadAndScan(ctx context.Context, msg *imapclt.Message, dups *duplicates) (*scannedMail, error) {
 	tmpFile, err := os.CreateTemp(
 		c.tempDir,
 		"rspamd-iscan-mail-"+strconv.Itoa(int(msg.UID)),
@@ -332,7 +908,7 @@ func (c *Client) downloadAndScan(msg *imapclt.Message) (*scannedMail, error) {
 		}
 	}
 
-	_, err = io.Copy(tmpFile, msg.Message)
+	size, err := io.Copy(tmpFile, msg.Message)
 	if err != nil {
 		errCleanupfn()
 		return nil, fmt.Errorf("downloading imap message to disk failed: %w", err)
@@ -352,76 +928,428 @@ func (c *Client) downloadAndScan(msg *imapclt.Message) (*scannedMail, error) {
 		errCleanupfn()
 		return nil, fmt.Errorf("setting %q file position to beginning failed: %w", tmpFile.Name(), err)
 	}
-	// TODO: retry Check if it failed with a temporary error
-	scanResult, err := c.rspamc.Check(context.Background(), tmpFile, envelopeToRspamcHdrs(env))
+
+	ip, err := mail.ReceivedIP(tmpFile)
+	if err != nil {
+		logger.Debug("determining sender ip address from received headers failed", "error", err)
+	}
+
+	_, err = tmpFile.Seek(0, 0)
+	if err != nil {
+		errCleanupfn()
+		return nil, fmt.Errorf("setting %q file position to beginning failed: %w", tmpFile.Name(), err)
+	}
+
+	scanResult, err := c.check(ctx, logger, tmpFile, msg, ip, dups)
 	if err != nil {
 		errCleanupfn()
 		return nil, err
 	}
+	scanResult = applyScoreOverride(logger, c.scoreOverrides, env.From, scanResult)
 
 	if err := tmpFile.Close(); err != nil {
 		errCleanupfn()
 		return nil, fmt.Errorf("closing file of downloaded mail failed: %w", err)
 	}
 
-	err = addScanResultHeaders(tmpFile.Name(), scanResult)
-	if err != nil {
-		return nil, fmt.Errorf("adding scan result headers to local mail copy failed: %w", err)
+	// the local copy of truncated mails is not uploaded, headers are not
+	// needed
+	if !msg.Truncated {
+		// the modifications are applied to the original headers, like
+		// an MTA does
+		if edit := milterEdit(scanResult); c.milter && edit != nil {
+			if err := mail.EditHeaders(tmpFile.Name(), edit); err != nil {
+				logger.Warn("applying milter headers failed",
+					"error", err, "event", "iscan.milter_headers_failed")
+			} else {
+				logMilterEdit(logger, edit)
+			}
+		}
+
+		err = c.addScanResultHeaders(tmpFile.Name(), env.MessageID, scanResult)
+		if err != nil {
+			return nil, fmt.Errorf("adding scan result headers to local mail copy failed: %w", err)
+		}
+
+		if c.subjectTagger != nil && c.subjectTagger.matches(scanResult) {
+			err = mail.RewriteSubject(tmpFile.Name(), func(subject string) string {
+				return c.subjectTagger.tag(subject, scanResult.Score)
+			})
+			if err != nil {
+				errCleanupfn()
+				return nil, fmt.Errorf("tagging subject of local mail copy failed: %w", err)
+			}
+			logger.Debug("tagged subject", "event", "iscan.subject_tagged")
+		}
 	}
 
-	logger.Info("message scanned",
-		"scan.score", scanResult.Score, "scan.IsSpam", c.isSpam(scanResult),
-	)
+	logScanResult(logger, scanResult, c.isSpam(scanResult))
 
 	return &scannedMail{
-		Path:        tmpFile.Name(),
-		UID:         msg.UID,
-		Envelope:    env,
-		CheckResult: scanResult,
+		Path:         tmpFile.Name(),
+		UID:          msg.UID,
+		Envelope:     env,
+		CheckResult:  scanResult,
+		Truncated:    msg.Truncated,
+		Size:         size,
+		InternalDate: msg.InternalDate,
+		Flags:        msg.Flags,
 	}, nil
 }
 
-func envelopeToRspamcHdrs(env *imapclt.Envelope) *rspamc.MailHeaders {
+// check returns the rspamd check result for the mail in f.
+// The result of a duplicate in dups is reused first, when the scan cache is
+// enabled the result is looked up in the cache next.
+func (c *Client) check(
+	ctx context.Context,
+	logger *slog.Logger,
+	f *os.File,
+	msg *imapclt.Message,
+	ip netip.Addr,
+	dups *duplicates,
+) (*rspamc.CheckResult, error) {
+	var cacheKey, dupKey string
+
+	// truncated mails are skipped, the result of a partial scan should not
+	// be reused for the complete mail
+	if (c.cache != nil || dups != nil) && !msg.Truncated {
+		key, err := c.messageKey(f, msg)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Envelope.MessageID != "" || msg.GmailMsgID != 0 {
+			dupKey = key
+		}
+
+		if result, exists := dups.get(dupKey); exists {
+			logger.Info("using scan result of duplicate message",
+				"scan.score", result.Score, "mail.envelope.messageID", msg.Envelope.MessageID,
+				"event", "iscan.duplicate")
+			return result, nil
+		}
+
+		if c.cache != nil {
+			cacheKey = key
+			if result, exists := c.cache.get(cacheKey, time.Now()); exists {
+				logger.Debug("using cached scan result",
+					"scan.score", result.Score, "event", "cache.hit")
+				dups.add(dupKey, result)
+				return result, nil
+			}
+		}
+	}
+
+	_, span := c.tracer.Start(ctx, "rspamd.check", trace.Int("mail.uid", int64(msg.UID)))
+	defer span.End()
+
+	// TODO: retry Check if it failed with a temporary error
+	result, err := checkFiltered(ctx, c.rspamc, logger, c.partFilters, f, c.rspamcHdrs(&msg.Envelope, ip))
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttributes(
+		trace.Float("scan.score", float64(result.Score)),
+		trace.String("scan.action", result.Action),
+	)
+
+	// deferred mails must be rescanned, their result is not cached
+	if cacheKey != "" && !c.isDeferrable(result) {
+		c.cache.add(cacheKey, result, time.Now())
+	}
+
+	dups.add(dupKey, result)
+
+	return result, nil
+}
+
+// messageKey returns the key of msg for the deduplication and the scan cache.
+// Messages with a Gmail message ID are identified by it, it is the same for
+// the copies of a message in all mailboxes. Otherwise the key is derived from
+// the Message-ID and the hash of the body in f.
+func (c *Client) messageKey(f *os.File, msg *imapclt.Message) (string, error) {
+	if msg.GmailMsgID != 0 {
+		return "gm:" + strconv.FormatUint(msg.GmailMsgID, 10), nil
+	}
+
+	bodyHash, err := mail.BodyHash(f)
+	if err != nil {
+		return "", fmt.Errorf("hashing mail body failed: %w", err)
+	}
+
+	if _, err = f.Seek(0, 0); err != nil {
+		return "", fmt.Errorf("setting %q file position to beginning failed: %w", f.Name(), err)
+	}
+
+	return scanCacheKey(msg.Envelope.MessageID, bodyHash), nil
+}
+
+// rspamcHdrs returns the headers that are sent with a rspamd request for
+// a mail with the given envelope.
+// ip is the address of the host that delivered the mail, it is omitted
+// when it is invalid.
+func (c *Client) rspamcHdrs(env *imapclt.Envelope, ip netip.Addr) *rspamc.MailHeaders {
 	return &rspamc.MailHeaders{
+		DeliverTo:  c.rspamdDeliverTo,
+		User:       c.rspamdUser,
+		IP:         ip,
 		Subject:    env.Subject,
 		From:       env.From,
 		Recipients: env.Recipients,
 	}
 }
 
-func (c *Client) ProcessScanBox() error {
-	//nolint:prealloc // number of mails is unknown before iterating
-	var scannedMails []*scannedMail
-	var errs []error
+func (c *Client) ProcessScanBox() (err error) {
+	var needBodyUIDs []uint32
+
+	sc := newScanCycle()
+	if c.deduplicate {
+		sc.dups = newDuplicates()
+	}
+
+	ctx, span := c.tracer.Start(c.ctx, "iscan.scan_cycle",
+		trace.String("mailbox.source", c.scanMailbox),
+	)
+	defer func() {
+		span.SetAttributes(
+			trace.Int("mail.scanned_count", int64(len(sc.scanned))),
+			trace.Int("mail.kept_count", int64(sc.kept)),
+			trace.Bool("rspamd.degraded", sc.degraded),
+		)
+		span.SetError(err)
+		span.End()
+
+		counters := c.scanCycleStats(sc, err)
+		recordStats(c.logger, c.stats, counters)
+		notifyCycle(ctx, c.notifier, counters, fmt.Sprintf("moved to %q", c.spamMailbox), err)
+	}()
 
 	logger := c.logger.With("mailbox.source", c.scanMailbox)
 	logger.Info("processing scan box")
 
-	for msg, err := range c.clt.Messages(c.scanMailbox) {
+	// In pre-scan mode only the headers are fetched in the first step,
+	// the complete messages are only fetched when they must be scanned.
+	fetchOpts := imapclt.FetchOptions{
+		MaxBodySize: c.maxMessageSize,
+		HeaderOnly:  c.headerPreScan,
+	}
+
+	if criteria := c.scanSearchCriteria(); !criteria.IsEmpty() {
+		res, err := c.clt.Search(c.scanMailbox, criteria)
 		if err != nil {
-			return fmt.Errorf("fetching messages from scanbox failed: %w", err)
+			return fmt.Errorf("searching messages in scanbox failed: %w", err)
+		}
+
+		// messages that do not match are left in the mailbox
+		sc.kept += res.NumMessages - uint32(len(res.UIDs))
+
+		if len(res.UIDs) == 0 {
+			logger.Debug("scan box contains no matching messages")
+			c.keptMsgCount = sc.kept
+			return nil
 		}
 
-		sm, err := c.downloadAndScan(msg)
+		fetchOpts.UIDs = res.UIDs
+	}
+	// the span includes the processing of the messages, they are fetched
+	// while iterating
+	_, fetchSpan := c.tracer.Start(ctx, "imap.fetch",
+		trace.String("mailbox.source", c.scanMailbox),
+		trace.Bool("header_only", c.headerPreScan),
+	)
+	for msg, err := range c.clt.Messages(ctx, c.scanMailbox, &fetchOpts) {
 		if err != nil {
+			if ctx.Err() != nil {
+				// the already scanned messages are processed
+				sc.errs = append(sc.errs, err)
+				sc.aborted = true
+				break
+			}
+			fetchSpan.SetError(err)
+			fetchSpan.End()
+			return fmt.Errorf("fetching messages from scanbox failed: %w", err)
+		}
+
+		sc.seen[msg.UID] = struct{}{}
+
+		if sc.degraded && !c.degradedFiltering {
+			sc.kept++
+			continue
+		}
+
+		if !c.triage(sc, msg) {
+			continue
+		}
+
+		if c.headerPreScan {
+			needBodyUIDs = append(needBodyUIDs, msg.UID)
+			continue
+		}
+
+		if sc.degraded {
+			sc.kept++
+			continue
+		}
+
+		if err := c.scan(ctx, sc, msg); err != nil {
+			if c.degrade(logger, sc, err) {
+				continue
+			}
 			// TODO: abort on local tmpfile errors immediately,
 			// unlikely that the following mail won't encounter the
 			// same issue
-			errs = append(errs, err)
-			break
+			if err := c.handleScanFailure(ctx, sc, msg, err); err != nil {
+				sc.errs = append(sc.errs, err)
+				sc.aborted = true
+				break
+			}
+		}
+	}
+	fetchSpan.End()
+
+	if len(needBodyUIDs) > 0 {
+		logger.Debug("fetching messages that require scanning", "count", len(needBodyUIDs))
+
+		fetchOpts := imapclt.FetchOptions{
+			MaxBodySize: c.maxMessageSize,
+			UIDs:        needBodyUIDs,
+		}
+		for msg, err := range c.clt.Messages(ctx, c.scanMailbox, &fetchOpts) {
+			if err != nil {
+				if ctx.Err() != nil {
+					sc.errs = append(sc.errs, err)
+					sc.aborted = true
+					break
+				}
+				return fmt.Errorf("fetching messages from scanbox failed: %w", err)
+			}
+
+			if sc.degraded {
+				sc.kept++
+				continue
+			}
+
+			if err := c.scan(ctx, sc, msg); err != nil {
+				if c.degrade(logger, sc, err) {
+					continue
+				}
+				if err := c.handleScanFailure(ctx, sc, msg, err); err != nil {
+					sc.errs = append(sc.errs, err)
+					sc.aborted = true
+					break
+				}
+			}
+		}
+	}
+
+	// when the iteration was aborted, sc.seen does not contain all
+	// messages in the mailbox
+	if !sc.aborted {
+		c.deferred.retain(sc.seen)
+		c.failures.retain(sc.seen)
+	}
+
+	c.moveTriaged(ctx, sc)
+
+	if err := c.replaceWithModifiedMails(ctx, c.keepInPlace(sc)); err != nil {
+		sc.errs = append(sc.errs, err)
+	}
+
+	c.markScanned(ctx, sc)
+	c.flagFailed(ctx, logger, sc)
+	c.keptMsgCount = sc.kept
+
+	if cnt := sc.dups.cnt(); cnt > 0 {
+		logger.Info("scanned duplicate messages only once",
+			"count", cnt, "event", "iscan.duplicates_skipped")
+	}
+
+	c.cntProcessedMails.Add(uint64(len(sc.scanned)))
+
+	if c.cache != nil {
+		if err := c.cache.save(time.Now()); err != nil {
+			logger.Warn("saving scan cache failed",
+				"error", err, "path", c.cache.path, "event", "cache.save_failed")
 		}
 
-		scannedMails = append(scannedMails, sm)
+		hits, misses, entries := c.cache.stats()
+		logger.Info("scan cache statistics",
+			"cache.hits", hits, "cache.misses", misses,
+			"cache.entries", entries,
+		)
+		span.SetAttributes(
+			trace.Int("cache.hits", int64(hits)),
+			trace.Int("cache.misses", int64(misses)),
+		)
+	}
+
+	return errors.Join(sc.errs...)
+}
+
+// scanCycleStats returns the statistics of the scan cycle sc.
+func (c *Client) scanCycleStats(sc *scanCycle, err error) *stats.Counters {
+	result := stats.Counters{
+		Scanned:    uint64(len(sc.scanned)),
+		Duplicates: uint64(sc.dups.cnt()),
+	}
+
+	if sc.degraded {
+		result.Degraded++
+	}
+
+	for _, mail := range sc.scanned {
+		if c.isSpam(mail.CheckResult) {
+			result.Spam++
+		} else {
+			result.Ham++
+		}
+		result.Bytes += uint64(mail.Size)
 	}
 
-	err := c.replaceWithModifiedMails(scannedMails)
 	if err != nil {
-		errs = append(errs, err)
+		result.Errors++
 	}
 
-	c.cntProcessedMails.Add(uint64(len(scannedMails)))
+	return &result
+}
 
-	return errors.Join(errs...)
+// scanSearchCriteria returns the criteria that messages in the scan mailbox
+// must match to be processed.
+func (c *Client) scanSearchCriteria() *imapclt.SearchCriteria {
+	criteria := c.scanSearch
+	if c.scannedKeyword != "" {
+		criteria.NotFlags = append(slices.Clone(criteria.NotFlags), c.scannedKeyword)
+	}
+	if c.scanFailedKeyword != "" {
+		criteria.NotFlags = append(slices.Clone(criteria.NotFlags), c.scanFailedKeyword)
+	}
+
+	return &criteria
+}
+
+// scan downloads and scans msg and records the result in sc.
+func (c *Client) scan(ctx context.Context, sc *scanCycle, msg *imapclt.Message) error {
+	if backscatter, err := c.handleBackscatter(ctx, sc, msg); err != nil || backscatter {
+		return err
+	}
+
+	sm, err := c.downloadAndScan(ctx, msg, sc.dups)
+	if err != nil {
+		return err
+	}
+	c.failures.remove(msg.UID)
+
+	if c.deferred.contains(msg.UID) {
+		c.deferred.remove(msg.UID)
+	} else if c.isDeferrable(sm.CheckResult) {
+		c.deferVerdict(sm)
+		sc.kept++
+		return nil
+	}
+
+	sc.scanned = append(sc.scanned, sm)
+
+	return nil
 }
 
 // Monitor monitors the Unscanned mailbox for new messages and processes them
@@ -436,45 +1364,84 @@ func (c *Client) Monitor() error {
 	c.wgRun.Add(1)
 	defer c.wgRun.Done()
 
-	if err := c.RunOnce(); err != nil {
-		return WrapRetryableError(err)
+	if err := c.runOnce(); err != nil {
+		return c.monitorErr(err)
 	}
 
-	lastLearnAt := time.Now()
+	nextPollAt := time.Now().Add(c.poll.next())
+
+	notifier := c.startNotifier()
+	var notifyCh <-chan *imapclt.EventMailboxChanged
+	if notifier != nil {
+		defer notifier.Close()
+		notifyCh = notifier.Events()
+	}
 
 	for {
-		eventCh, monitorCancelFn, err := c.clt.Monitor(c.scanMailbox)
+		eventCh, monitorCancelFn, err := c.clt.Monitor(c.scanMailbox, c.keptMsgCount)
 		if err != nil {
-			return WrapRetryableError(err)
+			return c.monitorErr(err)
 		}
 
 		c.logger.Debug("waiting for mailbox update events")
 		select {
-		case <-time.After(c.learnInterval - time.Since(lastLearnAt)):
-			c.logger.Debug("learn timer expired, checking mailboxes for new messages")
+		case <-c.deferralTimer():
+			c.logger.Debug("deferral timer expired, rescanning deferred messages")
 
 			if err := monitorCancelFn(); err != nil {
-				return WrapRetryableError(err)
+				return c.monitorErr(err)
+			}
+
+			if err := c.ProcessScanBox(); err != nil {
+				return c.monitorErr(err)
+			}
+
+		case <-time.After(time.Until(nextPollAt)):
+			c.logger.Debug("poll timer expired, checking mailboxes for new messages")
+
+			if err := monitorCancelFn(); err != nil {
+				return c.monitorErr(err)
 			}
 
+			processedCnt := c.cntProcessedMails.Load()
+
 			// sometimes monitoring stopped working and no updates
 			// were send anymore, despite new imap messages, as
 			// workaround we additionally check the Scanbox. //
 			// TODO: verify if that really is still an issue or
 			// could be removed
-			if err := c.ProcessScanBox(); err != nil {
-				return WrapRetryableError(err)
+			if err := c.processMailboxes(); err != nil {
+				return c.monitorErr(err)
 			}
 
-			if err := c.ProcessHam(); err != nil {
-				return WrapRetryableError(err)
+			c.poll.record(c.cntProcessedMails.Load() != processedCnt)
+			nextPollAt = time.Now().Add(c.poll.next())
+			c.logger.Debug("scheduled next poll", "at", nextPollAt)
+
+		case op := <-c.ops:
+			if err := monitorCancelFn(); err != nil {
+				op.done <- err
+				return c.monitorErr(err)
 			}
 
-			if err := c.ProcessSpam(); err != nil {
-				return WrapRetryableError(err)
+			op.run(c.ctx)
+
+		case ev, ok := <-notifyCh:
+			if err := monitorCancelFn(); err != nil {
+				return c.monitorErr(err)
 			}
 
-			lastLearnAt = time.Now()
+			if !ok {
+				c.logger.Warn("NOTIFY connection terminated, polling learn mailboxes",
+					"error", notifier.Err(), "event", "imap.notify_terminated")
+				notifyCh = nil
+				continue
+			}
+
+			c.logger.Debug("learn mailbox changed", "mailbox", ev.Mailbox)
+			if err := c.processLearnMailbox(ev.Mailbox); err != nil {
+				return c.monitorErr(err)
+			}
 
 		case evA, ok := <-eventCh:
 			if !ok {
@@ -484,7 +1451,7 @@ func (c *Client) Monitor() error {
 			}
 
 			if err := monitorCancelFn(); err != nil {
-				return WrapRetryableError(err)
+				return c.monitorErr(err)
 			}
 
 			if evA.NewMsgCount == 0 {
@@ -494,10 +1461,17 @@ func (c *Client) Monitor() error {
 
 			err = c.ProcessScanBox()
 			if err != nil {
-				return WrapRetryableError(err)
+				return c.monitorErr(err)
+			}
+
+			// new messages are arriving, poll the other mailboxes
+			// soon
+			c.poll.record(true)
+			if pollAt := time.Now().Add(c.poll.next()); pollAt.Before(nextPollAt) {
+				nextPollAt = pollAt
 			}
 
-		case <-c.stopCh:
+		case <-c.ctx.Done():
 			if err := monitorCancelFn(); err != nil {
 				return WrapRetryableError(err)
 			}
@@ -507,31 +1481,111 @@ func (c *Client) Monitor() error {
 	}
 }
 
-// RunOnce processes all mails in the ham, spam and scan mailbox once.
-func (c *Client) RunOnce() error {
-	err := c.ProcessHam()
-	if err != nil {
-		return fmt.Errorf("learning ham failed: %w", WrapRetryableError(err))
+// startNotifier establishes the NOTIFY connection for the enabled learn
+// mailboxes. It returns nil if NOTIFY is disabled or can not be used, the
+// learn mailboxes are then only polled.
+func (c *Client) startNotifier() *imapclt.Notifier {
+	if c.notifyCfg == nil {
+		return nil
+	}
+
+	var mailboxes []string
+	for _, t := range c.learnTasks() {
+		if t.enabled && t.mailbox != "" && !slices.Contains(mailboxes, t.mailbox) {
+			mailboxes = append(mailboxes, t.mailbox)
+		}
+	}
+	if len(mailboxes) == 0 {
+		return nil
 	}
 
-	err = c.ProcessSpam()
+	n, err := imapclt.Notify(c.notifyCfg, mailboxes)
 	if err != nil {
-		return fmt.Errorf("learning spam failed: %w", WrapRetryableError(err))
+		if errors.Is(err, imapclt.ErrNotifyUnsupported) {
+			c.logger.Info("NOTIFY can not be used, polling learn mailboxes",
+				"error", err, "event", "imap.notify_unsupported")
+		} else {
+			c.logger.Warn("establishing NOTIFY connection failed, polling learn mailboxes",
+				"error", err, "event", "imap.notify_failed")
+		}
+		return nil
+	}
+
+	return n
+}
+
+// monitorErr returns nil if err happened because [Client.Stop] canceled the
+// in-flight operations, otherwise it returns err wrapped with
+// [WrapRetryableError].
+func (c *Client) monitorErr(err error) error {
+	if c.ctx.Err() != nil {
+		c.logger.Debug("processing was aborted by stop", "error", err)
+		return nil
 	}
 
-	return c.ProcessScanBox()
+	return WrapRetryableError(err)
+}
+
+// deferralTimer returns a channel that receives a value when the next deferred
+// message is due for rescanning.
+// If no messages are deferred, a nil channel is returned.
+func (c *Client) deferralTimer() <-chan time.Time {
+	rescanAt, exists := c.deferred.next()
+	if !exists {
+		return nil
+	}
+
+	return time.After(time.Until(rescanAt))
+}
+
+// RunOnce processes all mails in the ham, spam, fuzzy and scan mailbox once.
+// When [Client.Stop] is called concurrently, the processing is aborted and
+// nil is returned.
+func (c *Client) RunOnce() error {
+	c.wgRun.Add(1)
+	defer c.wgRun.Done()
+
+	if err := c.runOnce(); err != nil && c.ctx.Err() == nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) runOnce() error {
+	return c.processMailboxes()
+}
+
+// closeConns closes the primary connection and the connection pool.
+func (c *Client) closeConns() error {
+	if c.pool == nil {
+		return c.clt.Close()
+	}
+
+	return errors.Join(c.clt.Close(), c.pool.Close())
 }
 
 // Stop closes the connection the IMAP-Server.
-// If [Client.Monitor] is being executed concurrently, it first terminates it
-// gracefully.
+// If [Client.Monitor] or [Client.RunOnce] are being executed concurrently, it
+// cancels their in-flight operations and waits until they terminated.
+// Messages that were already scanned are still moved to their destination
+// mailboxes. If this does not finish within the shutdown timeout, the
+// connection is closed forcefully.
 func (c *Client) Stop() error {
 	var err error
 
 	c.stopOnce.Do(func() {
-		close(c.stopCh)
-		c.wgRun.Wait()
-		err = c.clt.Close()
+		c.cancel()
+
+		if !waitTimeout(&c.wgRun, c.shutdownTimeout) {
+			c.logger.Warn("in-flight operations did not finish in time, closing connection",
+				"timeout", c.shutdownTimeout, "event", "iscan.shutdown_timeout")
+			err = c.closeConns()
+			c.wgRun.Wait()
+			return
+		}
+
+		err = c.closeConns()
 	})
 
 	return err
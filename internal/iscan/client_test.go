@@ -1,16 +1,29 @@
 package iscan
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/imapclt"
 	"github.com/fho/rspamd-iscan/internal/log"
 	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/stats"
 	"github.com/fho/rspamd-iscan/internal/testutils/assert"
 	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
+	"github.com/fho/rspamd-iscan/internal/testutils/jmapserver"
 	"github.com/fho/rspamd-iscan/internal/testutils/mail"
 	"github.com/fho/rspamd-iscan/internal/testutils/mock"
 )
@@ -35,6 +48,8 @@ func testClientCfg(t *testing.T, srv *imapserver.Server) *Config {
 		Logger:                      log.SlogTestLogger(t),
 		Rspamc:                      mock.NewRspamc(),
 		SpamTreshold:                10,
+		MinPollInterval:             30 * time.Second,
+		MaxPollInterval:             30 * time.Minute,
 		TempDir:                     t.TempDir(),
 	}
 }
@@ -71,10 +86,10 @@ func TestProcessScanBox_DownloadAndScanFails(t *testing.T) {
 		},
 	}
 
-	err := clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now())
+	err := clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil)
 	assert.NoError(t, err)
 
-	err = clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now())
+	err = clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil)
 	assert.NoError(t, err)
 
 	err = clt.ProcessScanBox()
@@ -89,7 +104,7 @@ func TestProcessScanBox_DownloadAndScanFails(t *testing.T) {
 
 func TestRun(t *testing.T) {
 	srv, clt := startServerClient(t)
-	clt.learnInterval = 100 * time.Millisecond
+	clt.poll = newPollScheduler(100*time.Millisecond, 100*time.Millisecond, 0)
 
 	runErrChan := make(chan error, 1)
 	go func() {
@@ -98,16 +113,16 @@ func TestRun(t *testing.T) {
 
 	clt2 := newTestClient(t, srv)
 
-	err := clt2.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now())
+	err := clt2.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil)
 	assert.NoError(t, err)
 
-	err = clt2.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now())
+	err = clt2.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil)
 	assert.NoError(t, err)
 
-	err = clt2.clt.Upload(mail.TestHamMailPath(t), srv.HamMailbox, time.Now())
+	err = clt2.clt.Upload(mail.TestHamMailPath(t), srv.HamMailbox, time.Now(), nil)
 	assert.NoError(t, err)
 
-	err = clt2.clt.Upload(mail.TestSpamMailPath(t), srv.UndetectedMailbox, time.Now())
+	err = clt2.clt.Upload(mail.TestSpamMailPath(t), srv.UndetectedMailbox, time.Now(), nil)
 	assert.NoError(t, err)
 
 	for clt.cntProcessedMails.Load() < 4 {
@@ -138,8 +153,197 @@ func TestRun(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRunOnce_ConnectionPool(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	uploadClt := newTestClient(t, srv)
+
+	cfg := testClientCfg(t, srv)
+	cfg.IMAPPoolSize = 2
+	clt, err := NewClient(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	for _, mbox := range []string{srv.ScanMailbox, srv.HamMailbox} {
+		err := uploadClt.clt.Upload(mail.TestHamMailPath(t), mbox, time.Now(), nil)
+		assert.NoError(t, err)
+	}
+	err = uploadClt.clt.Upload(mail.TestSpamMailPath(t), srv.UndetectedMailbox, time.Now(), nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, clt.RunOnce())
+	assert.Equal(t, 3, clt.cntProcessedMails.Load())
+
+	assert.Equal(t, true, mailboxIsEmpty(t, uploadClt.clt, srv.HamMailbox))
+	assert.Equal(t, true, mailboxIsEmpty(t, uploadClt.clt, srv.UndetectedMailbox))
+	assert.Equal(t, 2,
+		mailboxContainsMailCnt(t, uploadClt.clt, srv.InboxMailBox, mail.HamMailSubject),
+	)
+	assert.Equal(t, 1,
+		mailboxContainsMailCnt(t, uploadClt.clt, srv.SpamMailbox, mail.SpamMailSubject),
+	)
+}
+
+func TestProcessLearnMailbox(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	uploadClt := newTestClient(t, srv)
+
+	cfg := testClientCfg(t, srv)
+	cfg.IMAPNotify = true
+	clt, err := NewClient(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	// the test server does not support NOTIFY, the learn mailboxes are
+	// polled
+	assert.Equal(t, true, clt.startNotifier() == nil)
+
+	err = uploadClt.clt.Upload(mail.TestHamMailPath(t), srv.HamMailbox, time.Now(), nil)
+	assert.NoError(t, err)
+	err = uploadClt.clt.Upload(mail.TestSpamMailPath(t), srv.UndetectedMailbox, time.Now(), nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, clt.processLearnMailbox(srv.HamMailbox))
+	assert.Equal(t, true, mailboxIsEmpty(t, uploadClt.clt, srv.HamMailbox))
+	assert.Equal(t, 1,
+		mailboxContainsMailCnt(t, uploadClt.clt, srv.UndetectedMailbox, mail.SpamMailSubject),
+	)
+}
+
+func TestProcessFuzzy(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	uploadClt := newTestClient(t, srv)
+
+	type fuzzyReq struct {
+		subject       string
+		flag, weight  int
+		containsGTUBE bool
+	}
+	var reqs []fuzzyReq
+
+	rspamcMock := mock.NewRspamc()
+	rspamcMock.FuzzyAddFn = func(_ context.Context, r io.Reader, hdrs *rspamc.MailHeaders, flag, weight int) error {
+		data, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		reqs = append(reqs, fuzzyReq{
+			subject:       hdrs.Subject,
+			flag:          flag,
+			weight:        weight,
+			containsGTUBE: bytes.Contains(data, []byte("GTUBE")),
+		})
+		return nil
+	}
+
+	cfg := testClientCfg(t, srv)
+	cfg.Rspamc = rspamcMock
+	cfg.CreateMailboxes = true
+	cfg.FuzzyMailbox = "fuzzy"
+	cfg.FuzzyFlag = 11
+	cfg.FuzzyWeight = 10
+	cfg.SpamLearnedKeyword = "$learned"
+	clt, err := NewClient(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	assert.NoError(t, uploadClt.clt.Upload(mail.TestSpamMailPath(t), "fuzzy", time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessFuzzy())
+	assert.Equal(t, 1, len(reqs))
+	assert.Equal(t, fuzzyReq{subject: mail.SpamMailSubject, flag: 11, weight: 10, containsGTUBE: true}, reqs[0])
+
+	// the message is moved to the spam mailbox and flagged as learned, it
+	// is not learned again from there
+	assert.Equal(t, true, mailboxIsEmpty(t, uploadClt.clt, "fuzzy"))
+	cnt := 0
+	for msg, err := range uploadClt.clt.Messages(context.Background(), srv.SpamMailbox, nil) {
+		assert.NoError(t, err)
+		assert.Equal(t, true, slices.Contains(msg.Flags, "$learned"))
+		cnt++
+	}
+	assert.Equal(t, 1, cnt)
+}
+
+func TestNewClient_CreateMailboxes(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	uploadClt := newTestClient(t, srv)
+
+	cfg := testClientCfg(t, srv)
+	cfg.SpamMailboxName = "Junk/Spam"
+	cfg.CreateMailboxes = true
+	clt, err := NewClient(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	err = uploadClt.clt.Upload(mail.TestSpamMailPath(t), "Junk/Spam", time.Now(), nil)
+	assert.NoError(t, err)
+
+	created, err := clt.createMailboxes()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(created))
+}
+
+func TestRunOnce_SpoolsMessages(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	uploadClt := newTestClient(t, srv)
+
+	cfg := testClientCfg(t, srv)
+	cfg.SpoolThreshold = 1
+	cfg.IMAPPoolSize = 1
+	clt, err := NewClient(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	assert.NoError(t, uploadClt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, uploadClt.clt.Upload(mail.TestSpamMailPath(t), srv.UndetectedMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.RunOnce())
+	assert.Equal(t, 2, clt.cntProcessedMails.Load())
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, uploadClt.clt, srv.InboxMailBox, mail.HamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, uploadClt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+
+	// the spool files were removed
+	spoolFiles, err := filepath.Glob(filepath.Join(cfg.TempDir, "rspamd-iscan-spool-*"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(spoolFiles))
+}
+
+func TestStop_AbortsInFlightCheck(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	checkStarted := make(chan struct{})
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(ctx context.Context, _ io.Reader, _ *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			close(checkStarted)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	clt2 := newTestClient(t, srv)
+	err := clt2.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil)
+	assert.NoError(t, err)
+
+	runErrChan := make(chan error, 1)
+	go func() {
+		runErrChan <- clt.RunOnce()
+	}()
+
+	<-checkStarted
+
+	start := time.Now()
+	assert.NoError(t, clt.Stop())
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("stop took %s", d)
+	}
+	assert.NoError(t, <-runErrChan)
+
+	// the message that was being scanned is left in the scan mailbox
+	assert.Equal(t, 1,
+		mailboxContainsMailCnt(t, clt2.clt, srv.ScanMailbox, mail.HamMailSubject),
+	)
+}
+
 func mailboxIsEmpty(t *testing.T, clt IMAPClient, mailbox string) bool {
-	for _, err := range clt.Messages(mailbox) {
+	for _, err := range clt.Messages(context.Background(), mailbox, nil) {
 		assert.NoError(t, err)
 		return false
 	}
@@ -153,7 +357,7 @@ func mailboxContainsMailCnt(
 	mailSubject string,
 ) int {
 	cnt := 0
-	for msg, err := range clt.Messages(mailbox) {
+	for msg, err := range clt.Messages(context.Background(), mailbox, nil) {
 		assert.NoError(t, err)
 		if msg.Envelope.Subject == mailSubject {
 			cnt++
@@ -162,3 +366,964 @@ func mailboxContainsMailCnt(
 
 	return cnt
 }
+
+func TestProcessScanBox_GreylistedMailsAreDeferred(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.greylistDelay = 200 * time.Millisecond
+
+	checkCnt := 0
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			checkCnt++
+			if checkCnt == 1 {
+				return &rspamc.CheckResult{Action: actionGreylist}, nil
+			}
+			return &rspamc.CheckResult{Action: "no action"}, nil
+		},
+	}
+
+	err := clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, checkCnt)
+	assert.Equal(t, 1, clt.keptMsgCount)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject))
+
+	// the delay did not expire yet, the message is not rescanned
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, checkCnt)
+
+	time.Sleep(clt.greylistDelay)
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 2, checkCnt)
+	assert.Equal(t, 0, clt.keptMsgCount)
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+}
+
+func TestProcessScanBox_AbortedCycleKeepsDeferrals(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.greylistDelay = time.Hour
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			return nil, errors.New("mock err")
+		},
+	}
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	res, err := clt.clt.Search(srv.ScanMailbox, &imapclt.SearchCriteria{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res.UIDs))
+	clt.deferred.add(res.UIDs[1], time.Now().Add(clt.greylistDelay))
+
+	// the cycle is aborted at the first message, the deferral of the
+	// second one that was not reached is kept
+	assert.Error(t, clt.ProcessScanBox())
+	assert.Equal(t, true, clt.deferred.contains(res.UIDs[1]))
+	assert.Equal(t, 0, clt.keptMsgCount)
+
+	clt.rspamc = mock.NewRspamc()
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, clt.keptMsgCount)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.SpamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+}
+
+func TestProcessScanBox_OversizedMails(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.maxMessageSize = 20
+	clt.oversizedAction = OversizedActionMove
+	clt.tooLargeMailbox = srv.BackupMailbox
+
+	err := clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.BackupMailbox, mail.HamMailSubject))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.InboxMailBox))
+
+	clt.oversizedAction = OversizedActionTruncate
+	err = clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+	assert.Equal(t, 0, mailboxContainsMailCnt(t, clt.clt, srv.BackupMailbox, mail.SpamMailSubject))
+}
+
+func TestProcessScanBox_HeaderPreScan(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.headerPreScan = true
+	clt.scanResultKey = []byte("secret")
+	clt.allowlist = []senderPattern{"example.net"}
+
+	checkCnt := 0
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			checkCnt++
+			return mock.CheckFnDefault(ctx, r, hdrs)
+		},
+	}
+
+	hamMail, err := os.ReadFile(mail.TestHamMailPath(t))
+	assert.NoError(t, err)
+	withHeaders := func(name string, hdrs ...string) string {
+		path := filepath.Join(t.TempDir(), name)
+		data := []byte(strings.Join(hdrs, "\r\n") + "\r\n")
+		assert.NoError(t, os.WriteFile(path, append(data, hamMail...), 0o600))
+		return path
+	}
+
+	sig := scanResultSignature(clt.scanResultKey, "signed@example.com", "100")
+	scannedMailPath := withHeaders("scanned.mail",
+		"Message-ID: <signed@example.com>",
+		hdrRspamdScore+": 100",
+		hdrSignature+": "+sig,
+	)
+	// a score header added by the sender, the signature belongs to another
+	// message
+	forgedMailPath := withHeaders("forged.mail",
+		"Message-ID: <forged@example.com>",
+		hdrRspamdScore+": 100",
+		hdrSignature+": "+sig,
+	)
+
+	assert.NoError(t, clt.clt.Upload(scannedMailPath, srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(forgedMailPath, srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	// the sender of the spam mail is allowlisted
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 2, checkCnt)
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.HamMailSubject))
+	assert.Equal(t, 2, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.SpamMailSubject))
+	assert.Equal(t, 2, mailboxContainsMailCnt(t, clt.clt, srv.BackupMailbox, mail.HamMailSubject))
+}
+
+func TestProcessScanBox_HeaderPreScanUnsigned(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.headerPreScan = true
+
+	checkCnt := 0
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			checkCnt++
+			return mock.CheckFnDefault(ctx, r, hdrs)
+		},
+	}
+
+	// without a ScanResultSecret score headers are never trusted
+	spamMail, err := os.ReadFile(mail.TestSpamMailPath(t))
+	assert.NoError(t, err)
+	forgedMailPath := filepath.Join(t.TempDir(), "forged.mail")
+	spamMail = append([]byte(hdrRspamdScore+": -100\r\n"), spamMail...)
+	assert.NoError(t, os.WriteFile(forgedMailPath, spamMail, 0o600))
+	assert.NoError(t, clt.clt.Upload(forgedMailPath, srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, checkCnt)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+}
+
+func TestScanResultHeadersSigned(t *testing.T) {
+	clt := &Client{scanResultKey: []byte("secret")}
+	path := filepath.Join(t.TempDir(), "mail")
+	assert.NoError(t, os.WriteFile(path, []byte("Message-ID: <id@example.com>\r\n\r\nbody"), 0o600))
+
+	assert.NoError(t, clt.addScanResultHeaders(path, "id@example.com", &rspamc.CheckResult{Score: 2.5}))
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	score, found, err := clt.signedScore(&imapclt.Message{
+		Envelope: imapclt.Envelope{MessageID: "id@example.com"},
+		Message:  bytes.NewReader(data),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, true, found)
+	assert.Equal(t, 2.5, score)
+}
+
+func TestProcessScanBox_RspamdRequestHeaders(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	uploadClt := newTestClient(t, srv)
+
+	cfg := testClientCfg(t, srv)
+	cfg.RspamdDeliverTo = "owner@example.net"
+	cfg.RspamdUser = "scanner"
+	rspamcMock := mock.NewRspamc()
+	cfg.Rspamc = rspamcMock
+	clt, err := NewClient(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	spamMail, err := os.ReadFile(mail.TestSpamMailPath(t))
+	assert.NoError(t, err)
+	received := "Received: from localhost (localhost [127.0.0.1]) by mx.example.net\r\n" +
+		"Received: from relay.example.com (relay.example.com [203.0.113.5]) by mx.example.net\r\n" +
+		"Received: from origin.example.org (origin.example.org [198.51.100.7]) by relay.example.com\r\n"
+	path := filepath.Join(t.TempDir(), "received.mail")
+	assert.NoError(t, os.WriteFile(path, append([]byte(received), spamMail...), 0o600))
+	assert.NoError(t, uploadClt.clt.Upload(path, srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+
+	hdrs := rspamcMock.CheckHeaders()
+	assert.Equal(t, 1, len(hdrs))
+
+	expected := (&rspamc.MailHeaders{
+		DeliverTo:  "owner@example.net",
+		User:       "scanner",
+		IP:         netip.MustParseAddr("203.0.113.5"),
+		From:       []string{"sender@example.net"},
+		Recipients: []string{"recipient@example.net"},
+		Subject:    mail.SpamMailSubject,
+	}).Header()
+	assert.Equal(t, len(expected), len(hdrs[0]))
+	for k := range expected {
+		assert.Equal(t, strings.Join(expected.Values(k), ","), strings.Join(hdrs[0].Values(k), ","))
+	}
+
+	// the request headers contain the most recent public hop
+	assert.Equal(t, "203.0.113.5", hdrs[0].Get("IP"))
+}
+
+func TestProcessScanBox_ScanCache(t *testing.T) {
+	srv, clt := startServerClient(t)
+	cachePath := filepath.Join(t.TempDir(), "cache.json")
+	clt.cache = newScanCache(cachePath, time.Hour)
+
+	checkCnt := 0
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			checkCnt++
+			return mock.CheckFnDefault(ctx, r, hdrs)
+		},
+	}
+
+	err := clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, checkCnt)
+
+	// the same mail reappears after a restart
+	clt.cache = newScanCache(cachePath, time.Hour)
+	assert.NoError(t, clt.cache.load())
+
+	err = clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, checkCnt)
+	assert.Equal(t, 1, clt.cache.hits)
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 2, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+}
+
+func TestProcessScanBox_DeduplicateMessages(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.deduplicate = true
+	clt.stats = stats.New(filepath.Join(t.TempDir(), "stats.json"), "test")
+
+	checkCnt := 0
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			checkCnt++
+			return mock.CheckFnDefault(ctx, r, hdrs)
+		},
+	}
+
+	for _, path := range []string{mail.TestSpamMailPath(t), mail.TestSpamMailPath(t), mail.TestHamMailPath(t)} {
+		assert.NoError(t, clt.clt.Upload(path, srv.ScanMailbox, time.Now(), nil))
+	}
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 2, checkCnt)
+	assert.Equal(t, 2, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+
+	counters := clt.stats.Sum("test", time.Now().Add(-time.Hour), time.Now())
+	assert.Equal(t, 3, counters.Scanned)
+	assert.Equal(t, 1, counters.Duplicates)
+}
+
+func TestMessageKey(t *testing.T) {
+	var c Client
+
+	key := func(body string, msg *imapclt.Message) string {
+		f, err := os.CreateTemp(t.TempDir(), "")
+		assert.NoError(t, err)
+		t.Cleanup(func() { _ = f.Close() })
+		_, err = f.WriteString("Subject: test\r\n\r\n" + body)
+		assert.NoError(t, err)
+		_, err = f.Seek(0, 0)
+		assert.NoError(t, err)
+
+		k, err := c.messageKey(f, msg)
+		assert.NoError(t, err)
+		return k
+	}
+
+	msg := imapclt.Message{Envelope: imapclt.Envelope{MessageID: "<1@example.com>"}}
+	if key("a", &msg) == key("b", &msg) {
+		t.Error("messages with different bodies have the same key")
+	}
+
+	// the Gmail message ID identifies the message in all mailboxes
+	msg.GmailMsgID = 1278455344230334865
+	assert.Equal(t, key("a", &msg), key("b", &msg))
+	assert.Equal(t, "gm:1278455344230334865", key("a", &msg))
+}
+
+func TestProcessScanBox_InboxIsScanMailbox(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.inboxMailbox = clt.scanMailbox
+	clt.scannedKeyword = "$rspamdiscanscanned"
+
+	checkCnt := 0
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			checkCnt++
+			return mock.CheckFnDefault(ctx, r, hdrs)
+		},
+	}
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 2, checkCnt)
+	assert.Equal(t, 1, clt.keptMsgCount)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+
+	// the ham mail is flagged and not scanned again
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 2, checkCnt)
+	assert.Equal(t, 1, clt.keptMsgCount)
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 3, checkCnt)
+	assert.Equal(t, 2, clt.keptMsgCount)
+	assert.Equal(t, 2, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject))
+}
+
+func TestProcessScanBox_ScanSearch(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	res, err := clt.clt.Search(srv.ScanMailbox, &imapclt.SearchCriteria{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res.UIDs))
+	assert.NoError(t, clt.clt.AddKeyword(res.UIDs[:1], "$skip"))
+
+	criteria, err := imapclt.ParseSearchCriteria("NOT KEYWORD $skip")
+	assert.NoError(t, err)
+	clt.scanSearch = *criteria
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, clt.keptMsgCount)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+}
+
+func TestProcessScanBox_ScanFailedMailbox(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.scanFailedMailbox = srv.UndetectedMailbox
+	clt.maxScanAttempts = 2
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			if hdrs.Subject == mail.HamMailSubject {
+				return nil, errors.New("mock err")
+			}
+			return mock.CheckFnDefault(ctx, r, hdrs)
+		},
+	}
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	// the failing message blocks the processing of the following one
+	err := clt.ProcessScanBox()
+	var retryableErr *ErrRetryable
+	if !errors.As(err, &retryableErr) {
+		t.Fatalf("expected a retryable error, got: %v", err)
+	}
+	assert.Equal(t, 2, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject)+
+		mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.SpamMailSubject))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.UndetectedMailbox, mail.HamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+}
+
+func TestProcessScanBox_ScanFailedKeyword(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.scanFailedKeyword = "$scanFailed"
+	clt.maxScanAttempts = 1
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			return nil, errors.New("mock err")
+		},
+	}
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, clt.keptMsgCount)
+
+	// the flagged message is not scanned again
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			t.Error("message was scanned again")
+			return &rspamc.CheckResult{}, nil
+		},
+	}
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, clt.keptMsgCount)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject))
+}
+
+func TestProcessScanBox_ScanFailedUnavailable(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.scanFailedMailbox = srv.UndetectedMailbox
+	clt.maxScanAttempts = 1
+
+	scanErrs := []error{
+		fmt.Errorf("%w: connection refused", rspamc.ErrUnavailable),
+		&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+		fmt.Errorf("request failed: %w", context.DeadlineExceeded),
+	}
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			if len(scanErrs) > 0 {
+				err := scanErrs[0]
+				scanErrs = scanErrs[1:]
+				return nil, err
+			}
+			return mock.CheckFnDefault(ctx, r, hdrs)
+		},
+	}
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	// unavailability errors are not counted as failed scan attempts
+	for range 3 {
+		assert.Error(t, clt.ProcessScanBox())
+		assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject))
+	}
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.UndetectedMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+}
+
+func TestProcessScanBox_JMAP(t *testing.T) {
+	srv := jmapserver.StartServer(t)
+
+	clt, err := NewClient(&Config{
+		Protocol:              ProtocolJMAP,
+		ServerAddr:            srv.SessionURL,
+		User:                  srv.UserName,
+		Password:              srv.UserPasswd,
+		ScanMailbox:           srv.ScanMailbox,
+		InboxMailbox:          srv.InboxMailBox,
+		BackupMailbox:         srv.BackupMailbox,
+		HamMailbox:            srv.HamMailbox,
+		SpamMailboxName:       srv.SpamMailbox,
+		UndetectedMailboxName: srv.UndetectedMailbox,
+		Logger:                log.SlogTestLogger(t),
+		Rspamc:                mock.NewRspamc(),
+		SpamTreshold:          10,
+		MinPollInterval:       30 * time.Second,
+		MaxPollInterval:       30 * time.Minute,
+		TempDir:               t.TempDir(),
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+	assert.Equal(t, 2, srv.MessageCount(srv.BackupMailbox))
+}
+
+func TestProcessScanBox_ForwardCleanMails(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	var forwarded [][]byte
+	clt.forwarder = forwarderFn(func(_ context.Context, msg io.Reader) error {
+		data, err := io.ReadAll(msg)
+		forwarded = append(forwarded, data)
+		return err
+	})
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, len(forwarded))
+	assert.Equal(t, true, bytes.Contains(forwarded[0], []byte(mail.HamMailSubject)))
+	assert.Equal(t, true, bytes.Contains(forwarded[0], []byte(hdrRspamdScore)))
+	// forwarded mails are also moved to the inbox
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+}
+
+// failingMoveClient fails to move messages to mailbox.
+type failingMoveClient struct {
+	IMAPClient
+	mailbox string
+}
+
+func (c *failingMoveClient) Move(uids []uint32, mailbox string) error {
+	if mailbox == c.mailbox {
+		return errors.New("move failed")
+	}
+
+	return c.IMAPClient.Move(uids, mailbox)
+}
+
+func TestProcessScanBox_ForwardAfterMove(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	forwardCnt := 0
+	clt.forwarder = forwarderFn(func(context.Context, io.Reader) error {
+		forwardCnt++
+		return nil
+	})
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	// the mail stays in the scan mailbox and is not forwarded, it would be
+	// forwarded again when it is rescanned
+	origClt := clt.clt
+	clt.clt = &failingMoveClient{IMAPClient: origClt, mailbox: srv.BackupMailbox}
+	assert.Error(t, clt.ProcessScanBox())
+	assert.Equal(t, 0, forwardCnt)
+
+	clt.clt = origClt
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, forwardCnt)
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+}
+
+func TestProcessScanBox_ForwardInPlaceAfterFlagging(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	uploadClt := newTestClient(t, srv)
+
+	cfg := testClientCfg(t, srv)
+	cfg.InboxMailbox = srv.ScanMailbox
+	cfg.ScannedKeyword = "$scanned"
+	clt, err := NewClient(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	var forwarded [][]byte
+	clt.forwarder = forwarderFn(func(_ context.Context, msg io.Reader) error {
+		data, err := io.ReadAll(msg)
+		forwarded = append(forwarded, data)
+		return err
+	})
+
+	assert.NoError(t, uploadClt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, len(forwarded))
+	assert.Equal(t, true, bytes.Contains(forwarded[0], []byte(mail.HamMailSubject)))
+
+	// the flagged mail is not scanned and forwarded again
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, len(forwarded))
+}
+
+func TestProcessScanBox_PreservesDateAndFlags(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	date := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, date, []string{`\Seen`}))
+
+	assert.NoError(t, clt.ProcessScanBox())
+
+	cnt := 0
+	for msg, err := range clt.clt.Messages(context.Background(), srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		assert.Equal(t, true, msg.InternalDate.Equal(date))
+		assert.Equal(t, `\Seen`, strings.Join(msg.Flags, ","))
+		cnt++
+	}
+	assert.Equal(t, 1, cnt)
+}
+
+func TestProcessScanBox_Flags(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	uploadClt := newTestClient(t, srv)
+
+	cfg := testClientCfg(t, srv)
+	cfg.SpamFlags = []string{`\Seen`, "$Junk"}
+	cfg.BorderlineFlags = []string{`\Flagged`}
+	cfg.BorderlineThreshold = -1
+	clt, err := NewClient(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	assert.NoError(t, uploadClt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, uploadClt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+
+	flags := func(mailbox string) string {
+		var result []string
+		for msg, err := range uploadClt.clt.Messages(context.Background(), mailbox, nil) {
+			assert.NoError(t, err)
+			// the server returns the flags in random order
+			slices.Sort(msg.Flags)
+			result = append(result, strings.Join(msg.Flags, ","))
+		}
+		return strings.Join(result, ";")
+	}
+
+	assert.Equal(t, `$Junk,\Seen`, flags(srv.SpamMailbox))
+	assert.Equal(t, `\Flagged`, flags(srv.InboxMailBox))
+}
+
+// readAuditLog returns the entries of the audit log file at path.
+func readAuditLog(t *testing.T, path string) []*audit.Entry {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	var entries []*audit.Entry
+	for line := range strings.Lines(string(data)) {
+		var e audit.Entry
+		assert.NoError(t, json.Unmarshal([]byte(line), &e))
+		entries = append(entries, &e)
+	}
+
+	return entries
+}
+
+func TestProcessScanBox_Audit(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	var err error
+	clt.audit, err = audit.Open(&audit.Config{Path: path})
+	assert.NoError(t, err)
+
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.HamMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.NoError(t, clt.ProcessHam())
+	assert.NoError(t, clt.audit.Close())
+
+	entries := readAuditLog(t, path)
+	assert.Equal(t, 4, len(entries))
+
+	assert.Equal(t, audit.ActionMove, entries[0].Action)
+	assert.Equal(t, srv.ScanMailbox, entries[0].Mailbox)
+	assert.Equal(t, srv.BackupMailbox, entries[0].Destination)
+	assert.Equal(t, mail.SpamMailSubject, entries[0].Subject)
+
+	assert.Equal(t, audit.ActionUpload, entries[1].Action)
+	assert.Equal(t, srv.SpamMailbox, entries[1].Destination)
+	assert.Equal(t, reasonSpam, entries[1].Reason)
+	assert.Equal(t, float32(100), *entries[1].Score)
+	assert.Equal(t, entries[0].UID, entries[1].UID)
+
+	assert.Equal(t, audit.ActionLearnHam, entries[2].Action)
+	assert.Equal(t, srv.HamMailbox, entries[2].Mailbox)
+	assert.Equal(t, mail.HamMailSubject, entries[2].Subject)
+
+	assert.Equal(t, audit.ActionMove, entries[3].Action)
+	assert.Equal(t, srv.InboxMailBox, entries[3].Destination)
+	assert.Equal(t, reasonLearned, entries[3].Reason)
+}
+
+func TestProcessScanBox_SpamArchive(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	uploadClt := newTestClient(t, srv)
+
+	cfg := testClientCfg(t, srv)
+	cfg.SpamArchiveMailbox = "Archive"
+	cfg.CreateMailboxes = true
+	clt, err := NewClient(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	assert.NoError(t, uploadClt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, uploadClt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, uploadClt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+
+	var archived []*imapclt.Message
+	for msg, err := range uploadClt.clt.Messages(context.Background(), "Archive", nil) {
+		assert.NoError(t, err)
+		archived = append(archived, msg)
+
+		data, err := io.ReadAll(msg.Message)
+		assert.NoError(t, err)
+		if !bytes.Contains(data, []byte(`filename=`+spamArchiveReportName)) ||
+			!bytes.Contains(data, []byte(`"score": 100`)) {
+			t.Errorf("archived message does not contain the scan result:\n%s", data)
+		}
+	}
+
+	assert.Equal(t, 1, len(archived))
+	assert.Equal(t, mail.SpamMailSubject, archived[0].Envelope.Subject)
+}
+
+func TestProcessScanBox_SubjectTag(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	var err error
+	clt.subjectTagger, err = newSubjectTagger("[SPAM %.1f] %s", 50)
+	assert.NoError(t, err)
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			if hdrs.Subject == mail.HamMailSubject {
+				return &rspamc.CheckResult{Score: 5, Action: actionRewriteSubject}, nil
+			}
+			return mock.CheckFnDefault(ctx, r, hdrs)
+		},
+	}
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, "[SPAM 5.0] "+mail.HamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, "[SPAM 100.0] "+mail.SpamMailSubject))
+	// the originals in the backup mailbox are unmodified
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.BackupMailbox, mail.HamMailSubject))
+}
+
+func TestProcessScanBox_MilterHeaders(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.milter = true
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			return &rspamc.CheckResult{
+				Score: 1,
+				Milter: &rspamc.Milter{
+					AddHeaders: map[string]rspamc.MilterHeaders{
+						"Subject":     {{Value: "rewritten"}},
+						"X-Spamd-Bar": {{Value: "+"}},
+					},
+					RemoveHeaders: map[string]int{"Subject": 0},
+				},
+			}, nil
+		},
+	}
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessScanBox())
+
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, "rewritten"))
+}
+
+func TestProcessSpamMailbox(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.spamLearnedKeyword = "$rspamdIscanSpam"
+
+	var learned []string
+	rspamdMock := mock.NewRspamc()
+	rspamdMock.SpamFn = func(_ context.Context, _ io.Reader, hdrs *rspamc.MailHeaders) error {
+		learned = append(learned, hdrs.Subject)
+		return nil
+	}
+	clt.rspamc = rspamdMock
+
+	// moved to the spam mailbox by the scanner
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessScanBox())
+	// moved unmodified to the spam mailbox after learning
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.UndetectedMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessSpam())
+	// moved to the spam mailbox by the user
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.SpamMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessSpamMailbox())
+	assert.Equal(t, mail.SpamMailSubject+","+mail.HamMailSubject, strings.Join(learned, ","))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.HamMailSubject))
+
+	// learned messages are flagged and not learned again
+	assert.NoError(t, clt.ProcessSpamMailbox())
+	assert.Equal(t, 2, len(learned))
+}
+
+func TestProcessSpamMailbox_MissedSpam(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.spamLearnedKeyword = "$rspamdIscanSpam"
+
+	var learned []string
+	rspamdMock := mock.NewRspamc()
+	rspamdMock.SpamFn = func(_ context.Context, _ io.Reader, hdrs *rspamc.MailHeaders) error {
+		learned = append(learned, hdrs.Subject)
+		return nil
+	}
+	clt.rspamc = rspamdMock
+
+	// the scanner delivers the mail with scan result headers to the inbox
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+
+	// the user moves it to the spam mailbox
+	res, err := clt.clt.Search(srv.InboxMailBox, &imapclt.SearchCriteria{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res.UIDs))
+	assert.NoError(t, clt.clt.Move(res.UIDs, srv.SpamMailbox))
+
+	assert.NoError(t, clt.ProcessSpamMailbox())
+	assert.Equal(t, mail.HamMailSubject, strings.Join(learned, ","))
+}
+
+func TestScanResultHeaders(t *testing.T) {
+	result := rspamc.CheckResult{
+		Score: 1.5,
+		Symbols: map[string]*rspamc.Symbol{
+			"R_SPF_ALLOW":  {Name: "R_SPF_ALLOW", Score: -0.2},
+			"R_DKIM_NA":    {Name: "R_DKIM_NA", Score: 0},
+			"MIME_UNKNOWN": {Name: "MIME_UNKNOWN", Score: 0},
+			"BAYES_SPAM":   {Name: "BAYES_SPAM", Score: 1.7},
+		},
+	}
+
+	var hdrs []string
+	for _, h := range scanResultHeaders(&result) {
+		hdrs = append(hdrs, h.Name+": "+h.Body)
+	}
+
+	assert.Equal(t, strings.Join([]string{
+		hdrRspamdAuth + ": R_DKIM_NA, R_SPF_ALLOW",
+		hdrPrefix + "Symbol-BAYES_SPAM: 1.7",
+		hdrPrefix + "Symbol-R_DKIM_NA: 0",
+		hdrPrefix + "Symbol-R_SPF_ALLOW: -0.2",
+		hdrRspamdScore + ": 1.5",
+	}, "\n"), strings.Join(hdrs, "\n"))
+}
+
+func writeTestBounce(t *testing.T, subject, originalFrom string) string {
+	t.Helper()
+
+	data := "From: MAILER-DAEMON@mx.example.net\r\n" +
+		"To: me@example.com\r\n" +
+		"Return-Path: <>\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"The mail could not be delivered.\r\n" +
+		"--b1\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"From: " + originalFrom + "\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"hello\r\n" +
+		"--b1--\r\n"
+
+	path := filepath.Join(t.TempDir(), "bounce.eml")
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+
+	return path
+}
+
+func TestProcessScanBox_Backscatter(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.backscatterMailbox = srv.BackupMailbox
+	ownSenders, err := parseSenderPatterns([]string{"example.com"})
+	assert.NoError(t, err)
+	clt.ownSenders = ownSenders
+
+	checkCnt := 0
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			checkCnt++
+			return mock.CheckFnDefault(ctx, r, hdrs)
+		},
+	}
+
+	const backscatterSubject = "Undelivered Mail: forged"
+	const ownSubject = "Undelivered Mail: own"
+
+	for _, path := range []string{
+		writeTestBounce(t, backscatterSubject, "spammer@example.net"),
+		writeTestBounce(t, ownSubject, "me@example.com"),
+	} {
+		assert.NoError(t, clt.clt.Upload(path, srv.ScanMailbox, time.Now(), nil))
+	}
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, checkCnt)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.BackupMailbox, backscatterSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, ownSubject))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+}
+
+func TestProcessScanBox_Degraded(t *testing.T) {
+	for _, filtering := range []bool{false, true} {
+		t.Run(fmt.Sprintf("filtering=%t", filtering), func(t *testing.T) {
+			srv, clt := startServerClient(t)
+			// the sender of the spam mail is allowlisted
+			clt.allowlist = []senderPattern{"example.net"}
+			clt.degradedFiltering = filtering
+			clt.scanFailedKeyword = "$failed"
+			clt.maxScanAttempts = 1
+
+			checkCnt := 0
+			clt.rspamc = &mock.Rspamc{
+				CheckFn: func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+					checkCnt++
+					return nil, rspamc.ErrCircuitOpen
+				},
+			}
+
+			assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+			assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+			assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+			assert.NoError(t, clt.ProcessScanBox())
+			assert.Equal(t, 1, checkCnt)
+			assert.Equal(t, 2, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject))
+
+			if filtering {
+				assert.Equal(t, uint32(2), clt.keptMsgCount)
+				assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.SpamMailSubject))
+			} else {
+				assert.Equal(t, uint32(3), clt.keptMsgCount)
+				assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.SpamMailSubject))
+			}
+
+			// the messages were not flagged as failed
+			for msg, err := range clt.clt.Messages(context.Background(), srv.ScanMailbox, nil) {
+				assert.NoError(t, err)
+				assert.Equal(t, false, slices.Contains(msg.Flags, "$failed"))
+			}
+		})
+	}
+}
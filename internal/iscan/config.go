@@ -1,30 +1,111 @@
 package iscan
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"iter"
 	"log/slog"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/fho/rspamd-iscan/internal/audit"
 	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/stats"
+	"github.com/fho/rspamd-iscan/internal/trace"
 )
 
-type IMAPClient interface {
+// MessageSource provides the messages of a mailbox. It is implemented by the
+// IMAP, JMAP and POP3 clients.
+type MessageSource interface {
 	Close() error
 	Connect() error
-	Messages(mailbox string) iter.Seq2[*imapclt.Message, error]
-	Monitor(mailbox string) (<-chan *imapclt.EventNewMessages, func() error, error)
+	Messages(ctx context.Context, mailbox string, opts *imapclt.FetchOptions) iter.Seq2[*imapclt.Message, error]
+}
+
+type IMAPClient interface {
+	MessageSource
+	Monitor(mailbox string, knownMsgCount uint32) (<-chan *imapclt.EventNewMessages, func() error, error)
 	Move(uids []uint32, mailbox string) error
-	Upload(path, mailbox string, ts time.Time) error
+	Search(mailbox string, criteria *imapclt.SearchCriteria) (*imapclt.SearchResult, error)
+	AddKeyword(uids []uint32, keyword string) error
+	Upload(path, mailbox string, ts time.Time, flags []string) error
 }
 
+// OversizedAction defines how messages that exceed the max. message size are
+// processed.
+type OversizedAction string
+
+const (
+	// OversizedActionSkip leaves the messages unscanned in the scan
+	// mailbox.
+	OversizedActionSkip OversizedAction = "skip"
+	// OversizedActionTruncate scans only the beginning of the messages.
+	// The original messages are moved to the spam or inbox mailbox,
+	// scan result headers are not added.
+	OversizedActionTruncate OversizedAction = "truncate"
+	// OversizedActionMove moves the messages unscanned to the too large
+	// mailbox.
+	OversizedActionMove OversizedAction = "move"
+)
+
+// Protocol is the protocol that is used to access the mailboxes.
+type Protocol string
+
+const (
+	ProtocolIMAP Protocol = "imap"
+	// ProtocolJMAP accesses the mailboxes via JMAP, ServerAddr is the
+	// URL of the JMAP session resource.
+	ProtocolJMAP Protocol = "jmap"
+)
+
 type Config struct {
+	// Protocol defaults to [ProtocolIMAP] when it is empty.
+	Protocol                    Protocol
 	ServerAddr                  string
 	AllowInsecureIMAPConnection bool
 	User                        string
 	Password                    string
+	// IMAPCompression enables compressing the IMAP connection if the
+	// server supports it.
+	IMAPCompression bool
+	// IMAPPoolSize is the max. number of additional connections that the
+	// learn mailboxes are processed on, concurrently to the scan mailbox.
+	// If it is 0, all mailboxes are processed one after another on one
+	// connection.
+	IMAPPoolSize int
+	// IMAPNotify enables watching the learn mailboxes for new messages
+	// with the IMAP NOTIFY extension on an additional connection, when the
+	// server supports it. New messages in them are then processed
+	// immediately instead of at the next poll.
+	IMAPNotify bool
+	// Gmail enables the Gmail mode for Gmail accounts, see
+	// [imapclt.GmailClient]. Messages are moved by changing their labels,
+	// they are identified by their Gmail message ID for the deduplication
+	// and the scan cache. Scanned messages are moved unmodified, copies
+	// with the scan result headers are not uploaded.
+	Gmail bool
+	// CreateMailboxes enables creating the configured mailboxes that do
+	// not exist, when the client is created.
+	CreateMailboxes bool
+	// IMAPConnectTimeout, IMAPSelectTimeout and IMAPFetchTimeout are the
+	// timeouts of establishing the IMAP connection including the login,
+	// of selecting a mailbox and of receiving a message, see
+	// [imapclt.Config]. When one is exceeded, the connection is closed
+	// and a retryable error is returned.
+	IMAPConnectTimeout time.Duration
+	IMAPSelectTimeout  time.Duration
+	IMAPFetchTimeout   time.Duration
+	// JMAPToken is sent as bearer token to the JMAP server instead of
+	// authenticating with User and Password.
+	JMAPToken string
+	// JMAPStateFile is the path of the file in which the JMAP client
+	// stores the UIDs that it assigned to the JMAP emails, to keep them
+	// stable across restarts.
+	JMAPStateFile string
 
 	BackupMailbox         string
 	HamMailbox            string
@@ -32,25 +113,319 @@ type Config struct {
 	ScanMailbox           string
 	SpamMailboxName       string
 	UndetectedMailboxName string
+	// FuzzyMailbox is optional, the hashes of mails in the mailbox are
+	// added to the rspamd fuzzy storage and the mails are moved to
+	// SpamMailboxName.
+	FuzzyMailbox string
+	// FuzzyFlag is the fuzzy storage flag that the hashes are added
+	// with.
+	FuzzyFlag int
+	// FuzzyWeight is the weight that hashes are added with.
+	FuzzyWeight int
 
 	TempDir       string
 	KeepTempFiles bool
+	// SpoolThreshold is the size in bytes above which fetched IMAP
+	// messages are buffered in a temporary file in TempDir instead of in
+	// memory.
+	// MemoryBudget is the max. number of bytes of fetched IMAP messages
+	// that are buffered in memory at once, messages that would exceed it
+	// are buffered in a temporary file too.
+	// If both are 0, messages are always buffered in memory.
+	SpoolThreshold int64
+	MemoryBudget   int64
+
+	// MinPollInterval is the interval in which the mailboxes are polled
+	// for new messages while messages are found.
+	// When no messages are found the interval is doubled up to
+	// MaxPollInterval.
+	// Changes in the ScanMailbox are additionally detected via IMAP IDLE.
+	MinPollInterval time.Duration
+	MaxPollInterval time.Duration
+	// PollJitter is the upper limit of a random duration that is added
+	// to every poll interval.
+	PollJitter time.Duration
+	// ShutdownTimeout is the max. duration that [Client.Stop] waits for
+	// canceled operations to finish, before the connection is closed
+	// forcefully. If it is 0, 30s are used.
+	ShutdownTimeout time.Duration
 
 	SpamTreshold float32
+	// MaxMessageSize is the max. size of a message in bytes that is
+	// fetched from the scan mailbox. Bigger messages are processed
+	// according to OversizedAction.
+	// If it is 0, the size is not limited.
+	MaxMessageSize  int64
+	OversizedAction OversizedAction
+	// TooLargeMailbox is the mailbox that messages are moved to if
+	// OversizedAction is [OversizedActionMove].
+	TooLargeMailbox string
+
+	// HeaderPreScan enables fetching only the headers of messages in the
+	// scan mailbox first. Complete messages are only fetched when the
+	// local checks do not decide how to process them.
+	// When enabled and ScanResultSecret is set, messages that already
+	// contain a scan result header with a valid signature are moved
+	// according to their score without scanning them again.
+	HeaderPreScan bool
+	// ScanResultSecret is optional, when it is set the scan result headers
+	// are signed with it, see [hdrSignature].
+	ScanResultSecret string
+	// AllowlistSenders and BlocklistSenders are lists of sender
+	// addresses ("user@example.com"), domains ("example.com") or
+	// subdomain wildcards ("*.example.com").
+	// Messages in the scan mailbox from a sender on the allowlist are moved
+	// unscanned to the InboxMailbox, messages from senders on the
+	// blocklist to the SpamMailbox.
+	// The sender is taken from the From header, which can be spoofed.
+	AllowlistSenders []string
+	BlocklistSenders []string
+	// DegradedFiltering enables processing the messages of allowlisted
+	// and blocklisted senders while rspamd is unavailable, i.e. the
+	// circuit breaker of the [RspamdClient] is open. Otherwise all
+	// messages are left in the scan mailbox until rspamd recovers.
+	DegradedFiltering bool
+
+	// ScannedKeyword is optional, when it is set messages that are
+	// processed but left in the ScanMailbox are flagged with the keyword
+	// and excluded from following scans.
+	// When it is set, ScanMailbox and InboxMailbox can be the same
+	// mailbox, ham is then left in place without adding scan result
+	// headers.
+	ScannedKeyword string
+	// FolderPolicies are optional, the messages in the mailboxes that
+	// match one of them are scanned additionally to the ScanMailbox and
+	// processed as defined by the first matching policy. Mailboxes of
+	// all namespaces are matched, e.g. shared mailboxes, the configured
+	// mailboxes are skipped. Scanned messages are flagged with the
+	// ScannedKeyword, it is required.
+	// The policy that matches the InboxMailbox, or else the ScanMailbox,
+	// applies to the messages in the ScanMailbox: its SpamThreshold
+	// replaces SpamTreshold and with the tag action spam is delivered to
+	// the InboxMailbox flagged with the Keywords.
+	FolderPolicies []*FolderPolicy
+	// SpamLearnedKeyword is optional, when it is set messages that are
+	// moved to the SpamMailboxName by the user are learned as spam.
+	// Messages that the scanner moves there and learned ones are flagged
+	// with the keyword.
+	SpamLearnedKeyword string
+	// SpamFlags are optional flags, e.g. \Seen, or keywords that are
+	// added to messages that the scanner moves or uploads to the
+	// SpamMailboxName.
+	SpamFlags []string
+	// BorderlineFlags are optional flags or keywords that are added to
+	// scanned ham with a score >= BorderlineThreshold, e.g. \Flagged.
+	BorderlineFlags     []string
+	BorderlineThreshold float32
+	// ScanSearch is an optional IMAP search expression, only messages in
+	// the ScanMailbox that match it are processed, e.g.
+	// "UNSEEN SINCE 7d". The syntax is described at
+	// [imapclt.ParseSearchCriteria].
+	ScanSearch string
+	// ScoreOverrides is optional, it maps sender patterns (see
+	// AllowlistSenders) to values that are added to the rspamd score of
+	// mails from matching senders before the verdict is made.
+	// When multiple patterns match, the most specific one is applied.
+	ScoreOverrides map[string]float32
+	// PartFilters are optional, the bodies of MIME parts that match a
+	// filter are stripped or truncated before the mail is sent to rspamd,
+	// e.g. to not send large video attachments. The mails in the mailboxes
+	// are not modified.
+	PartFilters []*mail.PartFilter
+	// SubjectTag is optional, when it is set the subjects of mails for
+	// which rspamd returned the "rewrite subject" action, or whose score
+	// is >= SubjectTagThreshold, are rewritten before the mails are
+	// uploaded. It is a fmt format string that is formatted with the
+	// score and the original subject, e.g. "[SPAM %.1f] %s".
+	SubjectTag string
+	// SubjectTagThreshold is optional, if it is 0 only the rspamd action
+	// decides if a subject is tagged.
+	SubjectTagThreshold float32
+	// ApplyMilterHeaders enables applying the header modifications that
+	// rspamd returns in the milter section of its response, e.g. the ones
+	// of the milter_headers module, to the uploaded mails.
+	ApplyMilterHeaders bool
+	// DeduplicateMessages enables scanning messages that are contained
+	// multiple times in the ScanMailbox only once per scan cycle, the
+	// result is applied to all copies. Copies have the same Message-ID
+	// and body. Copies in later cycles are detected by the scan cache.
+	DeduplicateMessages bool
+
+	// BackscatterMailbox is optional, when it is set bounces of messages
+	// that were not sent from one of the OwnSenders are moved to it
+	// without being scanned. Bounces are messages with a null
+	// Return-Path, an Auto-Submitted header or a multipart/report
+	// content type. Bounces that do not contain the original message
+	// are scanned.
+	BackscatterMailbox string
+	// BackscatterFuzzy enables adding the bounces that are moved to the
+	// BackscatterMailbox to the fuzzy storage with FuzzyFlag and
+	// FuzzyWeight.
+	BackscatterFuzzy bool
+	// OwnSenders are the patterns of the addresses that mails are sent
+	// from, in the same format as AllowlistSenders.
+	OwnSenders []string
+
+	// SpamArchiveMailbox is optional, when it is set a copy of every
+	// scanned spam message is uploaded to it, before the message is moved
+	// to the SpamMailbox. The copy contains the message as attachment,
+	// followed by the rspamd scan result as JSON attachment.
+	// Partially scanned messages are not archived.
+	SpamArchiveMailbox string
+
+	// ScanFailedMailbox is optional, when it is set messages whose scan
+	// failed MaxScanAttempts times in a row are moved to it.
+	ScanFailedMailbox string
+	// ScanFailedKeyword is optional, when it is set messages whose scan
+	// failed MaxScanAttempts times in a row are flagged with the keyword
+	// and excluded from following scans.
+	// It can not be used together with ScanFailedMailbox.
+	ScanFailedKeyword string
+	// MaxScanAttempts is the number of times that scanning a message can
+	// fail, before it is moved to ScanFailedMailbox or flagged with
+	// ScanFailedKeyword. Failures because a service is unavailable are
+	// not counted.
+	MaxScanAttempts int
+
+	// SpamRetention and ScanFailedRetention are the ages after which
+	// messages in the SpamMailboxName, respectively the
+	// ScanFailedMailbox, are deleted permanently. The age is determined
+	// by the internal date, it is rounded up to full days.
+	// If they are 0, messages are kept.
+	SpamRetention       time.Duration
+	ScanFailedRetention time.Duration
+	// LearnExpiredSpam enables learning expired messages in the
+	// SpamMailboxName as spam before they are deleted.
+	LearnExpiredSpam bool
+
+	// GreylistDelay is the duration after which mails for which rspamd
+	// returned a greylist or soft reject action are rescanned. The mails
+	// are left in the ScanMailbox until then.
+	// If it is 0, the action is not handled differently.
+	GreylistDelay time.Duration
+
+	// ScanCacheFile is optional, when it is set the check results of
+	// scanned messages are stored in the file. Messages with the same
+	// Message-ID and body that are found again in the ScanMailbox within
+	// ScanCacheTTL are not sent to rspamd again.
+	ScanCacheFile string
+	ScanCacheTTL  time.Duration
+
+	// RspamdDeliverTo is sent as Deliver-To header with every rspamd
+	// request, it enables per-user settings and bayes statistics.
+	RspamdDeliverTo string
+	// RspamdUser is sent as User header with every rspamd request when it
+	// is not empty. Rspamd considers those mails as sent by an
+	// authenticated user.
+	RspamdUser string
+
+	// Forwarder is optional, when it is set clean mails from the
+	// ScanMailbox are additionally forwarded after they were scanned.
+	Forwarder Forwarder
+	// Stats is optional, when it is set the counters of processed mails
+	// are recorded in it.
+	Stats *stats.Store
+	// Audit is optional, when it is set every modification of a message
+	// and every learned message is recorded in it.
+	Audit *audit.Log
+	// Notifier is optional, when it is set it is informed about the
+	// result of every scan cycle.
+	Notifier Notifier
 
 	Logger *slog.Logger
+	// Tracer is optional, when it is set spans are recorded for scan and
+	// learn cycles.
+	Tracer *trace.Tracer
 	Rspamc RspamdClient
 
 	DryRun bool
 }
 
 func (c *Config) validate() error {
+	switch c.Protocol {
+	case "", ProtocolIMAP, ProtocolJMAP:
+	default:
+		return fmt.Errorf("invalid Protocol: %q", c.Protocol)
+	}
+
+	if c.CreateMailboxes && c.Protocol == ProtocolJMAP {
+		return errors.New("CreateMailboxes is not supported with the JMAP protocol")
+	}
+
+	if c.Gmail && c.Protocol == ProtocolJMAP {
+		return errors.New("Gmail is not supported with the JMAP protocol")
+	}
+
 	if c.SpamTreshold <= 0 {
 		return errors.New("SpamTreshold must be >0")
 	}
 
-	if c.ScanMailbox == c.InboxMailbox {
-		return errors.New("ScanMailbox and InboxMailbox must differ")
+	if c.ScanMailbox == c.InboxMailbox && c.ScannedKeyword == "" {
+		return errors.New("ScanMailbox and InboxMailbox must differ, when ScannedKeyword is not set")
+	}
+
+	if c.ScannedKeyword != "" && !isValidKeyword(c.ScannedKeyword) {
+		return fmt.Errorf("invalid ScannedKeyword: %q", c.ScannedKeyword)
+	}
+
+	if len(c.FolderPolicies) != 0 {
+		if c.Protocol == ProtocolJMAP {
+			return errors.New("FolderPolicies are not supported with the JMAP protocol")
+		}
+
+		if c.ScannedKeyword == "" {
+			return errors.New("ScannedKeyword is required when FolderPolicies are set")
+		}
+
+		for i, p := range c.FolderPolicies {
+			if err := p.validate(); err != nil {
+				return fmt.Errorf("FolderPolicies[%d]: %w", i, err)
+			}
+		}
+	}
+
+	if c.SpamLearnedKeyword != "" && !isValidKeyword(c.SpamLearnedKeyword) {
+		return fmt.Errorf("invalid SpamLearnedKeyword: %q", c.SpamLearnedKeyword)
+	}
+
+	for _, f := range slices.Concat(c.SpamFlags, c.BorderlineFlags) {
+		if !isValidFlag(f) {
+			return fmt.Errorf("invalid flag: %q", f)
+		}
+	}
+
+	if len(c.BorderlineFlags) > 0 && c.BorderlineThreshold >= c.SpamTreshold {
+		return errors.New("BorderlineThreshold must be smaller than SpamTreshold")
+	}
+
+	if c.ScanFailedMailbox != "" || c.ScanFailedKeyword != "" {
+		if c.ScanFailedMailbox != "" && c.ScanFailedKeyword != "" {
+			return errors.New("ScanFailedMailbox and ScanFailedKeyword can not be used together")
+		}
+
+		if c.ScanFailedMailbox == c.ScanMailbox {
+			return errors.New("ScanMailbox and ScanFailedMailbox must differ")
+		}
+
+		if c.ScanFailedKeyword != "" && !isValidKeyword(c.ScanFailedKeyword) {
+			return fmt.Errorf("invalid ScanFailedKeyword: %q", c.ScanFailedKeyword)
+		}
+
+		if c.MaxScanAttempts <= 0 {
+			return errors.New("MaxScanAttempts must be >0")
+		}
+	}
+
+	if c.SpamRetention < 0 || c.ScanFailedRetention < 0 {
+		return errors.New("SpamRetention and ScanFailedRetention must not be negative")
+	}
+
+	if c.ScanFailedRetention > 0 && c.ScanFailedMailbox == "" {
+		return errors.New("ScanFailedMailbox is required when ScanFailedRetention is set")
+	}
+
+	if c.LearnExpiredSpam && c.SpamRetention == 0 {
+		return errors.New("SpamRetention is required when LearnExpiredSpam is enabled")
 	}
 
 	if c.ScanMailbox == c.UndetectedMailboxName {
@@ -61,6 +436,100 @@ func (c *Config) validate() error {
 		return errors.New("ScanMailbox and HamMailbox must differ")
 	}
 
+	if c.FuzzyMailbox != "" {
+		if c.ScanMailbox == c.FuzzyMailbox {
+			return errors.New("ScanMailbox and FuzzyMailbox must differ")
+		}
+
+		if c.FuzzyMailbox == c.SpamMailboxName {
+			return errors.New("FuzzyMailbox and SpamMailbox must differ")
+		}
+
+		if c.FuzzyFlag <= 0 {
+			return errors.New("FuzzyFlag must be >0")
+		}
+	}
+
+	if c.BackscatterMailbox != "" {
+		if c.BackscatterMailbox == c.ScanMailbox {
+			return errors.New("ScanMailbox and BackscatterMailbox must differ")
+		}
+
+		if len(c.OwnSenders) == 0 {
+			return errors.New("OwnSenders can not be empty when BackscatterMailbox is set")
+		}
+
+		if c.BackscatterFuzzy && c.FuzzyFlag <= 0 {
+			return errors.New("FuzzyFlag must be >0 when BackscatterFuzzy is enabled")
+		}
+	} else if c.BackscatterFuzzy {
+		return errors.New("BackscatterFuzzy requires BackscatterMailbox")
+	}
+
+	if c.SpamArchiveMailbox != "" && c.SpamArchiveMailbox == c.ScanMailbox {
+		return errors.New("ScanMailbox and SpamArchiveMailbox must differ")
+	}
+
+	if c.MinPollInterval <= 0 {
+		return errors.New("MinPollInterval must be >0")
+	}
+
+	if c.MaxPollInterval < c.MinPollInterval {
+		return errors.New("MaxPollInterval must be >=MinPollInterval")
+	}
+
+	if c.PollJitter < 0 {
+		return errors.New("PollJitter must be >=0")
+	}
+
+	if c.SpoolThreshold < 0 {
+		return errors.New("SpoolThreshold must be >=0")
+	}
+
+	if c.MemoryBudget < 0 {
+		return errors.New("MemoryBudget must be >=0")
+	}
+
+	if c.MaxMessageSize < 0 {
+		return errors.New("MaxMessageSize must be >=0")
+	}
+
+	if c.MaxMessageSize > 0 {
+		switch c.OversizedAction {
+		case OversizedActionSkip, OversizedActionTruncate:
+		case OversizedActionMove:
+			if c.TooLargeMailbox == "" {
+				return errors.New("TooLargeMailbox can not be empty when OversizedAction is move")
+			}
+
+			if c.TooLargeMailbox == c.ScanMailbox {
+				return errors.New("ScanMailbox and TooLargeMailbox must differ")
+			}
+		default:
+			return fmt.Errorf("invalid OversizedAction: %q", c.OversizedAction)
+		}
+	}
+
+	if c.GreylistDelay < 0 {
+		return errors.New("GreylistDelay must be >=0")
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return errors.New("ShutdownTimeout must be >=0")
+	}
+
+	if c.IMAPPoolSize < 0 {
+		return errors.New("IMAPPoolSize must be >=0")
+	}
+
+	if c.IMAPConnectTimeout < 0 || c.IMAPSelectTimeout < 0 || c.IMAPFetchTimeout < 0 {
+		return errors.New("IMAP timeouts must be >=0")
+	}
+
+	if c.ScanCacheFile != "" && c.ScanCacheTTL <= 0 {
+		return errors.New("ScanCacheTTL must be >0")
+	}
+
 	if c.BackupMailbox == "" {
 		return errors.New("BackupMailbox can not be empty")
 	}
@@ -88,5 +557,42 @@ func (c *Config) validate() error {
 		return errors.New("rspamc can not be nil")
 	}
 
+	if err := validatePartFilters(c.PartFilters); err != nil {
+		return err
+	}
+
 	return nil
 }
+
+// isValidKeyword returns true if s is a valid IMAP keyword: an atom that is
+// not a system flag.
+// (https://datatracker.ietf.org/doc/html/rfc3501#section-9)
+// settableSystemFlags are the system flags that can be configured to be added
+// to messages.
+var settableSystemFlags = []string{`\Seen`, `\Flagged`, `\Answered`, `\Draft`}
+
+// isValidFlag returns true if s is a keyword or one of the
+// [settableSystemFlags].
+func isValidFlag(s string) bool {
+	if strings.HasPrefix(s, `\`) {
+		return slices.ContainsFunc(settableSystemFlags, func(f string) bool {
+			return strings.EqualFold(f, s)
+		})
+	}
+
+	return isValidKeyword(s)
+}
+
+func isValidKeyword(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, r := range s {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`(){%*"\]`, r) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,51 @@
+package iscan
+
+import "github.com/fho/rspamd-iscan/internal/rspamc"
+
+// duplicates records the check results of the messages of a scan cycle, to
+// scan messages that are contained multiple times in the scan mailbox only
+// once, e.g. because they were delivered to multiple aliases.
+// Messages are identified by their Message-ID and the hash of their body, the
+// same key that [scanCache] uses. Messages without a Message-ID are always
+// scanned.
+// A nil *duplicates disables the deduplication.
+type duplicates struct {
+	results map[string]*rspamc.CheckResult
+	// count is the number of messages whose result was reused.
+	count int
+}
+
+func newDuplicates() *duplicates {
+	return &duplicates{results: map[string]*rspamc.CheckResult{}}
+}
+
+// get returns the result of a previous copy of the message with key.
+func (d *duplicates) get(key string) (*rspamc.CheckResult, bool) {
+	if d == nil || key == "" {
+		return nil, false
+	}
+
+	result, exists := d.results[key]
+	if exists {
+		d.count++
+	}
+
+	return result, exists
+}
+
+func (d *duplicates) add(key string, result *rspamc.CheckResult) {
+	if d == nil || key == "" {
+		return
+	}
+
+	d.results[key] = result
+}
+
+// cnt returns the number of messages whose result was reused.
+func (d *duplicates) cnt() int {
+	if d == nil {
+		return 0
+	}
+
+	return d.count
+}
@@ -0,0 +1,63 @@
+package iscan
+
+import (
+	"time"
+)
+
+// deferralQueue records messages whose verdict is postponed until they have
+// been rescanned after a delay.
+type deferralQueue struct {
+	// entries maps the UIDs of messages to the time at which they are
+	// rescanned.
+	entries map[uint32]time.Time
+}
+
+func newDeferralQueue() *deferralQueue {
+	return &deferralQueue{entries: map[uint32]time.Time{}}
+}
+
+// add queues the message with the given uid for rescanning at rescanAt.
+func (q *deferralQueue) add(uid uint32, rescanAt time.Time) {
+	q.entries[uid] = rescanAt
+}
+
+// remove removes the message with the given uid from the queue.
+func (q *deferralQueue) remove(uid uint32) {
+	delete(q.entries, uid)
+}
+
+// contains returns true if the message with the given uid is in the queue.
+func (q *deferralQueue) contains(uid uint32) bool {
+	_, exists := q.entries[uid]
+	return exists
+}
+
+// isPending returns true if the message with the given uid is in the queue and
+// is not due yet for rescanning.
+func (q *deferralQueue) isPending(uid uint32, now time.Time) bool {
+	rescanAt, exists := q.entries[uid]
+	return exists && now.Before(rescanAt)
+}
+
+// retain removes all messages from the queue whose uids are not in uids.
+func (q *deferralQueue) retain(uids map[uint32]struct{}) {
+	for uid := range q.entries {
+		if _, exists := uids[uid]; !exists {
+			delete(q.entries, uid)
+		}
+	}
+}
+
+// next returns the earliest time at which a message is due for rescanning.
+// If the queue is empty, false is returned.
+func (q *deferralQueue) next() (time.Time, bool) {
+	var result time.Time
+
+	for _, rescanAt := range q.entries {
+		if result.IsZero() || rescanAt.Before(result) {
+			result = rescanAt
+		}
+	}
+
+	return result, !result.IsZero()
+}
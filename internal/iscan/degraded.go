@@ -0,0 +1,30 @@
+package iscan
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// degrade switches sc into degraded mode, if err happened because rspamd is
+// unavailable. In degraded mode the remaining messages are left in the scan
+// mailbox, without counting them as failed scans. Only allowlisted and
+// blocklisted messages are processed, if [Client.degradedFiltering] is
+// enabled.
+// It returns false if err has another cause.
+func (c *Client) degrade(logger *slog.Logger, sc *scanCycle, err error) bool {
+	if !errors.Is(err, rspamc.ErrCircuitOpen) {
+		return false
+	}
+
+	sc.kept++
+
+	if !sc.degraded {
+		sc.degraded = true
+		logger.Warn("rspamd is unavailable, messages are not scanned until it recovers",
+			"sender_filtering", c.degradedFiltering, "event", "iscan.degraded")
+	}
+
+	return true
+}
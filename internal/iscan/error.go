@@ -5,6 +5,8 @@ import (
 	"log/slog"
 	"net"
 	"strings"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
 )
 
 type ErrRetryable struct {
@@ -22,6 +24,11 @@ func (e *ErrRetryable) UnwrapError() error {
 func WrapRetryableError(err error) error {
 	var ne *net.OpError
 
+	// the connection was closed, a new one must be established
+	if errors.Is(err, imapclt.ErrTimeout) {
+		return &ErrRetryable{err: err}
+	}
+
 	if strings.Contains(err.Error(), "use of closed network connection") {
 		return &ErrRetryable{err: err}
 	}
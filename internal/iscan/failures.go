@@ -0,0 +1,144 @@
+package iscan
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/clamav"
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/trace"
+)
+
+// failureCounter counts the consecutive failed scan attempts of messages.
+type failureCounter struct {
+	// counts maps the UIDs of messages to the number of failed attempts.
+	counts map[uint32]int
+}
+
+func newFailureCounter() *failureCounter {
+	return &failureCounter{counts: map[uint32]int{}}
+}
+
+// add records a failed attempt for the message with the given uid and returns
+// the number of failed attempts.
+func (f *failureCounter) add(uid uint32) int {
+	f.counts[uid]++
+	return f.counts[uid]
+}
+
+// remove resets the count of the message with the given uid.
+func (f *failureCounter) remove(uid uint32) {
+	delete(f.counts, uid)
+}
+
+// retain removes the counts of all messages whose uids are not in uids.
+func (f *failureCounter) retain(uids map[uint32]struct{}) {
+	for uid := range f.counts {
+		if _, exists := uids[uid]; !exists {
+			delete(f.counts, uid)
+		}
+	}
+}
+
+// deadLettersEnabled returns true if messages whose scan failed repeatedly are
+// moved or flagged.
+func (c *Client) deadLettersEnabled() bool {
+	return c.scanFailedMailbox != "" || c.scanFailedKeyword != ""
+}
+
+// isUnavailableErr returns true if err happened because a scanner or the
+// server could not be reached or did not respond in time, instead of being
+// caused by the message.
+func isUnavailableErr(err error) bool {
+	var netErr net.Error
+
+	return errors.Is(err, rspamc.ErrUnavailable) ||
+		errors.Is(err, clamav.ErrUnavailable) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr)
+}
+
+// handleScanFailure records that scanning msg failed with err.
+// Only failures that are specific to the message are counted, see
+// [isUnavailableErr].
+// When it failed [Client.maxScanAttempts] times, the message is recorded in sc
+// to be moved to [Client.scanFailedMailbox] or flagged with
+// [Client.scanFailedKeyword] and nil is returned.
+// Otherwise err is returned, as [ErrRetryable] if the message is retried in
+// the next cycle.
+func (c *Client) handleScanFailure(ctx context.Context, sc *scanCycle, msg *imapclt.Message, err error) error {
+	// failures caused by stopping the client or by unavailable services
+	// are not the fault of the message
+	if !c.deadLettersEnabled() || ctx.Err() != nil || isUnavailableErr(err) {
+		return err
+	}
+
+	logger := c.logger.With(
+		"mail.subject", msg.Envelope.Subject,
+		"mail.uid", msg.UID,
+	)
+
+	attempts := c.failures.add(msg.UID)
+	if attempts < c.maxScanAttempts {
+		logger.Debug("scanning message failed",
+			"error", err, "attempts", attempts, "attempts.max", c.maxScanAttempts)
+		return &ErrRetryable{err: err}
+	}
+
+	c.failures.remove(msg.UID)
+
+	if c.scanFailedMailbox != "" {
+		sc.move(c.scanFailedMailbox, newAuditEntry(c.scanMailbox, msg.UID, &msg.Envelope, reasonScanFailed))
+		logger.Error("scanning message failed repeatedly, moving it to the scan failed mailbox",
+			"error", err,
+			"attempts", attempts,
+			"mailbox.destination", c.scanFailedMailbox,
+			"event", "iscan.msg_scan_failed",
+		)
+		return nil
+	}
+
+	sc.failed = append(sc.failed, msg.UID)
+	sc.entries[msg.UID] = newAuditEntry(c.scanMailbox, msg.UID, &msg.Envelope, reasonScanFailed)
+	sc.kept++
+	logger.Error("scanning message failed repeatedly, flagging it",
+		"error", err,
+		"attempts", attempts,
+		"keyword", c.scanFailedKeyword,
+		"event", "iscan.msg_scan_failed",
+	)
+
+	return nil
+}
+
+// flagFailed flags the messages whose scan failed repeatedly with
+// [Client.scanFailedKeyword], to exclude them from following scans.
+func (c *Client) flagFailed(ctx context.Context, logger *slog.Logger, sc *scanCycle) {
+	if len(sc.failed) == 0 {
+		return
+	}
+
+	_, span := c.tracer.Start(ctx, "imap.add_keyword",
+		trace.String("mailbox.source", c.scanMailbox),
+		trace.Int("mail.count", int64(len(sc.failed))),
+	)
+	defer span.End()
+
+	if err := c.clt.AddKeyword(sc.failed, c.scanFailedKeyword); err != nil {
+		span.SetError(err)
+		// the messages are scanned again in the next cycle
+		logger.Warn("flagging messages that could not be scanned failed",
+			"error", err,
+			"keyword", c.scanFailedKeyword,
+			"count", len(sc.failed),
+			"event", "imap.keyword_failed",
+		)
+		return
+	}
+
+	c.recordAudit(audit.ActionFlag, "", sc.auditEntries(c.scanMailbox, sc.failed), c.scanFailedKeyword)
+}
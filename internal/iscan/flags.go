@@ -0,0 +1,63 @@
+package iscan
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// destinationFlags returns the flags that are added to messages that the
+// scanner moves or uploads to mailbox.
+func (c *Client) destinationFlags(mailbox string) []string {
+	if mailbox != c.spamMailbox {
+		return nil
+	}
+
+	flags := slices.Clone(c.spamFlags)
+	if c.spamLearnedKeyword != "" {
+		flags = appendFlags(flags, c.spamLearnedKeyword)
+	}
+
+	return flags
+}
+
+// isBorderline returns true if r is the result of a ham message whose score is
+// >= [Client.borderlineThreshold].
+func (c *Client) isBorderline(r *rspamc.CheckResult) bool {
+	return len(c.borderlineFlags) > 0 && !c.isSpam(r) && r.Score >= c.borderlineThreshold
+}
+
+// addFlags adds flags to the messages with uids in the mailbox that is
+// selected on clt.
+// Failures are only logged. Messages that are moved to the spam mailbox
+// without the spam learned keyword are learned by
+// [Client.ProcessSpamMailbox].
+func (c *Client) addFlags(clt IMAPClient, uids []uint32, flags []string) {
+	if len(uids) == 0 {
+		return
+	}
+
+	for _, f := range flags {
+		if err := clt.AddKeyword(uids, f); err != nil {
+			c.logger.Warn("flagging messages failed",
+				"error", err,
+				"keyword", f,
+				"count", len(uids),
+				"event", "imap.keyword_failed",
+			)
+		}
+	}
+}
+
+// appendFlags appends the flags that flags does not contain yet.
+// Flags are case-insensitive.
+func appendFlags(flags []string, add ...string) []string {
+	for _, f := range add {
+		if !slices.ContainsFunc(flags, func(e string) bool { return strings.EqualFold(e, f) }) {
+			flags = append(flags, f)
+		}
+	}
+
+	return flags
+}
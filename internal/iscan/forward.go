@@ -0,0 +1,66 @@
+package iscan
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/fho/rspamd-iscan/internal/forward"
+)
+
+// Forwarder delivers a mail to another mailbox.
+type Forwarder interface {
+	Forward(ctx context.Context, msg io.Reader) error
+}
+
+// forwardClean forwards mail with [Client.forwarder], if it is not spam.
+// It must only be called after mail was moved out of the scan mailbox or was
+// flagged as scanned, otherwise it is forwarded again when it is rescanned.
+// Failures are only logged, the mail is processed as usual.
+func (c *Client) forwardClean(ctx context.Context, mail *scannedMail) {
+	if c.forwarder == nil || c.isSpam(mail.CheckResult) {
+		return
+	}
+
+	logger := c.logger.With(
+		"mail.subject", mail.Envelope.Subject,
+		"mail.uid", mail.UID,
+	)
+
+	if mail.Truncated {
+		logger.Warn("not forwarding partially downloaded mail",
+			"event", "forward.skipped")
+		return
+	}
+
+	if err := c.forward(ctx, mail); err != nil {
+		if errors.Is(err, forward.ErrLoop) {
+			logger.Warn("not forwarding mail, it was already forwarded to the recipients",
+				"event", "forward.loop")
+			return
+		}
+
+		logger.Warn("forwarding mail failed",
+			"error", err, "event", "forward.failed")
+		return
+	}
+
+	logger.Info("forwarded clean mail", "event", "forward.sent")
+}
+
+func (c *Client) forward(ctx context.Context, mail *scannedMail) error {
+	f, err := os.Open(mail.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, span := c.tracer.Start(ctx, "forward.send")
+	defer span.End()
+
+	err = c.forwarder.Forward(ctx, f)
+	span.SetError(err)
+
+	return err
+}
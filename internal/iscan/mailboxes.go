@@ -0,0 +1,67 @@
+package iscan
+
+import (
+	"context"
+	"errors"
+	"slices"
+)
+
+// mailboxCreator is implemented by the clients that can create mailboxes.
+type mailboxCreator interface {
+	CreateMailboxes(mailboxes []string) ([]string, error)
+}
+
+// configuredMailboxes returns the names of all mailboxes that are configured.
+func (c *Client) configuredMailboxes() []string {
+	var result []string
+
+	for _, mb := range []string{
+		c.scanMailbox,
+		c.inboxMailbox,
+		c.spamMailbox,
+		c.hamMailbox,
+		c.backupMailbox,
+		c.undetectedMailbox,
+		c.fuzzyMailbox,
+		c.tooLargeMailbox,
+		c.scanFailedMailbox,
+		c.backscatterMailbox,
+		c.spamArchiveMailbox,
+	} {
+		if mb != "" && !slices.Contains(result, mb) {
+			result = append(result, mb)
+		}
+	}
+
+	return result
+}
+
+// createMailboxes creates the configured mailboxes that do not exist.
+func (c *Client) createMailboxes() ([]string, error) {
+	creator, ok := c.clt.(mailboxCreator)
+	if !ok {
+		return nil, errors.New("creating mailboxes is not supported by the protocol")
+	}
+
+	created, err := creator.CreateMailboxes(c.configuredMailboxes())
+	if len(created) > 0 {
+		c.logger.Info("created missing mailboxes", "mailboxes", created, "event", "iscan.mailboxes_created")
+	}
+
+	return created, err
+}
+
+// CreateMailboxes creates the configured mailboxes that do not exist and
+// returns their names.
+// [Client.Monitor] must be running.
+func (c *Client) CreateMailboxes(ctx context.Context) ([]string, error) {
+	var created []string
+
+	err := runAdminOp(ctx, c.ctx, c.ops, func(context.Context) error {
+		var err error
+		created, err = c.createMailboxes()
+		return err
+	})
+
+	return created, err
+}
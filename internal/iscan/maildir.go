@@ -0,0 +1,508 @@
+package iscan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/maildir"
+	"github.com/fho/rspamd-iscan/internal/stats"
+	"github.com/fho/rspamd-iscan/internal/trace"
+)
+
+const hdrSpam = "X-Spam"
+
+type MaildirConfig struct {
+	// Path is the path of the Maildir that is scanned.
+	Path string
+	// SpamFolder is the name of the Maildir++ folder that spam is moved
+	// to. It is created if it does not exist.
+	SpamFolder string
+	// AddHeaders enables adding X-Spam and scan result headers to the
+	// scanned mails.
+	AddHeaders bool
+	// StateFile is the file that the keys of scanned mails that are left
+	// in the Maildir are stored in, they are not scanned again. If it is
+	// empty, a file in Path is used.
+	StateFile string
+	// ApplyMilterHeaders enables applying the header modifications that
+	// rspamd returns in the milter section of its response, when
+	// AddHeaders is enabled.
+	ApplyMilterHeaders bool
+
+	SpamTreshold float32
+
+	MinPollInterval time.Duration
+	MaxPollInterval time.Duration
+	PollJitter      time.Duration
+	// ShutdownTimeout is the max. duration that [MaildirScanner.Stop] waits for
+	// canceled operations to finish. If it is 0, 30s are used.
+	ShutdownTimeout time.Duration
+
+	RspamdDeliverTo string
+	RspamdUser      string
+	// ScoreOverrides is optional, see [Config.ScoreOverrides].
+	ScoreOverrides map[string]float32
+	// PartFilters are optional, see [Config.PartFilters].
+	PartFilters []*mail.PartFilter
+
+	// Stats is optional, when it is set the counters of processed mails
+	// are recorded in it.
+	Stats *stats.Store
+	// Audit is optional, when it is set every mail that is moved or
+	// rewritten with scan result headers is recorded in it.
+	Audit *audit.Log
+	// Notifier is optional, when it is set it is informed about the
+	// result of every scan cycle.
+	Notifier Notifier
+
+	Logger *slog.Logger
+	Tracer *trace.Tracer
+	Rspamc RspamdClient
+
+	DryRun bool
+}
+
+func (c *MaildirConfig) validate() error {
+	if c.Path == "" {
+		return errors.New("Path can not be empty")
+	}
+
+	if c.SpamFolder == "" {
+		return errors.New("SpamFolder can not be empty")
+	}
+
+	if c.SpamTreshold <= 0 {
+		return errors.New("SpamTreshold must be >0")
+	}
+
+	if c.MinPollInterval <= 0 {
+		return errors.New("MinPollInterval must be >0")
+	}
+
+	if c.MaxPollInterval < c.MinPollInterval {
+		return errors.New("MaxPollInterval must be >=MinPollInterval")
+	}
+
+	if c.PollJitter < 0 {
+		return errors.New("PollJitter must be >=0")
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return errors.New("ShutdownTimeout must be >=0")
+	}
+
+	if c.Rspamc == nil {
+		return errors.New("rspamc can not be nil")
+	}
+
+	if err := validatePartFilters(c.PartFilters); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MaildirScanner scans the mails in the new and cur directories of a local
+// Maildir and moves spam to a Maildir++ folder.
+type MaildirScanner struct {
+	dir      maildir.Dir
+	spamDir  maildir.Dir
+	rspamc   RspamdClient
+	logger   *slog.Logger
+	tracer   *trace.Tracer
+	stats    *stats.Store
+	audit    *audit.Log
+	notifier Notifier
+
+	// ctx is canceled by [MaildirScanner.Stop].
+	ctx             context.Context
+	cancel          context.CancelFunc
+	stopOnce        sync.Once
+	wgRun           sync.WaitGroup
+	shutdownTimeout time.Duration
+	// ops receives the operations that are requested via the admin API,
+	// they are run by [MaildirScanner.Monitor].
+	ops chan *adminOp
+
+	spamTreshold float32
+	addHeaders   bool
+	milter       bool
+	dryMode      bool
+
+	rspamdDeliverTo string
+	rspamdUser      string
+	scoreOverrides  []scoreOverride
+	partFilters     []*mail.PartFilter
+
+	poll *pollScheduler
+
+	// scanned contains the keys of mails that were scanned and left in
+	// the Maildir, they are not scanned again.
+	scanned *scannedKeys
+
+	// cntProcessedMails counts the number of scanned mails.
+	// It is only used in tests.
+	cntProcessedMails atomic.Uint64
+}
+
+func NewMaildirScanner(cfg *MaildirConfig) (*MaildirScanner, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	scoreOverrides, err := parseScoreOverrides(cfg.ScoreOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ScoreOverrides: %w", err)
+	}
+
+	dir := maildir.Dir(cfg.Path)
+	if _, err := dir.Messages(); err != nil {
+		return nil, fmt.Errorf("invalid Maildir: %w", err)
+	}
+
+	statePath := cfg.StateFile
+	if statePath == "" {
+		statePath = filepath.Join(cfg.Path, defaultMaildirStateFile)
+	}
+
+	scanned, err := loadScannedKeys(statePath)
+	if err != nil {
+		return nil, fmt.Errorf("loading state file failed: %w", err)
+	}
+
+	s := &MaildirScanner{
+		dir:             dir,
+		spamDir:         dir.Folder(cfg.SpamFolder),
+		rspamc:          cfg.Rspamc,
+		logger:          log.Module(cfg.Logger, "iscan").With("maildir", cfg.Path),
+		tracer:          cfg.Tracer,
+		stats:           cfg.Stats,
+		audit:           cfg.Audit,
+		notifier:        cfg.Notifier,
+		shutdownTimeout: shutdownTimeoutOrDefault(cfg.ShutdownTimeout),
+		spamTreshold:    cfg.SpamTreshold,
+		addHeaders:      cfg.AddHeaders,
+		milter:          cfg.ApplyMilterHeaders,
+		dryMode:         cfg.DryRun,
+		rspamdDeliverTo: cfg.RspamdDeliverTo,
+		rspamdUser:      cfg.RspamdUser,
+		scoreOverrides:  scoreOverrides,
+		partFilters:     cfg.PartFilters,
+		poll:            newPollScheduler(cfg.MinPollInterval, cfg.MaxPollInterval, cfg.PollJitter),
+		scanned:         scanned,
+		ops:             make(chan *adminOp),
+	}
+
+	if !cfg.DryRun {
+		if err := s.spamDir.Create(); err != nil {
+			return nil, fmt.Errorf("creating spam folder failed: %w", err)
+		}
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	return s, nil
+}
+
+// ProcessMaildir scans the mails in the Maildir that have not been scanned
+// before.
+func (s *MaildirScanner) ProcessMaildir() (err error) {
+	var scannedCnt, spamCnt int
+
+	ctx, span := s.tracer.Start(s.ctx, "iscan.maildir_scan_cycle")
+	defer func() {
+		span.SetAttributes(
+			trace.Int("mail.scanned_count", int64(scannedCnt)),
+			trace.Int("mail.spam_count", int64(spamCnt)),
+		)
+		span.SetError(err)
+		span.End()
+
+		counters := stats.Counters{
+			Scanned: uint64(scannedCnt),
+			Spam:    uint64(spamCnt),
+			Ham:     uint64(scannedCnt - spamCnt),
+		}
+		if err != nil {
+			counters.Errors++
+		}
+		recordStats(s.logger, s.stats, &counters)
+		notifyCycle(ctx, s.notifier, &counters, fmt.Sprintf("moved to %q", s.spamDir), err)
+	}()
+
+	msgs, err := s.dir.Messages()
+	if err != nil {
+		return fmt.Errorf("listing mails failed: %w", err)
+	}
+
+	// forget mails that were deleted or moved by other programs
+	present := make(map[string]struct{}, len(msgs))
+	for _, m := range msgs {
+		present[m.Key()] = struct{}{}
+	}
+	s.scanned.retain(present)
+	defer s.saveState()
+
+	for _, m := range msgs {
+		if s.scanned.contains(m.Key()) {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			s.logger.Debug("processing maildir was aborted", "error", ctx.Err())
+			break
+		}
+
+		isSpam, scanned, key, err := s.scan(ctx, m)
+		if err != nil {
+			if ctx.Err() != nil {
+				// the mail is left unchanged and scanned again
+				// in the next cycle
+				s.logger.Debug("processing maildir was aborted", "error", err)
+				break
+			}
+			return err
+		}
+
+		if scanned {
+			scannedCnt++
+			s.cntProcessedMails.Add(1)
+		}
+
+		if isSpam {
+			spamCnt++
+		} else if scanned {
+			s.scanned.add(key)
+		}
+	}
+
+	s.logger.Debug("processed maildir",
+		"count.scanned", scannedCnt, "count.spam", spamCnt,
+		"event", "maildir.scan_cycle_finished")
+
+	return nil
+}
+
+// scan checks the mail m and moves it to the spam folder if it is spam.
+// key is the key of the mail after it was processed, it changes when the scan
+// result headers are added. If the mail vanished, it is not scanned and
+// scanned is false.
+func (s *MaildirScanner) scan(ctx context.Context, m *maildir.Message) (isSpam, scanned bool, key string, _ error) {
+	logger := s.logger.With("mail.file", m.Name)
+
+	data, err := os.ReadFile(s.dir.Path(m))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// the mail was moved by a client, e.g. from new to
+			// cur, it is scanned in the next cycle
+			logger.Debug("mail vanished before it was scanned")
+			return false, false, "", nil
+		}
+		return false, false, "", fmt.Errorf("reading mail failed: %w", err)
+	}
+
+	hdrs := parseMailHeaders(s.logger, data)
+	hdrs.DeliverTo = s.rspamdDeliverTo
+	hdrs.User = s.rspamdUser
+	logger = logger.With("mail.subject", hdrs.Subject)
+
+	_, span := s.tracer.Start(ctx, "rspamd.check", trace.String("mail.file", m.Name))
+	result, err := checkFiltered(ctx, s.rspamc, logger, s.partFilters, bytes.NewReader(data), hdrs)
+	if err != nil {
+		span.SetError(err)
+		span.End()
+		return false, false, "", err
+	}
+	span.SetAttributes(
+		trace.Float("scan.score", float64(result.Score)),
+		trace.String("scan.action", result.Action),
+	)
+	span.End()
+
+	result = applyScoreOverride(logger, s.scoreOverrides, hdrs.From, result)
+	isSpam = result.Score >= s.spamTreshold
+	logScanResult(logger, result, isSpam)
+
+	if s.dryMode {
+		return isSpam, true, m.Key(), nil
+	}
+
+	env, err := imapclt.HeaderEnvelope(bytes.NewReader(data))
+	if err != nil {
+		env = &imapclt.Envelope{Subject: hdrs.Subject}
+	}
+	entry := keyAuditEntry(string(s.dir), m.Key(), env, result, isSpam)
+
+	dest := s.dir
+	if isSpam {
+		dest = s.spamDir
+	}
+
+	if !s.addHeaders {
+		if isSpam {
+			if err := s.dir.Move(m, dest); err != nil {
+				return false, true, "", fmt.Errorf("moving mail to spam folder failed: %w", err)
+			}
+			logger.Info("moved mail to spam folder", "event", "maildir.mail_moved")
+			recordAudit(s.audit, audit.ActionMove, string(dest), []*audit.Entry{entry})
+		}
+
+		return isSpam, true, m.Key(), nil
+	}
+
+	spamVal := "No"
+	if isSpam {
+		spamVal = "Yes"
+	}
+
+	hdrsData, err := mail.AsHeaders(append(
+		[]*mail.Header{{Name: hdrSpam, Body: spamVal}},
+		scanResultHeaders(result)...,
+	))
+	if err != nil {
+		return false, true, "", err
+	}
+
+	if edit := milterEdit(result); s.milter && edit != nil {
+		modified, err := mail.EditHeadersData(data, edit)
+		if err != nil {
+			logger.Warn("applying milter headers failed",
+				"error", err, "event", "iscan.milter_headers_failed")
+		} else {
+			data = modified
+			logMilterEdit(logger, edit)
+		}
+	}
+
+	newM, err := s.replace(m, data, hdrsData, dest)
+	if err != nil {
+		return false, true, "", fmt.Errorf("adding scan result headers failed: %w", err)
+	}
+	recordAudit(s.audit, audit.ActionUpload, string(dest), []*audit.Entry{entry})
+
+	if isSpam {
+		logger.Info("moved mail with scan result headers to spam folder", "event", "maildir.mail_moved")
+	}
+
+	return isSpam, true, newM.Key(), nil
+}
+
+// replace writes the mail m with the additional headers to dest and removes
+// the original. It returns the written message.
+func (s *MaildirScanner) replace(m *maildir.Message, data, hdrs []byte, dest maildir.Dir) (*maildir.Message, error) {
+	modified, err := mail.InsertHeaders(data, hdrs)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := dest.CreateTemp()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Write(modified); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+
+	// the size in the file name would be wrong
+	newM := m.WithoutSize()
+	if err := dest.Deliver(f.Name(), newM); err != nil {
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+
+	if dest == s.dir && newM.Name == m.Name {
+		return newM, nil
+	}
+
+	return newM, s.dir.Remove(m)
+}
+
+// saveState writes the keys of the scanned mails to the state file.
+func (s *MaildirScanner) saveState() {
+	if s.dryMode {
+		return
+	}
+
+	if err := s.scanned.save(); err != nil {
+		s.logger.Warn("saving state file failed, mails might be scanned again after a restart",
+			"error", err, "path", s.scanned.path, "event", "maildir.state_save_failed")
+	}
+}
+
+// Monitor processes the Maildir periodically.
+// The method blocks until an error occurred or [*MaildirScanner.Stop] is
+// called.
+func (s *MaildirScanner) Monitor() error {
+	s.wgRun.Add(1)
+	defer s.wgRun.Done()
+
+	nextPollAt := time.Now()
+
+	for {
+		select {
+		case <-time.After(time.Until(nextPollAt)):
+			processedCnt := s.cntProcessedMails.Load()
+
+			if err := s.ProcessMaildir(); err != nil {
+				return err
+			}
+
+			s.poll.record(s.cntProcessedMails.Load() != processedCnt)
+			nextPoll := s.poll.next()
+			nextPollAt = time.Now().Add(nextPoll)
+			s.logger.Debug("scheduled next poll", "in", nextPoll)
+
+		case op := <-s.ops:
+			op.run(s.ctx)
+
+		case <-s.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// RunOnce processes the Maildir once.
+func (s *MaildirScanner) RunOnce() error {
+	s.wgRun.Add(1)
+	defer s.wgRun.Done()
+
+	return s.ProcessMaildir()
+}
+
+// Stop terminates [*MaildirScanner.Monitor] and [*MaildirScanner.RunOnce]
+// gracefully, if they are running.
+// The in-flight rspamd request is canceled, the mail is scanned again in the
+// next run.
+func (s *MaildirScanner) Stop() error {
+	s.stopOnce.Do(func() {
+		s.cancel()
+
+		if !waitTimeout(&s.wgRun, s.shutdownTimeout) {
+			s.logger.Warn("in-flight operations did not finish in time, terminating anyway",
+				"timeout", s.shutdownTimeout, "event", "iscan.shutdown_timeout")
+		}
+	})
+
+	return nil
+}
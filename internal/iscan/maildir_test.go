@@ -0,0 +1,234 @@
+package iscan
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/maildir"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/stats"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+)
+
+func newTestMaildir(t *testing.T) maildir.Dir {
+	dir := maildir.Dir(t.TempDir())
+	assert.NoError(t, dir.Create())
+
+	for i, path := range []string{mail.TestHamMailPath(t), mail.TestSpamMailPath(t)} {
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+
+		name := filepath.Join(string(dir), maildir.SubdirNew, fmt.Sprintf("1700000000.M%dP1.test", i))
+		assert.NoError(t, os.WriteFile(name, data, 0o600))
+	}
+
+	return dir
+}
+
+func newTestMaildirScanner(t *testing.T, dir maildir.Dir, addHeaders bool) (*MaildirScanner, *mock.Rspamc) {
+	rspamc := mock.NewRspamc()
+
+	s, err := NewMaildirScanner(&MaildirConfig{
+		Path:            string(dir),
+		SpamFolder:      "Spam",
+		AddHeaders:      addHeaders,
+		SpamTreshold:    10,
+		MinPollInterval: 30 * time.Second,
+		MaxPollInterval: 30 * time.Minute,
+		Logger:          log.SlogTestLogger(t),
+		Rspamc:          rspamc,
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = s.Stop() })
+
+	return s, rspamc
+}
+
+func assertMsgCount(t *testing.T, dir maildir.Dir, expected int) []*maildir.Message {
+	t.Helper()
+
+	msgs, err := dir.Messages()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, len(msgs))
+
+	return msgs
+}
+
+func TestProcessMaildir(t *testing.T) {
+	dir := newTestMaildir(t)
+	s, rspamcMock := newTestMaildirScanner(t, dir, false)
+
+	var checkCnt int
+	rspamcMock.CheckFn = func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+		checkCnt++
+		return mock.CheckFnDefault(ctx, r, hdrs)
+	}
+
+	assert.NoError(t, s.ProcessMaildir())
+	assert.Equal(t, 2, checkCnt)
+	assertMsgCount(t, dir, 1)
+	assertMsgCount(t, dir.Folder("Spam"), 1)
+
+	// the ham mail is not scanned again
+	assert.NoError(t, s.ProcessMaildir())
+	assert.Equal(t, 2, checkCnt)
+}
+
+func TestProcessMaildir_AddHeaders(t *testing.T) {
+	dir := newTestMaildir(t)
+	s, _ := newTestMaildirScanner(t, dir, true)
+
+	assert.NoError(t, s.ProcessMaildir())
+
+	ham := assertMsgCount(t, dir, 1)
+	data, err := os.ReadFile(dir.Path(ham[0]))
+	assert.NoError(t, err)
+	if !bytes.Contains(data, []byte(hdrSpam+": No\r\n")) {
+		t.Errorf("ham mail has no %q header", hdrSpam)
+	}
+
+	spamDir := dir.Folder("Spam")
+	spam := assertMsgCount(t, spamDir, 1)
+	data, err = os.ReadFile(spamDir.Path(spam[0]))
+	assert.NoError(t, err)
+	if !bytes.Contains(data, []byte(hdrSpam+": Yes\n")) {
+		t.Errorf("spam mail has no %q header", hdrSpam)
+	}
+
+	// a new scanner instance, e.g. after a restart, does not scan the mail
+	// with the scan result headers again
+	s, rspamcMock := newTestMaildirScanner(t, dir, true)
+	rspamcMock.CheckFn = func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+		t.Error("mail was scanned again")
+		return &rspamc.CheckResult{}, nil
+	}
+	assert.NoError(t, s.ProcessMaildir())
+}
+
+func TestProcessMaildir_DryRun(t *testing.T) {
+	dir := newTestMaildir(t)
+
+	s, err := NewMaildirScanner(&MaildirConfig{
+		Path:            string(dir),
+		SpamFolder:      "Spam",
+		SpamTreshold:    10,
+		MinPollInterval: 30 * time.Second,
+		MaxPollInterval: 30 * time.Minute,
+		Logger:          log.SlogTestLogger(t),
+		Rspamc:          mock.NewRspamc(),
+		DryRun:          true,
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.ProcessMaildir())
+	assertMsgCount(t, dir, 2)
+
+	if _, err := os.Stat(string(dir.Folder("Spam"))); err == nil {
+		t.Error("spam folder was created in dry-run mode")
+	}
+}
+
+func TestProcessMaildir_RecordsStats(t *testing.T) {
+	dir := newTestMaildir(t)
+	s, _ := newTestMaildirScanner(t, dir, false)
+	s.stats = stats.New(filepath.Join(t.TempDir(), "stats.json"), "test")
+
+	assert.NoError(t, s.ProcessMaildir())
+
+	c := s.stats.Sum("test", time.Now().Add(-time.Hour), time.Now())
+	assert.Equal(t, stats.Counters{Scanned: 2, Spam: 1, Ham: 1}, *c)
+}
+
+func TestProcessMaildir_ScanResultHeaderNotTrusted(t *testing.T) {
+	dir := maildir.Dir(t.TempDir())
+	assert.NoError(t, dir.Create())
+
+	// a score header added by the sender does not prevent the scan
+	data, err := os.ReadFile(mail.TestSpamMailPath(t))
+	assert.NoError(t, err)
+	data = append([]byte(hdrRspamdScore+": -100\r\n"), data...)
+	name := filepath.Join(string(dir), maildir.SubdirNew, "1700000000.M1P1.test")
+	assert.NoError(t, os.WriteFile(name, data, 0o600))
+
+	s, _ := newTestMaildirScanner(t, dir, false)
+	assert.NoError(t, s.ProcessMaildir())
+	assertMsgCount(t, dir, 0)
+	assertMsgCount(t, dir.Folder("Spam"), 1)
+}
+
+func TestProcessMaildir_StateFile(t *testing.T) {
+	dir := newTestMaildir(t)
+	s, _ := newTestMaildirScanner(t, dir, false)
+	assert.NoError(t, s.ProcessMaildir())
+
+	// a new scanner instance, e.g. after a restart, does not scan the ham
+	// mail again
+	s, rspamcMock := newTestMaildirScanner(t, dir, false)
+	rspamcMock.CheckFn = func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+		t.Error("mail was scanned again")
+		return &rspamc.CheckResult{}, nil
+	}
+	assert.NoError(t, s.ProcessMaildir())
+
+	// an unparseable state file is not overwritten
+	statePath := filepath.Join(string(dir), defaultMaildirStateFile)
+	assert.NoError(t, os.WriteFile(statePath, []byte("{"), 0o600))
+	_, err := NewMaildirScanner(&MaildirConfig{
+		Path:            string(dir),
+		SpamFolder:      "Spam",
+		SpamTreshold:    10,
+		MinPollInterval: 30 * time.Second,
+		MaxPollInterval: 30 * time.Minute,
+		Logger:          log.SlogTestLogger(t),
+		Rspamc:          mock.NewRspamc(),
+	})
+	assert.Error(t, err)
+}
+
+func TestProcessMaildir_Audit(t *testing.T) {
+	for _, addHeaders := range []bool{false, true} {
+		t.Run(fmt.Sprintf("addHeaders=%t", addHeaders), func(t *testing.T) {
+			dir := newTestMaildir(t)
+			s, _ := newTestMaildirScanner(t, dir, addHeaders)
+
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			var err error
+			s.audit, err = audit.Open(&audit.Config{Path: path})
+			assert.NoError(t, err)
+
+			assert.NoError(t, s.ProcessMaildir())
+			assert.NoError(t, s.audit.Close())
+
+			entries := readAuditLog(t, path)
+			spam := entries[len(entries)-1]
+			assert.Equal(t, reasonSpam, spam.Reason)
+			assert.Equal(t, string(dir), spam.Mailbox)
+			assert.Equal(t, string(dir.Folder("Spam")), spam.Destination)
+			assert.Equal(t, "1700000000.M1P1.test", spam.Key)
+			assert.Equal(t, mail.SpamMailSubject, spam.Subject)
+
+			if !addHeaders {
+				// the ham mail is not modified
+				assert.Equal(t, 1, len(entries))
+				assert.Equal(t, audit.ActionMove, spam.Action)
+				return
+			}
+
+			assert.Equal(t, 2, len(entries))
+			assert.Equal(t, audit.ActionUpload, spam.Action)
+			assert.Equal(t, audit.ActionUpload, entries[0].Action)
+			assert.Equal(t, reasonHam, entries[0].Reason)
+			assert.Equal(t, string(dir), entries[0].Destination)
+		})
+	}
+}
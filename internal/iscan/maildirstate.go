@@ -0,0 +1,92 @@
+package iscan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/fho/rspamd-iscan/internal/fsutil"
+)
+
+// defaultMaildirStateFile is the name of the state file in the Maildir, when
+// no [MaildirConfig.StateFile] is configured.
+const defaultMaildirStateFile = ".rspamd-iscan-scanned.json"
+
+// scannedKeys is the set of the keys of Maildir messages that were scanned and
+// left in the Maildir. It is persisted in a file, to not scan them again after
+// a restart.
+type scannedKeys struct {
+	path  string
+	keys  map[string]struct{}
+	dirty bool
+}
+
+// loadScannedKeys reads the keys from the file at path.
+// If the file does not exist, the set is empty. If it can not be parsed, an
+// error is returned, it is not overwritten.
+func loadScannedKeys(path string) (*scannedKeys, error) {
+	s := scannedKeys{path: path, keys: map[string]struct{}{}}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &s, nil
+		}
+		return nil, err
+	}
+
+	var keys []string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("decoding %q failed: %w", path, err)
+	}
+
+	for _, k := range keys {
+		s.keys[k] = struct{}{}
+	}
+
+	return &s, nil
+}
+
+func (s *scannedKeys) contains(key string) bool {
+	_, exists := s.keys[key]
+	return exists
+}
+
+func (s *scannedKeys) add(key string) {
+	s.keys[key] = struct{}{}
+	s.dirty = true
+}
+
+// retain removes all keys that are not in present.
+func (s *scannedKeys) retain(present map[string]struct{}) {
+	for key := range s.keys {
+		if _, exists := present[key]; !exists {
+			delete(s.keys, key)
+			s.dirty = true
+		}
+	}
+}
+
+// save writes the keys to the file, if they were modified.
+func (s *scannedKeys) save() error {
+	if !s.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(slices.Sorted(maps.Keys(s.keys)))
+	if err != nil {
+		return err
+	}
+
+	if err := fsutil.WriteFileAtomic(s.path, data); err != nil {
+		return err
+	}
+
+	s.dirty = false
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package iscan
+
+import (
+	"bytes"
+	"log/slog"
+	netmail "net/mail"
+
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// parseMailHeaders returns the rspamd request headers for the mail in data,
+// for sources that do not provide an envelope like IMAP.
+// Headers that can not be parsed are omitted.
+func parseMailHeaders(logger *slog.Logger, data []byte) *rspamc.MailHeaders {
+	var result rspamc.MailHeaders
+
+	ip, err := mail.ReceivedIP(bytes.NewReader(data))
+	if err == nil {
+		result.IP = ip
+	}
+
+	msg, err := netmail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		logger.Debug("parsing message headers failed", "error", err)
+		return &result
+	}
+
+	result.Subject = mail.DecodeHeader(msg.Header.Get("Subject"))
+
+	addrs := func(hdr string) []string {
+		var r []string
+		list, _ := msg.Header.AddressList(hdr)
+		for _, a := range list {
+			r = append(r, a.Address)
+		}
+		return r
+	}
+
+	result.From = addrs("From")
+	for _, hdr := range []string{"To", "Cc", "Bcc"} {
+		result.Recipients = append(result.Recipients, addrs(hdr)...)
+	}
+
+	return &result
+}
@@ -0,0 +1,66 @@
+package iscan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// The operations in this file are run directly, they are used by the command
+// line interface. They must not be called while [Client.Monitor] is running,
+// the admin API provides the same operations for a running client.
+
+// LearnMessages learns the messages with uids in mailbox as spam or ham. The
+// messages are not moved.
+// All messages are processed, the errors of failed ones are returned.
+func (c *Client) LearnMessages(ctx context.Context, mailbox string, uids []uint32, spam bool) error {
+	var errs []error
+
+	for _, uid := range uids {
+		if err := c.learnMessage(ctx, mailbox, uid, spam); err != nil {
+			errs = append(errs, fmt.Errorf("uid %d: %w", uid, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// RescannedMessage is a message that was scanned by [Client.RescanMessages].
+type RescannedMessage struct {
+	UID     uint32              `json:"uid"`
+	Subject string              `json:"subject"`
+	Spam    bool                `json:"spam"`
+	Result  *rspamc.CheckResult `json:"result"`
+}
+
+// RescanMessages scans the messages with uids in mailbox and moves the spam to
+// the spam mailbox, like [Client.RescanMailbox].
+// It returns the scan results of the messages. If a message does not exist,
+// an error wrapping [ErrMessageNotFound] is returned.
+func (c *Client) RescanMessages(ctx context.Context, mailbox string, uids []uint32) ([]*RescannedMessage, error) {
+	var result []*RescannedMessage
+	found := map[uint32]struct{}{}
+
+	_, err := c.rescanMailbox(ctx, mailbox, uids, func(sm *scannedMail) {
+		found[sm.UID] = struct{}{}
+		result = append(result, &RescannedMessage{
+			UID:     sm.UID,
+			Subject: sm.Envelope.Subject,
+			Spam:    c.isSpam(sm.CheckResult),
+			Result:  sm.CheckResult,
+		})
+	})
+	if err != nil {
+		return result, err
+	}
+
+	for _, uid := range uids {
+		if _, exists := found[uid]; !exists {
+			return result, fmt.Errorf("%w: uid %d in %s", ErrMessageNotFound, uid, mailbox)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,59 @@
+package iscan
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+)
+
+func TestRescanAndLearnMessages(t *testing.T) {
+	srv, clt := startServerClient(t)
+	ctx := context.Background()
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.InboxMailBox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.InboxMailBox, time.Now(), nil))
+
+	uids := map[string]uint32{}
+	for msg, err := range clt.clt.Messages(ctx, srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		uids[msg.Envelope.Subject] = msg.UID
+	}
+
+	var learned []string
+	rspamcMock := mock.NewRspamc()
+	rspamcMock.SpamFn = func(_ context.Context, _ io.Reader, hdrs *rspamc.MailHeaders) error {
+		learned = append(learned, hdrs.Subject)
+		return nil
+	}
+	clt.rspamc = rspamcMock
+
+	assert.NoError(t, clt.LearnMessages(ctx, srv.InboxMailBox, []uint32{uids[mail.HamMailSubject]}, true))
+	assert.Equal(t, 1, len(learned))
+	assert.Equal(t, mail.HamMailSubject, learned[0])
+
+	res, err := clt.RescanMessages(ctx, srv.InboxMailBox, []uint32{uids[mail.SpamMailSubject]})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, true, res[0].Spam)
+	assert.Equal(t, float32(100), res[0].Result.Score)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+	// the ham was not scanned
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+
+	_, err = clt.RescanMessages(ctx, srv.InboxMailBox, []uint32{uids[mail.SpamMailSubject]})
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected ErrMessageNotFound, got: %v", err)
+	}
+
+	err = clt.LearnMessages(ctx, srv.InboxMailBox, []uint32{uids[mail.SpamMailSubject]}, true)
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected ErrMessageNotFound, got: %v", err)
+	}
+}
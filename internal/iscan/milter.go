@@ -0,0 +1,59 @@
+package iscan
+
+import (
+	"cmp"
+	"log/slog"
+	"maps"
+	"slices"
+
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// milterEdit returns the header modifications that rspamd requested in the
+// milter section of r. If there are none, nil is returned.
+// Added headers are ordered by their order value and name.
+func milterEdit(r *rspamc.CheckResult) *mail.HeaderEdit {
+	if r.Milter == nil || (len(r.Milter.AddHeaders) == 0 && len(r.Milter.RemoveHeaders) == 0) {
+		return nil
+	}
+
+	type orderedHeader struct {
+		hdr   *mail.Header
+		order int
+	}
+
+	var add []*orderedHeader
+	for _, name := range slices.Sorted(maps.Keys(r.Milter.AddHeaders)) {
+		for _, v := range r.Milter.AddHeaders[name] {
+			add = append(add, &orderedHeader{
+				hdr:   &mail.Header{Name: name, Body: v.Value},
+				order: v.Order,
+			})
+		}
+	}
+	slices.SortStableFunc(add, func(a, b *orderedHeader) int {
+		return cmp.Compare(a.order, b.order)
+	})
+
+	result := mail.HeaderEdit{Remove: r.Milter.RemoveHeaders}
+	for _, h := range add {
+		result.Add = append(result.Add, h.hdr)
+	}
+
+	return &result
+}
+
+// logMilterEdit logs the header modifications that were applied.
+func logMilterEdit(logger *slog.Logger, edit *mail.HeaderEdit) {
+	added := make([]string, 0, len(edit.Add))
+	for _, h := range edit.Add {
+		added = append(added, h.Name)
+	}
+
+	logger.Debug("applied milter headers",
+		"headers.added", added,
+		"headers.removed", slices.Sorted(maps.Keys(edit.Remove)),
+		"event", "iscan.milter_headers_applied",
+	)
+}
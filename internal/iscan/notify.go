@@ -0,0 +1,29 @@
+package iscan
+
+import (
+	"context"
+
+	"github.com/fho/rspamd-iscan/internal/notify"
+	"github.com/fho/rspamd-iscan/internal/stats"
+)
+
+// Notifier is informed about the results of scan cycles, e.g. to send
+// notifications about detected spam and failures.
+type Notifier interface {
+	ScanCycleDone(ctx context.Context, r *notify.CycleResult)
+}
+
+// notifyCycle passes the result of a scan cycle to n, if it is not nil.
+// spamAction describes what happened to the detected spam.
+// Errors of cycles that were aborted by a shutdown are not reported.
+func notifyCycle(ctx context.Context, n Notifier, c *stats.Counters, spamAction string, err error) {
+	if n == nil {
+		return
+	}
+
+	if ctx.Err() != nil {
+		err = nil
+	}
+
+	n.ScanCycleDone(ctx, &notify.CycleResult{Counters: *c, SpamAction: spamAction, Err: err})
+}
@@ -0,0 +1,100 @@
+package iscan
+
+import (
+	"cmp"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// symbolScoreOverride is the name of the symbol that is added to check
+// results whose score was adjusted by a [scoreOverride].
+const symbolScoreOverride = "ISCAN_SCORE_OVERRIDE"
+
+// scoreOverride adjusts the rspamd score of mails from matching senders.
+type scoreOverride struct {
+	pattern    senderPattern
+	adjustment float32
+}
+
+// parseScoreOverrides parses the map of sender patterns to score adjustments.
+// The result is ordered by specificity: addresses first, then domains, then
+// wildcard domains with the longest first.
+func parseScoreOverrides(overrides map[string]float32) ([]scoreOverride, error) {
+	result := make([]scoreOverride, 0, len(overrides))
+
+	for _, k := range slices.Sorted(maps.Keys(overrides)) {
+		patterns, err := parseSenderPatterns([]string{k})
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, scoreOverride{pattern: patterns[0], adjustment: overrides[k]})
+	}
+
+	slices.SortStableFunc(result, func(a, b scoreOverride) int {
+		if c := cmp.Compare(a.pattern.specificity(), b.pattern.specificity()); c != 0 {
+			return -c
+		}
+		return -cmp.Compare(len(a.pattern), len(b.pattern))
+	})
+
+	return result, nil
+}
+
+// specificity returns how specific p is, a higher value is more specific.
+func (p senderPattern) specificity() int {
+	switch {
+	case strings.Contains(string(p), "@"):
+		return 2
+	case strings.HasPrefix(string(p), "*"):
+		return 0
+	default:
+		return 1
+	}
+}
+
+// applyScoreOverride adjusts the score of result by the most specific override
+// that matches one of the sender addresses from.
+// If none matches, result is returned. Otherwise a copy of result is returned
+// that contains the [symbolScoreOverride] symbol.
+func applyScoreOverride(
+	logger *slog.Logger,
+	overrides []scoreOverride,
+	from []string,
+	result *rspamc.CheckResult,
+) *rspamc.CheckResult {
+	for _, o := range overrides {
+		if _, matched := matchSender([]senderPattern{o.pattern}, from); !matched {
+			continue
+		}
+
+		// the result can be stored in the scan cache, it must not be
+		// modified
+		adjusted := *result
+		adjusted.Score += o.adjustment
+		adjusted.Symbols = maps.Clone(result.Symbols)
+		if adjusted.Symbols == nil {
+			adjusted.Symbols = map[string]*rspamc.Symbol{}
+		}
+		adjusted.Symbols[symbolScoreOverride] = &rspamc.Symbol{
+			Name:    symbolScoreOverride,
+			Score:   o.adjustment,
+			Options: []string{string(o.pattern)},
+		}
+
+		logger.Info("adjusted score by sender override",
+			"pattern", o.pattern,
+			"scan.score_adjustment", o.adjustment,
+			"scan.score", adjusted.Score,
+			"event", "iscan.score_overridden",
+		)
+
+		return &adjusted
+	}
+
+	return result
+}
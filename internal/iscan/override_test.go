@@ -0,0 +1,60 @@
+package iscan
+
+import (
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestApplyScoreOverride_MostSpecificWins(t *testing.T) {
+	overrides, err := parseScoreOverrides(map[string]float32{
+		"*.example.com":          10,
+		"*.lists.example.com":    5,
+		"lists.example.com":      -2,
+		"news@lists.example.com": -5,
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		from     string
+		expected float32
+	}{
+		{"news@lists.example.com", -5},
+		{"other@lists.example.com", -2},
+		{"user@a.lists.example.com", 5},
+		{"user@marketing.example.com", 10},
+		{"user@example.org", 0},
+	}
+
+	logger := log.SlogTestLogger(t)
+	for _, tt := range tests {
+		result := applyScoreOverride(logger, overrides, []string{tt.from}, &rspamc.CheckResult{Score: 3})
+		assert.Equal(t, 3+tt.expected, result.Score)
+	}
+}
+
+func TestApplyScoreOverride_DoesNotModifyResult(t *testing.T) {
+	overrides, err := parseScoreOverrides(map[string]float32{"example.com": -5})
+	assert.NoError(t, err)
+
+	result := &rspamc.CheckResult{
+		Score:   12,
+		Symbols: map[string]*rspamc.Symbol{"BAYES_SPAM": {Name: "BAYES_SPAM", Score: 5}},
+	}
+
+	adjusted := applyScoreOverride(log.SlogTestLogger(t), overrides, []string{"user@example.com"}, result)
+	assert.Equal(t, float32(7), adjusted.Score)
+	if adjusted.Symbols[symbolScoreOverride] == nil {
+		t.Errorf("adjusted result has no %s symbol", symbolScoreOverride)
+	}
+
+	assert.Equal(t, float32(12), result.Score)
+	assert.Equal(t, 1, len(result.Symbols))
+}
+
+func TestParseScoreOverridesInvalid(t *testing.T) {
+	_, err := parseScoreOverrides(map[string]float32{"foo.*.com": 1})
+	assert.Error(t, err)
+}
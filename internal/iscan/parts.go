@@ -0,0 +1,66 @@
+package iscan
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// validatePartFilters returns an error if one of filters is invalid.
+func validatePartFilters(filters []*mail.PartFilter) error {
+	for i, f := range filters {
+		if err := f.Validate(); err != nil {
+			return fmt.Errorf("PartFilters[%d]: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// checkFiltered sends msg to rspamd with the MIME parts that match filters
+// stripped or truncated, see [mail.FilterParts].
+// The mail is filtered while it is sent, it is not copied. If no filters are
+// configured, msg is sent unmodified.
+func checkFiltered(
+	ctx context.Context,
+	clt RspamdClient,
+	logger *slog.Logger,
+	filters []*mail.PartFilter,
+	msg io.Reader,
+	hdrs *rspamc.MailHeaders,
+) (*rspamc.CheckResult, error) {
+	if len(filters) == 0 {
+		return clt.Check(ctx, msg, hdrs)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		res, err := mail.FilterParts(msg, pw, filters)
+		pw.CloseWithError(err)
+
+		if err == nil && (res.Stripped > 0 || res.Truncated > 0) {
+			logger.Debug("filtered MIME parts sent to rspamd",
+				"parts.stripped", res.Stripped,
+				"parts.truncated", res.Truncated,
+				"parts.removed_bytes", res.RemovedBytes,
+				"event", "iscan.parts_filtered",
+			)
+		}
+	}()
+
+	result, err := clt.Check(ctx, pr, hdrs)
+	// the filter blocks until the mail is read completely, when the
+	// request failed before
+	_ = pr.Close()
+	<-done
+
+	return result, err
+}
@@ -0,0 +1,47 @@
+package iscan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+)
+
+func TestCheckFiltered(t *testing.T) {
+	msg := "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\ntext\r\n" +
+		"--b\r\nContent-Type: video/mp4\r\n\r\nAAAA\r\n" +
+		"--b--\r\n"
+	filters := []*mail.PartFilter{{ContentType: "video/*"}}
+
+	var sent []byte
+	clt := &mock.Rspamc{
+		CheckFn: func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			var err error
+			sent, err = io.ReadAll(r)
+			assert.NoError(t, err)
+			return mock.CheckFnDefault(ctx, bytes.NewReader(sent), hdrs)
+		},
+	}
+
+	_, err := checkFiltered(context.Background(), clt, log.SlogTestLogger(t), filters, strings.NewReader(msg), &rspamc.MailHeaders{})
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Replace(msg, "AAAA\r\n", "\r\n", 1), string(sent))
+
+	// the filter does not block when the mail is not read
+	clt.CheckFn = func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+		return nil, rspamc.ErrCircuitOpen
+	}
+	_, err = checkFiltered(context.Background(), clt, log.SlogTestLogger(t), filters, strings.NewReader(msg), &rspamc.MailHeaders{})
+	if !errors.Is(err, rspamc.ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got: %v", err)
+	}
+}
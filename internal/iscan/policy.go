@@ -0,0 +1,305 @@
+package iscan
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/stats"
+	"github.com/fho/rspamd-iscan/internal/trace"
+)
+
+// PolicyAction defines what is done with spam in the mailboxes of a
+// [FolderPolicy].
+type PolicyAction string
+
+const (
+	// PolicyActionMove moves spam to the spam mailbox.
+	PolicyActionMove PolicyAction = "move"
+	// PolicyActionTag flags spam with the keywords of the policy, it is
+	// left in its mailbox.
+	PolicyActionTag PolicyAction = "tag"
+)
+
+// defaultPolicyKeywords are the keywords that spam is flagged with by
+// [PolicyActionTag], when the policy does not define them.
+var defaultPolicyKeywords = []string{"$Junk"}
+
+// FolderPolicy defines how the messages in the mailboxes that match Mailbox
+// are processed.
+type FolderPolicy struct {
+	// Mailbox is a pattern of mailbox names in the syntax of
+	// [path.Match], e.g. "Shared/*" or "INBOX".
+	Mailbox string
+	Action  PolicyAction
+	// SpamThreshold is the score from which messages are spam. If it is
+	// 0, [Config.SpamTreshold] applies.
+	SpamThreshold float32
+	// Keywords are the keywords that spam is flagged with by
+	// [PolicyActionTag], they default to "$Junk".
+	Keywords []string
+}
+
+func (p *FolderPolicy) validate() error {
+	if _, err := path.Match(p.Mailbox, ""); err != nil || p.Mailbox == "" {
+		return fmt.Errorf("invalid Mailbox pattern: %q", p.Mailbox)
+	}
+
+	switch p.Action {
+	case PolicyActionMove:
+		if len(p.Keywords) != 0 {
+			return errors.New("Keywords are only supported with the tag action")
+		}
+	case PolicyActionTag:
+	default:
+		return fmt.Errorf("unsupported Action: %q", p.Action)
+	}
+
+	if p.SpamThreshold < 0 {
+		return errors.New("SpamThreshold must not be negative")
+	}
+
+	for _, kw := range p.Keywords {
+		if !isValidFlag(kw) {
+			return fmt.Errorf("invalid keyword: %q", kw)
+		}
+	}
+
+	return nil
+}
+
+// folderPolicies returns copies of policies with the defaults applied.
+func folderPolicies(policies []*FolderPolicy, spamThreshold float32) []*FolderPolicy {
+	result := make([]*FolderPolicy, 0, len(policies))
+	for _, p := range policies {
+		p := *p
+		if p.SpamThreshold == 0 {
+			p.SpamThreshold = spamThreshold
+		}
+		if p.Action == PolicyActionTag && len(p.Keywords) == 0 {
+			p.Keywords = defaultPolicyKeywords
+		}
+		result = append(result, &p)
+	}
+
+	return result
+}
+
+// mailboxLister is implemented by the clients that can list the mailboxes of
+// all namespaces.
+type mailboxLister interface {
+	ListMailboxes() ([]string, error)
+}
+
+// matchPolicy returns the first folder policy whose pattern matches mailbox,
+// or nil.
+func (c *Client) matchPolicy(mailbox string) *FolderPolicy {
+	for _, p := range c.folderPolicies {
+		if matched, _ := path.Match(p.Mailbox, mailbox); matched {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// scanMailboxPolicy returns the folder policy that applies to the messages in
+// the scan mailbox, or nil.
+// The policy that matches the inbox mailbox, to which the messages are
+// delivered, has precedence over the one that matches the scan mailbox.
+func (c *Client) scanMailboxPolicy() *FolderPolicy {
+	if p := c.matchPolicy(c.inboxMailbox); p != nil {
+		return p
+	}
+
+	return c.matchPolicy(c.scanMailbox)
+}
+
+// tagsSpam returns true if spam from the scan mailbox is delivered to the
+// inbox mailbox and flagged with the keywords of the scan policy, instead of
+// being moved to the spam mailbox.
+func (c *Client) tagsSpam() bool {
+	return c.scanPolicy != nil && c.scanPolicy.Action == PolicyActionTag
+}
+
+// scanDestination returns the mailbox that a message from the scan mailbox
+// with the scan result r is delivered to.
+func (c *Client) scanDestination(r *rspamc.CheckResult) string {
+	if !c.isSpam(r) || c.tagsSpam() {
+		return c.inboxMailbox
+	}
+
+	return c.spamMailbox
+}
+
+// policyKeywords returns the keywords that a message from the scan mailbox
+// with the scan result r is flagged with by the scan policy.
+func (c *Client) policyKeywords(r *rspamc.CheckResult) []string {
+	if !c.tagsSpam() || !c.isSpam(r) {
+		return nil
+	}
+
+	return c.scanPolicy.Keywords
+}
+
+// ProcessPolicyMailboxes scans the new messages in the mailboxes that match a
+// folder policy and processes the spam as defined by the policy.
+// The mailboxes of all namespaces are matched, e.g. shared mailboxes. The
+// configured mailboxes, e.g. the spam mailbox, are skipped. The policy that
+// matches the inbox or scan mailbox is applied by [Client.ProcessScanBox].
+func (c *Client) ProcessPolicyMailboxes() error {
+	return c.processPolicyMailboxes(c.clt)
+}
+
+func (c *Client) processPolicyMailboxes(clt IMAPClient) error {
+	if len(c.folderPolicies) == 0 {
+		return nil
+	}
+
+	lister, ok := clt.(mailboxLister)
+	if !ok {
+		return errors.New("listing mailboxes is not supported by the protocol")
+	}
+
+	mailboxes, err := lister.ListMailboxes()
+	if err != nil {
+		return err
+	}
+
+	configured := c.configuredMailboxes()
+	for _, mailbox := range mailboxes {
+		if slices.Contains(configured, mailbox) {
+			continue
+		}
+
+		p := c.matchPolicy(mailbox)
+		if p == nil {
+			continue
+		}
+
+		if err := c.processPolicyMailbox(clt, mailbox, p); err != nil {
+			return fmt.Errorf("processing mailbox %q failed: %w", mailbox, err)
+		}
+	}
+
+	return nil
+}
+
+// processPolicyMailbox scans the messages in mailbox that are not flagged with
+// the scanned keyword. Spam is moved or tagged as defined by p, all scanned
+// messages are flagged with the scanned keyword.
+// Messages whose scan failed are scanned again in the next cycle.
+func (c *Client) processPolicyMailbox(clt IMAPClient, mailbox string, p *FolderPolicy) (err error) {
+	var scannedUIDs, spamUIDs []uint32
+	var scanned, spam []*audit.Entry
+	var counters stats.Counters
+
+	ctx, span := c.tracer.Start(c.ctx, "iscan.scan_policy_mailbox", trace.String("mailbox.source", mailbox))
+	defer func() {
+		span.SetAttributes(trace.Int("mail.count", int64(len(scannedUIDs))))
+		span.SetError(err)
+		span.End()
+
+		if err != nil {
+			counters.Errors++
+		}
+		recordStats(c.logger, c.stats, &counters)
+	}()
+
+	logger := c.logger.With("mailbox.source", mailbox, "policy.action", p.Action)
+
+	res, err := clt.Search(mailbox, &imapclt.SearchCriteria{NotFlags: []string{c.scannedKeyword}})
+	if err != nil {
+		return fmt.Errorf("searching messages failed: %w", err)
+	}
+
+	if len(res.UIDs) == 0 {
+		return nil
+	}
+
+	logger.Info("scanning new messages in mailbox with folder policy", "count", len(res.UIDs))
+
+	fetchOpts := imapclt.FetchOptions{UIDs: res.UIDs, MaxBodySize: c.maxMessageSize}
+	for msg, err := range clt.Messages(ctx, mailbox, &fetchOpts) {
+		if err != nil {
+			if ctx.Err() != nil {
+				// flag the messages that were already scanned
+				break
+			}
+			return fmt.Errorf("fetching messages failed: %w", err)
+		}
+
+		sm, err := c.downloadAndScan(ctx, msg, nil)
+		if err != nil {
+			// the remaining messages are scanned when rspamd recovered
+			if ctx.Err() != nil || errors.Is(err, rspamc.ErrCircuitOpen) {
+				break
+			}
+			logger.Warn("scanning message failed",
+				"error", err, "mail.uid", msg.UID, "event", "rspamd.msg_scan_failed")
+			counters.Errors++
+			continue
+		}
+		c.removeTempFile(sm.Path)
+
+		counters.Scanned++
+		counters.Bytes += uint64(sm.Size)
+		scannedUIDs = append(scannedUIDs, sm.UID)
+
+		e := newAuditEntry(mailbox, sm.UID, sm.Envelope, reasonHam)
+		e.Score = &sm.CheckResult.Score
+		e.RspamdAction = sm.CheckResult.Action
+
+		if sm.CheckResult.Score < p.SpamThreshold {
+			counters.Ham++
+			scanned = append(scanned, e)
+			continue
+		}
+
+		counters.Spam++
+		e.Reason = reasonSpam
+		spamUIDs = append(spamUIDs, sm.UID)
+		spam = append(spam, e)
+		logger.Info("found spam",
+			"mail.subject", sm.Envelope.Subject,
+			"mail.uid", sm.UID,
+			"scan.score", sm.CheckResult.Score,
+			"event", "iscan.policy_spam_found",
+		)
+	}
+
+	if len(scannedUIDs) == 0 {
+		return nil
+	}
+
+	// moved spam is flagged too, it is not rescanned if the user moves it
+	// back
+	if err := clt.AddKeyword(scannedUIDs, c.scannedKeyword); err != nil {
+		return fmt.Errorf("flagging scanned messages failed: %w", err)
+	}
+	c.recordAudit(audit.ActionFlag, "", slices.Concat(scanned, spam), c.scannedKeyword)
+
+	if len(spamUIDs) == 0 {
+		return nil
+	}
+
+	switch p.Action {
+	case PolicyActionTag:
+		c.addFlags(clt, spamUIDs, p.Keywords)
+		c.recordAudit(audit.ActionFlag, "", spam, p.Keywords...)
+
+	case PolicyActionMove:
+		if err := c.move(ctx, clt, spamUIDs, c.spamMailbox); err != nil {
+			return fmt.Errorf("moving spam to %s failed: %w", c.spamMailbox, err)
+		}
+		c.recordAudit(audit.ActionMove, c.spamMailbox, spam)
+	}
+
+	c.cntProcessedMails.Add(uint64(len(scannedUIDs)))
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package iscan
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+)
+
+func TestProcessPolicyMailboxes(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	uploadClt := newTestClient(t, srv)
+
+	cfg := testClientCfg(t, srv)
+	cfg.ScannedKeyword = "$scanned"
+	cfg.CreateMailboxes = true
+	cfg.FolderPolicies = []*FolderPolicy{
+		{Mailbox: "Shared/*", Action: PolicyActionTag},
+		{Mailbox: "Personal", Action: PolicyActionMove, SpamThreshold: 150},
+		{Mailbox: "*", Action: PolicyActionMove},
+	}
+
+	var checked int
+	rspamcMock := mock.NewRspamc()
+	rspamcMock.CheckFn = func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+		checked++
+		return mock.CheckFnDefault(ctx, r, hdrs)
+	}
+	cfg.Rspamc = rspamcMock
+
+	clt, err := NewClient(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	creator := uploadClt.clt.(mailboxCreator)
+	_, err = creator.CreateMailboxes([]string{"Shared/support", "Personal", "Other"})
+	assert.NoError(t, err)
+
+	for _, mbox := range []string{"Shared/support", "Personal", "Other"} {
+		assert.NoError(t, uploadClt.clt.Upload(mail.TestHamMailPath(t), mbox, time.Now(), nil))
+		assert.NoError(t, uploadClt.clt.Upload(mail.TestSpamMailPath(t), mbox, time.Now(), nil))
+	}
+
+	assert.NoError(t, clt.ProcessPolicyMailboxes())
+	assert.Equal(t, 6, checked)
+
+	// the spam is tagged and left in place
+	for msg, err := range uploadClt.clt.Messages(context.Background(), "Shared/support", nil) {
+		assert.NoError(t, err)
+		isSpam := msg.Envelope.Subject == mail.SpamMailSubject
+		assert.Equal(t, isSpam, slices.Contains(msg.Flags, "$Junk"))
+		assert.Equal(t, true, slices.Contains(msg.Flags, "$scanned"))
+	}
+
+	// the score of the spam is below the threshold of the policy
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, uploadClt.clt, "Personal", mail.SpamMailSubject))
+
+	// the spam is moved to the spam mailbox
+	assert.Equal(t, 0, mailboxContainsMailCnt(t, uploadClt.clt, "Other", mail.SpamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, uploadClt.clt, "Other", mail.HamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, uploadClt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+
+	// scanned messages are skipped, the configured mailboxes are never
+	// matched
+	assert.NoError(t, uploadClt.clt.Upload(mail.TestSpamMailPath(t), srv.InboxMailBox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessPolicyMailboxes())
+	assert.Equal(t, 6, checked)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, uploadClt.clt, srv.InboxMailBox, mail.SpamMailSubject))
+}
+
+func TestRunOnce_FolderPolicyScanCachePool(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	uploadClt := newTestClient(t, srv)
+
+	cfg := testClientCfg(t, srv)
+	cfg.ScannedKeyword = "$scanned"
+	cfg.CreateMailboxes = true
+	cfg.IMAPPoolSize = 2
+	cfg.ScanCacheFile = filepath.Join(t.TempDir(), "cache.json")
+	cfg.ScanCacheTTL = time.Hour
+	cfg.FolderPolicies = []*FolderPolicy{
+		{Mailbox: "Other", Action: PolicyActionMove},
+	}
+
+	// slow down the checks to make the scans of both mailboxes overlap
+	rspamcMock := mock.NewRspamc()
+	rspamcMock.CheckFn = func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+		time.Sleep(10 * time.Millisecond)
+		return mock.CheckFnDefault(ctx, r, hdrs)
+	}
+	cfg.Rspamc = rspamcMock
+
+	clt, err := NewClient(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	creator := uploadClt.clt.(mailboxCreator)
+	_, err = creator.CreateMailboxes([]string{"Other"})
+	assert.NoError(t, err)
+
+	// the policy mailbox and the scan mailbox are processed concurrently,
+	// both use the scan cache
+	for range 5 {
+		for _, mbox := range []string{"Other", srv.ScanMailbox} {
+			assert.NoError(t, uploadClt.clt.Upload(mail.TestHamMailPath(t), mbox, time.Now(), nil))
+			assert.NoError(t, uploadClt.clt.Upload(mail.TestSpamMailPath(t), mbox, time.Now(), nil))
+		}
+	}
+
+	assert.NoError(t, clt.RunOnce())
+
+	assert.Equal(t, true, mailboxIsEmpty(t, uploadClt.clt, srv.ScanMailbox))
+	assert.Equal(t, 0, mailboxContainsMailCnt(t, uploadClt.clt, "Other", mail.SpamMailSubject))
+	assert.Equal(t, 5, mailboxContainsMailCnt(t, uploadClt.clt, "Other", mail.HamMailSubject))
+	assert.Equal(t, 10, mailboxContainsMailCnt(t, uploadClt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+}
+
+func TestFolderPolicyValidate(t *testing.T) {
+	for _, p := range []*FolderPolicy{
+		{Mailbox: "[", Action: PolicyActionTag},
+		{Mailbox: "", Action: PolicyActionTag},
+		{Mailbox: "INBOX", Action: "delete"},
+		{Mailbox: "INBOX", Action: PolicyActionMove, Keywords: []string{"$Junk"}},
+		{Mailbox: "INBOX", Action: PolicyActionTag, Keywords: []string{"in valid"}},
+	} {
+		assert.Error(t, p.validate())
+	}
+
+	assert.NoError(t, (&FolderPolicy{Mailbox: "Shared/*", Action: PolicyActionTag, Keywords: []string{`\Flagged`}}).validate())
+}
+
+func TestProcessScanBox_FolderPolicy(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	uploadClt := newTestClient(t, srv)
+
+	cfg := testClientCfg(t, srv)
+	cfg.ScannedKeyword = "$scanned"
+	cfg.FolderPolicies = []*FolderPolicy{
+		{Mailbox: "INBOX", Action: PolicyActionMove, SpamThreshold: 150},
+		{Mailbox: "*", Action: PolicyActionMove},
+	}
+	clt, err := NewClient(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	assert.NoError(t, uploadClt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessScanBox())
+
+	// the score of the spam is below the threshold of the INBOX policy
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, uploadClt.clt, srv.InboxMailBox, mail.SpamMailSubject))
+	assert.Equal(t, true, mailboxIsEmpty(t, uploadClt.clt, srv.SpamMailbox))
+}
+
+func TestProcessScanBox_FolderPolicyTag(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	uploadClt := newTestClient(t, srv)
+
+	cfg := testClientCfg(t, srv)
+	cfg.ScannedKeyword = "$scanned"
+	cfg.InboxMailbox = srv.ScanMailbox
+	cfg.FolderPolicies = []*FolderPolicy{{Mailbox: srv.ScanMailbox, Action: PolicyActionTag}}
+	clt, err := NewClient(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = clt.Stop() })
+
+	assert.NoError(t, uploadClt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, uploadClt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessScanBox())
+
+	// the spam is tagged and left in place
+	assert.Equal(t, true, mailboxIsEmpty(t, uploadClt.clt, srv.SpamMailbox))
+	cnt := 0
+	for msg, err := range uploadClt.clt.Messages(context.Background(), srv.ScanMailbox, nil) {
+		assert.NoError(t, err)
+		isSpam := msg.Envelope.Subject == mail.SpamMailSubject
+		assert.Equal(t, isSpam, slices.Contains(msg.Flags, "$Junk"))
+		assert.Equal(t, true, slices.Contains(msg.Flags, "$scanned"))
+		cnt++
+	}
+	assert.Equal(t, 2, cnt)
+}
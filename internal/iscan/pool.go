@@ -0,0 +1,111 @@
+package iscan
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// poolIdleTimeout is the duration after which idle pooled connections are
+// closed. It is shorter than the autologout timer of IMAP servers (RFC 9051
+// requires >= 30min).
+const poolIdleTimeout = 10 * time.Minute
+
+// learnTask processes a learn mailbox or the mailboxes with folder policies.
+type learnTask struct {
+	desc    string
+	enabled bool
+	// mailbox is the mailbox that the task processes, it is empty when the
+	// task processes multiple mailboxes.
+	mailbox string
+	fn      func(IMAPClient) error
+}
+
+func (c *Client) learnTasks() []*learnTask {
+	return []*learnTask{
+		{"learning ham", c.hamMailbox != "", c.hamMailbox, c.processHam},
+		{"learning spam", c.undetectedMailbox != "", c.undetectedMailbox, c.processSpam},
+		{"adding fuzzy hashes", c.fuzzyMailbox != "", c.fuzzyMailbox, c.processFuzzy},
+		{"learning spam moved by the user", c.spamLearnedKeyword != "", c.spamMailbox, c.processSpamMailbox},
+		{"scanning mailboxes with folder policies", len(c.folderPolicies) != 0, "", c.processPolicyMailboxes},
+		{"deleting expired messages", c.spamRetention > 0 || c.scanFailedRetention > 0, "", c.processRetention},
+	}
+}
+
+// processMailboxes processes the learn mailboxes and the scan mailbox.
+// If the connection pool is enabled, the learn mailboxes are processed
+// concurrently on pooled connections, while the scan mailbox is processed on
+// the primary connection. Otherwise all are processed one after another on
+// the primary connection, the scan mailbox last.
+func (c *Client) processMailboxes() error {
+	if c.pool == nil {
+		for _, t := range c.learnTasks() {
+			if err := t.fn(c.clt); err != nil {
+				return fmt.Errorf("%s failed: %w", t.desc, WrapRetryableError(err))
+			}
+		}
+
+		return c.ProcessScanBox()
+	}
+
+	var wg sync.WaitGroup
+	tasks := c.learnTasks()
+	errs := make([]error, len(tasks)+1)
+
+	for i, t := range tasks {
+		if !t.enabled {
+			continue
+		}
+
+		wg.Go(func() {
+			if err := c.runPooled(t.fn); err != nil {
+				errs[i] = fmt.Errorf("%s failed: %w", t.desc, WrapRetryableError(err))
+			}
+		})
+	}
+
+	errs[len(tasks)] = c.ProcessScanBox()
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// processLearnMailbox runs the enabled learn tasks of mailbox.
+func (c *Client) processLearnMailbox(mailbox string) error {
+	for _, t := range c.learnTasks() {
+		if !t.enabled || t.mailbox != mailbox {
+			continue
+		}
+
+		var err error
+		if c.pool == nil {
+			err = t.fn(c.clt)
+		} else {
+			err = c.runPooled(t.fn)
+		}
+		if err != nil {
+			return fmt.Errorf("%s failed: %w", t.desc, WrapRetryableError(err))
+		}
+	}
+
+	return nil
+}
+
+// runPooled runs fn with a connection from the pool.
+// If fn fails, the connection is closed instead of being reused.
+func (c *Client) runPooled(fn func(IMAPClient) error) error {
+	clt, err := c.pool.Checkout(c.ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(clt); err != nil {
+		c.pool.Discard(clt)
+		return err
+	}
+
+	c.pool.Release(clt)
+
+	return nil
+}
@@ -0,0 +1,485 @@
+package iscan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/forward"
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/pop3clt"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/stats"
+	"github.com/fho/rspamd-iscan/internal/trace"
+)
+
+// POP3Client is a [MessageSource] for a POP3 maildrop. The UIDs of its
+// messages are the message numbers of the session.
+type POP3Client interface {
+	MessageSource
+	// UIDs returns the unique-id listings of the messages by their
+	// message number.
+	UIDs() (map[uint32]string, error)
+	Delete(uids []uint32) error
+}
+
+// pop3Mailbox is the mailbox name of POP3 messages in the audit log, the
+// maildrop is the inbox of the user.
+const pop3Mailbox = "INBOX"
+
+// POP3SpamAction defines what happens with messages in a POP3 maildrop that
+// are classified as spam.
+type POP3SpamAction string
+
+const (
+	// POP3SpamActionDelete deletes spam messages from the maildrop.
+	POP3SpamActionDelete POP3SpamAction = "delete"
+	// POP3SpamActionKeep leaves spam messages in the maildrop.
+	POP3SpamActionKeep POP3SpamAction = "keep"
+)
+
+type POP3Config struct {
+	ServerAddr              string
+	User                    string
+	Password                string
+	AllowInsecureConnection bool
+
+	SpamTreshold float32
+	SpamAction   POP3SpamAction
+	// Forwarder is optional, when it is set clean messages are forwarded
+	// and deleted from the maildrop afterwards.
+	Forwarder Forwarder
+
+	MinPollInterval time.Duration
+	MaxPollInterval time.Duration
+	PollJitter      time.Duration
+	// ShutdownTimeout is the max. duration that [POP3Scanner.Stop] waits for
+	// canceled operations to finish. If it is 0, 30s are used.
+	ShutdownTimeout time.Duration
+
+	RspamdDeliverTo string
+	RspamdUser      string
+	// ScoreOverrides is optional, see [Config.ScoreOverrides].
+	ScoreOverrides map[string]float32
+	// PartFilters are optional, see [Config.PartFilters].
+	PartFilters []*mail.PartFilter
+
+	// Stats is optional, when it is set the counters of processed mails
+	// are recorded in it.
+	Stats *stats.Store
+	// Audit is optional, when it is set every deleted message is recorded
+	// in it.
+	Audit *audit.Log
+	// Notifier is optional, when it is set it is informed about the
+	// result of every scan cycle.
+	Notifier Notifier
+
+	Logger *slog.Logger
+	Tracer *trace.Tracer
+	Rspamc RspamdClient
+
+	DryRun bool
+}
+
+func (c *POP3Config) validate() error {
+	if c.SpamTreshold <= 0 {
+		return errors.New("SpamTreshold must be >0")
+	}
+
+	switch c.SpamAction {
+	case POP3SpamActionDelete, POP3SpamActionKeep:
+	default:
+		return fmt.Errorf("invalid SpamAction: %q", c.SpamAction)
+	}
+
+	if c.MinPollInterval <= 0 {
+		return errors.New("MinPollInterval must be >0")
+	}
+
+	if c.MaxPollInterval < c.MinPollInterval {
+		return errors.New("MaxPollInterval must be >=MinPollInterval")
+	}
+
+	if c.PollJitter < 0 {
+		return errors.New("PollJitter must be >=0")
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return errors.New("ShutdownTimeout must be >=0")
+	}
+
+	if c.Rspamc == nil {
+		return errors.New("rspamc can not be nil")
+	}
+
+	if err := validatePartFilters(c.PartFilters); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// POP3Scanner scans the messages in a POP3 maildrop.
+// POP3 has no mailboxes, therefore messages can only be deleted or kept.
+// Every check opens a new session, POP3 servers lock the maildrop while a
+// session is established.
+type POP3Scanner struct {
+	clt       POP3Client
+	rspamc    RspamdClient
+	forwarder Forwarder
+	logger    *slog.Logger
+	tracer    *trace.Tracer
+	stats     *stats.Store
+	audit     *audit.Log
+	notifier  Notifier
+
+	// ctx is canceled by [POP3Scanner.Stop].
+	ctx             context.Context
+	cancel          context.CancelFunc
+	stopOnce        sync.Once
+	wgRun           sync.WaitGroup
+	shutdownTimeout time.Duration
+	// ops receives the operations that are requested via the admin API,
+	// they are run by [POP3Scanner.Monitor].
+	ops chan *adminOp
+
+	spamTreshold float32
+	spamAction   POP3SpamAction
+
+	rspamdDeliverTo string
+	rspamdUser      string
+	scoreOverrides  []scoreOverride
+	partFilters     []*mail.PartFilter
+
+	poll *pollScheduler
+
+	// scanned contains the UIDs of messages that were scanned and kept
+	// in the maildrop, they are not scanned again.
+	scanned map[string]struct{}
+
+	// cntProcessedMails counts the number of scanned messages.
+	// It is only used in tests.
+	cntProcessedMails atomic.Uint64
+}
+
+func NewPOP3Scanner(cfg *POP3Config) (*POP3Scanner, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	scoreOverrides, err := parseScoreOverrides(cfg.ScoreOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ScoreOverrides: %w", err)
+	}
+
+	popCfg := pop3clt.Config{
+		Address:       cfg.ServerAddr,
+		User:          cfg.User,
+		Password:      cfg.Password,
+		AllowInsecure: cfg.AllowInsecureConnection,
+		Logger:        cfg.Logger,
+	}
+
+	s := &POP3Scanner{
+		rspamc:          cfg.Rspamc,
+		forwarder:       cfg.Forwarder,
+		logger:          log.Module(cfg.Logger, "iscan"),
+		tracer:          cfg.Tracer,
+		stats:           cfg.Stats,
+		audit:           cfg.Audit,
+		notifier:        cfg.Notifier,
+		shutdownTimeout: shutdownTimeoutOrDefault(cfg.ShutdownTimeout),
+		spamTreshold:    cfg.SpamTreshold,
+		spamAction:      cfg.SpamAction,
+		rspamdDeliverTo: cfg.RspamdDeliverTo,
+		rspamdUser:      cfg.RspamdUser,
+		scoreOverrides:  scoreOverrides,
+		partFilters:     cfg.PartFilters,
+		poll:            newPollScheduler(cfg.MinPollInterval, cfg.MaxPollInterval, cfg.PollJitter),
+		scanned:         map[string]struct{}{},
+		ops:             make(chan *adminOp),
+	}
+
+	if cfg.DryRun {
+		s.clt = pop3clt.NewDryClient(&popCfg)
+		// forwarded messages would be forwarded again on every run
+		s.forwarder = nil
+	} else {
+		s.clt = pop3clt.NewClient(&popCfg)
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	return s, nil
+}
+
+// ProcessMaildrop scans the messages in the maildrop that have not been
+// scanned before.
+// Messages are marked as deleted right after they were processed, the
+// deletions are applied when the session ends, also when processing a later
+// message failed.
+func (s *POP3Scanner) ProcessMaildrop() (err error) {
+	var scannedCnt, deletedCnt int
+	var counters stats.Counters
+
+	ctx, span := s.tracer.Start(s.ctx, "iscan.pop3_scan_cycle")
+	defer func() {
+		span.SetAttributes(
+			trace.Int("mail.scanned_count", int64(scannedCnt)),
+			trace.Int("mail.deleted_count", int64(deletedCnt)),
+		)
+		span.SetError(err)
+		span.End()
+
+		if err != nil {
+			counters.Errors++
+		}
+		recordStats(s.logger, s.stats, &counters)
+
+		spamAction := "deleted"
+		if s.spamAction == POP3SpamActionKeep {
+			spamAction = "kept in the maildrop"
+		}
+		notifyCycle(ctx, s.notifier, &counters, spamAction, err)
+	}()
+
+	if err := s.clt.Connect(); err != nil {
+		return err
+	}
+	defer func() {
+		// messages are only deleted when the session is closed
+		// successfully
+		if cErr := s.clt.Close(); cErr != nil {
+			err = errors.Join(err, fmt.Errorf("closing pop3 session failed: %w", cErr))
+		}
+	}()
+
+	uids, err := s.clt.UIDs()
+	if err != nil {
+		return err
+	}
+
+	fetchIDs := s.unscanned(uids)
+	if len(fetchIDs) == 0 {
+		s.logger.Debug("maildrop contains no unscanned messages", "event", "pop3.scan_cycle_finished")
+		return nil
+	}
+
+	for msg, err := range s.clt.Messages(ctx, "", &imapclt.FetchOptions{UIDs: fetchIDs}) {
+		if err != nil {
+			if ctx.Err() != nil {
+				s.logger.Debug("processing maildrop was aborted", "error", err)
+				break
+			}
+			return err
+		}
+
+		deleteEntry, err := s.scan(ctx, msg, &counters)
+		if err != nil {
+			if ctx.Err() != nil {
+				// the message is kept, the already processed
+				// messages are still deleted
+				s.logger.Debug("processing maildrop was aborted", "error", err)
+				break
+			}
+			return err
+		}
+
+		scannedCnt++
+		s.cntProcessedMails.Add(1)
+
+		// the message is also recorded when it is deleted, to not
+		// forward it again if the deletion does not succeed, it is
+		// forgotten when it is not in the maildrop anymore
+		if msg.POP3UID != "" {
+			s.scanned[msg.POP3UID] = struct{}{}
+		}
+
+		if deleteEntry == nil {
+			continue
+		}
+
+		if err := s.clt.Delete([]uint32{msg.UID}); err != nil {
+			return err
+		}
+		deletedCnt++
+		recordAudit(s.audit, audit.ActionDelete, "", []*audit.Entry{deleteEntry})
+	}
+
+	s.logger.Debug("processed pop3 maildrop",
+		"count.scanned", scannedCnt, "count.deleted", deletedCnt,
+		"event", "pop3.scan_cycle_finished")
+
+	return nil
+}
+
+// unscanned returns the sorted message numbers of the messages in uids that
+// have not been scanned before. Scanned messages that are not in uids anymore
+// are forgotten.
+func (s *POP3Scanner) unscanned(uids map[uint32]string) []uint32 {
+	present := make(map[string]struct{}, len(uids))
+	var result []uint32
+
+	for id, uid := range uids {
+		present[uid] = struct{}{}
+		if _, scanned := s.scanned[uid]; !scanned || uid == "" {
+			result = append(result, id)
+		}
+	}
+
+	for uid := range s.scanned {
+		if _, exists := present[uid]; !exists {
+			delete(s.scanned, uid)
+		}
+	}
+
+	slices.Sort(result)
+
+	return result
+}
+
+// scan checks msg and returns the audit log entry for deleting it, if it must
+// be deleted from the maildrop. If it is kept, nil is returned.
+// The result is recorded in cnt.
+func (s *POP3Scanner) scan(ctx context.Context, msg *imapclt.Message, cnt *stats.Counters) (*audit.Entry, error) {
+	data, err := io.ReadAll(msg.Message)
+	if err != nil {
+		return nil, fmt.Errorf("reading message %d failed: %w", msg.UID, err)
+	}
+	cnt.Bytes += uint64(len(data))
+
+	hdrs := s.rspamcHdrs(data)
+	logger := s.logger.With("mail.subject", hdrs.Subject, "mail.pop3_uid", msg.POP3UID)
+
+	_, span := s.tracer.Start(ctx, "rspamd.check", trace.String("mail.pop3_uid", msg.POP3UID))
+	result, err := checkFiltered(ctx, s.rspamc, logger, s.partFilters, bytes.NewReader(data), hdrs)
+	if err != nil {
+		span.SetError(err)
+		span.End()
+		return nil, err
+	}
+	span.SetAttributes(
+		trace.Float("scan.score", float64(result.Score)),
+		trace.String("scan.action", result.Action),
+	)
+	span.End()
+
+	result = applyScoreOverride(logger, s.scoreOverrides, hdrs.From, result)
+	isSpam := result.Score >= s.spamTreshold
+	logScanResult(logger, result, isSpam)
+
+	cnt.Scanned++
+	if isSpam {
+		cnt.Spam++
+	} else {
+		cnt.Ham++
+	}
+
+	entry := keyAuditEntry(pop3Mailbox, msg.POP3UID, &msg.Envelope, result, isSpam)
+
+	if isSpam {
+		if s.spamAction != POP3SpamActionDelete {
+			return nil, nil
+		}
+		return entry, nil
+	}
+
+	if s.forwarder == nil {
+		return nil, nil
+	}
+
+	if err := s.forwarder.Forward(ctx, bytes.NewReader(data)); err != nil {
+		if errors.Is(err, forward.ErrLoop) {
+			logger.Warn("keeping clean message, it was already forwarded to the recipients",
+				"event", "pop3.forward_loop")
+			return nil, nil
+		}
+		return nil, fmt.Errorf("forwarding message failed: %w", err)
+	}
+	logger.Info("forwarded clean message", "event", "pop3.message_forwarded")
+	entry.Reason = reasonForwarded
+
+	return entry, nil
+}
+
+// rspamcHdrs returns the rspamd request headers for the mail in data.
+func (s *POP3Scanner) rspamcHdrs(data []byte) *rspamc.MailHeaders {
+	result := parseMailHeaders(s.logger, data)
+	result.DeliverTo = s.rspamdDeliverTo
+	result.User = s.rspamdUser
+
+	return result
+}
+
+// Monitor processes the maildrop periodically.
+// The method blocks until an error occurred or [*POP3Scanner.Stop] is called.
+func (s *POP3Scanner) Monitor() error {
+	s.wgRun.Add(1)
+	defer s.wgRun.Done()
+
+	nextPollAt := time.Now()
+
+	for {
+		select {
+		case <-time.After(time.Until(nextPollAt)):
+			processedCnt := s.cntProcessedMails.Load()
+
+			if err := s.ProcessMaildrop(); err != nil {
+				if s.ctx.Err() != nil {
+					return nil
+				}
+				return WrapRetryableError(err)
+			}
+
+			s.poll.record(s.cntProcessedMails.Load() != processedCnt)
+			nextPoll := s.poll.next()
+			nextPollAt = time.Now().Add(nextPoll)
+			s.logger.Debug("scheduled next poll", "in", nextPoll)
+
+		case op := <-s.ops:
+			op.run(s.ctx)
+
+		case <-s.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// RunOnce processes the maildrop once.
+func (s *POP3Scanner) RunOnce() error {
+	s.wgRun.Add(1)
+	defer s.wgRun.Done()
+
+	if err := s.ProcessMaildrop(); err != nil && s.ctx.Err() == nil {
+		return err
+	}
+
+	return nil
+}
+
+// Stop terminates [*POP3Scanner.Monitor] and [*POP3Scanner.RunOnce]
+// gracefully, if they are running.
+// The in-flight rspamd and forwarding requests are canceled, messages that
+// were already processed are still deleted.
+func (s *POP3Scanner) Stop() error {
+	s.stopOnce.Do(func() {
+		s.cancel()
+
+		if !waitTimeout(&s.wgRun, s.shutdownTimeout) {
+			s.logger.Warn("in-flight operations did not finish in time, terminating anyway",
+				"timeout", s.shutdownTimeout, "event", "iscan.shutdown_timeout")
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package iscan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/forward"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+	"github.com/fho/rspamd-iscan/internal/testutils/pop3server"
+)
+
+type forwarderFn func(context.Context, io.Reader) error
+
+func (f forwarderFn) Forward(ctx context.Context, msg io.Reader) error {
+	return f(ctx, msg)
+}
+
+func newTestPOP3Scanner(t *testing.T, srv *pop3server.Server) (*POP3Scanner, *mock.Rspamc) {
+	rspamc := mock.NewRspamc()
+
+	s, err := NewPOP3Scanner(&POP3Config{
+		ServerAddr:              srv.ListenAddr,
+		User:                    srv.UserName,
+		Password:                srv.UserPasswd,
+		AllowInsecureConnection: true,
+		SpamTreshold:            10,
+		SpamAction:              POP3SpamActionDelete,
+		MinPollInterval:         30 * time.Second,
+		MaxPollInterval:         30 * time.Minute,
+		Logger:                  log.SlogTestLogger(t),
+		Rspamc:                  rspamc,
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = s.Stop() })
+
+	return s, rspamc
+}
+
+func addTestMails(t *testing.T, srv *pop3server.Server) {
+	for _, path := range []string{mail.TestHamMailPath(t), mail.TestSpamMailPath(t)} {
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		srv.AddMessage(data)
+	}
+}
+
+func TestPOP3ProcessMaildrop(t *testing.T) {
+	srv := pop3server.StartServer(t)
+	addTestMails(t, srv)
+
+	s, rspamcMock := newTestPOP3Scanner(t, srv)
+
+	var checkCnt int
+	rspamcMock.CheckFn = func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+		checkCnt++
+		return mock.CheckFnDefault(ctx, r, hdrs)
+	}
+
+	assert.NoError(t, s.ProcessMaildrop())
+	assert.Equal(t, 2, checkCnt)
+	assert.Equal(t, 1, srv.MessageCount())
+
+	// the kept ham mail is not scanned again
+	assert.NoError(t, s.ProcessMaildrop())
+	assert.Equal(t, 2, checkCnt)
+	assert.Equal(t, 1, srv.MessageCount())
+}
+
+func TestPOP3ProcessMaildrop_SpamActionKeep(t *testing.T) {
+	srv := pop3server.StartServer(t)
+	addTestMails(t, srv)
+
+	s, _ := newTestPOP3Scanner(t, srv)
+	s.spamAction = POP3SpamActionKeep
+
+	assert.NoError(t, s.ProcessMaildrop())
+	assert.Equal(t, 2, srv.MessageCount())
+	assert.Equal(t, 2, len(s.scanned))
+}
+
+func TestPOP3ProcessMaildrop_ForwardCleanMails(t *testing.T) {
+	srv := pop3server.StartServer(t)
+	addTestMails(t, srv)
+
+	s, _ := newTestPOP3Scanner(t, srv)
+
+	var forwarded [][]byte
+	s.forwarder = forwarderFn(func(_ context.Context, msg io.Reader) error {
+		data, err := io.ReadAll(msg)
+		forwarded = append(forwarded, data)
+		return err
+	})
+
+	assert.NoError(t, s.ProcessMaildrop())
+	assert.Equal(t, 0, srv.MessageCount())
+	assert.Equal(t, 1, len(forwarded))
+	assert.Equal(t, true, bytes.Contains(forwarded[0], []byte(mail.HamMailSubject)))
+}
+
+func TestPOP3ProcessMaildrop_ForwardLoop(t *testing.T) {
+	srv := pop3server.StartServer(t)
+	addTestMails(t, srv)
+
+	s, _ := newTestPOP3Scanner(t, srv)
+	s.forwarder = forwarderFn(func(context.Context, io.Reader) error {
+		return forward.ErrLoop
+	})
+
+	assert.NoError(t, s.ProcessMaildrop())
+	// the clean mail is kept
+	assert.Equal(t, 1, srv.MessageCount())
+}
+
+func TestPOP3ProcessMaildrop_DeleteBeforeLaterError(t *testing.T) {
+	srv := pop3server.StartServer(t)
+	addTestMails(t, srv)
+
+	s, rspamcMock := newTestPOP3Scanner(t, srv)
+
+	var forwardCnt int
+	s.forwarder = forwarderFn(func(context.Context, io.Reader) error {
+		forwardCnt++
+		return nil
+	})
+
+	var checkCnt int
+	rspamcMock.CheckFn = func(ctx context.Context, r io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+		checkCnt++
+		if checkCnt == 2 {
+			return nil, errors.New("rspamd unavailable")
+		}
+		return mock.CheckFnDefault(ctx, r, hdrs)
+	}
+
+	assert.Error(t, s.ProcessMaildrop())
+	assert.Equal(t, 1, forwardCnt)
+	// the forwarded mail was deleted, the spam mail is kept
+	assert.Equal(t, 1, srv.MessageCount())
+
+	assert.NoError(t, s.ProcessMaildrop())
+	assert.Equal(t, 1, forwardCnt)
+	assert.Equal(t, 0, srv.MessageCount())
+}
+
+func TestPOP3ProcessMaildrop_Audit(t *testing.T) {
+	srv := pop3server.StartServer(t)
+	addTestMails(t, srv)
+
+	s, _ := newTestPOP3Scanner(t, srv)
+	s.forwarder = forwarderFn(func(context.Context, io.Reader) error { return nil })
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	var err error
+	s.audit, err = audit.Open(&audit.Config{Path: path})
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.ProcessMaildrop())
+	assert.NoError(t, s.audit.Close())
+
+	entries := readAuditLog(t, path)
+	assert.Equal(t, 2, len(entries))
+
+	assert.Equal(t, audit.ActionDelete, entries[0].Action)
+	assert.Equal(t, reasonForwarded, entries[0].Reason)
+	assert.Equal(t, "uid-1", entries[0].Key)
+	assert.Equal(t, mail.HamMailSubject, entries[0].Subject)
+
+	assert.Equal(t, audit.ActionDelete, entries[1].Action)
+	assert.Equal(t, reasonSpam, entries[1].Reason)
+	assert.Equal(t, "uid-2", entries[1].Key)
+	assert.Equal(t, float32(100), *entries[1].Score)
+}
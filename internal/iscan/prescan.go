@@ -0,0 +1,327 @@
+package iscan
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/trace"
+)
+
+// scanCycle holds the state of one [Client.ProcessScanBox] run.
+type scanCycle struct {
+	scanned []*scannedMail
+	// moves maps destination mailboxes to the UIDs of messages that are
+	// moved to them unmodified.
+	moves map[string][]uint32
+	// kept is the number of messages that are left in the scan mailbox.
+	kept uint32
+	// inPlace contains the UIDs of processed messages that are left in the
+	// scan mailbox, they are flagged with the scanned keyword.
+	inPlace []uint32
+	// inPlaceScanned are the scanned messages in inPlace, their
+	// temporary files are kept until they were flagged.
+	inPlaceScanned []*scannedMail
+	// failed contains the UIDs of messages whose scan failed repeatedly,
+	// they are flagged with the scan failed keyword.
+	failed []uint32
+	// entries contains the audit log entries of the messages in moves,
+	// inPlace and failed, by UID.
+	entries map[uint32]*audit.Entry
+	// seen contains the UIDs of all messages in the scan mailbox, when the
+	// iteration was not aborted.
+	seen map[uint32]struct{}
+	// aborted is true when the iteration over the messages in the scan
+	// mailbox stopped early because of an error.
+	aborted bool
+	// dups is nil if deduplication is disabled.
+	dups *duplicates
+	// degraded is true when rspamd became unavailable during the cycle,
+	// the remaining messages are not scanned.
+	degraded bool
+	errs     []error
+}
+
+func newScanCycle() *scanCycle {
+	return &scanCycle{
+		moves:   map[string][]uint32{},
+		entries: map[uint32]*audit.Entry{},
+		seen:    map[uint32]struct{}{},
+	}
+}
+
+// move records that the message of e is moved to mailbox.
+func (sc *scanCycle) move(mailbox string, e *audit.Entry) {
+	sc.moves[mailbox] = append(sc.moves[mailbox], e.UID)
+	sc.entries[e.UID] = e
+}
+
+// auditEntries returns the audit log entries of the messages with uids.
+func (sc *scanCycle) auditEntries(mailbox string, uids []uint32) []*audit.Entry {
+	result := make([]*audit.Entry, 0, len(uids))
+	for _, uid := range uids {
+		e, exists := sc.entries[uid]
+		if !exists {
+			e = &audit.Entry{Mailbox: mailbox, UID: uid}
+		}
+		result = append(result, e)
+	}
+
+	return result
+}
+
+// triage runs the checks that do not require scanning the message with rspamd.
+// When the message can be processed without a scan, the action is recorded in
+// sc and false is returned.
+// When the messages must be scanned, true is returned.
+func (c *Client) triage(sc *scanCycle, msg *imapclt.Message) bool {
+	logger := c.logger.With(
+		"mail.subject", msg.Envelope.Subject,
+		"mail.uid", msg.UID,
+	)
+
+	if c.deferred.isPending(msg.UID, time.Now()) {
+		sc.kept++
+		return false
+	}
+
+	if c.maxMessageSize > 0 && msg.Size > c.maxMessageSize {
+		logger := logger.With("mail.size", msg.Size, "action", c.oversizedAction)
+
+		switch c.oversizedAction {
+		case OversizedActionSkip:
+			logger.Info("skipping message, it exceeds the max. message size")
+			sc.kept++
+			return false
+		case OversizedActionMove:
+			logger.Info("moving message, it exceeds the max. message size")
+			sc.move(c.tooLargeMailbox, newAuditEntry(c.scanMailbox, msg.UID, &msg.Envelope, reasonTooLarge))
+			return false
+		case OversizedActionTruncate:
+			logger.Info("message exceeds the max. message size, scanning only the beginning")
+		}
+	}
+
+	if p, matched := matchSender(c.allowlist, msg.Envelope.From); matched {
+		logger.Info("sender is allowlisted, moving message without scanning",
+			"pattern", p, "event", "iscan.sender_allowlisted")
+		sc.move(c.inboxMailbox, newAuditEntry(c.scanMailbox, msg.UID, &msg.Envelope, reasonAllowlisted))
+		return false
+	}
+
+	if p, matched := matchSender(c.blocklist, msg.Envelope.From); matched {
+		logger.Info("sender is blocklisted, moving message without scanning",
+			"pattern", p, "event", "iscan.sender_blocklisted")
+		sc.move(c.spamMailbox, newAuditEntry(c.scanMailbox, msg.UID, &msg.Envelope, reasonBlocklisted))
+		return false
+	}
+
+	if !c.headerPreScan || len(c.scanResultKey) == 0 {
+		return true
+	}
+
+	score, found, err := c.signedScore(msg)
+	if err != nil {
+		logger.Debug("parsing message header failed", "error", err)
+		return true
+	}
+
+	if found {
+		mbox := c.inboxMailbox
+		if score >= c.spamTreshold {
+			if c.tagsSpam() {
+				// the message is scanned to flag it with the
+				// keywords of the policy
+				return true
+			}
+			mbox = c.spamMailbox
+		}
+
+		logger.Info("message was already scanned, moving it without rescanning",
+			"scan.score", score, "mailbox.destination", mbox)
+		e := newAuditEntry(c.scanMailbox, msg.UID, &msg.Envelope, reasonPrescanned)
+		e.Score = &score
+		sc.move(mbox, e)
+		return false
+	}
+
+	return true
+}
+
+// signedScore returns the score of the [hdrRspamdScore] header of msg, if it
+// has a valid signature, see [scanResultSignature].
+// Any sender can add a score header, if the header does not exist or is not
+// signed with [Client.scanResultKey], found is false.
+func (c *Client) signedScore(msg *imapclt.Message) (score float32, found bool, _ error) {
+	hdr, err := readHeader(msg.Message)
+	if err != nil {
+		return 0, false, err
+	}
+
+	v := hdr.Get(hdrRspamdScore)
+	sig := hdr.Get(hdrSignature)
+	// without a Message-ID the signature could be copied from another mail
+	if v == "" || sig == "" || msg.Envelope.MessageID == "" {
+		return 0, false, nil
+	}
+
+	expected := scanResultSignature(c.scanResultKey, msg.Envelope.MessageID, v)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		c.logger.Warn("ignoring scan result header with invalid signature",
+			"mail.uid", msg.UID, "event", "iscan.invalid_signature")
+		return 0, false, nil
+	}
+
+	return parseScore(v)
+}
+
+// scanResultSignature returns the hex encoded HMAC-SHA256 of the Message-ID
+// and the score header value of a mail with key.
+func scanResultSignature(key []byte, messageID, score string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(messageID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(score))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func readHeader(r io.Reader) (textproto.MIMEHeader, error) {
+	hdr, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return hdr, nil
+}
+
+// parseScore parses the value of a [hdrRspamdScore] header, if it is empty
+// found is false.
+func parseScore(v string) (score float32, found bool, _ error) {
+	if v == "" {
+		return 0, false, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 32)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return float32(f), true, nil
+}
+
+// moveTriaged moves the messages recorded by [Client.triage] to their
+// destination mailboxes.
+func (c *Client) moveTriaged(ctx context.Context, sc *scanCycle) {
+	for _, mbox := range slices.Sorted(maps.Keys(sc.moves)) {
+		uids := sc.moves[mbox]
+
+		if mbox == c.scanMailbox {
+			sc.inPlace = append(sc.inPlace, uids...)
+			c.cntProcessedMails.Add(uint64(len(uids)))
+			continue
+		}
+
+		if err := c.move(ctx, c.clt, uids, mbox); err != nil {
+			sc.errs = append(sc.errs, fmt.Errorf("moving unscanned messages to %s failed: %w", mbox, err))
+			continue
+		}
+		c.recordAudit(audit.ActionMove, mbox, sc.auditEntries(c.scanMailbox, uids))
+
+		c.logger.Info("moved unscanned messages",
+			"count", len(uids),
+			"mailbox.source", c.scanMailbox,
+			"mailbox.destination", mbox,
+		)
+		c.cntProcessedMails.Add(uint64(len(uids)))
+	}
+}
+
+// keepInPlace records scanned ham messages, and spam that is tagged by the
+// scan policy, as left in place when the scan mailbox is also the inbox
+// mailbox.
+// The messages are not replaced with a copy that contains the scan result
+// headers.
+// It returns the scanned messages that must be relocated.
+func (c *Client) keepInPlace(sc *scanCycle) []*scannedMail {
+	if c.inboxMailbox != c.scanMailbox {
+		return sc.scanned
+	}
+
+	result := make([]*scannedMail, 0, len(sc.scanned))
+	for _, mail := range sc.scanned {
+		if c.scanDestination(mail.CheckResult) != c.inboxMailbox {
+			result = append(result, mail)
+			continue
+		}
+
+		if c.isBorderline(mail.CheckResult) {
+			c.addFlags(c.clt, []uint32{mail.UID}, c.borderlineFlags)
+		}
+		c.addFlags(c.clt, []uint32{mail.UID}, c.policyKeywords(mail.CheckResult))
+		sc.inPlace = append(sc.inPlace, mail.UID)
+		sc.inPlaceScanned = append(sc.inPlaceScanned, mail)
+		sc.entries[mail.UID] = c.scannedAuditEntry(mail)
+	}
+
+	return result
+}
+
+// markScanned flags the messages that are left in place with the scanned
+// keyword, to exclude them from following scans.
+// Clean scanned messages are forwarded after they were flagged.
+func (c *Client) markScanned(ctx context.Context, sc *scanCycle) {
+	defer func() {
+		for _, mail := range sc.inPlaceScanned {
+			c.removeTempFile(mail.Path)
+		}
+	}()
+
+	if len(sc.inPlace) == 0 {
+		return
+	}
+
+	sc.kept += uint32(len(sc.inPlace))
+
+	_, span := c.tracer.Start(ctx, "imap.add_keyword",
+		trace.String("mailbox.source", c.scanMailbox),
+		trace.Int("mail.count", int64(len(sc.inPlace))),
+	)
+	defer span.End()
+
+	err := c.clt.AddKeyword(sc.inPlace, c.scannedKeyword)
+	if err != nil {
+		span.SetError(err)
+		// the messages are scanned again in the next cycle
+		c.logger.Warn("flagging scanned messages failed",
+			"error", err,
+			"keyword", c.scannedKeyword,
+			"count", len(sc.inPlace),
+			"event", "imap.keyword_failed",
+		)
+		return
+	}
+	c.recordAudit(audit.ActionFlag, "", sc.auditEntries(c.scanMailbox, sc.inPlace), c.scannedKeyword)
+
+	for _, mail := range sc.inPlaceScanned {
+		c.forwardClean(ctx, mail)
+	}
+
+	c.logger.Info("left scanned messages in place",
+		"count", len(sc.inPlace),
+		"mailbox.source", c.scanMailbox,
+		"keyword", c.scannedKeyword,
+	)
+}
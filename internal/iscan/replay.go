@@ -0,0 +1,264 @@
+package iscan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/maildir"
+)
+
+// Label is the classification of a mail that is known in advance.
+type Label string
+
+const (
+	LabelNone Label = ""
+	LabelSpam Label = "spam"
+	LabelHam  Label = "ham"
+)
+
+// folderLabel returns the label of the mails in the folder with the given
+// name. Folders whose name contains "spam" or "junk" contain spam, folders
+// whose name contains "ham" or that are named "inbox" contain ham.
+func folderLabel(name string) Label {
+	name = strings.ToLower(name)
+	switch {
+	case strings.Contains(name, "spam"), strings.Contains(name, "junk"):
+		return LabelSpam
+	case strings.Contains(name, "ham"), name == "inbox":
+		return LabelHam
+	default:
+		return LabelNone
+	}
+}
+
+type ReplayConfig struct {
+	SpamTreshold    float32
+	RspamdDeliverTo string
+	RspamdUser      string
+	// ScoreOverrides is optional, see [Config.ScoreOverrides].
+	ScoreOverrides map[string]float32
+
+	Logger *slog.Logger
+	Rspamc RspamdClient
+}
+
+// Replayer scans the mails of mbox files and Maildirs without modifying them,
+// to evaluate the configuration against a known set of spam and ham.
+type Replayer struct {
+	rspamc          RspamdClient
+	logger          *slog.Logger
+	spamTreshold    float32
+	rspamdDeliverTo string
+	rspamdUser      string
+	scoreOverrides  []scoreOverride
+}
+
+func NewReplayer(cfg *ReplayConfig) (*Replayer, error) {
+	if cfg.Rspamc == nil {
+		return nil, errors.New("Rspamc is nil")
+	}
+
+	scoreOverrides, err := parseScoreOverrides(cfg.ScoreOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ScoreOverrides: %w", err)
+	}
+
+	return &Replayer{
+		rspamc:          cfg.Rspamc,
+		logger:          log.Module(cfg.Logger, "replay"),
+		spamTreshold:    cfg.SpamTreshold,
+		rspamdDeliverTo: cfg.RspamdDeliverTo,
+		rspamdUser:      cfg.RspamdUser,
+		scoreOverrides:  scoreOverrides,
+	}, nil
+}
+
+// ReplayResult is the scan result of a single mail.
+type ReplayResult struct {
+	// Source is the path of the mail file, mails in mbox files are
+	// referenced as PATH:N, where N is the 1-based position in the file.
+	Source  string  `json:"source"`
+	Folder  string  `json:"folder"`
+	Label   Label   `json:"label,omitempty"`
+	Subject string  `json:"subject"`
+	Score   float32 `json:"score"`
+	Action  string  `json:"action"`
+	IsSpam  bool    `json:"is_spam"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// ReplaySummary compares the scan results with the labels of the mails.
+type ReplaySummary struct {
+	// TruePositives is the number of spam mails that were detected.
+	TruePositives int `json:"true_positives"`
+	// FalsePositives is the number of ham mails that were classified as
+	// spam.
+	FalsePositives int `json:"false_positives"`
+	// TrueNegatives is the number of ham mails that were classified as
+	// ham.
+	TrueNegatives int `json:"true_negatives"`
+	// FalseNegatives is the number of spam mails that were not detected.
+	FalseNegatives int `json:"false_negatives"`
+	// Unlabeled is the number of scanned mails without label.
+	Unlabeled int `json:"unlabeled"`
+	// Errors is the number of mails that could not be scanned.
+	Errors int `json:"errors"`
+}
+
+func (s *ReplaySummary) add(r *ReplayResult) {
+	switch {
+	case r.Error != "":
+		s.Errors++
+	case r.Label == LabelSpam && r.IsSpam:
+		s.TruePositives++
+	case r.Label == LabelSpam:
+		s.FalseNegatives++
+	case r.Label == LabelHam && r.IsSpam:
+		s.FalsePositives++
+	case r.Label == LabelHam:
+		s.TrueNegatives++
+	default:
+		s.Unlabeled++
+	}
+}
+
+type ReplayReport struct {
+	Threshold float32         `json:"threshold"`
+	Results   []*ReplayResult `json:"results"`
+	Summary   ReplaySummary   `json:"summary"`
+}
+
+// Replay scans all mails in paths. A path can be a Maildir, its Maildir++
+// folders are scanned too, or an mbox file.
+// The label of the mails is derived from the name of their folder,
+// respectively of the mbox file.
+// Mails that can not be scanned are recorded in the report, an error is only
+// returned if a path can not be read.
+func (r *Replayer) Replay(ctx context.Context, paths []string) (*ReplayReport, error) {
+	report := ReplayReport{Threshold: r.spamTreshold}
+
+	add := func(res *ReplayResult) {
+		report.Results = append(report.Results, res)
+		report.Summary.add(res)
+	}
+
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if fi.IsDir() {
+			err = r.replayMaildir(ctx, path, add)
+		} else {
+			err = r.replayMbox(ctx, path, add)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	return &report, nil
+}
+
+func (r *Replayer) replayMaildir(ctx context.Context, path string, add func(*ReplayResult)) error {
+	type folder struct {
+		name string
+		dir  maildir.Dir
+	}
+	folders := []folder{{filepath.Base(filepath.Clean(path)), maildir.Dir(path)}}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name, isFolder := strings.CutPrefix(e.Name(), ".")
+		if !e.IsDir() || !isFolder || name == "" {
+			continue
+		}
+		folders = append(folders, folder{name, maildir.Dir(filepath.Join(path, e.Name()))})
+	}
+
+	for _, f := range folders {
+		msgs, err := f.dir.Messages()
+		if err != nil {
+			return fmt.Errorf("reading Maildir folder %q failed: %w", f.name, err)
+		}
+
+		for _, m := range msgs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			res := &ReplayResult{Source: f.dir.Path(m), Folder: f.name, Label: folderLabel(f.name)}
+			data, err := os.ReadFile(res.Source)
+			if err != nil {
+				res.Error = err.Error()
+			} else {
+				r.scan(ctx, data, res)
+			}
+			add(res)
+		}
+	}
+
+	return nil
+}
+
+func (r *Replayer) replayMbox(ctx context.Context, path string, add func(*ReplayResult)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	folder := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	var n int
+
+	return mail.ReadMbox(f, func(data []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n++
+		res := &ReplayResult{
+			Source: fmt.Sprintf("%s:%d", path, n),
+			Folder: folder,
+			Label:  folderLabel(folder),
+		}
+		r.scan(ctx, data, res)
+		add(res)
+
+		return nil
+	})
+}
+
+// scan checks data with rspamd and stores the result in res.
+func (r *Replayer) scan(ctx context.Context, data []byte, res *ReplayResult) {
+	logger := r.logger.With("mail.source", res.Source)
+
+	hdrs := parseMailHeaders(logger, data)
+	hdrs.DeliverTo = r.rspamdDeliverTo
+	hdrs.User = r.rspamdUser
+	res.Subject = hdrs.Subject
+
+	result, err := r.rspamc.Check(ctx, bytes.NewReader(data), hdrs)
+	if err != nil {
+		logger.Warn("scanning mail failed", "error", err, "event", "replay.scan_failed")
+		res.Error = err.Error()
+		return
+	}
+
+	result = applyScoreOverride(logger, r.scoreOverrides, hdrs.From, result)
+	res.Score = result.Score
+	res.Action = result.Action
+	res.IsSpam = result.Score >= r.spamTreshold
+}
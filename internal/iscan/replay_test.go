@@ -0,0 +1,75 @@
+package iscan
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/maildir"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+)
+
+func writeTestMail(t *testing.T, dir maildir.Dir, name, srcPath string) {
+	t.Helper()
+
+	data, err := os.ReadFile(srcPath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(string(dir), maildir.SubdirNew, name), data, 0o600))
+}
+
+func TestReplay(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	root := maildir.Dir(filepath.Join(tmpDir, "Maildir"))
+	assert.NoError(t, root.Create())
+	writeTestMail(t, root, "1", mail.TestSpamMailPath(t))
+
+	junk := root.Folder("Junk")
+	assert.NoError(t, junk.Create())
+	writeTestMail(t, junk, "2", mail.TestSpamMailPath(t))
+	writeTestMail(t, junk, "3", mail.TestHamMailPath(t))
+
+	ham, err := os.ReadFile(mail.TestHamMailPath(t))
+	assert.NoError(t, err)
+	mboxPath := filepath.Join(tmpDir, "ham.mbox")
+	mbox := append([]byte("From test@example.com Mon Jan  1 00:00:00 2024\n"), ham...)
+	assert.NoError(t, os.WriteFile(mboxPath, mbox, 0o600))
+
+	r, err := NewReplayer(&ReplayConfig{
+		SpamTreshold: 10,
+		Logger:       log.SlogTestLogger(t),
+		Rspamc:       mock.NewRspamc(),
+	})
+	assert.NoError(t, err)
+
+	report, err := r.Replay(context.Background(), []string{string(root), mboxPath})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 4, len(report.Results))
+	assert.Equal(t, ReplaySummary{
+		TruePositives:  1,
+		FalseNegatives: 1,
+		TrueNegatives:  1,
+		Unlabeled:      1,
+	}, report.Summary)
+
+	assert.Equal(t, mboxPath+":1", report.Results[3].Source)
+	assert.Equal(t, LabelHam, report.Results[3].Label)
+}
+
+func TestFolderLabel(t *testing.T) {
+	for name, expected := range map[string]Label{
+		"INBOX":         LabelHam,
+		"Junk":          LabelSpam,
+		"Archive.Spam":  LabelSpam,
+		"ham-2024":      LabelHam,
+		"Sent":          LabelNone,
+		"inbox-archive": LabelNone,
+	} {
+		assert.Equal(t, expected, folderLabel(name))
+	}
+}
@@ -0,0 +1,148 @@
+package iscan
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/stats"
+	"github.com/fho/rspamd-iscan/internal/trace"
+)
+
+// retentionInterval is the interval in that the spam and scan failed
+// mailboxes are checked for expired messages.
+const retentionInterval = time.Hour
+
+// messageDeleter is implemented by the clients that can delete messages
+// permanently.
+type messageDeleter interface {
+	Delete(uids []uint32) error
+}
+
+// ProcessRetention deletes the messages in the spam mailbox and in the scan
+// failed mailbox that are older than their retention. Expired messages in the
+// spam mailbox are learned as spam before, if [Config.LearnExpiredSpam] is
+// enabled.
+// The mailboxes are only checked once per [retentionInterval].
+func (c *Client) ProcessRetention() error {
+	return c.processRetention(c.clt)
+}
+
+func (c *Client) processRetention(clt IMAPClient) error {
+	if c.spamRetention <= 0 && c.scanFailedRetention <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	if now.Before(c.nextRetentionAt) {
+		return nil
+	}
+
+	deleter, ok := clt.(messageDeleter)
+	if !ok {
+		return errors.New("deleting messages is not supported by the protocol")
+	}
+
+	if c.spamRetention > 0 {
+		if err := c.deleteExpired(clt, deleter, c.spamMailbox, c.spamRetention, c.learnExpiredSpam); err != nil {
+			return err
+		}
+	}
+
+	if c.scanFailedRetention > 0 {
+		if err := c.deleteExpired(clt, deleter, c.scanFailedMailbox, c.scanFailedRetention, false); err != nil {
+			return err
+		}
+	}
+
+	c.nextRetentionAt = now.Add(retentionInterval)
+
+	return nil
+}
+
+// deleteExpired deletes the messages in mailbox whose internal date is older
+// than retention. If learn is true, they are learned as spam before, messages
+// whose learning failed are deleted in a later run.
+func (c *Client) deleteExpired(clt IMAPClient, deleter messageDeleter, mailbox string, retention time.Duration, learn bool) (err error) {
+	var deleteUIDs []uint32
+	var entries []*audit.Entry
+	var counters stats.Counters
+
+	ctx, span := c.tracer.Start(c.ctx, "iscan.delete_expired", trace.String("mailbox.source", mailbox))
+	defer func() {
+		span.SetAttributes(trace.Int("mail.count", int64(len(deleteUIDs))))
+		span.SetError(err)
+		span.End()
+
+		if err != nil {
+			counters.Errors++
+		}
+		recordStats(c.logger, c.stats, &counters)
+	}()
+
+	logger := c.logger.With("mailbox.source", mailbox, "retention", retention)
+
+	res, err := clt.Search(mailbox, &imapclt.SearchCriteria{MinAge: retention})
+	if err != nil {
+		return fmt.Errorf("searching expired messages in %s failed: %w", mailbox, err)
+	}
+
+	if len(res.UIDs) == 0 {
+		return nil
+	}
+
+	fetchOpts := imapclt.FetchOptions{UIDs: res.UIDs, HeaderOnly: !learn}
+	for msg, err := range clt.Messages(ctx, mailbox, &fetchOpts) {
+		if err != nil {
+			if ctx.Err() != nil {
+				// delete the messages that were already learned
+				break
+			}
+			return fmt.Errorf("fetching expired messages from %s failed: %w", mailbox, err)
+		}
+
+		e := newAuditEntry(mailbox, msg.UID, &msg.Envelope, reasonExpired)
+
+		if learn {
+			r := countingReader{r: msg.Message}
+			err := c.rspamc.Spam(ctx, &r, c.rspamcHdrs(&msg.Envelope, netip.Addr{}))
+			counters.Bytes += r.n
+			if err != nil {
+				if ctx.Err() != nil || errors.Is(err, rspamc.ErrCircuitOpen) {
+					break
+				}
+				logger.Warn("learning expired message as spam failed, it is deleted later",
+					"error", err, "mail.uid", msg.UID, "event", "rspamd.msg_learn_failed")
+				counters.Errors++
+				continue
+			}
+
+			counters.Learned++
+			c.recordAudit(audit.ActionLearnSpam, "", []*audit.Entry{e})
+		}
+
+		deleteUIDs = append(deleteUIDs, msg.UID)
+		entries = append(entries, e)
+	}
+
+	if len(deleteUIDs) == 0 {
+		return nil
+	}
+
+	if err := deleter.Delete(deleteUIDs); err != nil {
+		return fmt.Errorf("deleting expired messages in %s failed: %w", mailbox, err)
+	}
+	c.recordAudit(audit.ActionDelete, "", entries)
+
+	logger.Info("deleted expired messages",
+		"count", len(deleteUIDs),
+		"learned", counters.Learned,
+		"event", "iscan.expired_deleted",
+	)
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package iscan
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+)
+
+func TestProcessRetention(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.spamRetention = 30 * 24 * time.Hour
+	clt.learnExpiredSpam = true
+	clt.scanFailedMailbox = srv.BackupMailbox
+	clt.scanFailedRetention = 7 * 24 * time.Hour
+
+	var learned []string
+	rspamcMock := mock.NewRspamc()
+	rspamcMock.SpamFn = func(_ context.Context, _ io.Reader, hdrs *rspamc.MailHeaders) error {
+		learned = append(learned, hdrs.Subject)
+		return nil
+	}
+	clt.rspamc = rspamcMock
+
+	expired := time.Now().Add(-40 * 24 * time.Hour)
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.SpamMailbox, expired, nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.SpamMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.BackupMailbox, expired, nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.BackupMailbox, time.Now().Add(-24*time.Hour), nil))
+
+	assert.NoError(t, clt.ProcessRetention())
+
+	// the expired spam was learned, messages in the scan failed mailbox
+	// are not learned
+	assert.Equal(t, 1, len(learned))
+	assert.Equal(t, mail.SpamMailSubject, learned[0])
+
+	assert.Equal(t, 0, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.HamMailSubject))
+	assert.Equal(t, 0, mailboxContainsMailCnt(t, clt.clt, srv.BackupMailbox, mail.HamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.BackupMailbox, mail.SpamMailSubject))
+
+	// the mailboxes are only checked once per interval
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.SpamMailbox, expired, nil))
+	assert.NoError(t, clt.ProcessRetention())
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+
+	clt.nextRetentionAt = time.Time{}
+	assert.NoError(t, clt.ProcessRetention())
+	assert.Equal(t, 0, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+	assert.Equal(t, 2, len(learned))
+}
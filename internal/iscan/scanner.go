@@ -0,0 +1,146 @@
+package iscan
+
+import (
+	"context"
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// Scanner checks messages and learns them as spam or ham.
+// It is implemented by the rspamd client and by other content scanners, like
+// the ClamAV client.
+type Scanner interface {
+	Check(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error)
+	Spam(context.Context, io.Reader, *rspamc.MailHeaders) error
+	Ham(context.Context, io.Reader, *rspamc.MailHeaders) error
+}
+
+// actionSeverity are the rspamd actions ordered from the least to the most
+// severe one. Unknown actions are less severe than all of them.
+var actionSeverity = []string{
+	"no action",
+	actionGreylist,
+	"add header",
+	"rewrite subject",
+	actionSoftReject,
+	"reject",
+}
+
+// ChainScanner checks messages with multiple scanners, e.g. for malware before
+// they are checked by rspamd, and combines their results.
+// Learn requests are sent to all scanners, fuzzy requests only to rspamd.
+type ChainScanner struct {
+	scanners []Scanner
+	rspamd   RspamdClient
+}
+
+// NewChainScanner returns a ChainScanner that checks messages with scanners in
+// the given order, followed by rspamd.
+func NewChainScanner(rspamd RspamdClient, scanners ...Scanner) *ChainScanner {
+	return &ChainScanner{
+		scanners: append(slices.Clone(scanners), rspamd),
+		rspamd:   rspamd,
+	}
+}
+
+// Check sends msg to all scanners and returns their combined result.
+// The scores are summed up, the symbols are merged and the most severe action
+// is used. If a scanner fails, the error is returned and msg is not sent to
+// the following scanners.
+func (c *ChainScanner) Check(ctx context.Context, msg io.Reader, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+	body, err := mail.Rewindable(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*rspamc.CheckResult
+	for _, s := range c.scanners {
+		r, err := body()
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := s.Check(ctx, r, hdrs)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, result)
+	}
+
+	return combineResults(results), nil
+}
+
+// Ham learns msg as ham with all scanners.
+func (c *ChainScanner) Ham(ctx context.Context, msg io.Reader, hdrs *rspamc.MailHeaders) error {
+	return c.learn(ctx, msg, hdrs, Scanner.Ham)
+}
+
+// Spam learns msg as spam with all scanners.
+func (c *ChainScanner) Spam(ctx context.Context, msg io.Reader, hdrs *rspamc.MailHeaders) error {
+	return c.learn(ctx, msg, hdrs, Scanner.Spam)
+}
+
+func (c *ChainScanner) learn(
+	ctx context.Context,
+	msg io.Reader,
+	hdrs *rspamc.MailHeaders,
+	fn func(Scanner, context.Context, io.Reader, *rspamc.MailHeaders) error,
+) error {
+	body, err := mail.Rewindable(msg)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range c.scanners {
+		r, err := body()
+		if err != nil {
+			return err
+		}
+
+		if err := fn(s, ctx, r, hdrs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *ChainScanner) FuzzyAdd(ctx context.Context, msg io.Reader, hdrs *rspamc.MailHeaders, flag, weight int) error {
+	return c.rspamd.FuzzyAdd(ctx, msg, hdrs, flag, weight)
+}
+
+func (c *ChainScanner) FuzzyDel(ctx context.Context, msg io.Reader, hdrs *rspamc.MailHeaders, flag int) error {
+	return c.rspamd.FuzzyDel(ctx, msg, hdrs, flag)
+}
+
+// combineResults merges results into one, see [ChainScanner.Check].
+// The milter headers of the last result that has them are used. The result is
+// only skipped if all results are.
+func combineResults(results []*rspamc.CheckResult) *rspamc.CheckResult {
+	combined := rspamc.CheckResult{
+		Action:    actionSeverity[0],
+		IsSkipped: true,
+		Symbols:   map[string]*rspamc.Symbol{},
+	}
+
+	for _, r := range results {
+		combined.Score += r.Score
+		combined.IsSkipped = combined.IsSkipped && r.IsSkipped
+		maps.Copy(combined.Symbols, r.Symbols)
+
+		if slices.Index(actionSeverity, r.Action) > slices.Index(actionSeverity, combined.Action) {
+			combined.Action = r.Action
+		}
+
+		if r.Milter != nil {
+			combined.Milter = r.Milter
+		}
+	}
+
+	return &combined
+}
@@ -0,0 +1,96 @@
+package iscan
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+)
+
+func TestChainScannerCheck(t *testing.T) {
+	const msg = "Subject: test\r\n\r\nbody"
+
+	var virusScanned, spamScanned string
+	virus := &mock.Rspamc{
+		CheckFn: func(_ context.Context, r io.Reader, _ *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			data, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			virusScanned = string(data)
+			return &rspamc.CheckResult{
+				Action: "reject",
+				Score:  100,
+				Symbols: map[string]*rspamc.Symbol{
+					"CLAMAV_VIRUS": {Name: "CLAMAV_VIRUS", Score: 100},
+				},
+			}, nil
+		},
+	}
+	spam := &mock.Rspamc{
+		CheckFn: func(_ context.Context, r io.Reader, _ *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			data, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			spamScanned = string(data)
+			return &rspamc.CheckResult{
+				Action: "add header",
+				Score:  6.5,
+				Symbols: map[string]*rspamc.Symbol{
+					"MIME_GOOD": {Name: "MIME_GOOD", Score: -0.1},
+				},
+				Milter: &rspamc.Milter{},
+			}, nil
+		},
+	}
+
+	chain := NewChainScanner(spam, virus)
+
+	// the message is not seekable, it is passed completely to both
+	// scanners
+	result, err := chain.Check(context.Background(), io.MultiReader(strings.NewReader(msg)), &rspamc.MailHeaders{})
+	assert.NoError(t, err)
+	assert.Equal(t, msg, virusScanned)
+	assert.Equal(t, msg, spamScanned)
+
+	assert.Equal(t, "reject", result.Action)
+	assert.Equal(t, 106.5, result.Score)
+	assert.Equal(t, 2, len(result.Symbols))
+	assert.Equal(t, true, result.Milter != nil)
+	assert.Equal(t, false, result.IsSkipped)
+}
+
+func TestChainScannerCheckError(t *testing.T) {
+	errScan := errors.New("scan failed")
+	virus := &mock.Rspamc{
+		CheckFn: func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			return nil, errScan
+		},
+	}
+	spam := &mock.Rspamc{
+		CheckFn: func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			t.Error("message was sent to rspamd after the virus scan failed")
+			return &rspamc.CheckResult{}, nil
+		},
+	}
+
+	_, err := NewChainScanner(spam, virus).Check(context.Background(), strings.NewReader("body"), &rspamc.MailHeaders{})
+	assert.Equal(t, true, errors.Is(err, errScan))
+}
+
+func TestCombineResultsActions(t *testing.T) {
+	result := combineResults([]*rspamc.CheckResult{
+		{Action: "no action", IsSkipped: true},
+		{Action: actionGreylist, IsSkipped: true},
+	})
+	assert.Equal(t, actionGreylist, result.Action)
+	assert.Equal(t, true, result.IsSkipped)
+
+	result = combineResults([]*rspamc.CheckResult{
+		{Action: actionSoftReject},
+		{Action: "rewrite subject"},
+	})
+	assert.Equal(t, actionSoftReject, result.Action)
+}
@@ -0,0 +1,50 @@
+package iscan
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// pollScheduler computes the interval in which mailboxes are polled.
+// While new messages are found, the mailboxes are polled every minInterval.
+// When a poll finds no new messages the interval is doubled, up to
+// maxInterval.
+// A random duration in the range [0, jitter) is added to every interval to
+// prevent that multiple rspamd-iscan instances poll a server at the same
+// time.
+type pollScheduler struct {
+	minInterval time.Duration
+	maxInterval time.Duration
+	jitter      time.Duration
+
+	interval time.Duration
+}
+
+func newPollScheduler(minInterval, maxInterval, jitter time.Duration) *pollScheduler {
+	return &pollScheduler{
+		minInterval: minInterval,
+		maxInterval: maxInterval,
+		jitter:      jitter,
+		interval:    minInterval,
+	}
+}
+
+// next returns the duration to wait until the next poll.
+func (s *pollScheduler) next() time.Duration {
+	if s.jitter <= 0 {
+		return s.interval
+	}
+
+	return s.interval + rand.N(s.jitter) //nolint:gosec // no cryptographic randomness needed
+}
+
+// record adapts the interval to the result of a poll.
+// active is true if the poll found new messages.
+func (s *pollScheduler) record(active bool) {
+	if active {
+		s.interval = s.minInterval
+		return
+	}
+
+	s.interval = min(2*s.interval, s.maxInterval)
+}
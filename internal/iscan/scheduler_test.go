@@ -0,0 +1,39 @@
+package iscan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestPollSchedulerBacksOff(t *testing.T) {
+	s := newPollScheduler(30*time.Second, 3*time.Minute, 0)
+	assert.Equal(t, 30*time.Second, s.next())
+
+	s.record(false)
+	assert.Equal(t, time.Minute, s.next())
+
+	s.record(false)
+	assert.Equal(t, 2*time.Minute, s.next())
+
+	s.record(false)
+	assert.Equal(t, 3*time.Minute, s.next())
+
+	s.record(false)
+	assert.Equal(t, 3*time.Minute, s.next())
+
+	s.record(true)
+	assert.Equal(t, 30*time.Second, s.next())
+}
+
+func TestPollSchedulerJitter(t *testing.T) {
+	s := newPollScheduler(time.Minute, time.Minute, 10*time.Second)
+
+	for range 100 {
+		d := s.next()
+		if d < time.Minute || d >= time.Minute+10*time.Second {
+			t.Fatalf("interval %s is out of range", d)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package iscan
+
+import (
+	"fmt"
+	"strings"
+)
+
+// senderPattern matches e-mail sender addresses.
+// It is either:
+//   - an address ("user@example.com"), matching the address,
+//   - a domain ("example.com"), matching all addresses of the domain,
+//   - a wildcard domain ("*.example.com"), matching all addresses of
+//     subdomains of the domain.
+//
+// Matching is case-insensitive.
+type senderPattern string
+
+func parseSenderPatterns(patterns []string) ([]senderPattern, error) {
+	result := make([]senderPattern, 0, len(patterns))
+
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" || p == "*." || strings.Count(p, "@") > 1 ||
+			strings.HasSuffix(p, "@") || strings.Contains(p[1:], "*") {
+			return nil, fmt.Errorf("invalid sender pattern: %q", p)
+		}
+
+		result = append(result, senderPattern(p))
+	}
+
+	return result, nil
+}
+
+func (p senderPattern) matches(addr string) bool {
+	addr = strings.ToLower(addr)
+	pattern := string(p)
+
+	if strings.Contains(pattern, "@") {
+		return addr == pattern
+	}
+
+	_, domain, found := strings.Cut(addr, "@")
+	if !found {
+		return false
+	}
+
+	if suffix, isWildcard := strings.CutPrefix(pattern, "*"); isWildcard {
+		return strings.HasSuffix(domain, suffix)
+	}
+
+	return domain == pattern
+}
+
+// matchSender returns the first pattern that matches one of the addresses.
+func matchSender(patterns []senderPattern, addrs []string) (senderPattern, bool) {
+	for _, p := range patterns {
+		for _, addr := range addrs {
+			if p.matches(addr) {
+				return p, true
+			}
+		}
+	}
+
+	return "", false
+}
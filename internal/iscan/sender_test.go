@@ -0,0 +1,42 @@
+package iscan
+
+import (
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestSenderPatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		addr    string
+		matches bool
+	}{
+		{"user@example.com", "user@example.com", true},
+		{"user@example.com", "User@Example.com", true},
+		{"user@example.com", "other@example.com", false},
+		{"example.com", "user@example.com", true},
+		{"example.com", "user@sub.example.com", false},
+		{"*.example.com", "user@sub.example.com", true},
+		{"*.example.com", "user@example.com", false},
+		{"*.example.com", "user@badexample.com", false},
+		{"example.com", "example.com", false},
+	}
+
+	for _, tt := range tests {
+		patterns, err := parseSenderPatterns([]string{tt.pattern})
+		assert.NoError(t, err)
+
+		if patterns[0].matches(tt.addr) != tt.matches {
+			t.Errorf("pattern %q matches %q: %v, expected: %v",
+				tt.pattern, tt.addr, !tt.matches, tt.matches)
+		}
+	}
+}
+
+func TestParseSenderPatternsInvalid(t *testing.T) {
+	for _, p := range []string{"", "a@b@c", "user@", "foo.*.com", "*."} {
+		_, err := parseSenderPatterns([]string{p})
+		assert.Error(t, err, p)
+	}
+}
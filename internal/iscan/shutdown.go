@@ -0,0 +1,35 @@
+package iscan
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultShutdownTimeout is the shutdown timeout that is used when none is
+// configured.
+const defaultShutdownTimeout = 30 * time.Second
+
+func shutdownTimeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		return defaultShutdownTimeout
+	}
+
+	return timeout
+}
+
+// waitTimeout waits until wg is done. It returns false if that did not happen
+// within timeout.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,109 @@
+package iscan
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/stats"
+	"github.com/fho/rspamd-iscan/internal/trace"
+)
+
+// ProcessSpamMailbox learns the messages as spam, that were moved to the spam
+// mailbox by the user instead of the scanner.
+// Messages that the scanner moves to the spam mailbox are flagged with
+// the spam learned keyword, messages without it are learned and flagged
+// afterwards. They are left in the spam mailbox.
+// Only the keyword decides if a message is learned. Ham that the scanner
+// delivered with scan result headers and the user moved to the spam mailbox
+// is learned too.
+func (c *Client) ProcessSpamMailbox() error {
+	return c.processSpamMailbox(c.clt)
+}
+
+func (c *Client) processSpamMailbox(clt IMAPClient) (err error) {
+	if c.spamLearnedKeyword == "" {
+		return nil
+	}
+
+	var learnedUIDs []uint32
+	var bytesRead uint64
+
+	ctx, span := c.tracer.Start(c.ctx, "iscan.learn_spam_mailbox", trace.String("mailbox.source", c.spamMailbox))
+	defer func() {
+		span.SetAttributes(trace.Int("mail.count", int64(len(learnedUIDs))))
+		span.SetError(err)
+		span.End()
+
+		counters := stats.Counters{Learned: uint64(len(learnedUIDs)), Bytes: bytesRead}
+		if err != nil {
+			counters.Errors++
+		}
+		recordStats(c.logger, c.stats, &counters)
+	}()
+
+	logger := c.logger.With("mailbox.source", c.spamMailbox)
+	logger.Debug("checking spam mailbox for messages that were moved by the user")
+
+	res, err := clt.Search(c.spamMailbox, &imapclt.SearchCriteria{
+		NotFlags: []string{c.spamLearnedKeyword},
+	})
+	if err != nil {
+		return fmt.Errorf("searching messages in spam mailbox failed: %w", err)
+	}
+
+	if len(res.UIDs) == 0 {
+		return nil
+	}
+
+	//nolint:prealloc // number of learned messages is unknown
+	var flagged []*audit.Entry
+
+	fetchOpts := imapclt.FetchOptions{UIDs: res.UIDs}
+	for msg, err := range clt.Messages(ctx, c.spamMailbox, &fetchOpts) {
+		if err != nil {
+			if ctx.Err() != nil {
+				// flag the messages that were already learned
+				break
+			}
+			return fmt.Errorf("fetching messages from spam mailbox failed: %w", err)
+		}
+
+		logger := logger.With("mail.subject", msg.Envelope.Subject, "mail.uid", msg.UID)
+
+		r := countingReader{r: msg.Message}
+		err = c.rspamc.Spam(ctx, &r, c.rspamcHdrs(&msg.Envelope, netip.Addr{}))
+		bytesRead += r.n
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			// the message is learned again in the next cycle
+			logger.Warn("learning message as spam failed", "error", err,
+				"event", "rspamd.msg_learn_failed")
+			continue
+		}
+
+		logger.Info("learned message that was moved to the spam mailbox as spam",
+			"event", "rspamd.msg_learned")
+		learnedUIDs = append(learnedUIDs, msg.UID)
+
+		e := newAuditEntry(c.spamMailbox, msg.UID, &msg.Envelope, reasonLearned)
+		c.recordAudit(audit.ActionLearnSpam, "", []*audit.Entry{e})
+		flagged = append(flagged, e)
+	}
+
+	if len(learnedUIDs) == 0 {
+		return nil
+	}
+
+	if err := clt.AddKeyword(learnedUIDs, c.spamLearnedKeyword); err != nil {
+		return fmt.Errorf("flagging messages in spam mailbox failed: %w", err)
+	}
+	c.recordAudit(audit.ActionFlag, "", flagged, c.spamLearnedKeyword)
+
+	c.cntProcessedMails.Add(uint64(len(learnedUIDs)))
+
+	return nil
+}
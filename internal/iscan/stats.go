@@ -0,0 +1,35 @@
+package iscan
+
+import (
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/stats"
+)
+
+// recordStats adds c to store and persists it.
+// Failures are only logged.
+func recordStats(logger *slog.Logger, store *stats.Store, c *stats.Counters) {
+	if store == nil || *c == (stats.Counters{}) {
+		return
+	}
+
+	now := time.Now()
+	store.Add(now, c)
+	if err := store.Save(now); err != nil {
+		logger.Warn("saving statistics failed", "error", err, "event", "stats.save_failed")
+	}
+}
+
+// countingReader counts the number of bytes that are read from r.
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += uint64(n)
+	return n, err
+}
@@ -0,0 +1,88 @@
+package iscan
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// actionRewriteSubject is the rspamd action for mails whose subject should be
+// tagged.
+const actionRewriteSubject = "rewrite subject"
+
+// subjectTagger rewrites the subjects of mails according to a template.
+type subjectTagger struct {
+	// template is a fmt format string, it is formatted with the score
+	// and the decoded original subject as arguments.
+	template string
+	// threshold is the score above which subjects are tagged, regardless
+	// of the rspamd action. If it is 0, only mails with the
+	// [actionRewriteSubject] action are tagged.
+	threshold float32
+}
+
+func newSubjectTagger(template string, threshold float32) (*subjectTagger, error) {
+	if template == "" {
+		return nil, errors.New("template is empty")
+	}
+
+	// fmt reports wrong verbs and missing or extra arguments in the
+	// output instead of returning an error
+	if s := fmt.Sprintf(template, float32(0), ""); strings.Contains(s, "%!") {
+		return nil, fmt.Errorf("template %q must contain a verb for the score and one for the subject: %s", template, s)
+	}
+
+	return &subjectTagger{template: template, threshold: threshold}, nil
+}
+
+// matches returns true if the subject of a mail with the scan result r must
+// be tagged.
+func (t *subjectTagger) matches(r *rspamc.CheckResult) bool {
+	if r.Action == actionRewriteSubject {
+		return true
+	}
+
+	return t.threshold != 0 && r.Score >= t.threshold
+}
+
+// tag returns the tagged version of the raw Subject header body subject.
+// RFC 2047 encoded words in subject are decoded before the template is
+// applied. If the original subject was encoded or the result contains
+// non-ASCII characters, the result is encoded with the same encoding as the
+// original, as UTF-8.
+func (t *subjectTagger) tag(subject string, score float32) string {
+	var dec mime.WordDecoder
+
+	decoded, err := dec.DecodeHeader(subject)
+	if err != nil {
+		// unsupported charset, keep the encoded words as they are
+		decoded = subject
+	}
+
+	result := strings.TrimSpace(fmt.Sprintf(t.template, score, decoded))
+	if decoded == subject && !needsEncoding(result) {
+		return result
+	}
+
+	enc := mime.QEncoding
+	if strings.Contains(strings.ToLower(subject), "?b?") {
+		enc = mime.BEncoding
+	}
+
+	return enc.Encode("utf-8", result)
+}
+
+// needsEncoding returns true if s contains characters that are not allowed in
+// an unencoded header body.
+func needsEncoding(s string) bool {
+	for i := range len(s) {
+		if (s[i] < ' ' && s[i] != '\t') || s[i] > '~' {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,48 @@
+package iscan
+
+import (
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestSubjectTaggerTag(t *testing.T) {
+	tagger, err := newSubjectTagger("[SPAM %.1f] %s", 0)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		subject  string
+		expected string
+	}{
+		{"Hello", "[SPAM 7.5] Hello"},
+		{"", "[SPAM 7.5]"},
+		{"=?utf-8?q?Gr=C3=BC=C3=9Fe?=", "=?utf-8?q?[SPAM_7.5]_Gr=C3=BC=C3=9Fe?="},
+		{"=?ISO-8859-1?B?R3L832U=?=", "=?utf-8?b?W1NQQU0gNy41XSBHcsO8w59l?="},
+		{"Grüße", "=?utf-8?q?[SPAM_7.5]_Gr=C3=BC=C3=9Fe?="},
+		// unsupported charsets are kept encoded
+		{"=?koi8-r?b?8NLJ18XU?=", "[SPAM 7.5] =?koi8-r?b?8NLJ18XU?="},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, tagger.tag(tt.subject, 7.5))
+	}
+}
+
+func TestSubjectTaggerMatches(t *testing.T) {
+	tagger, err := newSubjectTagger("[SPAM] %[2]s", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, true, tagger.matches(&rspamc.CheckResult{Action: actionRewriteSubject}))
+	assert.Equal(t, false, tagger.matches(&rspamc.CheckResult{Action: "no action", Score: 100}))
+
+	tagger.threshold = 6
+	assert.Equal(t, true, tagger.matches(&rspamc.CheckResult{Action: "no action", Score: 6}))
+	assert.Equal(t, false, tagger.matches(&rspamc.CheckResult{Action: "no action", Score: 5.9}))
+}
+
+func TestNewSubjectTaggerInvalidTemplate(t *testing.T) {
+	for _, tmpl := range []string{"", "[SPAM]", "%d %s", "%s %s %s"} {
+		_, err := newSubjectTagger(tmpl, 0)
+		assert.Error(t, err, tmpl)
+	}
+}
@@ -0,0 +1,197 @@
+package jmapclt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// errCannotCalculateChanges is the JMAP method error type that is returned
+// when the server can not calculate the changes since a state.
+const errCannotCalculateChanges = "cannotCalculateChanges"
+
+// mailboxEmailIDs returns the ids of the emails in the mailbox, oldest first.
+// The result of the previous call for the mailbox is updated via
+// Email/queryChanges. If that is not possible, all ids are queried.
+func (c *Client) mailboxEmailIDs(ctx context.Context, mailboxID string) ([]string, error) {
+	if err := c.syncChanges(ctx); err != nil {
+		return nil, fmt.Errorf("synchronizing email changes failed: %w", err)
+	}
+
+	filter := map[string]any{"inMailbox": mailboxID}
+
+	c.mu.Lock()
+	prev := c.queries[mailboxID]
+	c.mu.Unlock()
+
+	if prev != nil {
+		result, err := c.queryChanges(ctx, filter, prev)
+		if err == nil {
+			c.setQueryResult(mailboxID, result)
+			return result.ids, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		c.logger.Debug("calculating query changes failed, querying all emails",
+			"error", err, "event", "jmap.query_changes_failed")
+	}
+
+	result, err := c.query(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	c.setQueryResult(mailboxID, result)
+
+	return result.ids, nil
+}
+
+func (c *Client) setQueryResult(mailboxID string, result *queryResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if result.queryState == "" {
+		delete(c.queries, mailboxID)
+		return
+	}
+
+	c.queries[mailboxID] = result
+}
+
+type addedItem struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+}
+
+// queryChanges returns prev updated with the changes of the query result
+// since prev was retrieved.
+func (c *Client) queryChanges(ctx context.Context, filter any, prev *queryResult) (*queryResult, error) {
+	var resp struct {
+		NewQueryState string       `json:"newQueryState"`
+		Removed       []string     `json:"removed"`
+		Added         []*addedItem `json:"added"`
+	}
+
+	err := c.call(ctx, "Email/queryChanges", map[string]any{
+		"accountId":       c.accountID,
+		"filter":          filter,
+		"sort":            querySort,
+		"sinceQueryState": prev.queryState,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := slices.DeleteFunc(slices.Clone(prev.ids), func(id string) bool {
+		return slices.Contains(resp.Removed, id)
+	})
+
+	// the added entries must be inserted in ascending index order
+	// (RFC 8620, section 5.6)
+	slices.SortFunc(resp.Added, func(a, b *addedItem) int {
+		return a.Index - b.Index
+	})
+
+	for _, a := range resp.Added {
+		if a.Index < 0 || a.Index > len(ids) {
+			return nil, fmt.Errorf("Email/queryChanges returned invalid index %d for %d ids", a.Index, len(ids))
+		}
+		ids = slices.Insert(ids, a.Index, a.ID)
+	}
+
+	return &queryResult{ids: ids, queryState: resp.NewQueryState}, nil
+}
+
+// syncChanges removes the UIDs of the emails that were destroyed since the
+// last call, they are retrieved via Email/changes.
+func (c *Client) syncChanges(ctx context.Context) error {
+	c.mu.Lock()
+	since := c.emailState
+	c.mu.Unlock()
+
+	if since == "" {
+		return c.pruneUIDs(ctx)
+	}
+
+	for {
+		var resp struct {
+			NewState       string   `json:"newState"`
+			HasMoreChanges bool     `json:"hasMoreChanges"`
+			Destroyed      []string `json:"destroyed"`
+		}
+
+		err := c.call(ctx, "Email/changes", map[string]any{
+			"accountId":  c.accountID,
+			"sinceState": since,
+		}, &resp)
+		if err != nil {
+			var merr *methodError
+			if errors.As(err, &merr) && merr.Type == errCannotCalculateChanges {
+				c.logger.Debug("server can not calculate email changes, checking all known emails",
+					"error", err, "event", "jmap.email_changes_failed")
+				return c.pruneUIDs(ctx)
+			}
+
+			return err
+		}
+
+		c.forget(resp.Destroyed)
+		c.setEmailState(resp.NewState)
+
+		if !resp.HasMoreChanges {
+			return nil
+		}
+
+		since = resp.NewState
+	}
+}
+
+// pruneUIDs removes the UIDs of the emails that do not exist anymore and
+// records the current Email state.
+func (c *Client) pruneUIDs(ctx context.Context) error {
+	c.mu.Lock()
+	ids := slices.Collect(maps.Keys(c.uids))
+	c.mu.Unlock()
+
+	var state string
+	for start := 0; start == 0 || start < len(ids); start += queryLimit {
+		var resp struct {
+			State    string   `json:"state"`
+			NotFound []string `json:"notFound"`
+		}
+
+		err := c.call(ctx, "Email/get", map[string]any{
+			"accountId":  c.accountID,
+			"ids":        ids[start:min(start+queryLimit, len(ids))],
+			"properties": []string{"id"},
+		}, &resp)
+		if err != nil {
+			return err
+		}
+
+		if start == 0 {
+			state = resp.State
+		}
+
+		c.forget(resp.NotFound)
+	}
+
+	c.setEmailState(state)
+
+	return nil
+}
+
+func (c *Client) setEmailState(state string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.emailState != state {
+		c.emailState = state
+		c.stateDirty = true
+	}
+}
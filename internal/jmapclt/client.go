@@ -0,0 +1,365 @@
+// Package jmapclt implements a JMAP client (RFC 8620, RFC 8621) that provides
+// the same operations as [imapclt.Client].
+//
+// JMAP identifies messages by string ids, the client maps them to uint32 UIDs.
+// The mapping is valid for the lifetime of the client, or across restarts when
+// it is persisted in a state file.
+package jmapclt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+)
+
+const (
+	capCore = "urn:ietf:params:jmap:core"
+	capMail = "urn:ietf:params:jmap:mail"
+
+	requestTimeout = 120 * time.Second
+)
+
+type Client struct {
+	sessionURL string
+	user       string
+	password   string
+	token      string
+
+	httpClient *http.Client
+	logger     *slog.Logger
+
+	accountID      string
+	apiURL         string
+	downloadURL    string
+	uploadURL      string
+	eventSourceURL string
+
+	// mailboxIDs maps mailbox names to their ids.
+	mailboxIDs map[string]string
+
+	stateFile string
+
+	mu      sync.Mutex
+	uids    map[string]uint32
+	ids     map[uint32]string
+	lastUID uint32
+	// emailState is the Email state string of the server at the time
+	// uids was last synchronized with Email/changes.
+	emailState string
+	stateDirty bool
+	// queries are the results of the last Email/query calls per mailbox
+	// id, they are updated with Email/queryChanges.
+	queries map[string]*queryResult
+}
+
+type Config struct {
+	// SessionURL is the URL of the JMAP session resource, e.g.
+	// https://api.fastmail.com/jmap/session.
+	SessionURL string
+	// User and Password are used for HTTP basic authentication, when
+	// Token is empty.
+	User     string
+	Password string
+	// Token is sent as bearer token.
+	Token string
+	// StateFile is the path of the file in which the mapping of JMAP
+	// email ids to UIDs is stored, to keep UIDs stable across restarts.
+	// If empty, UIDs are only valid for the lifetime of the client.
+	StateFile string
+	Logger    *slog.Logger
+}
+
+// NewClient creates a new JMAP-Client.
+// [*Client.Connect] must be called before any other methods.
+func NewClient(cfg *Config) *Client {
+	return &Client{
+		sessionURL: cfg.SessionURL,
+		user:       cfg.User,
+		password:   cfg.Password,
+		token:      cfg.Token,
+		stateFile:  cfg.StateFile,
+		httpClient: &http.Client{},
+		logger:     log.Module(cfg.Logger, "jmapclt"),
+		uids:       map[string]uint32{},
+		ids:        map[uint32]string{},
+		queries:    map[string]*queryResult{},
+	}
+}
+
+type session struct {
+	Capabilities    map[string]json.RawMessage `json:"capabilities"`
+	PrimaryAccounts map[string]string          `json:"primaryAccounts"`
+	APIURL          string                     `json:"apiUrl"`
+	DownloadURL     string                     `json:"downloadUrl"`
+	UploadURL       string                     `json:"uploadUrl"`
+	EventSourceURL  string                     `json:"eventSourceUrl"`
+}
+
+// Connect fetches the JMAP session resource and the mailboxes of the
+// primary mail account.
+func (c *Client) Connect() error {
+	req, err := c.newRequest(http.MethodGet, c.sessionURL, nil)
+	if err != nil {
+		return err
+	}
+
+	var s session
+	if err := c.do(req, &s); err != nil {
+		return fmt.Errorf("fetching jmap session failed: %w", err)
+	}
+
+	if _, exists := s.Capabilities[capMail]; !exists {
+		return errors.New("jmap server does not support mail (" + capMail + ")")
+	}
+
+	c.accountID = s.PrimaryAccounts[capMail]
+	if c.accountID == "" {
+		return errors.New("jmap session has no primary mail account")
+	}
+
+	c.apiURL = s.APIURL
+	c.downloadURL = s.DownloadURL
+	c.uploadURL = s.UploadURL
+	c.eventSourceURL = s.EventSourceURL
+
+	if err := c.loadMailboxes(); err != nil {
+		return err
+	}
+
+	if err := c.loadState(); err != nil {
+		return fmt.Errorf("loading jmap state failed: %w", err)
+	}
+
+	c.logger.Info("session established",
+		"jmap.account_id", c.accountID, "event", "jmap.session_established")
+
+	return nil
+}
+
+// Close releases idle connections.
+func (c *Client) Close() error {
+	c.httpClient.CloseIdleConnections()
+	return nil
+}
+
+func (c *Client) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else {
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	return req, nil
+}
+
+// do sends req and decodes the JSON response body into result.
+func (c *Client) do(req *http.Request, result any) error {
+	data, err := c.fetch(req)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("decoding response failed: %w", err)
+	}
+
+	return nil
+}
+
+// fetch sends req and returns the response body.
+// The request is canceled when it does not finish within requestTimeout.
+func (c *Client) fetch(req *http.Request) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), requestTimeout)
+	defer cancel()
+
+	resp, err := c.send(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// send sends req and returns the response if it has a 2xx status code.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("server responded with status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return resp, nil
+}
+
+type request struct {
+	Using       []string     `json:"using"`
+	MethodCalls []invocation `json:"methodCalls"`
+}
+
+type response struct {
+	MethodResponses []invocation `json:"methodResponses"`
+}
+
+// invocation is a method call or response, it is encoded as
+// [name, arguments, callID].
+type invocation struct {
+	Name   string
+	Args   json.RawMessage
+	CallID string
+}
+
+func (i invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{i.Name, i.Args, i.CallID})
+}
+
+func (i *invocation) UnmarshalJSON(b []byte) error {
+	var v []json.RawMessage
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	if len(v) != 3 {
+		return fmt.Errorf("invocation has %d elements, expected 3", len(v))
+	}
+
+	if err := json.Unmarshal(v[0], &i.Name); err != nil {
+		return err
+	}
+	i.Args = v[1]
+
+	return json.Unmarshal(v[2], &i.CallID)
+}
+
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func (e *methodError) Error() string {
+	return "server responded with error " + e.Type + ": " + e.Description
+}
+
+// call invokes method with args and decodes the arguments of the response
+// into result.
+func (c *Client) call(ctx context.Context, method string, args, result any) error {
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(&request{
+		Using:       []string{capCore, capMail},
+		MethodCalls: []invocation{{Name: method, Args: argsJSON, CallID: "0"}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(http.MethodPost, c.apiURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp response
+	if err := c.do(req, &resp); err != nil {
+		return fmt.Errorf("%s failed: %w", method, err)
+	}
+
+	if len(resp.MethodResponses) != 1 {
+		return fmt.Errorf("%s failed: got %d method responses, expected 1", method, len(resp.MethodResponses))
+	}
+
+	mresp := resp.MethodResponses[0]
+	if mresp.Name == "error" {
+		var merr methodError
+		_ = json.Unmarshal(mresp.Args, &merr)
+		return fmt.Errorf("%s failed: %w", method, &merr)
+	}
+
+	if err := json.Unmarshal(mresp.Args, result); err != nil {
+		return fmt.Errorf("decoding %s response failed: %w", method, err)
+	}
+
+	return nil
+}
+
+// uid returns the UID for the JMAP email id, a new one is assigned if the id
+// is unknown.
+func (c *Client) uid(id string) uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if uid, exists := c.uids[id]; exists {
+		return uid
+	}
+
+	c.lastUID++
+	c.uids[id] = c.lastUID
+	c.ids[c.lastUID] = id
+	c.stateDirty = true
+
+	return c.lastUID
+}
+
+// forget removes the UIDs of the JMAP email ids.
+func (c *Client) forget(ids []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, id := range ids {
+		if uid, exists := c.uids[id]; exists {
+			delete(c.uids, id)
+			delete(c.ids, uid)
+			c.stateDirty = true
+		}
+	}
+}
+
+// emailIDs returns the JMAP email ids of uids.
+func (c *Client) emailIDs(uids []uint32) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		id, exists := c.ids[uid]
+		if !exists {
+			return nil, fmt.Errorf("unknown uid: %d", uid)
+		}
+		result = append(result, id)
+	}
+
+	return result, nil
+}
+
+// expandURL replaces the {name} variables in the URL template tmpl.
+func expandURL(tmpl string, vars map[string]string) string {
+	for k, v := range vars {
+		tmpl = strings.ReplaceAll(tmpl, "{"+k+"}", v)
+	}
+
+	return tmpl
+}
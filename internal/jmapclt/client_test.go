@@ -0,0 +1,223 @@
+package jmapclt
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/jmapserver"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+)
+
+func startServerClient(t *testing.T) (*jmapserver.Server, *Client) {
+	srv := jmapserver.StartServer(t)
+
+	clt := NewClient(&Config{
+		SessionURL: srv.SessionURL,
+		User:       srv.UserName,
+		Password:   srv.UserPasswd,
+		Logger:     log.SlogTestLogger(t),
+	})
+	assert.NoError(t, clt.Connect())
+	t.Cleanup(func() { _ = clt.Close() })
+
+	return srv, clt
+}
+
+func addTestMail(t *testing.T, srv *jmapserver.Server, mailbox string) {
+	data, err := os.ReadFile(mail.TestHamMailPath(t))
+	assert.NoError(t, err)
+	srv.AddMessage(mailbox, data)
+}
+
+func collect(t *testing.T, clt *Client, mailbox string, opts *imapclt.FetchOptions) []*imapclt.Message {
+	var result []*imapclt.Message
+	for msg, err := range clt.Messages(context.Background(), mailbox, opts) {
+		assert.NoError(t, err)
+		result = append(result, msg)
+	}
+
+	return result
+}
+
+func TestConnectInvalidPassword(t *testing.T) {
+	srv := jmapserver.StartServer(t)
+
+	clt := NewClient(&Config{
+		SessionURL: srv.SessionURL,
+		User:       srv.UserName,
+		Password:   "wrong",
+		Logger:     log.SlogTestLogger(t),
+	})
+	assert.Error(t, clt.Connect())
+}
+
+func TestMessagesMoveAndUpload(t *testing.T) {
+	srv, clt := startServerClient(t)
+	addTestMail(t, srv, srv.ScanMailbox)
+
+	msgs := collect(t, clt, srv.ScanMailbox, nil)
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, mail.HamMailSubject, msgs[0].Envelope.Subject)
+	assert.Equal(t, "someone@example.com", msgs[0].Envelope.From[0])
+
+	data, err := io.ReadAll(msgs[0].Message)
+	assert.NoError(t, err)
+	assert.Equal(t, msgs[0].Size, int64(len(data)))
+
+	assert.NoError(t, clt.Move([]uint32{msgs[0].UID}, srv.InboxMailBox))
+	assert.Equal(t, 0, srv.MessageCount(srv.ScanMailbox))
+	assert.Equal(t, 1, srv.MessageCount(srv.InboxMailBox))
+
+	date := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), srv.BackupMailbox, date, []string{`\Seen`, "$Important"}))
+	assert.Equal(t, 1, srv.MessageCount(srv.BackupMailbox))
+
+	msgs = collect(t, clt, srv.BackupMailbox, nil)
+	assert.Equal(t, true, msgs[0].InternalDate.Equal(date))
+	assert.Equal(t, `$important,\Seen`, strings.Join(msgs[0].Flags, ","))
+}
+
+func TestMessagesHeaderOnlyAndTruncated(t *testing.T) {
+	srv, clt := startServerClient(t)
+	addTestMail(t, srv, srv.ScanMailbox)
+
+	msgs := collect(t, clt, srv.ScanMailbox, &imapclt.FetchOptions{HeaderOnly: true})
+	assert.Equal(t, 1, len(msgs))
+	data, err := io.ReadAll(msgs[0].Message)
+	assert.NoError(t, err)
+	assert.Equal(t, true, strings.HasSuffix(string(data), "\r\n\r\n"))
+	assert.Equal(t, true, strings.Contains(string(data), "Subject: "+mail.HamMailSubject+"\r\n"))
+
+	msgs = collect(t, clt, srv.ScanMailbox, &imapclt.FetchOptions{MaxBodySize: 10})
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, true, msgs[0].Truncated)
+	data, err = io.ReadAll(msgs[0].Message)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(data))
+}
+
+func TestSearchAndAddKeyword(t *testing.T) {
+	srv, clt := startServerClient(t)
+	addTestMail(t, srv, srv.ScanMailbox)
+	addTestMail(t, srv, srv.ScanMailbox)
+
+	msgs := collect(t, clt, srv.ScanMailbox, nil)
+	assert.Equal(t, 2, len(msgs))
+
+	assert.NoError(t, clt.AddKeyword([]uint32{msgs[0].UID}, `\Seen`))
+	assert.Equal(t, "$seen", strings.Join(srv.Keywords(srv.ScanMailbox)[0], ","))
+
+	res, err := clt.Search(srv.ScanMailbox, &imapclt.SearchCriteria{NotFlags: []string{`\Seen`}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), res.NumMessages)
+	assert.Equal(t, 1, len(res.UIDs))
+	assert.Equal(t, msgs[1].UID, res.UIDs[0])
+}
+
+func TestDelete(t *testing.T) {
+	srv, clt := startServerClient(t)
+	addTestMail(t, srv, srv.ScanMailbox)
+	addTestMail(t, srv, srv.ScanMailbox)
+
+	msgs := collect(t, clt, srv.ScanMailbox, nil)
+	assert.Equal(t, 2, len(msgs))
+
+	assert.NoError(t, clt.Delete([]uint32{msgs[0].UID}))
+	assert.Equal(t, 1, srv.MessageCount(srv.ScanMailbox))
+
+	msgs2 := collect(t, clt, srv.ScanMailbox, nil)
+	assert.Equal(t, 1, len(msgs2))
+	assert.Equal(t, msgs[1].UID, msgs2[0].UID)
+}
+
+func TestMonitor(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	ch, stop, err := clt.Monitor(srv.ScanMailbox, 0)
+	assert.NoError(t, err)
+
+	addTestMail(t, srv, srv.ScanMailbox)
+
+	select {
+	case ev := <-ch:
+		assert.Equal(t, uint32(1), ev.NewMsgCount)
+	case <-time.After(10 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	assert.NoError(t, stop())
+
+	// the mailbox has more messages than known, an event is sent
+	// immediately
+	ch, stop, err = clt.Monitor(srv.ScanMailbox, 0)
+	assert.NoError(t, err)
+	ev := <-ch
+	assert.Equal(t, uint32(1), ev.NewMsgCount)
+	assert.NoError(t, stop())
+}
+
+func TestMessagesQueryChanges(t *testing.T) {
+	srv, clt := startServerClient(t)
+	addTestMail(t, srv, srv.ScanMailbox)
+	addTestMail(t, srv, srv.ScanMailbox)
+
+	msgs := collect(t, clt, srv.ScanMailbox, nil)
+	assert.Equal(t, 2, len(msgs))
+
+	assert.NoError(t, clt.Move([]uint32{msgs[0].UID}, srv.InboxMailBox))
+	addTestMail(t, srv, srv.ScanMailbox)
+
+	msgs2 := collect(t, clt, srv.ScanMailbox, nil)
+	assert.Equal(t, 2, len(msgs2))
+	assert.Equal(t, msgs[1].UID, msgs2[0].UID)
+	assert.Equal(t, true, msgs2[1].UID > msgs[1].UID)
+
+	// the second listing was calculated from the changes of the first
+	assert.Equal(t, 1, srv.Calls("Email/query"))
+	assert.Equal(t, 1, srv.Calls("Email/queryChanges"))
+}
+
+func TestStateFile(t *testing.T) {
+	srv := jmapserver.StartServer(t)
+	addTestMail(t, srv, srv.ScanMailbox)
+	addTestMail(t, srv, srv.ScanMailbox)
+
+	cfg := Config{
+		SessionURL: srv.SessionURL,
+		User:       srv.UserName,
+		Password:   srv.UserPasswd,
+		StateFile:  filepath.Join(t.TempDir(), "state.json"),
+		Logger:     log.SlogTestLogger(t),
+	}
+
+	clt := NewClient(&cfg)
+	assert.NoError(t, clt.Connect())
+	msgs := collect(t, clt, srv.ScanMailbox, nil)
+	assert.Equal(t, 2, len(msgs))
+	assert.NoError(t, clt.Delete([]uint32{msgs[0].UID}))
+	assert.NoError(t, clt.Close())
+
+	// the UIDs are the same after a restart, the one of the deleted
+	// message is removed via Email/changes
+	clt = NewClient(&cfg)
+	assert.NoError(t, clt.Connect())
+	t.Cleanup(func() { _ = clt.Close() })
+
+	addTestMail(t, srv, srv.ScanMailbox)
+	msgs2 := collect(t, clt, srv.ScanMailbox, nil)
+	assert.Equal(t, 2, len(msgs2))
+	assert.Equal(t, msgs[1].UID, msgs2[0].UID)
+	assert.Equal(t, true, msgs2[1].UID > msgs[1].UID)
+	assert.Equal(t, 1, srv.Calls("Email/changes"))
+
+	_, err := clt.emailIDs([]uint32{msgs[0].UID})
+	assert.Error(t, err)
+}
@@ -0,0 +1,48 @@
+package jmapclt
+
+import "time"
+
+// DryClient is a JMAP client that simulates operations that do changes on the
+// JMAP-Server.
+type DryClient struct {
+	*Client
+}
+
+// NewDryClient creates an new JMAP-Client.
+// [*DryClient.Connect] must be called before any other methods.
+func NewDryClient(cfg *Config) *DryClient {
+	return &DryClient{Client: NewClient(cfg)}
+}
+
+// Upload logs a debug message and returns nil
+func (c *DryClient) Upload(path, mailbox string, _ time.Time, _ []string) error {
+	c.logger.Debug("dry-client: skipping uploading mail to mailbox",
+		"jmap.mailbox", mailbox, "filepath", path)
+	return nil
+}
+
+// Move logs a debug message and returns nil
+func (c *DryClient) Move(uids []uint32, mailbox string) error {
+	c.logger.Debug("dry-client: skipping moving messages to mailbox",
+		"jmap.mailbox", mailbox,
+		"count", len(uids),
+	)
+	return nil
+}
+
+// Delete logs a debug message and returns nil
+func (c *DryClient) Delete(uids []uint32) error {
+	c.logger.Debug("dry-client: skipping deleting messages",
+		"count", len(uids),
+	)
+	return nil
+}
+
+// AddKeyword logs a debug message and returns nil
+func (c *DryClient) AddKeyword(uids []uint32, keyword string) error {
+	c.logger.Debug("dry-client: skipping adding keyword to messages",
+		"keyword", keyword,
+		"count", len(uids),
+	)
+	return nil
+}
@@ -0,0 +1,181 @@
+package jmapclt
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+)
+
+const (
+	defChanBufSiz = 1
+	// reconnectDelay is the duration that is waited before the push
+	// connection is reestablished after it failed.
+	reconnectDelay = 30 * time.Second
+	// pingInterval is the interval in seconds in that the server sends
+	// pings on the push connection.
+	pingInterval = "300"
+)
+
+// Monitor starts to monitor mailbox for new messages via JMAP push
+// (EventSource).
+// When new messages are found an event is sent to the returned channel.
+// Message delivery to the channel must not block. If delivery would block the
+// message is discarded.
+// knownMsgCount is the number of messages in the mailbox that have already
+// been seen by the caller and are left in the mailbox, only messages
+// exceeding the count are reported as new.
+//
+// If the push connection fails, it is reestablished until the returned stop
+// function is called. If the server does not support push, no events are
+// sent.
+// Unlike with [imapclt.Client], other operations can be run while monitoring.
+func (c *Client) Monitor(mailbox string, knownMsgCount uint32) (
+	_ <-chan *imapclt.EventNewMessages, stop func() error, _ error,
+) {
+	logger := c.logger.With("jmap.mailbox", mailbox)
+	logger.Debug("starting to monitor mailbox for changes")
+
+	ch := make(chan *imapclt.EventNewMessages, defChanBufSiz)
+
+	mailboxID, err := c.mailboxID(mailbox)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// checkNew sends an event when the mailbox has new messages and
+	// returns true in that case
+	checkNew := func() (bool, error) {
+		total, err := c.mailboxTotal(mailboxID)
+		if err != nil {
+			return false, err
+		}
+
+		if total <= knownMsgCount {
+			return false, nil
+		}
+
+		sendEventNewMessages(ch, total-knownMsgCount)
+		return true, nil
+	}
+
+	hasNew, err := checkNew()
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching mailbox %q failed: %w", mailbox, err)
+	}
+
+	if hasNew {
+		logger.Debug("mailbox has new message, skipping monitoring")
+		close(ch)
+		return ch, func() error { return nil }, nil
+	}
+
+	if c.eventSourceURL == "" {
+		logger.Warn("server does not support push notifications, relying on polling")
+		return ch, func() error {
+			close(ch)
+			return nil
+		}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for ctx.Err() == nil {
+			err := c.listen(ctx, func() {
+				if _, err := checkNew(); err != nil {
+					logger.Warn("checking mailbox for new messages failed", "error", err)
+				}
+			})
+			if ctx.Err() != nil {
+				return
+			}
+
+			logger.Warn("push connection failed, reconnecting",
+				"error", err, "delay", reconnectDelay, "event", "jmap.push_failed")
+
+			select {
+			case <-time.After(reconnectDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, func() error {
+		logger.Debug("stopping push connection")
+		cancel()
+		wg.Wait()
+		close(ch)
+		return nil
+	}, nil
+}
+
+// listen opens the EventSource connection and calls onChange for every
+// received state change, until ctx is canceled or the connection fails.
+func (c *Client) listen(ctx context.Context, onChange func()) error {
+	u := expandURL(c.eventSourceURL, map[string]string{
+		"types":      "Email,Mailbox",
+		"closeafter": "no",
+		"ping":       pingInterval,
+	})
+
+	req, err := c.newRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	c.logger.Debug("push connection established", "event", "jmap.push_connected")
+
+	// changes that happened before the connection was established are
+	// not pushed
+	onChange()
+
+	var event string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+
+		switch {
+		case line == "":
+			// an empty line dispatches the event
+			if event == "state" {
+				c.logger.Debug("received state change")
+				onChange()
+			}
+			event = ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("push connection closed by server")
+}
+
+func sendEventNewMessages(ch chan<- *imapclt.EventNewMessages, newMessages uint32) {
+	select {
+	case ch <- &imapclt.EventNewMessages{NewMsgCount: newMessages}:
+	default:
+	}
+}
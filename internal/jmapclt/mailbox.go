@@ -0,0 +1,95 @@
+package jmapclt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type mailbox struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ParentID    string `json:"parentId"`
+	Role        string `json:"role"`
+	TotalEmails uint32 `json:"totalEmails"`
+}
+
+type mailboxGetResponse struct {
+	State string     `json:"state"`
+	List  []*mailbox `json:"list"`
+}
+
+// loadMailboxes fetches all mailboxes of the account.
+// Nested mailboxes are named by their path, separated by "/", like IMAP
+// servers commonly do. The mailbox with the inbox role is named "INBOX".
+func (c *Client) loadMailboxes() error {
+	var resp mailboxGetResponse
+
+	err := c.call(context.Background(), "Mailbox/get", map[string]any{
+		"accountId":  c.accountID,
+		"ids":        nil,
+		"properties": []string{"id", "name", "parentId", "role"},
+	}, &resp)
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[string]*mailbox, len(resp.List))
+	for _, mb := range resp.List {
+		byID[mb.ID] = mb
+	}
+
+	c.mailboxIDs = make(map[string]string, len(resp.List))
+	for _, mb := range resp.List {
+		if mb.Role == "inbox" {
+			c.mailboxIDs["INBOX"] = mb.ID
+			continue
+		}
+
+		path := []string{mb.Name}
+		// the depth is limited to not loop forever on cyclic parents
+		for parent := byID[mb.ParentID]; parent != nil && len(path) < 64; parent = byID[parent.ParentID] {
+			path = append([]string{parent.Name}, path...)
+		}
+
+		c.mailboxIDs[strings.Join(path, "/")] = mb.ID
+	}
+
+	c.logger.Debug("loaded mailboxes", "count", len(c.mailboxIDs), "event", "jmap.mailboxes_loaded")
+
+	return nil
+}
+
+// mailboxID returns the id of the mailbox with the given name.
+func (c *Client) mailboxID(name string) (string, error) {
+	if strings.EqualFold(name, "INBOX") {
+		name = "INBOX"
+	}
+
+	id, exists := c.mailboxIDs[name]
+	if !exists {
+		return "", fmt.Errorf("mailbox %q does not exist", name)
+	}
+
+	return id, nil
+}
+
+// mailboxTotal returns the number of messages in the mailbox.
+func (c *Client) mailboxTotal(id string) (uint32, error) {
+	var resp mailboxGetResponse
+
+	err := c.call(context.Background(), "Mailbox/get", map[string]any{
+		"accountId":  c.accountID,
+		"ids":        []string{id},
+		"properties": []string{"totalEmails"},
+	}, &resp)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(resp.List) != 1 {
+		return 0, fmt.Errorf("mailbox %q not found", id)
+	}
+
+	return resp.List[0].TotalEmails, nil
+}
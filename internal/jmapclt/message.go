@@ -0,0 +1,629 @@
+package jmapclt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/mail"
+)
+
+const (
+	// queryLimit is the max. number of ids that are requested per
+	// Email/query call.
+	queryLimit = 256
+	// getBatchSize is the max. number of emails that are requested per
+	// Email/get call.
+	getBatchSize = 32
+)
+
+type emailAddress struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type emailHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type email struct {
+	ID         string          `json:"id"`
+	BlobID     string          `json:"blobId"`
+	Size       int64           `json:"size"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+	SentAt     *time.Time      `json:"sentAt"`
+	Subject    string          `json:"subject"`
+	MessageID  []string        `json:"messageId"`
+	From       []*emailAddress `json:"from"`
+	To         []*emailAddress `json:"to"`
+	Cc         []*emailAddress `json:"cc"`
+	Bcc        []*emailAddress `json:"bcc"`
+	Headers    []*emailHeader  `json:"headers"`
+	Keywords   map[string]bool `json:"keywords"`
+}
+
+var emailProperties = []string{
+	"id", "blobId", "size", "receivedAt", "sentAt", "subject", "messageId",
+	"from", "to", "cc", "bcc", "keywords",
+}
+
+type setError struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func (e *setError) Error() string {
+	if e.Description == "" {
+		return e.Type
+	}
+
+	return e.Type + ": " + e.Description
+}
+
+type emailSetResponse struct {
+	NotUpdated   map[string]*setError `json:"notUpdated"`
+	NotDestroyed map[string]*setError `json:"notDestroyed"`
+}
+
+// querySort is the sort order of all Email/query calls, oldest first.
+var querySort = []map[string]any{{"property": "receivedAt", "isAscending": true}}
+
+// queryResult are the ids of the emails that match a filter.
+type queryResult struct {
+	ids []string
+	// queryState is the state of the result, it is empty if the server
+	// can not calculate changes for it.
+	queryState string
+}
+
+// query returns the ids of the emails that match filter, oldest first.
+func (c *Client) query(ctx context.Context, filter any) (*queryResult, error) {
+	var result queryResult
+
+	for page := 0; ; page++ {
+		var resp struct {
+			IDs                 []string `json:"ids"`
+			QueryState          string   `json:"queryState"`
+			CanCalculateChanges bool     `json:"canCalculateChanges"`
+		}
+
+		err := c.call(ctx, "Email/query", map[string]any{
+			"accountId": c.accountID,
+			"filter":    filter,
+			"sort":      querySort,
+			"position":  len(result.ids),
+			"limit":     queryLimit,
+		}, &resp)
+		if err != nil {
+			return nil, err
+		}
+
+		// when the results changed between pages, changes can not be
+		// calculated for the combined result
+		if page == 0 && resp.CanCalculateChanges {
+			result.queryState = resp.QueryState
+		} else if resp.QueryState != result.queryState {
+			result.queryState = ""
+		}
+
+		result.ids = append(result.ids, resp.IDs...)
+		if len(resp.IDs) < queryLimit {
+			return &result, nil
+		}
+	}
+}
+
+// Messages returns an iterator over the messages in mailbox.
+// When an error happens a nil message and an error is passed via the yield
+// function.
+// When ctx is canceled, in-flight requests are aborted and ctx.Err() is
+// passed via the yield function.
+// opts can be nil.
+func (c *Client) Messages(ctx context.Context, mailbox string, opts *imapclt.FetchOptions) iter.Seq2[*imapclt.Message, error] {
+	if opts == nil {
+		opts = &imapclt.FetchOptions{}
+	}
+
+	return func(yield func(*imapclt.Message, error) bool) {
+		logger := c.logger.With("jmap.mailbox", mailbox)
+
+		mailboxID, err := c.mailboxID(mailbox)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		var ids []string
+		if len(opts.UIDs) != 0 {
+			ids, err = c.emailIDs(opts.UIDs)
+		} else {
+			ids, err = c.mailboxEmailIDs(ctx, mailboxID)
+		}
+		if err != nil {
+			yield(nil, fmt.Errorf("querying messages failed: %w", err))
+			return
+		}
+
+		for _, id := range ids {
+			c.uid(id)
+		}
+
+		if err := c.saveState(); err != nil {
+			yield(nil, err)
+			return
+		}
+
+		if len(ids) == 0 {
+			logger.Debug("mailbox is empty", "event", "jmap.mailbox_empty")
+			return
+		}
+
+		logger.Debug("new messages found", "event", "jmap.new_messages", "count", len(ids))
+
+		properties := emailProperties
+		if opts.HeaderOnly {
+			properties = append([]string{"headers"}, emailProperties...)
+		}
+
+		for start := 0; start < len(ids); start += getBatchSize {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+
+			var resp struct {
+				List []*email `json:"list"`
+			}
+
+			err := c.call(ctx, "Email/get", map[string]any{
+				"accountId":  c.accountID,
+				"ids":        ids[start:min(start+getBatchSize, len(ids))],
+				"properties": properties,
+			}, &resp)
+			if err != nil {
+				yield(nil, fmt.Errorf("fetching messages failed: %w", err))
+				return
+			}
+
+			for _, e := range resp.List {
+				msg, err := c.message(ctx, e, opts)
+				if !yield(msg, err) || err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *Client) message(ctx context.Context, e *email, opts *imapclt.FetchOptions) (*imapclt.Message, error) {
+	uid := c.uid(e.ID)
+
+	var body []byte
+	if opts.HeaderOnly {
+		var buf bytes.Buffer
+		for _, h := range e.Headers {
+			buf.WriteString(h.Name + ":" + h.Value + "\r\n")
+		}
+		buf.WriteString("\r\n")
+		body = buf.Bytes()
+	} else {
+		var err error
+		body, err = c.download(ctx, e.BlobID, opts.MaxBodySize)
+		if err != nil {
+			return nil, fmt.Errorf("downloading message %d failed: %w", uid, err)
+		}
+	}
+
+	if len(body) == 0 {
+		return nil, errors.New("message data reader is empty")
+	}
+
+	c.logger.Debug("fetched message", "mail.subject", e.Subject, "mail.uid", uid)
+
+	rawSubject, rawFrom := imapclt.RawHeaderFields(body)
+
+	var messageID string
+	if len(e.MessageID) > 0 {
+		// the IMAP ENVELOPE contains the id with angle brackets
+		messageID = "<" + e.MessageID[0] + ">"
+	}
+
+	date := e.ReceivedAt
+	if e.SentAt != nil {
+		date = *e.SentAt
+	}
+
+	return &imapclt.Message{
+		UID:          uid,
+		Size:         e.Size,
+		Truncated:    !opts.HeaderOnly && opts.MaxBodySize > 0 && e.Size > opts.MaxBodySize,
+		Message:      bytes.NewReader(body),
+		InternalDate: e.ReceivedAt,
+		Flags:        imapFlags(e.Keywords),
+		Envelope: imapclt.Envelope{
+			Date: date,
+			// the server decodes the encoded-words
+			Subject:    mail.NormalizeText(e.Subject),
+			RawSubject: rawSubject,
+			From:       addresses(e.From),
+			FromNames:  addressNames(e.From),
+			RawFrom:    rawFrom,
+			Recipients: append(append(addresses(e.To), addresses(e.Cc)...), addresses(e.Bcc)...),
+			MessageID:  messageID,
+		},
+	}, nil
+}
+
+func addressNames(addrs []*emailAddress) []string {
+	result := make([]string, 0, len(addrs))
+
+	for _, addr := range addrs {
+		result = append(result, mail.NormalizeText(addr.Name))
+	}
+
+	return result
+}
+
+func addresses(addrs []*emailAddress) []string {
+	result := make([]string, 0, len(addrs))
+
+	for _, addr := range addrs {
+		result = append(result, addr.Email)
+	}
+
+	return result
+}
+
+// download returns the content of the blob. If maxSize is >0 at most maxSize
+// bytes are returned.
+func (c *Client) download(ctx context.Context, blobID string, maxSize int64) ([]byte, error) {
+	u := expandURL(c.downloadURL, map[string]string{
+		"accountId": url.PathEscape(c.accountID),
+		"blobId":    url.PathEscape(blobID),
+		"type":      url.QueryEscape("message/rfc822"),
+		"name":      "message.eml",
+	})
+
+	req, err := c.newRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if maxSize > 0 {
+		// servers that do not support ranges return the whole blob
+		req.Header.Set("Range", "bytes=0-"+strconv.FormatInt(maxSize-1, 10))
+	}
+
+	data, err := c.fetch(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxSize > 0 && int64(len(data)) > maxSize {
+		data = data[:maxSize]
+	}
+
+	return data, nil
+}
+
+// Move moves the messages with the given uids to mailbox.
+// The keywords and the received date of the messages are preserved.
+func (c *Client) Move(uids []uint32, mailbox string) error {
+	if len(uids) == 0 {
+		return errors.New("no uids were given")
+	}
+
+	mailboxID, err := c.mailboxID(mailbox)
+	if err != nil {
+		return err
+	}
+
+	err = c.update(uids, map[string]any{"mailboxIds": map[string]bool{mailboxID: true}})
+	if err != nil {
+		return fmt.Errorf("moving messages failed: %w", err)
+	}
+
+	c.logger.Debug("moved messages",
+		"jmap.mailbox", mailbox,
+		"count", len(uids),
+		"event", "jmap.messages_moved",
+	)
+
+	return nil
+}
+
+// AddKeyword adds keyword to the messages with the given uids.
+// IMAP system flags (\Seen, \Flagged, ...) are mapped to their JMAP keywords.
+func (c *Client) AddKeyword(uids []uint32, keyword string) error {
+	if len(uids) == 0 {
+		return errors.New("no uids were given")
+	}
+
+	patch := map[string]any{"keywords/" + jsonPointerEscape(jmapKeyword(keyword)): true}
+	if err := c.update(uids, patch); err != nil {
+		return fmt.Errorf("storing keyword failed: %w", err)
+	}
+
+	c.logger.Debug("added keyword to messages",
+		"keyword", keyword,
+		"count", len(uids),
+		"event", "jmap.keyword_added",
+	)
+
+	return nil
+}
+
+// Delete destroys the messages with the given uids, they are removed
+// permanently.
+func (c *Client) Delete(uids []uint32) error {
+	if len(uids) == 0 {
+		return errors.New("no uids were given")
+	}
+
+	ids, err := c.emailIDs(uids)
+	if err != nil {
+		return err
+	}
+
+	var resp emailSetResponse
+	err = c.call(context.Background(), "Email/set", map[string]any{
+		"accountId": c.accountID,
+		"destroy":   ids,
+	}, &resp)
+	if err != nil {
+		return fmt.Errorf("deleting messages failed: %w", err)
+	}
+
+	for id, serr := range resp.NotDestroyed {
+		return fmt.Errorf("deleting email %s failed: %w", id, serr)
+	}
+
+	c.logger.Debug("deleted messages",
+		"count", len(uids),
+		"event", "jmap.messages_deleted",
+	)
+
+	return nil
+}
+
+// update applies patch to the emails with the given uids.
+func (c *Client) update(uids []uint32, patch map[string]any) error {
+	ids, err := c.emailIDs(uids)
+	if err != nil {
+		return err
+	}
+
+	update := make(map[string]any, len(ids))
+	for _, id := range ids {
+		update[id] = patch
+	}
+
+	var resp emailSetResponse
+	err = c.call(context.Background(), "Email/set", map[string]any{
+		"accountId": c.accountID,
+		"update":    update,
+	}, &resp)
+	if err != nil {
+		return err
+	}
+
+	for id, serr := range resp.NotUpdated {
+		return fmt.Errorf("updating email %s failed: %w", id, serr)
+	}
+
+	return nil
+}
+
+// Upload reads a message from file and imports it into mailbox.
+// The received date of the message is set to ts and its keywords to the ones
+// of the IMAP flags.
+func (c *Client) Upload(path, mailbox string, ts time.Time, flags []string) error {
+	mailboxID, err := c.mailboxID(mailbox)
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	u := expandURL(c.uploadURL, map[string]string{"accountId": url.PathEscape(c.accountID)})
+	req, err := c.newRequest(http.MethodPost, u, fd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "message/rfc822")
+
+	var blob struct {
+		BlobID string `json:"blobId"`
+	}
+	if err := c.do(req, &blob); err != nil {
+		return fmt.Errorf("uploading mail failed: %w", err)
+	}
+
+	var resp struct {
+		NotCreated map[string]*setError `json:"notCreated"`
+	}
+	err = c.call(context.Background(), "Email/import", map[string]any{
+		"accountId": c.accountID,
+		"emails": map[string]any{
+			"m": map[string]any{
+				"blobId":     blob.BlobID,
+				"mailboxIds": map[string]bool{mailboxID: true},
+				"keywords":   jmapKeywords(flags),
+				"receivedAt": ts.UTC().Format(time.RFC3339),
+			},
+		},
+	}, &resp)
+	if err != nil {
+		return fmt.Errorf("importing mail failed: %w", err)
+	}
+
+	if serr, exists := resp.NotCreated["m"]; exists {
+		return fmt.Errorf("importing mail failed: %w", serr)
+	}
+
+	c.logger.Debug(
+		"uploaded message to mailbox",
+		"jmap.mailbox", mailbox,
+		"event", "jmap.messages_uploaded",
+		"filepath", path,
+	)
+
+	return nil
+}
+
+// Search returns the UIDs of the messages in mailbox that match criteria.
+func (c *Client) Search(mailbox string, criteria *imapclt.SearchCriteria) (*imapclt.SearchResult, error) {
+	mailboxID, err := c.mailboxID(mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := c.mailboxTotal(mailboxID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := imapclt.SearchResult{NumMessages: total}
+	if total == 0 {
+		return &result, nil
+	}
+
+	qr, err := c.query(context.Background(), searchFilter(mailboxID, criteria, time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("searching messages failed: %w", err)
+	}
+
+	for _, id := range qr.ids {
+		result.UIDs = append(result.UIDs, c.uid(id))
+	}
+
+	if err := c.saveState(); err != nil {
+		return nil, err
+	}
+
+	c.logger.Debug("searched messages",
+		"jmap.mailbox", mailbox,
+		"count", len(result.UIDs),
+		"event", "jmap.messages_searched",
+	)
+
+	return &result, nil
+}
+
+// searchFilter returns the Email/query filter for criteria.
+func searchFilter(mailboxID string, sc *imapclt.SearchCriteria, now time.Time) map[string]any {
+	conditions := []map[string]any{{"inMailbox": mailboxID}}
+
+	for _, f := range sc.Flags {
+		conditions = append(conditions, map[string]any{"hasKeyword": jmapKeyword(f)})
+	}
+
+	for _, f := range sc.NotFlags {
+		conditions = append(conditions, map[string]any{"notKeyword": jmapKeyword(f)})
+	}
+
+	if sc.MaxAge > 0 {
+		conditions = append(conditions, map[string]any{
+			"after": now.Add(-sc.MaxAge).UTC().Format(time.RFC3339),
+		})
+	}
+
+	if sc.MinAge > 0 {
+		conditions = append(conditions, map[string]any{
+			"before": now.Add(-sc.MinAge).UTC().Format(time.RFC3339),
+		})
+	}
+
+	// minSize and maxSize are inclusive respectively exclusive, LARGER and
+	// SMALLER are both exclusive
+	if sc.Larger > 0 {
+		conditions = append(conditions, map[string]any{"minSize": sc.Larger + 1})
+	}
+
+	if sc.Smaller > 0 {
+		conditions = append(conditions, map[string]any{"maxSize": sc.Smaller})
+	}
+
+	for k, v := range sc.Headers {
+		conditions = append(conditions, map[string]any{"header": []string{k, v}})
+	}
+
+	return map[string]any{"operator": "AND", "conditions": conditions}
+}
+
+// jmapKeyword returns the JMAP keyword for an IMAP flag or keyword
+// (RFC 8621, section 4.1.1).
+func jmapKeyword(flag string) string {
+	switch strings.ToLower(flag) {
+	case `\seen`:
+		return "$seen"
+	case `\flagged`:
+		return "$flagged"
+	case `\answered`:
+		return "$answered"
+	case `\draft`:
+		return "$draft"
+	}
+
+	return strings.ToLower(flag)
+}
+
+// jmapKeywords returns the JMAP keywords for IMAP flags in the format that is
+// used in Email objects.
+func jmapKeywords(flags []string) map[string]bool {
+	result := make(map[string]bool, len(flags))
+	for _, f := range flags {
+		if strings.EqualFold(f, `\Recent`) {
+			continue
+		}
+		result[jmapKeyword(f)] = true
+	}
+
+	return result
+}
+
+// imapFlags returns the IMAP flags for the JMAP keywords, sorted.
+func imapFlags(keywords map[string]bool) []string {
+	result := make([]string, 0, len(keywords))
+	for k, set := range keywords {
+		if !set {
+			continue
+		}
+
+		switch k {
+		case "$seen":
+			k = `\Seen`
+		case "$flagged":
+			k = `\Flagged`
+		case "$answered":
+			k = `\Answered`
+		case "$draft":
+			k = `\Draft`
+		}
+		result = append(result, k)
+	}
+
+	slices.Sort(result)
+
+	return result
+}
+
+func jsonPointerEscape(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
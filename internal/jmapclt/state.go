@@ -0,0 +1,96 @@
+package jmapclt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/fho/rspamd-iscan/internal/fsutil"
+)
+
+// persistedState is the content of the state file.
+type persistedState struct {
+	AccountID  string            `json:"accountId"`
+	EmailState string            `json:"emailState"`
+	LastUID    uint32            `json:"lastUid"`
+	UIDs       map[string]uint32 `json:"uids"`
+}
+
+// loadState reads the UID mapping from the state file.
+// If no state file is configured or it does not exist, the mapping stays
+// empty. If the file belongs to a different account it is ignored.
+func (c *Client) loadState() error {
+	if c.stateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.stateFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var s persistedState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("decoding %q failed: %w", c.stateFile, err)
+	}
+
+	if s.AccountID != c.accountID {
+		c.logger.Info("ignoring state file of a different account",
+			"path", c.stateFile, "jmap.account_id", s.AccountID,
+			"event", "jmap.state_file_ignored")
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.emailState = s.EmailState
+	c.lastUID = s.LastUID
+	c.uids = map[string]uint32{}
+	c.ids = map[uint32]string{}
+	for id, uid := range s.UIDs {
+		c.uids[id] = uid
+		c.ids[uid] = id
+	}
+
+	return nil
+}
+
+// saveState writes the UID mapping to the state file, if it was modified.
+func (c *Client) saveState() error {
+	if c.stateFile == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	if !c.stateDirty {
+		c.mu.Unlock()
+		return nil
+	}
+
+	data, err := json.Marshal(&persistedState{
+		AccountID:  c.accountID,
+		EmailState: c.emailState,
+		LastUID:    c.lastUID,
+		UIDs:       c.uids,
+	})
+	c.stateDirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := fsutil.WriteFileAtomic(c.stateFile, data); err != nil {
+		c.mu.Lock()
+		c.stateDirty = true
+		c.mu.Unlock()
+		return fmt.Errorf("writing state file failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package log
+
+import (
+	"context"
+	"log/slog"
+)
+
+// ModuleKey is the attribute key that contains the name of the module that
+// emitted a log record.
+const ModuleKey = "module"
+
+// Module returns a logger that adds the module attribute with the value
+// name to every log record.
+func Module(logger *slog.Logger, name string) *slog.Logger {
+	return EnsureLoggerInstance(logger).With(ModuleKey, name)
+}
+
+// moduleLevelHandler discards records with a lower level than the one
+// configured for the module of the logger.
+type moduleLevelHandler struct {
+	handler slog.Handler
+	levels  map[string]slog.Level
+	level   slog.Level
+}
+
+func newModuleLevelHandler(h slog.Handler, level slog.Level, moduleLevels map[string]slog.Level) *moduleLevelHandler {
+	return &moduleLevelHandler{
+		handler: h,
+		levels:  moduleLevels,
+		level:   level,
+	}
+}
+
+func (h *moduleLevelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.handler.Enabled(ctx, level)
+}
+
+func (h *moduleLevelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *moduleLevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	level := h.level
+
+	for _, a := range attrs {
+		if a.Key != ModuleKey {
+			continue
+		}
+
+		if l, exists := h.levels[a.Value.String()]; exists {
+			level = l
+		}
+	}
+
+	return &moduleLevelHandler{
+		handler: h.handler.WithAttrs(attrs),
+		levels:  h.levels,
+		level:   level,
+	}
+}
+
+func (h *moduleLevelHandler) WithGroup(name string) slog.Handler {
+	return &moduleLevelHandler{
+		handler: h.handler.WithGroup(name),
+		levels:  h.levels,
+		level:   h.level,
+	}
+}
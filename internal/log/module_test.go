@@ -0,0 +1,38 @@
+package log
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestModuleLevels(t *testing.T) {
+	var buf bytes.Buffer
+
+	h := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	logger := slog.New(newModuleLevelHandler(h, slog.LevelInfo, map[string]slog.Level{
+		"imapclt": slog.LevelWarn,
+		"rspamc":  slog.LevelDebug,
+	}))
+
+	logger.Debug("root-debug")
+	logger.Info("root-info")
+	Module(logger, "imapclt").Info("imapclt-info")
+	Module(logger, "imapclt").With("k", "v").Warn("imapclt-warn")
+	Module(logger, "rspamc").WithGroup("g").Debug("rspamc-debug")
+	Module(logger, "other").Debug("other-debug")
+
+	out := buf.String()
+	for _, msg := range []string{"root-info", "imapclt-warn", "rspamc-debug"} {
+		if !strings.Contains(out, msg) {
+			t.Errorf("message %q is missing in output:\n%s", msg, out)
+		}
+	}
+
+	for _, msg := range []string{"root-debug", "imapclt-info", "other-debug"} {
+		if strings.Contains(out, msg) {
+			t.Errorf("message %q should have been filtered:\n%s", msg, out)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"strings"
+)
+
+const (
+	OutputStderr = "stderr"
+	OutputSyslog = "syslog"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+type Config struct {
+	// Format is either [FormatText] or [FormatJSON].
+	Format string
+	// Output is [OutputStderr], [OutputSyslog] or the path of a log file.
+	Output string
+	// FileMaxSize is the size in bytes at which the log file is rotated.
+	// If it is 0, the file is not rotated.
+	FileMaxSize int64
+	// FileMaxBackups is the number of rotated log files that are kept.
+	FileMaxBackups int
+	// Level is the minimum level of logged messages.
+	Level string
+	// ModuleLevels overwrites Level for the modules, keys are module
+	// names.
+	ModuleLevels map[string]string
+}
+
+// New creates a logger according to cfg.
+// The returned closer must be called to release the output.
+func New(cfg *Config) (*slog.Logger, io.Closer, error) {
+	var out io.WriteCloser
+	var err error
+	// the timestamp is omitted when the output adds one already, e.g.
+	// when rspamd-iscan runs as daemon journald or syslog do it
+	omitTime := true
+
+	level, err := parseLevel(cfg.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	moduleLevels := make(map[string]slog.Level, len(cfg.ModuleLevels))
+	for module, l := range cfg.ModuleLevels {
+		moduleLevels[module], err = parseLevel(l)
+		if err != nil {
+			return nil, nil, fmt.Errorf("module %q: %w", module, err)
+		}
+	}
+
+	switch cfg.Output {
+	case "", OutputStderr:
+		out = nopCloser{os.Stderr}
+	case OutputSyslog:
+		out, err = syslog.New(syslog.LOG_INFO|syslog.LOG_MAIL, "rspamd-iscan")
+		if err != nil {
+			return nil, nil, fmt.Errorf("connecting to syslog failed: %w", err)
+		}
+	default:
+		out, err = openRotatingFile(cfg.Output, cfg.FileMaxSize, cfg.FileMaxBackups)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening log file failed: %w", err)
+		}
+		omitTime = false
+	}
+
+	opts := slog.HandlerOptions{
+		// levels are filtered by moduleLevelHandler
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if omitTime && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+
+	var h slog.Handler
+	switch cfg.Format {
+	case "", FormatText:
+		h = slog.NewTextHandler(out, &opts)
+	case FormatJSON:
+		h = slog.NewJSONHandler(out, &opts)
+	default:
+		_ = out.Close()
+		return nil, nil, fmt.Errorf("unsupported log format: %q", cfg.Format)
+	}
+
+	return slog.New(newModuleLevelHandler(h, level, moduleLevels)), out, nil
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+
+	if err := l.UnmarshalText([]byte(strings.ToUpper(s))); err != nil {
+		return 0, fmt.Errorf("invalid log level: %q", s)
+	}
+
+	return l, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
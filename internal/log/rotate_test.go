@@ -0,0 +1,35 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iscan.log")
+
+	f, err := openRotatingFile(path, 10, 2)
+	assert.NoError(t, err)
+
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		_, err := f.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, f.Close())
+
+	for p, expected := range map[string]string{
+		path:        "line4\n",
+		path + ".1": "line3\n",
+		path + ".2": "line2\n",
+	} {
+		data, err := os.ReadFile(p)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+
+	_, err = os.Stat(path + ".3")
+	assert.Equal(t, true, os.IsNotExist(err))
+}
@@ -0,0 +1,104 @@
+package mail
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"slices"
+	"strings"
+)
+
+// wrappedHeaders are the headers that are copied from an e-mail to the
+// e-mail that [WrapWithAttachment] creates.
+var wrappedHeaders = []string{"From", "To", "Cc", "Date", "Subject"}
+
+// WrapWithAttachment writes a multipart e-mail to out, that contains the
+// e-mail from in unmodified as message/rfc822 part, followed by data as
+// attachment with the given filename and content type.
+// The From, To, Cc, Date and Subject headers of the e-mail are copied to the
+// new one.
+func WrapWithAttachment(in io.Reader, out io.Writer, filename, contentType string, data []byte) error {
+	br := bufio.NewReader(in)
+	bw := bufio.NewWriter(out)
+
+	fields, eol, err := readHeaderFields(br)
+	if err != nil {
+		return err
+	}
+
+	mw := multipart.NewWriter(bw)
+
+	var hdr strings.Builder
+	for _, f := range fields {
+		if !slices.ContainsFunc(wrappedHeaders, func(name string) bool {
+			return strings.EqualFold(name, f.name)
+		}) {
+			continue
+		}
+
+		for _, line := range f.lines {
+			hdr.WriteString(strings.TrimRight(line, "\r\n"))
+			hdr.WriteString("\r\n")
+		}
+	}
+	hdr.WriteString("MIME-Version: 1.0\r\n")
+	hdr.WriteString("Content-Type: " + mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}) + "\r\n")
+	hdr.WriteString("\r\n")
+
+	if _, err := bw.WriteString(hdr.String()); err != nil {
+		return fmt.Errorf("writing failed: %w", err)
+	}
+
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"message/rfc822"},
+		"Content-Disposition": {"inline"},
+	})
+	if err != nil {
+		return fmt.Errorf("writing failed: %w", err)
+	}
+
+	for _, f := range fields {
+		for _, line := range f.lines {
+			if _, err := io.WriteString(pw, line); err != nil {
+				return fmt.Errorf("writing failed: %w", err)
+			}
+		}
+	}
+	if _, err := io.WriteString(pw, eol); err != nil {
+		return fmt.Errorf("writing failed: %w", err)
+	}
+	if _, err := io.Copy(pw, br); err != nil {
+		return fmt.Errorf("copying email failed: %w", err)
+	}
+
+	pw, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(contentType, map[string]string{"name": filename})},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return fmt.Errorf("writing failed: %w", err)
+	}
+
+	qw := quotedprintable.NewWriter(pw)
+	if _, err := qw.Write(data); err != nil {
+		return fmt.Errorf("writing attachment failed: %w", err)
+	}
+	if err := qw.Close(); err != nil {
+		return fmt.Errorf("writing attachment failed: %w", err)
+	}
+
+	if err := mw.Close(); err != nil {
+		return fmt.Errorf("writing failed: %w", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("flushing buffer failed: %w", err)
+	}
+
+	return nil
+}
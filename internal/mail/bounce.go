@@ -0,0 +1,122 @@
+package mail
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// maxBounceParts is the max. number of MIME parts of a bounce that are
+// searched for the original message.
+const maxBounceParts = 16
+
+// Bounce describes a delivery status notification or another automatically
+// generated reply to a message.
+type Bounce struct {
+	// Reason describes why the mail is a bounce, e.g. "null return-path".
+	Reason string
+	// OriginalFrom are the From addresses of the message that the bounce
+	// refers to. They are empty if the bounce does not contain the
+	// message or its header.
+	OriginalFrom []string
+	// OriginalMessageID is the Message-ID of the message that the bounce
+	// refers to, including the angle brackets.
+	OriginalMessageID string
+}
+
+// ParseBounce parses the mail from r and returns a [Bounce] if it is a bounce,
+// otherwise nil.
+// A mail is considered a bounce, if its return path is null ("<>"), it has an
+// Auto-Submitted header with another value than "no" or it is a
+// multipart/report.
+// The original message is searched in message/rfc822 and text/rfc822-headers
+// parts.
+func ParseBounce(r io.Reader) (*Bounce, error) {
+	msg, err := netmail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+
+	var b Bounce
+	switch {
+	case mediaType == "multipart/report":
+		b.Reason = "multipart/report"
+	case strings.TrimSpace(msg.Header.Get("Return-Path")) == "<>":
+		b.Reason = "null return-path"
+	case isAutoSubmitted(msg.Header.Get("Auto-Submitted")):
+		b.Reason = "auto-submitted"
+	default:
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return &b, nil
+	}
+
+	hdr, err := findOriginalHeader(multipart.NewReader(msg.Body, params["boundary"]))
+	if err != nil || hdr == nil {
+		// the mail is a bounce regardless, truncated mails and
+		// malformed bounces are common
+		return &b, nil //nolint:nilerr // the original message is optional
+	}
+
+	if list, err := (&netmail.AddressParser{WordDecoder: NewWordDecoder()}).ParseList(hdr.Get("From")); err == nil {
+		for _, addr := range list {
+			b.OriginalFrom = append(b.OriginalFrom, addr.Address)
+		}
+	}
+	b.OriginalMessageID = strings.TrimSpace(hdr.Get("Message-Id"))
+
+	return &b, nil
+}
+
+func isAutoSubmitted(v string) bool {
+	v, _, _ = strings.Cut(v, ";")
+	v = strings.ToLower(strings.TrimSpace(v))
+
+	return v != "" && v != "no"
+}
+
+// findOriginalHeader returns the header of the first message/rfc822,
+// message/rfc822-headers or text/rfc822-headers part that mr contains.
+// Nested multipart parts are searched too.
+func findOriginalHeader(mr *multipart.Reader) (textproto.MIMEHeader, error) {
+	for range maxBounceParts {
+		part, err := mr.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		mediaType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch mediaType {
+		case "message/rfc822", "message/rfc822-headers", "text/rfc822-headers":
+			hdr, err := textproto.NewReader(bufio.NewReader(part)).ReadMIMEHeader()
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			return hdr, nil
+
+		case "multipart/alternative", "multipart/mixed", "multipart/report":
+			if params["boundary"] == "" {
+				continue
+			}
+
+			hdr, err := findOriginalHeader(multipart.NewReader(part, params["boundary"]))
+			if err != nil || hdr != nil {
+				return hdr, err
+			}
+		}
+	}
+
+	return nil, nil
+}
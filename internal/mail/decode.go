@@ -0,0 +1,113 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// cp1252 maps the bytes 0x80-0x9f of windows-1252 to their runes, the other
+// bytes are identical to ISO-8859-1. Undefined bytes are mapped to
+// [utf8.RuneError].
+var cp1252 = [32]rune{
+	'€', utf8.RuneError, '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', utf8.RuneError, 'Ž', utf8.RuneError,
+	utf8.RuneError, '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', utf8.RuneError, 'ž', 'Ÿ',
+}
+
+// iso885915 maps the bytes of ISO-8859-15 that differ from ISO-8859-1 to
+// their runes.
+var iso885915 = map[byte]rune{
+	0xa4: '€', 0xa6: 'Š', 0xa8: 'š', 0xb4: 'Ž',
+	0xb8: 'ž', 0xbc: 'Œ', 0xbd: 'œ', 0xbe: 'Ÿ',
+}
+
+// NewWordDecoder returns a decoder for RFC 2047 encoded-words.
+// Additionally to the charsets that [mime.WordDecoder] supports (UTF-8,
+// US-ASCII, ISO-8859-1), it supports windows-1252 and ISO-8859-15, which are
+// commonly used by mail clients.
+func NewWordDecoder() *mime.WordDecoder {
+	return &mime.WordDecoder{CharsetReader: charsetReader}
+}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	var decode func(b byte) rune
+
+	switch strings.ToLower(charset) {
+	case "windows-1252", "cp1252":
+		decode = func(b byte) rune {
+			if b >= 0x80 && b <= 0x9f {
+				return cp1252[b-0x80]
+			}
+			return rune(b)
+		}
+
+	case "iso-8859-15", "latin-9":
+		decode = func(b byte) rune {
+			if r, ok := iso885915[b]; ok {
+				return r
+			}
+			return rune(b)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported charset: %q", charset)
+	}
+
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	for _, b := range data {
+		buf.WriteRune(decode(b))
+	}
+
+	return &buf, nil
+}
+
+// DecodeHeader returns the human-readable text of the unfolded header body
+// s. RFC 2047 encoded-words are decoded to UTF-8. Encoded-words with an
+// unsupported charset are kept.
+// The result is normalized with [NormalizeText].
+func DecodeHeader(s string) string {
+	decoded, err := NewWordDecoder().DecodeHeader(s)
+	if err != nil {
+		decoded = s
+	}
+
+	return NormalizeText(decoded)
+}
+
+// NormalizeText replaces invalid UTF-8 sequences with the Unicode replacement
+// character, replaces control characters (including line breaks) with
+// spaces, collapses runs of whitespace and trims s.
+func NormalizeText(s string) string {
+	s = strings.ToValidUTF8(s, string(utf8.RuneError))
+
+	var sb strings.Builder
+	sb.Grow(len(s))
+
+	space := false
+	for _, r := range s {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			space = true
+			continue
+		}
+
+		if space && sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		space = false
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
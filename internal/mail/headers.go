@@ -0,0 +1,190 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// HeaderEdit describes modifications of the header section of an e-mail.
+// Headers are removed before the new ones are added.
+type HeaderEdit struct {
+	// Remove maps header names to the occurrence of the header that is
+	// removed. 0 removes all occurrences, n > 0 the nth and n < 0 the nth
+	// from the end.
+	Remove map[string]int
+	// Add are the headers that are appended to the header section.
+	// Their bodies can be folded with "\n" or "\r\n", the line endings
+	// are converted to the ones of the e-mail. They must only consist of
+	// printable ASCII characters.
+	Add []*Header
+}
+
+// EditHeaders applies edit to the header section of the e-mail at path.
+func EditHeaders(path string, edit *HeaderEdit) error {
+	return rewriteFile(path, func(in io.Reader, out io.Writer) error {
+		return editHeaders(in, out, edit)
+	})
+}
+
+// EditHeadersData returns a copy of the e-mail in data with edit applied to
+// its header section.
+func EditHeadersData(data []byte, edit *HeaderEdit) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+
+	if err := editHeaders(bytes.NewReader(data), &buf, edit); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// headerField is a header field of an e-mail, including its folded lines.
+type headerField struct {
+	name  string
+	lines []string
+}
+
+// editHeaders reads an email from in, applies edit to its header section and
+// writes the result to out.
+func editHeaders(in io.Reader, out io.Writer, edit *HeaderEdit) error {
+	br := bufio.NewReader(in)
+	bw := bufio.NewWriter(out)
+
+	fields, eol, err := readHeaderFields(br)
+	if err != nil {
+		return err
+	}
+
+	for name, n := range edit.Remove {
+		fields = removeHeaderField(fields, name, n)
+	}
+
+	for _, f := range fields {
+		for _, line := range f.lines {
+			if _, err := bw.WriteString(line); err != nil {
+				return fmt.Errorf("writing failed: %w", err)
+			}
+		}
+	}
+
+	for _, hdr := range edit.Add {
+		line, err := foldedHeader(hdr, eol)
+		if err != nil {
+			return fmt.Errorf("header %q: %w", hdr.Name, err)
+		}
+
+		if _, err := bw.WriteString(line); err != nil {
+			return fmt.Errorf("writing failed: %w", err)
+		}
+	}
+
+	if _, err := bw.WriteString(eol); err != nil {
+		return fmt.Errorf("writing failed: %w", err)
+	}
+
+	if _, err := io.Copy(bw, br); err != nil {
+		return fmt.Errorf("copying email failed: %w", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("flushing buffer failed: %w", err)
+	}
+
+	return nil
+}
+
+// readHeaderFields reads the header section of an e-mail from br.
+// It returns the header fields and the line ending of the empty line that
+// terminates the section, br is positioned at the start of the body.
+func readHeaderFields(br *bufio.Reader) ([]*headerField, string, error) {
+	var fields []*headerField
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, "", errors.New("header end not found")
+			}
+			return nil, "", fmt.Errorf("reading email failed: %w", err)
+		}
+
+		if line == "\r\n" || line == "\n" {
+			return fields, line, nil
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			last := fields[len(fields)-1]
+			last.lines = append(last.lines, line)
+			continue
+		}
+
+		name, _, _ := strings.Cut(line, ":")
+		fields = append(fields, &headerField{name: strings.TrimSpace(name), lines: []string{line}})
+	}
+}
+
+// removeHeaderField removes the nth field with name from fields, see
+// [HeaderEdit.Remove].
+func removeHeaderField(fields []*headerField, name string, n int) []*headerField {
+	var idxs []int
+	for i, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			idxs = append(idxs, i)
+		}
+	}
+
+	var remove []int
+	switch {
+	case n == 0:
+		remove = idxs
+	case n > 0 && n <= len(idxs):
+		remove = idxs[n-1 : n]
+	case n < 0 && -n <= len(idxs):
+		remove = idxs[len(idxs)+n : len(idxs)+n+1]
+	}
+
+	// iterate backwards to keep the indexes valid
+	for i := len(remove) - 1; i >= 0; i-- {
+		fields = append(fields[:remove[i]], fields[remove[i]+1:]...)
+	}
+
+	return fields
+}
+
+// foldedHeader returns the header line(s) of hdr, terminated with eol.
+func foldedHeader(hdr *Header, eol string) (string, error) {
+	if hdr.Name == "" || strEmailHdrCharsOnly(hdr.Name) != hdr.Name {
+		return "", errors.New("header name contains an invalid character")
+	}
+
+	var sb strings.Builder
+
+	lines := strings.Split(strings.ReplaceAll(hdr.Body, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		if !isPrintableASCII(line) {
+			return "", errors.New("header body contains an invalid character")
+		}
+
+		if i == 0 {
+			line = hdr.Name + ": " + line
+		} else if line == "" {
+			continue
+		} else if line[0] != ' ' && line[0] != '\t' {
+			line = "\t" + line
+		}
+
+		if len(line)+len(eol) > maxLineLength {
+			return "", errors.New("header line is too long")
+		}
+
+		sb.WriteString(line)
+		sb.WriteString(eol)
+	}
+
+	return sb.String(), nil
+}
@@ -3,9 +3,12 @@ package mail
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"net/netip"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"slices"
@@ -71,6 +74,15 @@ func AsHeaders(hdrs []*Header) ([]byte, error) {
 // AddHeaders inserts additional headers to the e-mail at [path].
 // The file must be in RFC2822 format.
 func AddHeaders(path string, headers []byte) error {
+	return rewriteFile(path, func(in io.Reader, out io.Writer) error {
+		return addHeaders(in, out, headers)
+	})
+}
+
+// rewriteFile replaces the file at path with the output of fn.
+// fn is called with the content of the file and a writer to a temporary file,
+// that is renamed to path when fn succeeds.
+func rewriteFile(path string, fn func(in io.Reader, out io.Writer) error) error {
 	tmpfileFd, err := os.CreateTemp("", filepath.Base(path))
 	if err != nil {
 		return err
@@ -78,11 +90,12 @@ func AddHeaders(path string, headers []byte) error {
 
 	emailFd, err := os.Open(path)
 	if err != nil {
-		return err
+		_ = tmpfileFd.Close()
+		return errors.Join(err, os.Remove(tmpfileFd.Name()))
 	}
 	defer emailFd.Close()
 
-	err = addHeaders(emailFd, tmpfileFd, headers)
+	err = fn(emailFd, tmpfileFd)
 	if err != nil {
 		_ = tmpfileFd.Close()
 		delErr := os.Remove(tmpfileFd.Name())
@@ -172,3 +185,111 @@ func strEmailHdrCharsOnly(s string) string {
 		return -1
 	}, s)
 }
+
+// ReceivedIP returns the first public IP address in the topmost Received
+// header that contains one. This is the most recent hop, usually the host that
+// delivered the e-mail to the receiving MTA.
+// Addresses in private, loopback and link-local networks are skipped. If no
+// public address is found, an invalid [netip.Addr] is returned.
+func ReceivedIP(r io.Reader) (netip.Addr, error) {
+	hdr, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return netip.Addr{}, fmt.Errorf("parsing mail header failed: %w", err)
+	}
+
+	for _, v := range hdr.Values("Received") {
+		if addr, ok := receivedHdrIP(v); ok {
+			return addr, nil
+		}
+	}
+
+	return netip.Addr{}, nil
+}
+
+// receivedHdrIP returns the first public IP address in square brackets in the
+// body of a Received header, e.g.:
+// "from mx.example.com (mx.example.com [203.0.113.5]) by ...".
+func receivedHdrIP(body string) (netip.Addr, bool) {
+	for {
+		start := strings.IndexByte(body, '[')
+		if start == -1 {
+			return netip.Addr{}, false
+		}
+		body = body[start+1:]
+
+		end := strings.IndexByte(body, ']')
+		if end == -1 {
+			return netip.Addr{}, false
+		}
+
+		addr, err := netip.ParseAddr(strings.TrimPrefix(body[:end], "IPv6:"))
+		body = body[end+1:]
+		if err != nil {
+			continue
+		}
+
+		addr = addr.Unmap()
+		if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+			continue
+		}
+
+		return addr, true
+	}
+}
+
+// BodyHash returns the SHA-256 hash of the body of the e-mail read from r.
+// Headers are excluded, the hash does not change when headers are added or
+// modified.
+func BodyHash(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+
+	for {
+		line, err := br.ReadSlice('\n')
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			if errors.Is(err, io.EOF) {
+				// mail without a body
+				return sha256.New().Sum(nil), nil
+			}
+			return nil, fmt.Errorf("reading mail header failed: %w", err)
+		}
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			// skip the remainder of an overlong line
+			continue
+		}
+
+		if bytes.Equal(line, []byte("\r\n")) || bytes.Equal(line, []byte("\n")) {
+			break
+		}
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, br); err != nil {
+		return nil, fmt.Errorf("reading mail body failed: %w", err)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// InsertHeaders returns a copy of the e-mail in data with the additional
+// headers appended to its header section.
+// Unlike [AddHeaders], e-mails with LF line endings, as commonly stored in
+// Maildirs, are supported. hdrs must be CRLF terminated, the line endings are
+// converted to the ones of the e-mail.
+func InsertHeaders(data, hdrs []byte) ([]byte, error) {
+	idx := bytes.Index(data, []byte("\n\n"))
+	crlfIdx := bytes.Index(data, []byte("\r\n\r\n"))
+
+	if crlfIdx != -1 && (idx == -1 || crlfIdx < idx) {
+		// +2 to keep the \r\n of the last header line
+		return slices.Concat(data[:crlfIdx+2], hdrs, data[crlfIdx+2:]), nil
+	}
+
+	if idx == -1 {
+		return nil, errors.New("header end not found")
+	}
+
+	hdrs = bytes.ReplaceAll(hdrs, []byte("\r\n"), []byte("\n"))
+
+	return slices.Concat(data[:idx+1], hdrs, data[idx+1:]), nil
+}
@@ -2,8 +2,13 @@ package mail
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/fho/rspamd-iscan/internal/testutils/mail"
@@ -55,3 +60,404 @@ func TestAddHeaders(t *testing.T) {
 		t.Errorf("Got:\n%q\nExpected:\n%q\n", string(result), expected)
 	}
 }
+
+func TestReceivedIP(t *testing.T) {
+	const hdrs = "Received: from localhost (localhost [127.0.0.1])\r\n" +
+		"\tby mail.example.com (Postfix) with ESMTP id 1234\r\n" +
+		"Received: from relay.internal (relay.internal [10.0.0.3])\r\n" +
+		"\tby localhost (Postfix)\r\n" +
+		"Received: from mx.example.net (mx.example.net [IPv6:2001:db8::1] [203.0.113.5])\r\n" +
+		"\tby relay.internal\r\n" +
+		"Received: from origin.example.org (origin.example.org [198.51.100.7])\r\n" +
+		"Subject: test\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	addr, err := ReceivedIP(strings.NewReader(hdrs))
+	AssertNoErr(t, err)
+
+	if addr.String() != "2001:db8::1" {
+		t.Errorf("got address %q, expected %q", addr, "2001:db8::1")
+	}
+}
+
+func TestReceivedIPWithoutReceivedHeaders(t *testing.T) {
+	fd, err := os.Open(mail.TestHamMailPath(t))
+	AssertNoErr(t, err)
+	defer fd.Close()
+
+	addr, err := ReceivedIP(fd)
+	AssertNoErr(t, err)
+
+	if addr.IsValid() {
+		t.Errorf("got address %q, expected none", addr)
+	}
+}
+
+func TestBodyHashIgnoresHeaders(t *testing.T) {
+	const body = "\r\nthe body\r\n\r\nwith an empty line\r\n"
+
+	h1, err := BodyHash(strings.NewReader("Subject: test\r\n" + body))
+	AssertNoErr(t, err)
+
+	h2, err := BodyHash(strings.NewReader("X-rspamd-iscan-Score: 3\r\nSubject: test\r\n" + body))
+	AssertNoErr(t, err)
+
+	if !bytes.Equal(h1, h2) {
+		t.Errorf("hashes of mails with the same body differ: %x != %x", h1, h2)
+	}
+
+	h3, err := BodyHash(strings.NewReader("Subject: test\r\n\r\nanother body\r\n"))
+	AssertNoErr(t, err)
+
+	if bytes.Equal(h1, h3) {
+		t.Errorf("hashes of mails with different bodies are equal")
+	}
+}
+
+func TestInsertHeaders(t *testing.T) {
+	hdrs := []byte("New-Header: v1\r\n")
+
+	tests := []struct{ in, expected string }{
+		{
+			in:       "Subject: crlf\r\n\r\nbody\r\n",
+			expected: "Subject: crlf\r\nNew-Header: v1\r\n\r\nbody\r\n",
+		},
+		{
+			in:       "Subject: lf\n\nbody\n\nmore\n",
+			expected: "Subject: lf\nNew-Header: v1\n\nbody\n\nmore\n",
+		},
+	}
+
+	for _, tc := range tests {
+		result, err := InsertHeaders([]byte(tc.in), hdrs)
+		AssertNoErr(t, err)
+
+		if string(result) != tc.expected {
+			t.Errorf("Got:\n%q\nExpected:\n%q\n", string(result), tc.expected)
+		}
+	}
+
+	_, err := InsertHeaders([]byte("Subject: no body\n"), hdrs)
+	AssertErr(t, err)
+}
+
+func TestEditHeadersData(t *testing.T) {
+	edit := HeaderEdit{
+		Remove: map[string]int{"X-Spam": 0, "received": -1, "DKIM-Signature": 2},
+		Add: []*Header{
+			{Name: "X-Spam", Body: "Yes"},
+			{Name: "X-Spamd-Result", Body: "default: True [11.20 / 15.00];\n\tGTUBE(11.20)[]"},
+		},
+	}
+
+	tests := []struct{ in, expected string }{
+		{
+			in: "Received: 1\r\nX-Spam: No\r\nReceived: 2\r\n\tfolded\r\nx-spam: maybe\r\n" +
+				"DKIM-Signature: 1\r\nDKIM-Signature: 2\r\nSubject: crlf\r\n\r\nX-Spam: body\r\n",
+			expected: "Received: 1\r\nDKIM-Signature: 1\r\nSubject: crlf\r\nX-Spam: Yes\r\n" +
+				"X-Spamd-Result: default: True [11.20 / 15.00];\r\n\tGTUBE(11.20)[]\r\n\r\nX-Spam: body\r\n",
+		},
+		{
+			in:       "Subject: lf\n\nbody\n",
+			expected: "Subject: lf\nX-Spam: Yes\nX-Spamd-Result: default: True [11.20 / 15.00];\n\tGTUBE(11.20)[]\n\nbody\n",
+		},
+	}
+
+	for _, tc := range tests {
+		result, err := EditHeadersData([]byte(tc.in), &edit)
+		AssertNoErr(t, err)
+
+		if string(result) != tc.expected {
+			t.Errorf("Got:\n%q\nExpected:\n%q\n", string(result), tc.expected)
+		}
+	}
+
+	_, err := EditHeadersData([]byte("Subject: x\r\n\r\n"), &HeaderEdit{
+		Add: []*Header{{Name: "X-Invalid", Body: "\x00"}},
+	})
+	AssertErr(t, err)
+}
+
+func TestWrapWithAttachment(t *testing.T) {
+	in := "Received: 1\r\nFrom: a@example.com\r\nSubject: long\r\n\tsubject\r\n" +
+		"Message-ID: <1@example.com>\r\n\r\nbody\r\n"
+	report := []byte(`{"action": "reject", "score": 15}`)
+
+	var out bytes.Buffer
+	AssertNoErr(t, WrapWithAttachment(strings.NewReader(in), &out, "report.json", "application/json", report))
+
+	msg, err := netmail.ReadMessage(&out)
+	AssertNoErr(t, err)
+
+	if v := msg.Header.Get("Subject"); v != "long subject" {
+		t.Errorf("unexpected subject: %q", v)
+	}
+	if v := msg.Header.Get("Message-ID"); v != "" {
+		t.Errorf("message-id was copied: %q", v)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	AssertNoErr(t, err)
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("unexpected content type: %q", mediaType)
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+
+	p, err := mr.NextPart()
+	AssertNoErr(t, err)
+	data, err := io.ReadAll(p)
+	AssertNoErr(t, err)
+	if p.Header.Get("Content-Type") != "message/rfc822" || string(data) != in {
+		t.Errorf("unexpected first part %v:\n%q", p.Header, data)
+	}
+
+	p, err = mr.NextPart()
+	AssertNoErr(t, err)
+	data, err = io.ReadAll(p)
+	AssertNoErr(t, err)
+	if p.FileName() != "report.json" || !bytes.Equal(data, report) {
+		t.Errorf("unexpected second part %v:\n%q", p.Header, data)
+	}
+
+	_, err = mr.NextPart()
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF, got: %v", err)
+	}
+}
+
+func TestFilterParts(t *testing.T) {
+	hdr := "From: a@example.com\r\nContent-Type: multipart/mixed;\r\n boundary=\"outer\"\r\n\r\n"
+	alternative := "--outer\r\nContent-Type: multipart/alternative; boundary=outer2\r\n\r\n" +
+		"--outer2\r\nContent-Type: text/plain\r\n\r\ntext\r\n" +
+		"--outer2\r\nContent-Type: video/webm\r\n\r\nsmall\r\n" +
+		"--outer2--\r\n"
+	in := hdr + "preamble\r\n" + alternative +
+		"--outer\r\nContent-Type: VIDEO/mp4\r\n\r\nAAAA\r\nBBBB\r\n" +
+		"--outer\r\nContent-Type: application/octet-stream\r\n\r\n0123\r\n4567\r\n89ab\r\n" +
+		"--outer--  \r\nepilogue\r\n"
+	expected := hdr + "preamble\r\n" + alternative +
+		"--outer\r\nContent-Type: VIDEO/mp4\r\n\r\n\r\n" +
+		"--outer\r\nContent-Type: application/octet-stream\r\n\r\n0123\r\n4567\r\n" +
+		"--outer--  \r\nepilogue\r\n"
+
+	var out bytes.Buffer
+	res, err := FilterParts(strings.NewReader(in), &out, []*PartFilter{
+		{ContentType: "video/*", MaxSize: 10},
+		{ContentType: "application/octet-stream", MaxSize: 12, Truncate: true},
+	})
+	AssertNoErr(t, err)
+
+	if out.String() != expected {
+		t.Errorf("unexpected result:\n%q\nexpected:\n%q", out.String(), expected)
+	}
+	if *res != (FilterResult{Stripped: 1, Truncated: 1, RemovedBytes: 18}) {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	// mails without filtered parts are copied unmodified
+	out.Reset()
+	_, err = FilterParts(strings.NewReader(in), &out, []*PartFilter{{ContentType: "image/*"}})
+	AssertNoErr(t, err)
+	if out.String() != in {
+		t.Errorf("mail was modified:\n%q", out.String())
+	}
+}
+
+func TestRewriteSubject(t *testing.T) {
+	tests := []struct {
+		in       string
+		original string
+		expected string
+	}{
+		{
+			in:       "From: a@example.com\r\nSubject: Hello\r\n World\r\nTo: b@example.com\r\n\r\nSubject: body\r\n",
+			original: "Hello World",
+			expected: "From: a@example.com\r\nSubject: [TAG] Hello World\r\nTo: b@example.com\r\n\r\nSubject: body\r\n",
+		},
+		{
+			in:       "subject: Hello\n\nbody\n",
+			original: "Hello",
+			expected: "Subject: [TAG] Hello\n\nbody\n",
+		},
+		{
+			in:       "From: a@example.com\r\n\r\nbody\r\n",
+			original: "",
+			expected: "From: a@example.com\r\nSubject: [TAG] \r\n\r\nbody\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := rewriteSubject(strings.NewReader(tt.in), &out, func(s string) string {
+			if s != tt.original {
+				t.Errorf("got original subject %q, expected %q", s, tt.original)
+			}
+			return "[TAG] " + s
+		})
+		AssertNoErr(t, err)
+
+		if out.String() != tt.expected {
+			t.Errorf("Got:\n%q\nExpected:\n%q\n", out.String(), tt.expected)
+		}
+	}
+}
+
+func TestRewriteSubject_InvalidSubject(t *testing.T) {
+	err := rewriteSubject(
+		strings.NewReader("Subject: Hello\r\n\r\nbody\r\n"),
+		io.Discard,
+		func(string) string { return "Grüße" },
+	)
+	AssertErr(t, err)
+}
+
+func TestDecodeHeader(t *testing.T) {
+	tests := []struct{ in, expected string }{
+		{"=?UTF-8?B?R3LDvMOfZQ==?=", "Grüße"},
+		{"=?utf-8?q?Gr=C3=BC=C3=9Fe?= =?utf-8?q?_aus_Berlin?=", "Grüße aus Berlin"},
+		{"=?iso-8859-1?q?m=FCde?=", "müde"},
+		{"=?windows-1252?q?=80_100_=96_now?=", "€ 100 – now"},
+		{"=?iso-8859-15?q?=A4uro?=", "€uro"},
+		{"=?koi8-r?q?=F0?= kept", "=?koi8-r?q?=F0?= kept"},
+		{"  multiple   spaces\tand\r\n tabs ", "multiple spaces and tabs"},
+		{"invalid \xff utf-8", "invalid � utf-8"},
+	}
+
+	for _, tc := range tests {
+		if result := DecodeHeader(tc.in); result != tc.expected {
+			t.Errorf("DecodeHeader(%q) = %q, expected %q", tc.in, result, tc.expected)
+		}
+	}
+}
+
+const testBounce = "From: MAILER-DAEMON@mx.example.net\r\n" +
+	"To: me@example.com\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"The mail could not be delivered.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; nobody@example.net\r\n" +
+	"Action: failed\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"From: =?utf-8?q?M=C3=BCller?= <me@example.com>\r\n" +
+	"Message-ID: <1234@example.com>\r\n" +
+	"Subject: hello\r\n" +
+	"--b1--\r\n"
+
+func TestParseBounce(t *testing.T) {
+	b, err := ParseBounce(strings.NewReader(testBounce))
+	AssertNoErr(t, err)
+	if b == nil {
+		t.Fatal("bounce not detected")
+	}
+
+	if b.Reason != "multipart/report" {
+		t.Errorf("unexpected reason: %q", b.Reason)
+	}
+	if len(b.OriginalFrom) != 1 || b.OriginalFrom[0] != "me@example.com" {
+		t.Errorf("unexpected original from: %v", b.OriginalFrom)
+	}
+	if b.OriginalMessageID != "<1234@example.com>" {
+		t.Errorf("unexpected original message-id: %q", b.OriginalMessageID)
+	}
+}
+
+func TestParseBounce_Headers(t *testing.T) {
+	tests := []struct {
+		hdrs   string
+		reason string
+	}{
+		{"Return-Path: <>\r\n", "null return-path"},
+		{"Auto-Submitted: auto-replied\r\n", "auto-submitted"},
+		{"Auto-Submitted: no\r\n", ""},
+		{"Return-Path: <me@example.com>\r\n", ""},
+	}
+
+	for _, tc := range tests {
+		b, err := ParseBounce(strings.NewReader(tc.hdrs + "Subject: test\r\n\r\nbody\r\n"))
+		AssertNoErr(t, err)
+
+		switch {
+		case tc.reason == "" && b != nil:
+			t.Errorf("%q: unexpected bounce: %+v", tc.hdrs, b)
+		case tc.reason != "" && (b == nil || b.Reason != tc.reason):
+			t.Errorf("%q: expected bounce with reason %q, got: %+v", tc.hdrs, tc.reason, b)
+		case b != nil && len(b.OriginalFrom) != 0:
+			t.Errorf("%q: unexpected original from: %v", tc.hdrs, b.OriginalFrom)
+		}
+	}
+}
+
+func TestReadMbox(t *testing.T) {
+	const mbox = "From alice@example.com Mon Jan  1 00:00:00 2024\n" +
+		"Subject: first\n" +
+		"\n" +
+		"text\n" +
+		"From the start\n" +
+		">From escaped\n" +
+		">>From twice\n" +
+		"\n" +
+		"From bob@example.com Mon Jan  1 00:00:01 2024\n" +
+		"Subject: second\n" +
+		"\n" +
+		"body\n"
+
+	var msgs []string
+	err := ReadMbox(strings.NewReader(mbox), func(data []byte) error {
+		msgs = append(msgs, string(data))
+		return nil
+	})
+	AssertNoErr(t, err)
+
+	expected := []string{
+		"Subject: first\n\ntext\nFrom the start\nFrom escaped\n>From twice\n",
+		"Subject: second\n\nbody\n",
+	}
+	if len(msgs) != len(expected) {
+		t.Fatalf("got %d messages, expected %d: %q", len(msgs), len(expected), msgs)
+	}
+	for i := range expected {
+		if msgs[i] != expected[i] {
+			t.Errorf("message %d: got %q, expected %q", i, msgs[i], expected[i])
+		}
+	}
+}
+
+func TestReadMbox_Invalid(t *testing.T) {
+	err := ReadMbox(strings.NewReader("Subject: test\n\nbody\n"), func([]byte) error { return nil })
+	AssertErr(t, err)
+}
+
+func TestRewindable(t *testing.T) {
+	const msg = "Subject: test\r\n\r\nbody"
+
+	for _, r := range []io.Reader{
+		strings.NewReader(msg),
+		// not seekable
+		io.MultiReader(strings.NewReader(msg)),
+	} {
+		body, err := Rewindable(r)
+		AssertNoErr(t, err)
+
+		for range 2 {
+			rd, err := body()
+			AssertNoErr(t, err)
+			data, err := io.ReadAll(rd)
+			AssertNoErr(t, err)
+			if string(data) != msg {
+				t.Errorf("got %q, expected %q", data, msg)
+			}
+		}
+	}
+}
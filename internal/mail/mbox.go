@@ -0,0 +1,81 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// ReadMbox calls fn with the data of every message in the mbox that r
+// returns. The "From " separator lines are removed and lines that were
+// escaped as ">From ", ">>From ", etc. are unescaped (mboxrd format).
+// If fn returns an error, reading stops and the error is returned.
+func ReadMbox(r io.Reader, fn func(data []byte) error) error {
+	var msg []byte
+	var inMsg, prevBlank bool
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if isMboxSeparator(line) && (!inMsg || prevBlank) {
+				if inMsg {
+					if err := fn(trimMboxMessage(msg)); err != nil {
+						return err
+					}
+				}
+				msg = nil
+				inMsg = true
+				prevBlank = false
+			} else {
+				if !inMsg {
+					return errors.New("mbox does not start with a From line")
+				}
+				msg = append(msg, unescapeMboxLine(line)...)
+				prevBlank = len(bytes.TrimRight(line, "\r\n")) == 0
+			}
+		}
+
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				return err
+			}
+			break
+		}
+	}
+
+	if !inMsg {
+		return nil
+	}
+
+	return fn(trimMboxMessage(msg))
+}
+
+func isMboxSeparator(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+// unescapeMboxLine removes one ">" from lines that start with ">From ",
+// ">>From ", etc.
+func unescapeMboxLine(line []byte) []byte {
+	quoted := bytes.TrimLeft(line, ">")
+	if len(quoted) == len(line) || !bytes.HasPrefix(quoted, []byte("From ")) {
+		return line
+	}
+
+	return line[1:]
+}
+
+// trimMboxMessage removes the empty line that separates msg from the next
+// message.
+func trimMboxMessage(msg []byte) []byte {
+	if bytes.HasSuffix(msg, []byte("\r\n\r\n")) {
+		return msg[:len(msg)-2]
+	}
+	if bytes.HasSuffix(msg, []byte("\n\n")) {
+		return msg[:len(msg)-1]
+	}
+
+	return msg
+}
@@ -0,0 +1,342 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+)
+
+// maxContentTypeLen is the max. length of Content-Type header bodies that are
+// parsed, parts with longer ones are copied unfiltered.
+const maxContentTypeLen = 8192
+
+// PartFilter strips or truncates the bodies of MIME parts.
+type PartFilter struct {
+	// ContentType is a pattern of the media types of the parts in the
+	// syntax of [path.Match], e.g. "video/*". It is matched
+	// case-insensitively.
+	ContentType string
+	// MaxSize is the max. size of the encoded bodies of the parts in
+	// bytes. The bodies of larger parts are removed, or truncated to
+	// MaxSize bytes if Truncate is true.
+	MaxSize  int64
+	Truncate bool
+}
+
+// Validate returns an error if the filter is invalid.
+func (f *PartFilter) Validate() error {
+	if _, err := path.Match(f.ContentType, ""); err != nil || f.ContentType == "" {
+		return fmt.Errorf("invalid ContentType pattern: %q", f.ContentType)
+	}
+
+	if f.MaxSize < 0 {
+		return errors.New("MaxSize must not be negative")
+	}
+
+	return nil
+}
+
+// FilterResult describes the modifications of [FilterParts].
+type FilterResult struct {
+	Stripped  int
+	Truncated int
+	// RemovedBytes is the number of bytes that were removed from the
+	// bodies of the parts.
+	RemovedBytes int64
+}
+
+// FilterParts copies the e-mail from in to out, with the bodies of the MIME
+// parts that match one of filters stripped or truncated. The first matching
+// filter applies, multipart containers are never filtered. Headers and the
+// bodies of the other parts are copied unmodified.
+// The e-mail is processed as stream, only the body of a part that is stripped
+// is buffered until it exceeds the MaxSize of the filter.
+func FilterParts(in io.Reader, out io.Writer, filters []*PartFilter) (*FilterResult, error) {
+	pf := partFilter{
+		r:       bufio.NewReader(in),
+		w:       bufio.NewWriter(out),
+		filters: filters,
+		bol:     true,
+		eol:     "\r\n",
+	}
+
+	mediaType, params, err := pf.copyHeader()
+	if err == nil {
+		_, _, _, err = pf.body(mediaType, params, nil)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if err := pf.w.Flush(); err != nil {
+		return nil, fmt.Errorf("writing failed: %w", err)
+	}
+
+	return &pf.result, nil
+}
+
+type partFilter struct {
+	r       *bufio.Reader
+	w       *bufio.Writer
+	filters []*PartFilter
+	result  FilterResult
+	// bol is true if the next read starts at the beginning of a line.
+	bol bool
+	// eol is the line ending of the last header section.
+	eol string
+}
+
+// readLine returns the next line, including its line ending, and whether it
+// starts at the beginning of a line.
+// Lines that exceed the buffer of the reader are returned in multiple
+// fragments. The returned slice is only valid until the next call.
+// At the end of the input it returns the remaining data and io.EOF.
+func (pf *partFilter) readLine() ([]byte, bool, error) {
+	bol := pf.bol
+
+	line, err := pf.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		pf.bol = false
+		return line, bol, nil
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, bol, fmt.Errorf("reading email failed: %w", err)
+	}
+
+	pf.bol = true
+
+	return line, bol, err
+}
+
+func (pf *partFilter) write(data []byte) error {
+	if _, err := pf.w.Write(data); err != nil {
+		return fmt.Errorf("writing failed: %w", err)
+	}
+
+	return nil
+}
+
+// copyHeader copies the header section of a part and returns the media type
+// and parameters of its Content-Type header. Sections without a valid
+// Content-Type are text/plain.
+func (pf *partFilter) copyHeader() (string, map[string]string, error) {
+	var ctype []byte
+	var inCtype bool
+
+	for {
+		line, bol, err := pf.readLine()
+		if werr := pf.write(line); werr != nil {
+			return "", nil, werr
+		}
+		if err != nil {
+			return "", nil, err
+		}
+
+		if bol && (string(line) == "\r\n" || string(line) == "\n") {
+			pf.eol = string(line)
+			break
+		}
+
+		switch {
+		case !bol || line[0] == ' ' || line[0] == '\t':
+			if inCtype {
+				ctype = append(ctype, bytes.TrimRight(line, "\r\n")...)
+			}
+		default:
+			name, value, _ := bytes.Cut(line, []byte(":"))
+			inCtype = strings.EqualFold(string(bytes.TrimSpace(name)), "Content-Type")
+			if inCtype {
+				ctype = append(ctype[:0], bytes.TrimRight(value, "\r\n")...)
+			}
+		}
+
+		if len(ctype) > maxContentTypeLen {
+			ctype = nil
+			inCtype = false
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(string(ctype))
+	if err != nil {
+		return "text/plain", nil, nil
+	}
+
+	return mediaType, params, nil
+}
+
+// delimiter returns the index of the boundary in boundaries that line is a
+// delimiter of and whether it is a close delimiter. If it is not a delimiter,
+// -1 is returned.
+// The innermost boundary is last in boundaries.
+func delimiter(line []byte, bol bool, boundaries []string) (int, bool) {
+	if !bol || !bytes.HasPrefix(line, []byte("--")) {
+		return -1, false
+	}
+
+	// trailing whitespace is transport padding
+	line = bytes.TrimRight(line[2:], " \t\r\n")
+
+	for i := len(boundaries) - 1; i >= 0; i-- {
+		rest, found := bytes.CutPrefix(line, []byte(boundaries[i]))
+		if !found {
+			continue
+		}
+
+		switch string(rest) {
+		case "":
+			return i, false
+		case "--":
+			return i, true
+		}
+	}
+
+	return -1, false
+}
+
+// body processes the body of a part with the given media type until a
+// delimiter line of one of boundaries. It returns the index of the boundary,
+// whether it is a close delimiter and the delimiter line, which is not
+// written.
+// At the end of the input io.EOF is returned, with an index of -1 if the last
+// line is not a delimiter.
+func (pf *partFilter) body(mediaType string, params map[string]string, boundaries []string) (int, bool, []byte, error) {
+	boundary := params["boundary"]
+	if !strings.HasPrefix(mediaType, "multipart/") || boundary == "" {
+		if f := pf.match(mediaType); f != nil {
+			return pf.filterBody(f, boundaries)
+		}
+
+		return pf.copyBody(boundaries)
+	}
+
+	inner := append(boundaries[:len(boundaries):len(boundaries)], boundary)
+	own := len(inner) - 1
+
+	// the preamble
+	idx, closing, line, err := pf.copyBody(inner)
+
+	for {
+		if idx != own {
+			return idx, closing, line, err
+		}
+
+		if werr := pf.write(line); werr != nil {
+			return -1, false, nil, werr
+		}
+		if err != nil {
+			return -1, false, nil, err
+		}
+
+		if closing {
+			// the epilogue
+			return pf.copyBody(boundaries)
+		}
+
+		var mediaType string
+		var params map[string]string
+		if mediaType, params, err = pf.copyHeader(); err != nil {
+			return -1, false, nil, err
+		}
+
+		idx, closing, line, err = pf.body(mediaType, params, inner)
+	}
+}
+
+// copyBody copies lines until a delimiter of one of boundaries, see
+// [partFilter.body].
+func (pf *partFilter) copyBody(boundaries []string) (int, bool, []byte, error) {
+	for {
+		line, bol, err := pf.readLine()
+		if idx, closing := delimiter(line, bol, boundaries); idx >= 0 {
+			return idx, closing, bytes.Clone(line), err
+		}
+
+		if werr := pf.write(line); werr != nil {
+			return -1, false, nil, werr
+		}
+		if err != nil {
+			return -1, false, nil, err
+		}
+	}
+}
+
+// filterBody copies lines until a delimiter of one of boundaries, like
+// [partFilter.copyBody], and strips or truncates them according to f.
+func (pf *partFilter) filterBody(f *PartFilter, boundaries []string) (int, bool, []byte, error) {
+	var size, written int64
+	var exceeded bool
+	// buf contains the lines of a part that is stripped, until it exceeds
+	// the max. size
+	var buf bytes.Buffer
+
+	finish := func() error {
+		if !exceeded {
+			return pf.write(buf.Bytes())
+		}
+
+		pf.result.RemovedBytes += size - written
+		if f.Truncate {
+			pf.result.Truncated++
+		} else {
+			pf.result.Stripped++
+		}
+
+		// the line break before a delimiter belongs to the delimiter
+		if written == 0 {
+			return pf.write([]byte(pf.eol))
+		}
+
+		return nil
+	}
+
+	for {
+		line, bol, err := pf.readLine()
+		if idx, closing := delimiter(line, bol, boundaries); idx >= 0 {
+			line = bytes.Clone(line)
+			if ferr := finish(); ferr != nil {
+				return -1, false, nil, ferr
+			}
+			return idx, closing, line, err
+		}
+
+		size += int64(len(line))
+		if size > f.MaxSize {
+			exceeded = true
+		}
+
+		switch {
+		case exceeded:
+			buf.Reset()
+		case f.Truncate:
+			if werr := pf.write(line); werr != nil {
+				return -1, false, nil, werr
+			}
+			written = size
+		default:
+			buf.Write(line)
+		}
+
+		if err != nil {
+			if ferr := finish(); ferr != nil {
+				return -1, false, nil, ferr
+			}
+			return -1, false, nil, err
+		}
+	}
+}
+
+// match returns the first filter that matches mediaType or nil.
+func (pf *partFilter) match(mediaType string) *PartFilter {
+	for _, f := range pf.filters {
+		if matched, _ := path.Match(strings.ToLower(f.ContentType), mediaType); matched {
+			return f
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Rewindable returns a function that returns msg from the beginning on every
+// call, to send it to multiple receivers or to resend it.
+// If msg can not be seeked, it is read into memory.
+func Rewindable(msg io.Reader) (func() (io.Reader, error), error) {
+	if s, ok := msg.(io.ReadSeeker); ok {
+		start, err := s.Seek(0, io.SeekCurrent)
+		if err == nil {
+			return func() (io.Reader, error) {
+				_, err := s.Seek(start, io.SeekStart)
+				return s, err
+			}, nil
+		}
+	}
+
+	data, err := io.ReadAll(msg)
+	if err != nil {
+		return nil, fmt.Errorf("reading message failed: %w", err)
+	}
+
+	return func() (io.Reader, error) {
+		return bytes.NewReader(data), nil
+	}, nil
+}
@@ -0,0 +1,125 @@
+package mail
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// RewriteSubject replaces the Subject header of the e-mail at path with the
+// body returned by fn.
+// fn is called with the unfolded body of the original Subject header, it is
+// empty if the mail has none. In that case a Subject header is added.
+// The returned body must only consist of printable ASCII characters,
+// non-ASCII text must be encoded as described in RFC 2047.
+func RewriteSubject(path string, fn func(subject string) string) error {
+	return rewriteFile(path, func(in io.Reader, out io.Writer) error {
+		return rewriteSubject(in, out, fn)
+	})
+}
+
+// rewriteSubject reads an email from in, replaces its Subject header with the
+// one returned by fn and writes the result to out.
+func rewriteSubject(in io.Reader, out io.Writer, fn func(string) string) error {
+	br := bufio.NewReader(in)
+	bw := bufio.NewWriter(out)
+
+	var (
+		subject   strings.Builder
+		inSubject bool
+		found     bool
+		eol       = "\r\n"
+	)
+
+	writeSubject := func() error {
+		body := fn(strings.TrimSpace(subject.String()))
+		if !isPrintableASCII(body) {
+			return errors.New("subject contains an invalid character")
+		}
+
+		if len("Subject: ")+len(body)+len(eol) > maxLineLength {
+			return errors.New("subject is too long")
+		}
+
+		_, err := bw.WriteString("Subject: " + body + eol)
+		return err
+	}
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("header end not found")
+			}
+			return fmt.Errorf("reading email failed: %w", err)
+		}
+
+		if inSubject {
+			if line[0] == ' ' || line[0] == '\t' {
+				// unfolding only removes the line break
+				subject.WriteString(strings.TrimRight(line, "\r\n"))
+				continue
+			}
+
+			inSubject = false
+			if err := writeSubject(); err != nil {
+				return err
+			}
+		}
+
+		if line == "\r\n" || line == "\n" {
+			if !found {
+				eol = line
+				if err := writeSubject(); err != nil {
+					return err
+				}
+			}
+
+			if _, err := bw.WriteString(line); err != nil {
+				return fmt.Errorf("writing failed: %w", err)
+			}
+
+			break
+		}
+
+		if !found {
+			name, body, ok := strings.Cut(line, ":")
+			if ok && strings.EqualFold(name, "Subject") {
+				found = true
+				inSubject = true
+				body = strings.TrimRight(body, "\r\n")
+				eol = line[len(name)+1+len(body):]
+				subject.WriteString(body)
+				continue
+			}
+		}
+
+		if _, err := bw.WriteString(line); err != nil {
+			return fmt.Errorf("writing failed: %w", err)
+		}
+	}
+
+	if _, err := io.Copy(bw, br); err != nil {
+		return fmt.Errorf("copying email failed: %w", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("flushing buffer failed: %w", err)
+	}
+
+	return nil
+}
+
+// isPrintableASCII returns true if s only consists of printable ASCII
+// characters, spaces and tabs.
+func isPrintableASCII(s string) bool {
+	for _, r := range s {
+		if (r < 32 || r > 126) && r != '\t' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,152 @@
+// Package maildir implements accessing mails in Maildir++ directories.
+// (https://cr.yp.to/proto/maildir.html)
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SubdirNew = "new"
+	SubdirCur = "cur"
+	subdirTmp = "tmp"
+)
+
+// Dir is the path of a Maildir.
+type Dir string
+
+// Message is a mail file in a Maildir.
+type Message struct {
+	// Subdir is [SubdirNew] or [SubdirCur].
+	Subdir string
+	// Name is the file name of the message.
+	Name string
+}
+
+// Key returns the unique name of the message, it does not change when the
+// message is moved from new to cur or its flags are changed.
+func (m *Message) Key() string {
+	key, _, _ := strings.Cut(m.Name, ":")
+	return key
+}
+
+// WithoutSize returns a copy of m without the size attributes (S=, W=) in
+// its name, they must be removed when the content of a message is changed.
+func (m *Message) WithoutSize() *Message {
+	base, info, hasInfo := strings.Cut(m.Name, ":")
+
+	fields := strings.Split(base, ",")
+	kept := fields[:1]
+	for _, f := range fields[1:] {
+		if strings.HasPrefix(f, "S=") || strings.HasPrefix(f, "W=") {
+			continue
+		}
+		kept = append(kept, f)
+	}
+
+	name := strings.Join(kept, ",")
+	if hasInfo {
+		name += ":" + info
+	}
+
+	return &Message{Subdir: m.Subdir, Name: name}
+}
+
+// Path returns the path of the message in the Maildir d.
+func (d Dir) Path(m *Message) string {
+	return filepath.Join(string(d), m.Subdir, m.Name)
+}
+
+// Folder returns the Maildir++ folder with the given name.
+func (d Dir) Folder(name string) Dir {
+	return Dir(filepath.Join(string(d), "."+name))
+}
+
+// Create creates the directories of the Maildir, if they do not exist.
+func (d Dir) Create() error {
+	for _, sub := range []string{SubdirNew, SubdirCur, subdirTmp} {
+		if err := os.MkdirAll(filepath.Join(string(d), sub), 0o700); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Messages returns the messages in the new and cur directories.
+func (d Dir) Messages() ([]*Message, error) {
+	var result []*Message
+
+	for _, sub := range []string{SubdirNew, SubdirCur} {
+		entries, err := os.ReadDir(filepath.Join(string(d), sub))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+
+			result = append(result, &Message{Subdir: sub, Name: e.Name()})
+		}
+	}
+
+	return result, nil
+}
+
+// Move moves the message m from d to the same subdirectory of dest.
+func (d Dir) Move(m *Message, dest Dir) error {
+	return os.Rename(d.Path(m), dest.Path(m))
+}
+
+// CreateTemp creates a new file in the tmp directory of the Maildir.
+// The file can be moved into the Maildir with [Dir.Deliver].
+func (d Dir) CreateTemp() (*os.File, error) {
+	return os.OpenFile(
+		filepath.Join(string(d), subdirTmp, uniqueName()),
+		os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600,
+	)
+}
+
+// Deliver moves the file at tmpPath, created with [Dir.CreateTemp], to the
+// message m in d.
+// If a file for m already exists it is replaced.
+func (d Dir) Deliver(tmpPath string, m *Message) error {
+	return os.Rename(tmpPath, d.Path(m))
+}
+
+// Remove deletes the message m. It is not an error if it does not exist.
+func (d Dir) Remove(m *Message) error {
+	err := os.Remove(d.Path(m))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+var deliveryCnt atomic.Uint64
+
+// uniqueName returns a unique file name for a new message.
+func uniqueName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	// "/" and ":" are not allowed in the names
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+
+	now := time.Now()
+
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(), deliveryCnt.Add(1), host,
+	)
+}
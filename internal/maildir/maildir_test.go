@@ -0,0 +1,64 @@
+package maildir
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestMessageKey(t *testing.T) {
+	m := Message{Subdir: SubdirCur, Name: "1700000000.M1P2Q3.host,S=1024:2,S"}
+	assert.Equal(t, "1700000000.M1P2Q3.host,S=1024", m.Key())
+
+	m = Message{Subdir: SubdirNew, Name: "1700000000.M1P2Q3.host"}
+	assert.Equal(t, "1700000000.M1P2Q3.host", m.Key())
+}
+
+func TestMessageWithoutSize(t *testing.T) {
+	m := Message{Subdir: SubdirCur, Name: "1700000000.M1P2Q3.host,S=1024,W=1048:2,RS"}
+	assert.Equal(t, "1700000000.M1P2Q3.host:2,RS", m.WithoutSize().Name)
+
+	m = Message{Subdir: SubdirNew, Name: "1700000000.M1P2Q3.host,S=1024"}
+	assert.Equal(t, "1700000000.M1P2Q3.host", m.WithoutSize().Name)
+}
+
+func TestDeliverAndMove(t *testing.T) {
+	dir := Dir(t.TempDir())
+	assert.NoError(t, dir.Create())
+
+	spam := dir.Folder("Spam")
+	assert.NoError(t, spam.Create())
+
+	f, err := dir.CreateTemp()
+	assert.NoError(t, err)
+	_, err = f.WriteString("Subject: test\r\n\r\nbody\r\n")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	m := &Message{Subdir: SubdirNew, Name: filepath.Base(f.Name())}
+	assert.NoError(t, dir.Deliver(f.Name(), m))
+
+	// dotfiles and the Maildir++ folders are not listed as messages
+	assert.NoError(t, os.WriteFile(filepath.Join(string(dir), SubdirCur, ".hidden"), nil, 0o600))
+
+	msgs, err := dir.Messages()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, *m, *msgs[0])
+
+	assert.NoError(t, dir.Move(m, spam))
+
+	msgs, err = dir.Messages()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(msgs))
+
+	msgs, err = spam.Messages()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(msgs))
+
+	assert.NoError(t, spam.Remove(m))
+	// removing a message that does not exist is not an error
+	assert.NoError(t, spam.Remove(m))
+}
@@ -0,0 +1,40 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"time"
+)
+
+// MailSender delivers mails, it is implemented by smtpclt.Client.
+type MailSender interface {
+	Send(ctx context.Context, from string, to []string, msg io.Reader) error
+}
+
+// Email sends events as mails.
+type Email struct {
+	Sender MailSender
+	From   string
+	To     []string
+}
+
+func (e *Email) Notify(ctx context.Context, ev *Event) error {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From: %s\r\n", e.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "rspamd-iscan: "+ev.Title))
+	fmt.Fprintf(&buf, "Date: %s\r\n", ev.Time.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(ev.Message, "\n", "\r\n"))
+	buf.WriteString("\r\n")
+
+	return e.Sender.Send(ctx, e.From, e.To, &buf)
+}
@@ -0,0 +1,35 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Exec runs a command for every event, the event is passed JSON encoded via
+// stdin.
+type Exec struct {
+	// Command is run via "/bin/sh -c".
+	Command string
+}
+
+func (e *Exec) Notify(ctx context.Context, ev *Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", e.Command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
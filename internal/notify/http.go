@@ -0,0 +1,104 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxErrBodySize is the max. number of bytes of an error response body that
+// are included in errors.
+const maxErrBodySize = 512
+
+// Ntfy publishes events to a topic of a ntfy server (https://ntfy.sh).
+type Ntfy struct {
+	// URL is the URL of the topic, e.g. "https://ntfy.sh/mytopic".
+	URL string
+	// Token is optional, it is sent as bearer token.
+	Token string
+}
+
+func (n *Ntfy) Notify(ctx context.Context, ev *Event) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, strings.NewReader(ev.Message))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Title", ev.Title)
+	if ev.Type == EventErrorStreak {
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "warning")
+	}
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+
+	return send(req)
+}
+
+// defaultTelegramURL is the URL of the Telegram Bot API.
+const defaultTelegramURL = "https://api.telegram.org"
+
+// Telegram sends events as messages via a Telegram bot.
+type Telegram struct {
+	// Token is the token of the bot.
+	Token string
+	// ChatID is the id of the chat that the messages are sent to.
+	ChatID string
+	// APIURL is optional, it defaults to the URL of the Telegram Bot API.
+	APIURL string
+}
+
+func (t *Telegram) Notify(ctx context.Context, ev *Event) error {
+	apiURL := t.APIURL
+	if apiURL == "" {
+		apiURL = defaultTelegramURL
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"chat_id": t.ChatID,
+		"text":    ev.Title + "\n\n" + ev.Message,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(apiURL, "/")+"/bot"+t.Token+"/sendMessage",
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if err := send(req); err != nil {
+		// the token is part of the URL, it must not be logged
+		return errors.New(strings.ReplaceAll(err.Error(), t.Token, "***"))
+	}
+
+	return nil
+}
+
+// send sends req and returns an error if the response status is not 2xx.
+func send(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrBodySize))
+		return fmt.Errorf("server responded with status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	return nil
+}
@@ -0,0 +1,242 @@
+// Package notify sends notifications about events, like detected spam or
+// failing scan cycles, via ntfy, Telegram, e-mail or an external command.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/stats"
+)
+
+// sendTimeout is the max. duration of sending an event to a notifier.
+const sendTimeout = 30 * time.Second
+
+type EventType string
+
+const (
+	// EventSpamMoved is sent after a scan cycle in which spam was
+	// detected.
+	EventSpamMoved EventType = "spam_moved"
+	// EventErrorStreak is sent when a number of scan cycles in a row
+	// failed.
+	EventErrorStreak EventType = "error_streak"
+	// EventDigest is sent periodically, it contains the counters of the
+	// scan cycles since the last digest.
+	EventDigest EventType = "digest"
+	// EventRspamdUnavailable is sent after the first scan cycle in which
+	// messages were not scanned because rspamd was unavailable.
+	EventRspamdUnavailable EventType = "rspamd_unavailable"
+	// EventRspamdRecovered is sent after the first scan cycle that was not
+	// degraded anymore.
+	EventRspamdRecovered EventType = "rspamd_recovered"
+)
+
+// EventTypes are all supported event types.
+var EventTypes = []EventType{
+	EventSpamMoved, EventErrorStreak, EventDigest, EventRspamdUnavailable, EventRspamdRecovered,
+}
+
+// Event is a notification. It is passed to [Exec] commands JSON encoded.
+type Event struct {
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Account string    `json:"account"`
+	Title   string    `json:"title"`
+	Message string    `json:"message"`
+	// Counters are set for [EventSpamMoved] and [EventDigest] events.
+	Counters *stats.Counters `json:"counters,omitempty"`
+	// Error is set for [EventErrorStreak] events.
+	Error string `json:"error,omitempty"`
+}
+
+// Notifier delivers events.
+type Notifier interface {
+	Notify(ctx context.Context, ev *Event) error
+}
+
+// Target is a notifier and the events that are sent to it.
+type Target struct {
+	Name     string
+	Notifier Notifier
+	// Events are the types of events that are sent to the notifier, if
+	// it is empty all events are sent.
+	Events []EventType
+}
+
+func (t *Target) wants(typ EventType) bool {
+	return len(t.Events) == 0 || slices.Contains(t.Events, typ)
+}
+
+type Config struct {
+	Targets []*Target
+	// Account is the name of the scanned account, it is set in all
+	// events.
+	Account string
+	// ErrorStreak is the number of scan cycles in a row that must fail
+	// until an [EventErrorStreak] is sent. If it is 0, 1 is used.
+	ErrorStreak int
+	// DigestInterval is the interval in which [EventDigest] events are
+	// sent. If it is 0, no digests are sent.
+	DigestInterval time.Duration
+	Logger         *slog.Logger
+}
+
+// CycleResult is the result of a scan cycle.
+type CycleResult struct {
+	Counters stats.Counters
+	// SpamAction describes what happened to detected spam, e.g.
+	// "moved to Spam".
+	SpamAction string
+	Err        error
+}
+
+// Dispatcher creates events from the results of scan cycles and sends them to
+// the targets.
+// A nil *Dispatcher is disabled, its methods do nothing.
+type Dispatcher struct {
+	targets        []*Target
+	account        string
+	errorStreak    int
+	digestInterval time.Duration
+	logger         *slog.Logger
+
+	mu           sync.Mutex
+	failedCycles int
+	// degraded is true if rspamd was unavailable in the last scan cycle.
+	degraded    bool
+	digest      stats.Counters
+	digestStart time.Time
+}
+
+func New(cfg *Config) *Dispatcher {
+	return &Dispatcher{
+		targets:        cfg.Targets,
+		account:        cfg.Account,
+		errorStreak:    max(1, cfg.ErrorStreak),
+		digestInterval: cfg.DigestInterval,
+		logger:         log.Module(cfg.Logger, "notify"),
+		digestStart:    time.Now(),
+	}
+}
+
+// ScanCycleDone records the result of a scan cycle and sends the resulting
+// events.
+func (d *Dispatcher) ScanCycleDone(ctx context.Context, r *CycleResult) {
+	if d == nil {
+		return
+	}
+
+	for _, ev := range d.events(r, time.Now()) {
+		d.Notify(ctx, ev)
+	}
+}
+
+func (d *Dispatcher) events(r *CycleResult, now time.Time) []*Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var result []*Event
+
+	if r.Err != nil {
+		d.failedCycles++
+		// the event is only sent once per streak
+		if d.failedCycles == d.errorStreak {
+			result = append(result, &Event{
+				Type:    EventErrorStreak,
+				Title:   "Scanning mails fails",
+				Message: fmt.Sprintf("The last %d scan cycles failed, the last error was: %s", d.failedCycles, r.Err),
+				Error:   r.Err.Error(),
+			})
+		}
+	} else {
+		d.failedCycles = 0
+	}
+
+	switch degraded := r.Counters.Degraded > 0; {
+	case degraded && !d.degraded:
+		result = append(result, &Event{
+			Type:    EventRspamdUnavailable,
+			Title:   "rspamd is unavailable",
+			Message: "Mails are not scanned and left in the scan mailbox until rspamd is available again.",
+		})
+		d.degraded = true
+	case !degraded && d.degraded && r.Err == nil:
+		result = append(result, &Event{
+			Type:    EventRspamdRecovered,
+			Title:   "rspamd is available again",
+			Message: "Mails are scanned again.",
+		})
+		d.degraded = false
+	}
+
+	if r.Counters.Spam > 0 {
+		counters := r.Counters
+		result = append(result, &Event{
+			Type:     EventSpamMoved,
+			Title:    fmt.Sprintf("%d spam mails detected", r.Counters.Spam),
+			Message:  fmt.Sprintf("%d of %d scanned mails were spam and %s.", r.Counters.Spam, r.Counters.Scanned, r.SpamAction),
+			Counters: &counters,
+		})
+	}
+
+	if d.digestInterval > 0 {
+		d.digest.Add(&r.Counters)
+
+		if now.Sub(d.digestStart) >= d.digestInterval {
+			counters := d.digest
+			result = append(result, &Event{
+				Type:  EventDigest,
+				Title: "Scan digest",
+				Message: fmt.Sprintf("Since %s: %d mails scanned, %d spam, %d ham, %d failed scan cycles.",
+					d.digestStart.Format(time.DateTime), counters.Scanned, counters.Spam, counters.Ham, counters.Errors),
+				Counters: &counters,
+			})
+
+			d.digest = stats.Counters{}
+			d.digestStart = now
+		}
+	}
+
+	return result
+}
+
+// Notify sends ev to all targets that want it. Failures are logged.
+func (d *Dispatcher) Notify(ctx context.Context, ev *Event) {
+	if d == nil {
+		return
+	}
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.Account = d.account
+
+	// notifications about failures must also be sent during shutdown
+	ctx = context.WithoutCancel(ctx)
+
+	for _, t := range d.targets {
+		if !t.wants(ev.Type) {
+			continue
+		}
+
+		sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		err := t.Notifier.Notify(sendCtx, ev)
+		cancel()
+
+		if err != nil {
+			d.logger.Warn("sending notification failed",
+				"notifier", t.Name, "notify.event", ev.Type,
+				"error", err, "event", "notify.failed")
+			continue
+		}
+
+		d.logger.Debug("sent notification",
+			"notifier", t.Name, "notify.event", ev.Type, "event", "notify.sent")
+	}
+}
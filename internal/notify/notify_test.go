@@ -0,0 +1,208 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/stats"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+type recorder struct {
+	events []*Event
+}
+
+func (r *recorder) Notify(_ context.Context, ev *Event) error {
+	r.events = append(r.events, ev)
+	return nil
+}
+
+func (r *recorder) types() string {
+	var result []string
+	for _, ev := range r.events {
+		result = append(result, string(ev.Type))
+	}
+
+	return strings.Join(result, ",")
+}
+
+func TestDispatcherErrorStreak(t *testing.T) {
+	var rec recorder
+	d := New(&Config{
+		Targets:     []*Target{{Name: "rec", Notifier: &rec}},
+		Account:     "rick@imap",
+		ErrorStreak: 2,
+		Logger:      log.SlogTestLogger(t),
+	})
+
+	failed := &CycleResult{Err: errors.New("connection refused")}
+	d.ScanCycleDone(context.Background(), failed)
+	assert.Equal(t, "", rec.types())
+
+	d.ScanCycleDone(context.Background(), failed)
+	assert.Equal(t, "error_streak", rec.types())
+	assert.Equal(t, "rick@imap", rec.events[0].Account)
+	assert.Equal(t, "connection refused", rec.events[0].Error)
+
+	// the event is sent once per streak
+	d.ScanCycleDone(context.Background(), failed)
+	assert.Equal(t, "error_streak", rec.types())
+
+	d.ScanCycleDone(context.Background(), &CycleResult{})
+	d.ScanCycleDone(context.Background(), failed)
+	d.ScanCycleDone(context.Background(), failed)
+	assert.Equal(t, "error_streak,error_streak", rec.types())
+}
+
+func TestDispatcherRspamdUnavailable(t *testing.T) {
+	var rec recorder
+	d := New(&Config{
+		Targets: []*Target{{Name: "rec", Notifier: &rec}},
+		Logger:  log.SlogTestLogger(t),
+	})
+
+	degraded := &CycleResult{Counters: stats.Counters{Degraded: 1}}
+	d.ScanCycleDone(context.Background(), degraded)
+	d.ScanCycleDone(context.Background(), degraded)
+	assert.Equal(t, "rspamd_unavailable", rec.types())
+
+	// failed cycles do not end the degraded state
+	d.ScanCycleDone(context.Background(), &CycleResult{Err: errors.New("connection refused")})
+	d.ScanCycleDone(context.Background(), &CycleResult{})
+	assert.Equal(t, "rspamd_unavailable,error_streak,rspamd_recovered", rec.types())
+}
+
+func TestDispatcherSpamAndDigest(t *testing.T) {
+	var all, errorsOnly recorder
+	d := New(&Config{
+		Targets: []*Target{
+			{Name: "all", Notifier: &all},
+			{Name: "errors", Notifier: &errorsOnly, Events: []EventType{EventErrorStreak}},
+		},
+		DigestInterval: time.Hour,
+		Logger:         log.SlogTestLogger(t),
+	})
+
+	d.ScanCycleDone(context.Background(), &CycleResult{
+		Counters:   stats.Counters{Scanned: 3, Spam: 1, Ham: 2},
+		SpamAction: `moved to "Spam"`,
+	})
+	d.ScanCycleDone(context.Background(), &CycleResult{Counters: stats.Counters{Scanned: 1, Ham: 1}})
+	assert.Equal(t, "spam_moved", all.types())
+	assert.Equal(t, `1 of 3 scanned mails were spam and moved to "Spam".`, all.events[0].Message)
+
+	d.digestStart = time.Now().Add(-time.Hour)
+	d.ScanCycleDone(context.Background(), &CycleResult{})
+	assert.Equal(t, "spam_moved,digest", all.types())
+	assert.Equal(t, stats.Counters{Scanned: 4, Spam: 1, Ham: 3}, *all.events[1].Counters)
+
+	assert.Equal(t, "", errorsOnly.types())
+}
+
+func TestNilDispatcher(t *testing.T) {
+	var d *Dispatcher
+	d.ScanCycleDone(context.Background(), &CycleResult{Err: errors.New("err")})
+	d.Notify(context.Background(), &Event{Type: EventErrorStreak})
+}
+
+func TestNtfy(t *testing.T) {
+	var req *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	t.Cleanup(srv.Close)
+
+	n := Ntfy{URL: srv.URL + "/topic", Token: "secret"}
+	assert.NoError(t, n.Notify(context.Background(), &Event{
+		Type:    EventErrorStreak,
+		Title:   "title",
+		Message: "message",
+	}))
+
+	assert.Equal(t, "/topic", req.URL.Path)
+	assert.Equal(t, "title", req.Header.Get("Title"))
+	assert.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+	assert.Equal(t, "message", string(body))
+}
+
+func TestTelegram(t *testing.T) {
+	var path string
+	var msg map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		_ = json.NewDecoder(r.Body).Decode(&msg)
+		if msg["chat_id"] != "42" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	n := Telegram{Token: "123:abc", ChatID: "42", APIURL: srv.URL}
+	assert.NoError(t, n.Notify(context.Background(), &Event{Title: "title", Message: "message"}))
+	assert.Equal(t, "/bot123:abc/sendMessage", path)
+	assert.Equal(t, "title\n\nmessage", msg["text"])
+
+	n.ChatID = "1"
+	err := n.Notify(context.Background(), &Event{Title: "title", Message: "message"})
+	assert.Error(t, err)
+	if strings.Contains(err.Error(), n.Token) {
+		t.Errorf("error contains the token: %s", err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "event.json")
+
+	n := Exec{Command: "cat > " + out}
+	assert.NoError(t, n.Notify(context.Background(), &Event{Type: EventDigest, Title: "digest"}))
+
+	data, err := os.ReadFile(out)
+	assert.NoError(t, err)
+
+	var ev Event
+	assert.NoError(t, json.Unmarshal(data, &ev))
+	assert.Equal(t, EventDigest, ev.Type)
+	assert.Equal(t, "digest", ev.Title)
+
+	n = Exec{Command: "echo failed >&2; exit 1"}
+	assert.Error(t, n.Notify(context.Background(), &ev))
+}
+
+type mailRecorder struct {
+	to  []string
+	msg string
+}
+
+func (r *mailRecorder) Send(_ context.Context, _ string, to []string, msg io.Reader) error {
+	data, err := io.ReadAll(msg)
+	r.to = to
+	r.msg = string(data)
+	return err
+}
+
+func TestEmail(t *testing.T) {
+	var rec mailRecorder
+	n := Email{Sender: &rec, From: "iscan@example.com", To: []string{"rick@example.com"}}
+
+	assert.NoError(t, n.Notify(context.Background(), &Event{
+		Title:   "Grüße",
+		Message: "line1\nline2",
+		Time:    time.Now(),
+	}))
+
+	assert.Equal(t, "rick@example.com", strings.Join(rec.to, ","))
+	assert.Equal(t, true, strings.Contains(rec.msg, "Subject: =?utf-8?q?rspamd-iscan:_Gr=C3=BC=C3=9Fe?=\r\n"))
+	assert.Equal(t, true, strings.HasSuffix(rec.msg, "\r\n\r\nline1\r\nline2\r\n"))
+}
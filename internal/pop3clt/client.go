@@ -0,0 +1,351 @@
+// Package pop3clt implements a POP3 client (RFC 1939).
+package pop3clt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+)
+
+const dialTimeout = 120 * time.Second
+
+type Client struct {
+	address       string
+	user          string
+	password      string
+	allowInsecure bool
+
+	conn   net.Conn
+	br     *bufio.Reader
+	logger *slog.Logger
+}
+
+type Config struct {
+	// Address is the address of the POP3 server. If the port is "995" or
+	// "pop3s" an implicit TLS connection is established.
+	// Otherwise a explicit TLS (STLS) connection is established.
+	Address  string
+	User     string
+	Password string
+	// AllowInsecure enables falling back to establishing the
+	// connection without encryption when the server does not support TLS
+	AllowInsecure bool
+	Logger        *slog.Logger
+}
+
+// NewClient creates a new POP3-Client.
+// [*Client.Connect] must be called before any other methods.
+func NewClient(cfg *Config) *Client {
+	return &Client{
+		address:       cfg.Address,
+		user:          cfg.User,
+		password:      cfg.Password,
+		allowInsecure: cfg.AllowInsecure,
+		logger:        log.Module(cfg.Logger, "pop3clt"),
+	}
+}
+
+// Connect establishes a connection to the POP3-Server and authenticates.
+// The maildrop is locked by the server until [*Client.Close] is called.
+func (c *Client) Connect() error {
+	if err := c.dial(); err != nil {
+		return fmt.Errorf("establishing pop3 server connection failed: %w", err)
+	}
+
+	if _, err := c.cmd("USER %s", c.user); err != nil {
+		_ = c.conn.Close()
+		return fmt.Errorf("login at pop3 server failed: %w", err)
+	}
+
+	if _, err := c.cmd("PASS %s", c.password); err != nil {
+		_ = c.conn.Close()
+		return fmt.Errorf("login at pop3 server failed: %w", err)
+	}
+
+	c.logger.Info("connection established, authentication succeeded",
+		"event", "pop3.connection_established")
+
+	return nil
+}
+
+func (c *Client) dial() error {
+	host, port, err := net.SplitHostPort(c.address)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	logger := c.logger.With("server", c.address).With("timeout", dialTimeout)
+
+	if port == "995" || port == "pop3s" {
+		logger.Debug("connecting to pop3 server", "tlsmode", "implicit")
+
+		conn, err := tls.DialWithDialer(&dialer, "tcp", c.address, nil)
+		if err != nil {
+			return err
+		}
+		c.setConn(conn)
+
+		_, err = c.readResponse()
+		return err
+	}
+
+	logger.Debug("connecting to pop3 server", "tlsmode", "explicit")
+	conn, err := dialer.Dial("tcp", c.address)
+	if err != nil {
+		return err
+	}
+	c.setConn(conn)
+
+	if _, err := c.readResponse(); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	if _, err := c.cmd("STLS"); err != nil {
+		if !c.allowInsecure {
+			_ = conn.Close()
+			return fmt.Errorf("STLS failed: %w", err)
+		}
+
+		logger.Warn("establishing secure connection failed, continuing without encryption",
+			"tlsmode", "none", "error", err)
+		return nil
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("tls handshake failed: %w", err)
+	}
+	c.setConn(tlsConn)
+
+	return nil
+}
+
+func (c *Client) setConn(conn net.Conn) {
+	c.conn = conn
+	c.br = bufio.NewReader(conn)
+}
+
+// Close sends the QUIT command, which deletes the messages that were marked as
+// deleted, and closes the connection.
+func (c *Client) Close() error {
+	_, err := c.cmd("QUIT")
+	return errors.Join(err, c.conn.Close())
+}
+
+// cmd sends a command and returns the text of the positive response.
+func (c *Client) cmd(format string, args ...any) (string, error) {
+	if _, err := fmt.Fprintf(c.conn, format+"\r\n", args...); err != nil {
+		return "", err
+	}
+
+	return c.readResponse()
+}
+
+func (c *Client) readResponse() (string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return "", err
+	}
+
+	if text, ok := strings.CutPrefix(line, "+OK"); ok {
+		return strings.TrimSpace(text), nil
+	}
+
+	if text, ok := strings.CutPrefix(line, "-ERR"); ok {
+		return "", fmt.Errorf("server responded with an error: %s", strings.TrimSpace(text))
+	}
+
+	return "", fmt.Errorf("unexpected server response: %q", line)
+}
+
+// readLine returns the next line without the terminating CRLF.
+func (c *Client) readLine() (string, error) {
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readMultiLine reads the lines of a multi-line response, dot-stuffing is
+// removed. The line terminators are preserved.
+func (c *Client) readMultiLine() ([]byte, error) {
+	var buf bytes.Buffer
+
+	for {
+		line, err := c.br.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.Equal(bytes.TrimRight(line, "\r\n"), []byte(".")) {
+			return buf.Bytes(), nil
+		}
+
+		buf.Write(bytes.TrimPrefix(line, []byte(".")))
+	}
+}
+
+// list sends cmd and parses the "<id> <value>" lines of the response.
+func (c *Client) list(cmd string) (map[uint32]string, error) {
+	if _, err := c.cmd("%s", cmd); err != nil {
+		return nil, err
+	}
+
+	data, err := c.readMultiLine()
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[uint32]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		idStr, v, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s response line %q failed: %w", cmd, line, err)
+		}
+		result[uint32(id)] = v
+	}
+
+	return result, nil
+}
+
+// UIDs returns the unique-id listings (UIDL) of the messages in the maildrop,
+// by their message number.
+func (c *Client) UIDs() (map[uint32]string, error) {
+	uids, err := c.list("UIDL")
+	if err != nil {
+		return nil, fmt.Errorf("listing message uids failed: %w", err)
+	}
+
+	return uids, nil
+}
+
+// Messages returns an iterator over the messages in the maildrop.
+// POP3 has only a single maildrop, mailbox is ignored. The UID of the
+// returned messages is their message number, [imapclt.Message.POP3UID] is
+// their unique-id listing.
+// When an error happens a nil message and an error is passed via the yield
+// function.
+// opts can be nil.
+func (c *Client) Messages(ctx context.Context, _ string, opts *imapclt.FetchOptions) iter.Seq2[*imapclt.Message, error] {
+	if opts == nil {
+		opts = &imapclt.FetchOptions{}
+	}
+
+	return func(yield func(*imapclt.Message, error) bool) {
+		uids, err := c.list("UIDL")
+		if err != nil {
+			yield(nil, fmt.Errorf("listing message uids failed: %w", err))
+			return
+		}
+
+		sizes, err := c.list("LIST")
+		if err != nil {
+			yield(nil, fmt.Errorf("listing messages failed: %w", err))
+			return
+		}
+
+		c.logger.Debug("listed messages", "count", len(sizes), "event", "pop3.messages_listed")
+
+		for _, id := range slices.Sorted(maps.Keys(sizes)) {
+			if len(opts.UIDs) != 0 && !slices.Contains(opts.UIDs, id) {
+				continue
+			}
+
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+
+			data, err := c.fetch(id, opts.HeaderOnly)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			if !yield(c.message(id, uids[id], sizes[id], data, opts), nil) {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) message(id uint32, uid, sizeStr string, data []byte, opts *imapclt.FetchOptions) *imapclt.Message {
+	size, _ := strconv.ParseInt(sizeStr, 10, 64)
+	msg := imapclt.Message{UID: id, POP3UID: uid, Size: size}
+
+	env, err := imapclt.HeaderEnvelope(bytes.NewReader(data))
+	if err != nil {
+		c.logger.Debug("parsing message header failed", "mail.id", id, "error", err)
+	} else {
+		msg.Envelope = *env
+	}
+
+	if !opts.HeaderOnly && opts.MaxBodySize > 0 && int64(len(data)) > opts.MaxBodySize {
+		data = data[:opts.MaxBodySize]
+		msg.Truncated = true
+	}
+	msg.Message = bytes.NewReader(data)
+
+	return &msg
+}
+
+func (c *Client) fetch(id uint32, headerOnly bool) ([]byte, error) {
+	var err error
+
+	if headerOnly {
+		_, err = c.cmd("TOP %d 0", id)
+	} else {
+		_, err = c.cmd("RETR %d", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching message %d failed: %w", id, err)
+	}
+
+	data, err := c.readMultiLine()
+	if err != nil {
+		return nil, fmt.Errorf("reading message %d failed: %w", id, err)
+	}
+
+	c.logger.Debug("fetched message", "mail.id", id)
+
+	return data, nil
+}
+
+// Delete marks the messages with the given message numbers as deleted. They
+// are removed when the session ends with [*Client.Close].
+func (c *Client) Delete(ids []uint32) error {
+	for _, id := range ids {
+		if _, err := c.cmd("DELE %d", id); err != nil {
+			return fmt.Errorf("deleting message %d failed: %w", id, err)
+		}
+	}
+
+	c.logger.Debug("marked messages as deleted",
+		"count", len(ids), "event", "pop3.messages_deleted")
+
+	return nil
+}
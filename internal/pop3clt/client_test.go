@@ -0,0 +1,97 @@
+package pop3clt
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+	"github.com/fho/rspamd-iscan/internal/testutils/pop3server"
+)
+
+func startServerClient(t *testing.T) (*pop3server.Server, *Client) {
+	srv := pop3server.StartServer(t)
+
+	clt := NewClient(&Config{
+		Address:       srv.ListenAddr,
+		User:          srv.UserName,
+		Password:      srv.UserPasswd,
+		AllowInsecure: true,
+		Logger:        log.SlogTestLogger(t),
+	})
+
+	return srv, clt
+}
+
+func TestMessagesAndDelete(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	ham, err := os.ReadFile(mail.TestHamMailPath(t))
+	assert.NoError(t, err)
+	srv.AddMessage(ham)
+	srv.AddMessage([]byte("Subject: dot\r\n\r\n.leading dot\r\n"))
+
+	assert.NoError(t, clt.Connect())
+
+	var msgs []*imapclt.Message
+	for msg, err := range clt.Messages(context.Background(), "", nil) {
+		assert.NoError(t, err)
+		msgs = append(msgs, msg)
+	}
+	assert.Equal(t, 2, len(msgs))
+
+	data, err := io.ReadAll(msgs[0].Message)
+	assert.NoError(t, err)
+	assert.Equal(t, string(ham), string(data))
+	assert.Equal(t, int64(len(ham)), msgs[0].Size)
+	assert.Equal(t, "uid-1", msgs[0].POP3UID)
+	assert.Equal(t, uint32(1), msgs[0].UID)
+	assert.Equal(t, mail.HamMailSubject, msgs[0].Envelope.Subject)
+
+	data, err = io.ReadAll(msgs[1].Message)
+	assert.NoError(t, err)
+	assert.Equal(t, "Subject: dot\r\n\r\n.leading dot\r\n", string(data))
+
+	assert.NoError(t, clt.Delete([]uint32{msgs[1].UID}))
+	assert.NoError(t, clt.Close())
+	assert.Equal(t, 1, srv.MessageCount())
+}
+
+func TestMessagesHeaderOnlyAndUIDs(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	ham, err := os.ReadFile(mail.TestHamMailPath(t))
+	assert.NoError(t, err)
+	srv.AddMessage(ham)
+	srv.AddMessage(ham)
+
+	assert.NoError(t, clt.Connect())
+	t.Cleanup(func() { _ = clt.Close() })
+
+	var msgs []*imapclt.Message
+	opts := imapclt.FetchOptions{HeaderOnly: true, UIDs: []uint32{2}}
+	for msg, err := range clt.Messages(context.Background(), "", &opts) {
+		assert.NoError(t, err)
+		msgs = append(msgs, msg)
+	}
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, "uid-2", msgs[0].POP3UID)
+
+	data, err := io.ReadAll(msgs[0].Message)
+	assert.NoError(t, err)
+	if !strings.HasSuffix(string(data), "\r\n\r\n") || strings.Contains(string(data), "plain text body") {
+		t.Errorf("fetched data is not the header: %q", data)
+	}
+}
+
+func TestConnectInvalidPassword(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.password = srv.UserPasswd + "x"
+
+	assert.Error(t, clt.Connect())
+}
@@ -0,0 +1,19 @@
+package pop3clt
+
+// DryClient is a POP3 client that simulates operations that do changes on the
+// POP3-Server.
+type DryClient struct {
+	*Client
+}
+
+// NewDryClient creates an new POP3-Client.
+// [*DryClient.Connect] must be called before any other methods.
+func NewDryClient(cfg *Config) *DryClient {
+	return &DryClient{Client: NewClient(cfg)}
+}
+
+// Delete logs a debug message and returns nil
+func (c *DryClient) Delete(ids []uint32) error {
+	c.logger.Debug("dry-client: skipping deleting messages", "count", len(ids))
+	return nil
+}
@@ -0,0 +1,209 @@
+package rspamc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHealthCheckInterval is used when no health check interval is
+	// configured.
+	defaultHealthCheckInterval = 10 * time.Second
+	pingTimeout                = 5 * time.Second
+)
+
+// backend is a rspamd instance.
+type backend struct {
+	// url is the configured URL, it is used in log messages.
+	url        string
+	baseURL    string
+	httpClient *http.Client
+
+	// mu protects down and checkAt, backends are shared between pools.
+	mu sync.Mutex
+	// down is true when the last request to the backend failed, it is
+	// only used again after a successful health check.
+	down bool
+	// checkAt is the time when the next health check of a down backend
+	// is done.
+	checkAt time.Time
+}
+
+// unixSocketScheme is the URL scheme of rspamd URLs that refer to a unix
+// socket.
+const unixSocketScheme = "unix://"
+
+func newBackend(url string) *backend {
+	b := backend{
+		url:        url,
+		baseURL:    strings.TrimSuffix(url, "/"),
+		httpClient: http.DefaultClient,
+	}
+
+	if sockPath, ok := strings.CutPrefix(url, unixSocketScheme); ok {
+		// the host is ignored, all connections are established to
+		// the socket
+		b.baseURL = "http://localhost"
+		b.httpClient = &http.Client{Transport: unixSocketTransport(sockPath)}
+	}
+
+	return &b
+}
+
+// unixSocketTransport returns a transport that establishes all connections to
+// the unix socket at path.
+func unixSocketTransport(path string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+
+	return t
+}
+
+// ping sends a request to the /ping endpoint and returns an error if rspamd
+// does not respond with status 200.
+func (b *backend) ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.baseURL+"/ping", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ping failed with status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// pool is a group of backends that serve the same kind of requests.
+type pool struct {
+	backends []*backend
+	// roundRobin enables distributing the requests across the
+	// backends. Otherwise requests are sent to the first available
+	// backend in the configured order.
+	roundRobin          bool
+	healthCheckInterval time.Duration
+	// timeout is the max. duration of a request to a backend, if it is 0
+	// requests do not time out.
+	timeout time.Duration
+	// breaker rejects requests while all backends are unavailable, it is
+	// nil if the circuit breaker is disabled.
+	breaker *breaker
+	logger  *slog.Logger
+
+	mu   sync.Mutex
+	next int
+}
+
+// candidates returns the backends that a request is sent to, in the order in
+// which they are tried.
+// Backends that are down and whose health check is due are checked first, if
+// they are still down they are omitted. When all backends are down, all of
+// them are returned.
+func (p *pool) candidates(ctx context.Context) []*backend {
+	p.mu.Lock()
+	start := 0
+	if p.roundRobin {
+		start = p.next
+		p.next = (p.next + 1) % len(p.backends)
+	}
+	p.mu.Unlock()
+
+	ordered := make([]*backend, 0, len(p.backends))
+	for i := range p.backends {
+		ordered = append(ordered, p.backends[(start+i)%len(p.backends)])
+	}
+
+	result := make([]*backend, 0, len(ordered))
+	for _, b := range ordered {
+		if p.isAvailable(ctx, b) {
+			result = append(result, b)
+		}
+	}
+
+	if len(result) == 0 {
+		return ordered
+	}
+
+	return result
+}
+
+// isAvailable returns true if b is not down or its health check succeeded.
+func (p *pool) isAvailable(ctx context.Context, b *backend) bool {
+	b.mu.Lock()
+	if !b.down {
+		b.mu.Unlock()
+		return true
+	}
+	if time.Now().Before(b.checkAt) {
+		b.mu.Unlock()
+		return false
+	}
+	// prevent that concurrent requests check the backend at the same time
+	b.checkAt = time.Now().Add(p.healthCheckInterval)
+	b.mu.Unlock()
+
+	if err := b.ping(ctx); err != nil {
+		p.logger.Debug("health check failed", "server", b.url, "error", err)
+		return false
+	}
+
+	p.markUp(b)
+
+	return true
+}
+
+func (p *pool) markDown(b *backend, err error) {
+	// there is no other backend to fail over to
+	if len(p.backends) == 1 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.down {
+		p.logger.Warn("rspamd is unavailable, failing over",
+			"server", b.url, "error", err, "event", "rspamd.backend_down")
+	}
+
+	b.down = true
+	b.checkAt = time.Now().Add(p.healthCheckInterval)
+}
+
+func (p *pool) markUp(b *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.down {
+		p.logger.Info("rspamd is available again",
+			"server", b.url, "event", "rspamd.backend_up")
+	}
+
+	b.down = false
+}
+
+// ErrUnavailable is wrapped by errors of requests that failed because the
+// backend is not available.
+var ErrUnavailable = errors.New("rspamd unavailable")
@@ -0,0 +1,163 @@
+package rspamc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+type testBackend struct {
+	*httptest.Server
+	requests atomic.Int32
+	mu       sync.Mutex
+	status   int
+}
+
+func startTestBackend(t *testing.T) *testBackend {
+	b := testBackend{status: http.StatusOK}
+
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.Lock()
+		status := b.status
+		b.mu.Unlock()
+
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(status)
+			return
+		}
+
+		b.requests.Add(1)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(checkResponse))
+	}))
+	t.Cleanup(b.Close)
+
+	return &b
+}
+
+func (b *testBackend) setStatus(status int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.status = status
+}
+
+func check(t *testing.T, clt *Client) {
+	t.Helper()
+
+	_, err := clt.Check(context.Background(), strings.NewReader("Subject: test\r\n\r\nbody"), &MailHeaders{})
+	assert.NoError(t, err)
+}
+
+func TestCheckIsLoadBalanced(t *testing.T) {
+	b1, b2 := startTestBackend(t), startTestBackend(t)
+	clt := New(&Config{URLs: []string{b1.URL, b2.URL}, Logger: log.SlogTestLogger(t)})
+
+	for range 4 {
+		check(t, clt)
+	}
+
+	assert.Equal(t, int32(2), b1.requests.Load())
+	assert.Equal(t, int32(2), b2.requests.Load())
+}
+
+func TestCheckFailsOver(t *testing.T) {
+	b1, b2 := startTestBackend(t), startTestBackend(t)
+	b1.setStatus(http.StatusServiceUnavailable)
+
+	clt := New(&Config{
+		URLs:                []string{b1.URL, b2.URL},
+		HealthCheckInterval: 50 * time.Millisecond,
+		Logger:              log.SlogTestLogger(t),
+	})
+
+	for range 4 {
+		check(t, clt)
+	}
+
+	// the failed backend is not used until its health check succeeds
+	assert.Equal(t, int32(1), b1.requests.Load())
+	assert.Equal(t, int32(4), b2.requests.Load())
+
+	b1.setStatus(http.StatusOK)
+	time.Sleep(50 * time.Millisecond)
+
+	for range 2 {
+		check(t, clt)
+	}
+	assert.Equal(t, int32(2), b1.requests.Load())
+}
+
+func TestCheckFailsOverUnreachable(t *testing.T) {
+	b1, b2 := startTestBackend(t), startTestBackend(t)
+	b1.Close()
+
+	clt := New(&Config{URLs: []string{b1.URL, b2.URL}, Logger: log.SlogTestLogger(t)})
+
+	for range 2 {
+		check(t, clt)
+	}
+
+	assert.Equal(t, int32(2), b2.requests.Load())
+}
+
+func TestLearnIsPinnedToController(t *testing.T) {
+	b1, b2 := startTestBackend(t), startTestBackend(t)
+	clt := New(&Config{URLs: []string{b1.URL, b2.URL}, Logger: log.SlogTestLogger(t)})
+
+	for range 3 {
+		assert.NoError(t, clt.Ham(context.Background(), strings.NewReader("Subject: test\r\n\r\nbody"), &MailHeaders{}))
+	}
+
+	assert.Equal(t, int32(3), b1.requests.Load())
+	assert.Equal(t, int32(0), b2.requests.Load())
+
+	b1.setStatus(http.StatusInternalServerError)
+	assert.NoError(t, clt.Spam(context.Background(), strings.NewReader("Subject: test\r\n\r\nbody"), &MailHeaders{}))
+	assert.Equal(t, int32(1), b2.requests.Load())
+}
+
+func TestCheckTimeoutFailsOver(t *testing.T) {
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(stalled.Close)
+	t.Cleanup(func() { close(release) })
+	b := startTestBackend(t)
+
+	clt := New(&Config{
+		URLs:        []string{stalled.URL},
+		ScanTimeout: 100 * time.Millisecond,
+		Logger:      log.SlogTestLogger(t),
+	})
+	_, err := clt.Check(context.Background(), strings.NewReader("Subject: test\r\n\r\nbody"), &MailHeaders{})
+	assert.Error(t, err)
+	if !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	clt = New(&Config{
+		URLs:        []string{stalled.URL, b.URL},
+		ScanTimeout: 100 * time.Millisecond,
+		Logger:      log.SlogTestLogger(t),
+	})
+	check(t, clt)
+	assert.Equal(t, int32(1), b.requests.Load())
+}
@@ -0,0 +1,133 @@
+package rspamc
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// defaultBreakerTimeout is used when no circuit breaker timeout is configured.
+const defaultBreakerTimeout = time.Minute
+
+// ErrCircuitOpen is returned for requests that are not sent, because rspamd
+// was unavailable for the last requests.
+var ErrCircuitOpen = errors.New("rspamd is unavailable, circuit breaker is open")
+
+// breaker is a circuit breaker. It opens after threshold requests in a row
+// failed because rspamd was unavailable, requests then fail immediately.
+// After timeout a single probe request is let through, the breaker closes
+// if it succeeds and opens again otherwise.
+// A nil *breaker is disabled, it allows all requests.
+type breaker struct {
+	name      string
+	threshold int
+	timeout   time.Duration
+	logger    *slog.Logger
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	probing  bool
+	openedAt time.Time
+	retryAt  time.Time
+}
+
+func newBreaker(name string, threshold int, timeout time.Duration, logger *slog.Logger) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+
+	if timeout == 0 {
+		timeout = defaultBreakerTimeout
+	}
+
+	return &breaker{
+		name:      name,
+		threshold: threshold,
+		timeout:   timeout,
+		logger:    logger,
+	}
+}
+
+// allow returns [ErrCircuitOpen] if a request must not be sent.
+// If it returns nil, the result of the request must be passed to
+// [breaker.done].
+func (b *breaker) allow(now time.Time) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return nil
+	}
+
+	if b.probing || now.Before(b.retryAt) {
+		return ErrCircuitOpen
+	}
+
+	b.probing = true
+
+	return nil
+}
+
+// done records the result of a request that was allowed.
+// Only errors that wrap [ErrUnavailable] are failures, other errors are
+// responses of rspamd.
+func (b *breaker) done(err error, now time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasProbe := b.probing
+	b.probing = false
+
+	if !errors.Is(err, ErrUnavailable) {
+		b.failures = 0
+		if b.open {
+			b.open = false
+			b.logger.Info("rspamd is available again, closing circuit breaker",
+				"pool", b.name, "downtime", now.Sub(b.openedAt),
+				"event", "rspamd.circuit_closed")
+		}
+		return
+	}
+
+	if b.open {
+		if wasProbe {
+			b.retryAt = now.Add(b.timeout)
+		}
+		return
+	}
+
+	b.failures++
+	if b.failures < b.threshold {
+		return
+	}
+
+	b.open = true
+	b.openedAt = now
+	b.retryAt = now.Add(b.timeout)
+	b.logger.Warn("rspamd is unavailable, opening circuit breaker",
+		"pool", b.name, "failures", b.failures, "retry_in", b.timeout,
+		"error", err, "event", "rspamd.circuit_open")
+}
+
+// abort ends a request that was allowed without recording its result, e.g.
+// because it was canceled.
+func (b *breaker) abort() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
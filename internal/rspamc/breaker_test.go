@@ -0,0 +1,75 @@
+package rspamc
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker("scanners", 2, time.Minute, slog.New(slog.DiscardHandler))
+	now := time.Now()
+	errDown := fmt.Errorf("%w: connection refused", ErrUnavailable)
+
+	assert.NoError(t, b.allow(now))
+	b.done(errDown, now)
+	// rspamd responded, the failures are reset
+	assert.NoError(t, b.allow(now))
+	b.done(errors.New("request failed with status: 400 Bad Request"), now)
+
+	for range 2 {
+		assert.NoError(t, b.allow(now))
+		b.done(errDown, now)
+	}
+
+	if err := b.allow(now); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got: %v", err)
+	}
+
+	// a single probe is sent after the timeout, it fails
+	now = now.Add(time.Minute)
+	assert.NoError(t, b.allow(now))
+	assert.Error(t, b.allow(now))
+	b.done(errDown, now)
+	assert.Error(t, b.allow(now))
+
+	// a canceled probe does not change the state
+	now = now.Add(time.Minute)
+	assert.NoError(t, b.allow(now))
+	b.abort()
+
+	assert.NoError(t, b.allow(now))
+	b.done(nil, now)
+	assert.NoError(t, b.allow(now))
+	assert.NoError(t, b.allow(now))
+}
+
+func TestCheckCircuitBreaker(t *testing.T) {
+	backend := startTestBackend(t)
+	backend.setStatus(http.StatusServiceUnavailable)
+
+	clt := New(&Config{
+		URL:                     backend.URL,
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerTimeout:   time.Hour,
+		Logger:                  log.SlogTestLogger(t),
+	})
+
+	for range 2 {
+		_, err := clt.Check(t.Context(), strings.NewReader(""), &MailHeaders{})
+		assert.Error(t, err)
+	}
+
+	_, err := clt.Check(t.Context(), strings.NewReader(""), &MailHeaders{})
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got: %v", err)
+	}
+	assert.Equal(t, int32(2), backend.requests.Load())
+}
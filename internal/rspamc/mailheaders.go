@@ -2,24 +2,42 @@ package rspamc
 
 import (
 	"net/http"
+	"net/netip"
 )
 
 // MailHeaders contains optional pre-processed email data, to prevent redundant
 // processing of mail headers in rspamd
 type MailHeaders struct {
-	DeliverTo  string
+	// DeliverTo is the mailbox owner, rspamd uses it to apply per-user
+	// settings and statistics.
+	DeliverTo string
+	// User is the name of the authenticated user that submitted the mail.
+	// Rspamd treats mails with a User as outbound.
+	User string
+	// IP is the address of the host that delivered the mail to the
+	// receiving MTA.
+	IP         netip.Addr
 	From       []string
 	Recipients []string
 	Subject    string
 }
 
-func (h *MailHeaders) asHeader() http.Header {
+// Header returns the HTTP headers of the rspamd request for h.
+func (h *MailHeaders) Header() http.Header {
 	result := http.Header{}
 
 	if h.DeliverTo != "" {
 		result.Add("Deliver-To", h.DeliverTo)
 	}
 
+	if h.User != "" {
+		result.Add("User", h.User)
+	}
+
+	if h.IP.IsValid() {
+		result.Add("IP", h.IP.String())
+	}
+
 	if h.Subject != "" {
 		result.Add("Subject", h.Subject)
 	}
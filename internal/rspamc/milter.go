@@ -0,0 +1,83 @@
+package rspamc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Milter contains the modifications of the message headers that rspamd
+// requests, e.g. by its milter_headers module.
+//
+// https://rspamd.com/doc/architecture/protocol.html#rspamd-http-reply
+type Milter struct {
+	AddHeaders map[string]MilterHeaders `json:"add_headers,omitempty"`
+	// RemoveHeaders maps header names to the occurrence that is removed,
+	// 0 removes all occurrences, n > 0 the nth and n < 0 the nth from the
+	// end.
+	RemoveHeaders map[string]int `json:"remove_headers,omitempty"`
+}
+
+// MilterHeader is the value of a header that rspamd requests to add.
+type MilterHeader struct {
+	Value string `json:"value"`
+	Order int    `json:"order"`
+}
+
+// MilterHeaders are the values of a header that rspamd requests to add.
+// In rspamd responses a value is a string or an object, multiple
+// values are an array of them.
+type MilterHeaders []*MilterHeader
+
+func (h *MilterHeaders) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil
+	}
+
+	switch data[0] {
+	case '[':
+		var values []json.RawMessage
+		if err := json.Unmarshal(data, &values); err != nil {
+			return err
+		}
+
+		result := make(MilterHeaders, 0, len(values))
+		for _, v := range values {
+			hdr, err := unmarshalMilterHeader(v)
+			if err != nil {
+				return err
+			}
+			result = append(result, hdr)
+		}
+		*h = result
+
+	default:
+		hdr, err := unmarshalMilterHeader(data)
+		if err != nil {
+			return err
+		}
+		*h = MilterHeaders{hdr}
+	}
+
+	return nil
+}
+
+func unmarshalMilterHeader(data []byte) (*MilterHeader, error) {
+	var result MilterHeader
+
+	switch data[0] {
+	case '"':
+		if err := json.Unmarshal(data, &result.Value); err != nil {
+			return nil, err
+		}
+	case '{':
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported milter header value: %s", data)
+	}
+
+	return &result, nil
+}
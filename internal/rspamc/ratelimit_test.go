@@ -0,0 +1,39 @@
+package rspamc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := newTokenBucket(2, 2)
+	now := b.last
+
+	assert.Equal(t, 0, b.reserve(now))
+	assert.Equal(t, 0, b.reserve(now))
+	assert.Equal(t, 500*time.Millisecond, b.reserve(now))
+	assert.Equal(t, time.Second, b.reserve(now))
+
+	// after 2s 4 tokens were refilled, 2 were already reserved
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, 0, b.reserve(now))
+	assert.Equal(t, 0, b.reserve(now))
+	assert.Equal(t, 500*time.Millisecond, b.reserve(now))
+}
+
+func TestTokenBucketWaitCanceled(t *testing.T) {
+	b := newTokenBucket(0.001, 1)
+	assert.NoError(t, b.Wait(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := b.Wait(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded error, got: %v", err)
+	}
+}
@@ -3,35 +3,213 @@ package rspamc
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/mail"
 )
 
 type Client struct {
-	checkURL string
-	hamURL   string
-	spamURL  string
-	logger   *slog.Logger
-	password string
+	// scanners are the backends that check requests are sent to.
+	scanners *pool
+	// controllers are the backends that learn and fuzzy requests are
+	// sent to.
+	controllers *pool
+	logger      *slog.Logger
+	password    string
+	limiter     *tokenBucket
+}
+
+const (
+	pathCheck    = "/checkv2"
+	pathHam      = "/learnham"
+	pathSpam     = "/learnspam"
+	pathFuzzyAdd = "/fuzzyadd"
+	pathFuzzyDel = "/fuzzydel"
+)
+
+type Config struct {
+	// URL is the base URL of the rspamd controller.
+	// If it starts with "unix://", the rest of it is the path of a unix
+	// socket that rspamd listens on, e.g.
+	// "unix:///run/rspamd/worker.sock".
+	// It is ignored when URLs is set.
+	URL string
+	// URLs are the base URLs of multiple rspamd instances. Check
+	// requests are distributed across them, when one is unavailable
+	// requests are sent to the others.
+	URLs []string
+	// ControllerURLs are the base URLs of the rspamd instances that learn
+	// and fuzzy requests are sent to. They are sent to the first one that
+	// is available. If it is empty, URLs is used.
+	ControllerURLs []string
+	// HealthCheckInterval is the interval in which unavailable instances
+	// are checked via the /ping endpoint. If it is 0, 10s are used.
+	HealthCheckInterval time.Duration
+	Password            string
+	// RateLimit is the max. number of requests per second that are sent to
+	// rspamd. If it is 0, requests are not rate limited.
+	RateLimit float64
+	// RateBurst is the number of requests that can be sent at once,
+	// exceeding RateLimit. It must be >0 if RateLimit is set.
+	RateBurst int
+	// ScanTimeout is the max. duration of a check request, LearnTimeout
+	// the one of learn and fuzzy requests. When a request to an instance
+	// times out, it is sent to the next one.
+	// If they are 0, requests do not time out.
+	ScanTimeout  time.Duration
+	LearnTimeout time.Duration
+	// CircuitBreakerThreshold is the number of requests in a row that
+	// must fail because rspamd is unavailable, until requests are
+	// rejected with [ErrCircuitOpen] without sending them. If it is <= 0,
+	// the circuit breaker is disabled.
+	CircuitBreakerThreshold int
+	// CircuitBreakerTimeout is the duration after which a request is sent
+	// again to check if rspamd recovered. If it is 0, 1m is used.
+	CircuitBreakerTimeout time.Duration
+	Logger                *slog.Logger
 }
 
-func New(logger *slog.Logger, url, password string) *Client {
-	return &Client{
-		checkURL: url + "/checkv2",
-		hamURL:   url + "/learnham",
-		spamURL:  url + "/learnspam",
-		logger:   logger.WithGroup("rspamc").With("server", url),
-		password: password,
+func New(cfg *Config) *Client {
+	urls := cfg.URLs
+	if len(urls) == 0 {
+		urls = []string{cfg.URL}
+	}
+
+	controllerURLs := cfg.ControllerURLs
+	if len(controllerURLs) == 0 {
+		controllerURLs = urls
+	}
+
+	interval := cfg.HealthCheckInterval
+	if interval == 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	logger := log.Module(cfg.Logger, "rspamc").WithGroup("rspamc")
+
+	// backends are shared between the pools, to share their health state
+	backends := map[string]*backend{}
+	newPool := func(name string, urls []string, roundRobin bool, timeout time.Duration) *pool {
+		p := pool{
+			roundRobin:          roundRobin,
+			healthCheckInterval: interval,
+			timeout:             timeout,
+			breaker:             newBreaker(name, cfg.CircuitBreakerThreshold, cfg.CircuitBreakerTimeout, logger),
+			logger:              logger,
+		}
+		for _, u := range urls {
+			b, exists := backends[u]
+			if !exists {
+				b = newBackend(u)
+				backends[u] = b
+			}
+			p.backends = append(p.backends, b)
+		}
+		return &p
+	}
+
+	c := Client{
+		scanners:    newPool("scanners", urls, true, cfg.ScanTimeout),
+		controllers: newPool("controllers", controllerURLs, false, cfg.LearnTimeout),
+		logger:      logger,
+		password:    cfg.Password,
+	}
+
+	if cfg.RateLimit > 0 {
+		c.limiter = newTokenBucket(cfg.RateLimit, max(cfg.RateBurst, 1))
+	}
+
+	return &c
+}
+
+// sendRequest sends msg to the path of one of the backends in p.
+// When the backend is unavailable, the request is sent to the next one.
+// When the circuit breaker of p is open, [ErrCircuitOpen] is returned.
+func (c *Client) sendRequest(ctx context.Context, p *pool, path string, hdrs http.Header, msg io.Reader, result any) error {
+	if err := p.breaker.allow(time.Now()); err != nil {
+		return err
+	}
+
+	err := c.sendToBackends(ctx, p, path, hdrs, msg, result)
+	if ctx.Err() != nil {
+		p.breaker.abort()
+	} else {
+		p.breaker.done(err, time.Now())
+	}
+
+	return err
+}
+
+func (c *Client) sendToBackends(ctx context.Context, p *pool, path string, hdrs http.Header, msg io.Reader, result any) error {
+	if c.limiter != nil {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return fmt.Errorf("waiting for rate limiter failed: %w", err)
+		}
+	}
+
+	backends := p.candidates(ctx)
+
+	body := func() (io.Reader, error) { return msg, nil }
+	if len(backends) > 1 {
+		var err error
+		if body, err = mail.Rewindable(msg); err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	for _, b := range backends {
+		r, err := body()
+		if err != nil {
+			return err
+		}
+
+		err = c.send(ctx, b, p.timeout, path, hdrs, r, result)
+		if err == nil {
+			p.markUp(b)
+			return nil
+		}
+
+		if ctx.Err() != nil || !errors.Is(err, ErrUnavailable) {
+			return err
+		}
+
+		p.markDown(b, err)
+		errs = append(errs, fmt.Errorf("%s: %w", b.url, err))
 	}
+
+	return errors.Join(errs...)
 }
 
-func (c *Client) sendRequest(ctx context.Context, url string, hdrs http.Header, msg io.Reader, result any) error {
-	logger := c.logger.With("url", url)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, msg)
+// send sends msg to the path of b. If b is not reachable, responds with a
+// 5xx status code or the request exceeds timeout, the returned error wraps
+// [ErrUnavailable].
+func (c *Client) send(ctx context.Context, b *backend, timeout time.Duration, path string, hdrs http.Header, msg io.Reader, result any) error {
+	url := b.baseURL + path
+	logger := c.logger.With("server", b.url, "url", url)
+
+	reqCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// wrap in NopCloser to prevent that http.NewRequest closes the reader,
+	// it is not responsible for closing it, the caller is
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, url, io.NopCloser(msg))
 	if err != nil {
-		return nil
+		return err
 	}
 
 	if hdrs != nil {
@@ -40,10 +218,14 @@ func (c *Client) sendRequest(ctx context.Context, url string, hdrs http.Header,
 	req.Header.Add("password", c.password)
 
 	// TODO: use custom client with configured timeouts
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := b.httpClient.Do(req)
 	if err != nil {
-		return nil
+		if ctx.Err() == nil && reqCtx.Err() != nil {
+			return fmt.Errorf("%w: request timed out after %s: %w", ErrUnavailable, timeout, err)
+		}
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		// TODO: check content length, set max. size of body to read
@@ -55,6 +237,9 @@ func (c *Client) sendRequest(ctx context.Context, url string, hdrs http.Header,
 		if resp.StatusCode >= 200 && resp.StatusCode <= 300 {
 			return nil
 		}
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("%w: request failed with status: %s", ErrUnavailable, resp.Status)
+		}
 		return fmt.Errorf("request failed with status: %s", resp.Status)
 	}
 
@@ -78,6 +263,9 @@ func (c *Client) sendRequest(ctx context.Context, url string, hdrs http.Header,
 
 	err = json.NewDecoder(resp.Body).Decode(result)
 	if err != nil {
+		if ctx.Err() == nil && reqCtx.Err() != nil {
+			return fmt.Errorf("%w: reading response timed out after %s: %w", ErrUnavailable, timeout, err)
+		}
 		return err
 	}
 
@@ -86,9 +274,7 @@ func (c *Client) sendRequest(ctx context.Context, url string, hdrs http.Header,
 
 func (c *Client) Check(ctx context.Context, msg io.Reader, hdrs *MailHeaders) (*CheckResult, error) {
 	var result CheckResult
-	// wrap in NopCloser to prevent that http.NewRequest closes the reader,
-	// it is not responsible for closing it, the caller is
-	err := c.sendRequest(ctx, c.checkURL, hdrs.asHeader(), io.NopCloser(msg), &result)
+	err := c.sendRequest(ctx, c.scanners, pathCheck, hdrs.Header(), msg, &result)
 	if err != nil {
 		return nil, err
 	}
@@ -98,11 +284,30 @@ func (c *Client) Check(ctx context.Context, msg io.Reader, hdrs *MailHeaders) (*
 func (c *Client) Ham(ctx context.Context, msg io.Reader, hdrs *MailHeaders) error {
 	// resp code 208 == already learned, returns a json with an "error"
 	// field
-	return c.sendRequest(ctx, c.hamURL, hdrs.asHeader(), msg, nil)
+	return c.sendRequest(ctx, c.controllers, pathHam, hdrs.Header(), msg, nil)
 }
 
 func (c *Client) Spam(ctx context.Context, msg io.Reader, hdrs *MailHeaders) error {
-	return c.sendRequest(ctx, c.spamURL, hdrs.asHeader(), msg, nil)
+	return c.sendRequest(ctx, c.controllers, pathSpam, hdrs.Header(), msg, nil)
+}
+
+// FuzzyAdd adds the hashes of msg to the fuzzy storage with the given flag and
+// weight.
+func (c *Client) FuzzyAdd(ctx context.Context, msg io.Reader, hdrs *MailHeaders, flag, weight int) error {
+	h := hdrs.Header()
+	h.Set("Flag", strconv.Itoa(flag))
+	h.Set("Weight", strconv.Itoa(weight))
+
+	return c.sendRequest(ctx, c.controllers, pathFuzzyAdd, h, msg, nil)
+}
+
+// FuzzyDel removes the hashes of msg with the given flag from the fuzzy
+// storage.
+func (c *Client) FuzzyDel(ctx context.Context, msg io.Reader, hdrs *MailHeaders, flag int) error {
+	h := hdrs.Header()
+	h.Set("Flag", strconv.Itoa(flag))
+
+	return c.sendRequest(ctx, c.controllers, pathFuzzyDel, h, msg, nil)
 }
 
 type CheckResult struct {
@@ -110,10 +315,55 @@ type CheckResult struct {
 	Score     float32            `json:"score"`
 	IsSkipped bool               `json:"is_skipped"`
 	Symbols   map[string]*Symbol `json:"symbols"`
+	Milter    *Milter            `json:"milter,omitempty"`
 }
 
 // https://rspamd.com/doc/architecture/protocol.html#protocol-basics
 type Symbol struct {
-	Name  string  `json:"name"`
-	Score float32 `json:"score"`
+	Name        string   `json:"name"`
+	Score       float32  `json:"score"`
+	Description string   `json:"description,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// String returns the symbol in the format that rspamc uses, e.g.
+// "R_DKIM_ALLOW(-0.2)[example.com:s=sel]".
+func (s *Symbol) String() string {
+	result := fmt.Sprintf("%s(%g)", s.Name, s.Score)
+	if len(s.Options) > 0 {
+		result += "[" + strings.Join(s.Options, ",") + "]"
+	}
+
+	return result
+}
+
+// authSymbolPrefixes are the prefixes of the symbols that contain the
+// results of the DKIM, SPF and DMARC checks.
+var authSymbolPrefixes = []string{"R_DKIM_", "R_SPF_", "DMARC_"}
+
+// IsAuthSymbol returns true if name is the name of a symbol that contains the
+// result of a DKIM, SPF or DMARC check.
+func IsAuthSymbol(name string) bool {
+	for _, prefix := range authSymbolPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SortedSymbols returns all symbols sorted by name.
+func (r *CheckResult) SortedSymbols() []*Symbol {
+	return slices.SortedFunc(maps.Values(r.Symbols), func(a, b *Symbol) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+}
+
+// AuthSymbols returns the symbols of the DKIM, SPF and DMARC checks, sorted
+// by name.
+func (r *CheckResult) AuthSymbols() []*Symbol {
+	return slices.DeleteFunc(r.SortedSymbols(), func(s *Symbol) bool {
+		return !IsAuthSymbol(s.Name)
+	})
 }
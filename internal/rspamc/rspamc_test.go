@@ -0,0 +1,133 @@
+package rspamc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+const checkResponse = `{
+	"action": "no action",
+	"score": 0.9,
+	"symbols": {
+		"MIME_GOOD": {"name": "MIME_GOOD", "score": -0.1, "description": "Known content-type", "options": ["text/plain"]},
+		"R_SPF_ALLOW": {"name": "R_SPF_ALLOW", "score": -0.2, "options": ["+ip4:192.0.2.1"]},
+		"DMARC_POLICY_ALLOW": {"name": "DMARC_POLICY_ALLOW", "score": -0.5, "options": ["example.com", "none"]},
+		"R_DKIM_NA": {"name": "R_DKIM_NA", "score": 0}
+	}
+}`
+
+func TestCheckResultSymbols(t *testing.T) {
+	var result CheckResult
+	assert.NoError(t, json.Unmarshal([]byte(checkResponse), &result))
+
+	assert.Equal(t, 4, len(result.SortedSymbols()))
+
+	auth := result.AuthSymbols()
+	assert.Equal(t, 3, len(auth))
+	assert.Equal(t, "DMARC_POLICY_ALLOW(-0.5)[example.com,none]", auth[0].String())
+	assert.Equal(t, "R_DKIM_NA(0)", auth[1].String())
+	assert.Equal(t, "R_SPF_ALLOW(-0.2)[+ip4:192.0.2.1]", auth[2].String())
+
+	assert.Equal(t, "Known content-type", result.Symbols["MIME_GOOD"].Description)
+}
+
+func TestCheckResultMilter(t *testing.T) {
+	const resp = `{
+		"action": "add header",
+		"score": 7.5,
+		"milter": {
+			"add_headers": {
+				"X-Spamd-Bar": {"value": "+++++++", "order": 0},
+				"X-Spam": "Yes",
+				"X-Multi": [{"value": "a", "order": 1}, "b"]
+			},
+			"remove_headers": {"X-Spam": 0}
+		}
+	}`
+
+	var result CheckResult
+	assert.NoError(t, json.Unmarshal([]byte(resp), &result))
+
+	m := result.Milter
+	assert.Equal(t, MilterHeader{Value: "+++++++"}, *m.AddHeaders["X-Spamd-Bar"][0])
+	assert.Equal(t, MilterHeader{Value: "Yes"}, *m.AddHeaders["X-Spam"][0])
+	assert.Equal(t, 2, len(m.AddHeaders["X-Multi"]))
+	assert.Equal(t, MilterHeader{Value: "a", Order: 1}, *m.AddHeaders["X-Multi"][0])
+	assert.Equal(t, 0, m.RemoveHeaders["X-Spam"])
+
+	// cached results are marshaled and unmarshaled again
+	data, err := json.Marshal(&result)
+	assert.NoError(t, err)
+	var result2 CheckResult
+	assert.NoError(t, json.Unmarshal(data, &result2))
+	assert.Equal(t, "b", result2.Milter.AddHeaders["X-Multi"][1].Value)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"milter": {"add_headers": {"X": 1}}}`), &result))
+}
+
+func TestCheckViaUnixSocket(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "rspamd.sock")
+	ln, err := net.Listen("unix", sockPath)
+	assert.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/checkv2" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(checkResponse))
+	}))
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	clt := New(&Config{URL: "unix://" + sockPath, Logger: log.SlogTestLogger(t)})
+
+	result, err := clt.Check(context.Background(), strings.NewReader("Subject: test\r\n\r\nbody"), &MailHeaders{})
+	assert.NoError(t, err)
+	assert.Equal(t, "no action", result.Action)
+}
+
+func TestFuzzyAddDel(t *testing.T) {
+	type request struct {
+		path, flag, weight, body string
+	}
+
+	var requests []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		requests = append(requests, request{
+			path:   r.URL.Path,
+			flag:   r.Header.Get("Flag"),
+			weight: r.Header.Get("Weight"),
+			body:   string(body),
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"success": true}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	clt := New(&Config{URL: srv.URL, Logger: log.SlogTestLogger(t)})
+
+	const msg = "Subject: test\r\n\r\nbody"
+	assert.NoError(t, clt.FuzzyAdd(context.Background(), strings.NewReader(msg), &MailHeaders{}, 11, 10))
+	assert.NoError(t, clt.FuzzyDel(context.Background(), strings.NewReader(msg), &MailHeaders{}, 12))
+
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, request{path: pathFuzzyAdd, flag: "11", weight: "10", body: msg}, requests[0])
+	assert.Equal(t, request{path: pathFuzzyDel, flag: "12", body: msg}, requests[1])
+}
@@ -0,0 +1,345 @@
+// Package smtpclt implements a client that delivers mails via SMTP (RFC 5321)
+// or LMTP (RFC 2033).
+package smtpclt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+)
+
+const dialTimeout = 120 * time.Second
+
+type Config struct {
+	// Address is the address of the server. If the port is "465" or
+	// "smtps" an implicit TLS connection is established.
+	// Otherwise STARTTLS is used.
+	// If Address starts with "/" it is the path of a unix socket,
+	// connections via unix sockets are not encrypted.
+	Address string
+	// LMTP enables delivering mails via LMTP instead of SMTP.
+	LMTP bool
+	// User and Password are optional, when User is set the client
+	// authenticates with the PLAIN mechanism.
+	User     string
+	Password string
+	// AllowInsecure enables falling back to delivering mails without
+	// encryption when the server does not support STARTTLS.
+	AllowInsecure bool
+	// LocalName is the hostname that is sent in the EHLO/LHLO command,
+	// defaults to "localhost".
+	LocalName string
+	Logger    *slog.Logger
+}
+
+// Client delivers mails, a new session is established for every mail.
+type Client struct {
+	address       string
+	lmtp          bool
+	user          string
+	password      string
+	allowInsecure bool
+	localName     string
+	logger        *slog.Logger
+}
+
+// session is an established connection to the server.
+type session struct {
+	conn      net.Conn
+	tp        *textproto.Conn
+	encrypted bool
+	ext       map[string]string
+}
+
+// NewClient creates a new SMTP/LMTP-Client.
+func NewClient(cfg *Config) *Client {
+	localName := cfg.LocalName
+	if localName == "" {
+		localName = "localhost"
+	}
+
+	return &Client{
+		address:       cfg.Address,
+		lmtp:          cfg.LMTP,
+		user:          cfg.User,
+		password:      cfg.Password,
+		allowInsecure: cfg.AllowInsecure,
+		localName:     localName,
+		logger:        log.Module(cfg.Logger, "smtpclt"),
+	}
+}
+
+func (c *Client) protocol() string {
+	if c.lmtp {
+		return "lmtp"
+	}
+	return "smtp"
+}
+
+// Send delivers msg with the envelope sender from to the recipients to.
+// If from is empty the null sender is used.
+// With LMTP an error is returned if the delivery to any of the recipients
+// failed.
+func (c *Client) Send(ctx context.Context, from string, to []string, msg io.Reader) error {
+	if len(to) == 0 {
+		return errors.New("no recipients specified")
+	}
+
+	s, err := c.connect(ctx)
+	if err != nil {
+		return fmt.Errorf("establishing %s server connection failed: %w", c.protocol(), err)
+	}
+	defer s.conn.Close()
+
+	// the textproto package does not support contexts, the connection is
+	// closed instead to abort blocking operations
+	stop := context.AfterFunc(ctx, func() { _ = s.conn.Close() })
+	defer stop()
+
+	err = c.auth(s)
+	if err == nil {
+		err = c.deliver(s, from, to, msg)
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+
+	if _, _, err := c.cmd(s, 221, "QUIT"); err != nil {
+		c.logger.Debug("closing session failed", "error", err)
+	}
+
+	c.logger.Debug("delivered mail",
+		"server", c.address, "to", to, "event", c.protocol()+".mail_delivered")
+
+	return nil
+}
+
+func (c *Client) deliver(s *session, from string, to []string, msg io.Reader) error {
+	if _, _, err := c.cmd(s, 250, "MAIL FROM:<%s>", from); err != nil {
+		return fmt.Errorf("MAIL command failed: %w", err)
+	}
+
+	for _, rcpt := range to {
+		if _, _, err := c.cmd(s, 25, "RCPT TO:<%s>", rcpt); err != nil {
+			return fmt.Errorf("RCPT command for %q failed: %w", rcpt, err)
+		}
+	}
+
+	if _, _, err := c.cmd(s, 354, "DATA"); err != nil {
+		return fmt.Errorf("DATA command failed: %w", err)
+	}
+
+	w := s.tp.DotWriter()
+	if _, err := io.Copy(w, msg); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("sending mail failed: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("sending mail failed: %w", err)
+	}
+
+	if !c.lmtp {
+		if _, _, err := s.tp.ReadResponse(250); err != nil {
+			return fmt.Errorf("mail was not accepted: %w", err)
+		}
+		return nil
+	}
+
+	// LMTP servers reply with a status for every recipient
+	var errs []error
+	for _, rcpt := range to {
+		if _, _, err := s.tp.ReadResponse(250); err != nil {
+			var tpErr *textproto.Error
+			if !errors.As(err, &tpErr) {
+				return fmt.Errorf("reading delivery status failed: %w", err)
+			}
+
+			errs = append(errs, fmt.Errorf("delivery to %q failed: %w", rcpt, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Client) connect(ctx context.Context) (*session, error) {
+	logger := c.logger.With("server", c.address).With("timeout", dialTimeout)
+	dialer := net.Dialer{Timeout: dialTimeout}
+
+	if strings.HasPrefix(c.address, "/") {
+		logger.Debug("connecting to server via unix socket")
+
+		conn, err := dialer.DialContext(ctx, "unix", c.address)
+		if err != nil {
+			return nil, err
+		}
+
+		// a unix socket can only be accessed locally
+		s := newSession(conn, true)
+		if err := c.greet(s); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+
+		return s, nil
+	}
+
+	host, port, err := net.SplitHostPort(c.address)
+	if err != nil {
+		return nil, err
+	}
+
+	if port == "465" || port == "smtps" {
+		logger.Debug("connecting to server", "tlsmode", "implicit")
+
+		tlsDialer := tls.Dialer{NetDialer: &dialer}
+		conn, err := tlsDialer.DialContext(ctx, "tcp", c.address)
+		if err != nil {
+			return nil, err
+		}
+
+		s := newSession(conn, true)
+		if err := c.greet(s); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+
+		return s, nil
+	}
+
+	logger.Debug("connecting to server", "tlsmode", "explicit")
+	conn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSession(conn, false)
+	if err := c.greet(s); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if _, ok := s.ext["STARTTLS"]; !ok {
+		if !c.allowInsecure {
+			_ = conn.Close()
+			return nil, errors.New("server does not support STARTTLS")
+		}
+
+		logger.Warn("server does not support STARTTLS, continuing without encryption",
+			"tlsmode", "none")
+		return s, nil
+	}
+
+	if err := c.startTLS(s, host); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("STARTTLS failed: %w", err)
+	}
+
+	return s, nil
+}
+
+func newSession(conn net.Conn, encrypted bool) *session {
+	return &session{
+		conn:      conn,
+		tp:        textproto.NewConn(conn),
+		encrypted: encrypted,
+	}
+}
+
+// greet reads the server greeting and sends the EHLO or LHLO command.
+func (c *Client) greet(s *session) error {
+	if _, _, err := s.tp.ReadResponse(220); err != nil {
+		return fmt.Errorf("reading server greeting failed: %w", err)
+	}
+
+	return c.hello(s)
+}
+
+// hello sends the EHLO or LHLO command and records the supported extensions.
+func (c *Client) hello(s *session) error {
+	cmd := "EHLO"
+	if c.lmtp {
+		cmd = "LHLO"
+	}
+
+	_, msg, err := c.cmd(s, 250, "%s %s", cmd, c.localName)
+	if err != nil {
+		return fmt.Errorf("%s command failed: %w", cmd, err)
+	}
+
+	s.ext = map[string]string{}
+	lines := strings.Split(msg, "\n")
+	// the first line is the greeting of the server
+	for _, line := range lines[1:] {
+		k, v, _ := strings.Cut(line, " ")
+		s.ext[strings.ToUpper(k)] = v
+	}
+
+	return nil
+}
+
+func (c *Client) startTLS(s *session, host string) error {
+	if _, _, err := c.cmd(s, 220, "STARTTLS"); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Client(s.conn, &tls.Config{ServerName: host})
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("tls handshake failed: %w", err)
+	}
+
+	*s = *newSession(tlsConn, true)
+
+	// the extensions must be queried again after STARTTLS
+	return c.hello(s)
+}
+
+func (c *Client) auth(s *session) error {
+	if c.user == "" {
+		return nil
+	}
+
+	if !s.encrypted && !c.allowInsecure {
+		return errors.New("refusing to authenticate via an unencrypted connection")
+	}
+
+	mechanisms, ok := s.ext["AUTH"]
+	if !ok || !strings.Contains(" "+strings.ToUpper(mechanisms)+" ", " PLAIN ") {
+		return errors.New("server does not support the AUTH PLAIN mechanism")
+	}
+
+	resp := base64.StdEncoding.EncodeToString([]byte("\x00" + c.user + "\x00" + c.password))
+	if _, _, err := c.cmd(s, 235, "AUTH PLAIN %s", resp); err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+
+	c.logger.Debug("authentication succeeded", "event", c.protocol()+".authenticated")
+
+	return nil
+}
+
+// cmd sends a command and reads the response, it returns an error if the
+// response code does not start with expectCode.
+func (c *Client) cmd(s *session, expectCode int, format string, args ...any) (int, string, error) {
+	id, err := s.tp.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+
+	s.tp.StartResponse(id)
+	defer s.tp.EndResponse(id)
+
+	return s.tp.ReadResponse(expectCode)
+}
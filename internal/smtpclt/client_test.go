@@ -0,0 +1,87 @@
+package smtpclt
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/smtpserver"
+)
+
+const testMail = "Subject: test\r\n\r\n.leading dot\r\nbody\r\n"
+
+func TestSendSMTP(t *testing.T) {
+	srv := smtpserver.StartServer(t)
+
+	clt := NewClient(&Config{
+		Address:       srv.ListenAddr,
+		User:          srv.UserName,
+		Password:      srv.UserPasswd,
+		AllowInsecure: true,
+		Logger:        log.SlogTestLogger(t),
+	})
+
+	err := clt.Send(context.Background(), "from@example.com",
+		[]string{"a@example.com", "b@example.com"}, strings.NewReader(testMail),
+	)
+	assert.NoError(t, err)
+
+	mails := srv.Mails()
+	assert.Equal(t, 1, len(mails))
+	assert.Equal(t, "from@example.com", mails[0].From)
+	assert.Equal(t, 2, len(mails[0].To))
+	assert.Equal(t, strings.ReplaceAll(testMail, "\r\n", "\n"), string(mails[0].Data))
+}
+
+func TestSendSMTP_InsecureNotAllowed(t *testing.T) {
+	srv := smtpserver.StartServer(t)
+
+	clt := NewClient(&Config{
+		Address: srv.ListenAddr,
+		Logger:  log.SlogTestLogger(t),
+	})
+
+	err := clt.Send(context.Background(), "", []string{"a@example.com"}, strings.NewReader(testMail))
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(srv.Mails()))
+}
+
+func TestSendSMTP_AuthFailed(t *testing.T) {
+	srv := smtpserver.StartServer(t)
+
+	clt := NewClient(&Config{
+		Address:       srv.ListenAddr,
+		User:          srv.UserName,
+		Password:      "wrong",
+		AllowInsecure: true,
+		Logger:        log.SlogTestLogger(t),
+	})
+
+	err := clt.Send(context.Background(), "", []string{"a@example.com"}, strings.NewReader(testMail))
+	assert.Error(t, err)
+}
+
+func TestSendLMTP(t *testing.T) {
+	srv := smtpserver.StartLMTPServer(t)
+	srv.RejectRecipient("rejected@example.com")
+
+	clt := NewClient(&Config{
+		Address: srv.ListenAddr,
+		LMTP:    true,
+		Logger:  log.SlogTestLogger(t),
+	})
+
+	err := clt.Send(context.Background(), "", []string{"a@example.com"}, strings.NewReader(testMail))
+	assert.NoError(t, err)
+
+	err = clt.Send(context.Background(), "",
+		[]string{"a@example.com", "rejected@example.com"}, strings.NewReader(testMail),
+	)
+	assert.Error(t, err)
+
+	mails := srv.Mails()
+	assert.Equal(t, 2, len(mails))
+	assert.Equal(t, 1, len(mails[1].To))
+}
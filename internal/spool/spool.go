@@ -0,0 +1,213 @@
+// Package spool buffers message data in memory or, when it is large or the
+// memory budget is exhausted, in temporary files.
+package spool
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+)
+
+// filePrefix is the name prefix of the temporary files.
+const filePrefix = "rspamd-iscan-spool-"
+
+type Config struct {
+	// Dir is the directory that temporary files are created in. If it is
+	// empty, [os.TempDir] is used.
+	Dir string
+	// Threshold is the size in bytes above which data is always stored
+	// in a temporary file. If it is 0, only Budget applies.
+	Threshold int64
+	// Budget is the max. number of bytes that are buffered in memory by
+	// all users of the spool at once. Data that would exceed it is stored
+	// in a temporary file. If it is 0, the memory usage is not limited.
+	Budget int64
+	Logger *slog.Logger
+}
+
+// Spool buffers data in memory or temporary files.
+// It is safe for concurrent use. A nil *Spool buffers all data in memory.
+type Spool struct {
+	dir       string
+	threshold int64
+	budget    int64
+	logger    *slog.Logger
+
+	mu sync.Mutex
+	// inMemory is the number of bytes of all open in-memory buffers.
+	inMemory int64
+}
+
+// New creates a spool and removes temporary files in cfg.Dir that were left
+// by a previous process that crashed.
+func New(cfg *Config) (*Spool, error) {
+	dir := cfg.Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	s := Spool{
+		dir:       dir,
+		threshold: cfg.Threshold,
+		budget:    cfg.Budget,
+		logger:    log.Module(cfg.Logger, "spool"),
+	}
+
+	if err := s.removeStale(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (s *Spool) removeStale() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, filePrefix+"*"))
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing stale spool file failed: %w", err)
+		}
+		s.logger.Info("removed stale spool file", "path", p, "event", "spool.stale_file_removed")
+	}
+
+	return nil
+}
+
+// Buffer reads r until EOF and returns a buffer with its data. size is the
+// expected number of bytes, it decides if the data is buffered in memory or
+// in a temporary file.
+// The buffer must be closed to release its memory, respectively to remove
+// its file.
+func (s *Spool) Buffer(r io.Reader, size int64) (*Buffer, error) {
+	if !s.reserve(size) {
+		return s.bufferFile(r)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		s.release(size)
+		return nil, err
+	}
+
+	// the reservation is adjusted if the announced size was wrong
+	s.release(size - int64(len(data)))
+
+	return &Buffer{spool: s, data: data, size: int64(len(data))}, nil
+}
+
+// reserve returns true and adds size to the in-memory bytes, if data of size
+// can be buffered in memory.
+func (s *Spool) reserve(size int64) bool {
+	if s == nil {
+		return true
+	}
+
+	if s.threshold > 0 && size > s.threshold {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.budget > 0 && s.inMemory+size > s.budget {
+		return false
+	}
+
+	s.inMemory += size
+
+	return true
+}
+
+func (s *Spool) release(size int64) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.inMemory -= size
+	s.mu.Unlock()
+}
+
+func (s *Spool) bufferFile(r io.Reader) (*Buffer, error) {
+	f, err := os.CreateTemp(s.dir, filePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("creating spool file failed: %w", err)
+	}
+
+	b := Buffer{file: f}
+
+	// the file is removed while it is still open, its space is released
+	// when it is closed, also when the process crashes. Where this is not
+	// supported, it is removed in Close.
+	if err := os.Remove(f.Name()); err != nil {
+		b.path = f.Name()
+	}
+
+	b.size, err = io.Copy(f, r)
+	if err != nil {
+		_ = b.Close()
+		return nil, fmt.Errorf("writing spool file failed: %w", err)
+	}
+
+	s.logger.Debug("spooled data to file", "size", b.size, "event", "spool.file_buffered")
+
+	return &b, nil
+}
+
+// Buffer contains data that is stored in memory or in a temporary file.
+type Buffer struct {
+	spool *Spool
+	data  []byte
+	file  *os.File
+	// path is the path of file, when it could not be removed while it is
+	// open.
+	path string
+	size int64
+}
+
+// Size returns the number of bytes in the buffer.
+func (b *Buffer) Size() int64 {
+	return b.size
+}
+
+// Spooled returns true if the data is stored in a temporary file.
+func (b *Buffer) Spooled() bool {
+	return b.file != nil
+}
+
+// Reader returns a reader that reads the data from the beginning.
+// Multiple readers can be used concurrently.
+func (b *Buffer) Reader() io.Reader {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+
+	return bytes.NewReader(b.data)
+}
+
+// Close releases the memory of the buffer, respectively closes and removes its
+// file. Readers can not be used afterwards.
+func (b *Buffer) Close() error {
+	if b.file == nil {
+		b.spool.release(int64(len(b.data)))
+		b.data = nil
+		return nil
+	}
+
+	err := b.file.Close()
+	if b.path != "" {
+		err = errors.Join(err, os.Remove(b.path))
+	}
+
+	return err
+}
@@ -0,0 +1,99 @@
+package spool
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func newTestSpool(t *testing.T, threshold, budget int64) *Spool {
+	s, err := New(&Config{
+		Dir:       t.TempDir(),
+		Threshold: threshold,
+		Budget:    budget,
+		Logger:    log.SlogTestLogger(t),
+	})
+	assert.NoError(t, err)
+
+	return s
+}
+
+func buffer(t *testing.T, s *Spool, data string) *Buffer {
+	t.Helper()
+
+	b, err := s.Buffer(strings.NewReader(data), int64(len(data)))
+	assert.NoError(t, err)
+
+	read, err := io.ReadAll(b.Reader())
+	assert.NoError(t, err)
+	assert.Equal(t, data, string(read))
+	assert.Equal(t, int64(len(data)), b.Size())
+
+	return b
+}
+
+func TestBufferThreshold(t *testing.T) {
+	s := newTestSpool(t, 5, 0)
+
+	small := buffer(t, s, "12345")
+	assert.Equal(t, false, small.Spooled())
+
+	large := buffer(t, s, "123456")
+	assert.Equal(t, true, large.Spooled())
+
+	// the file was removed while it is open
+	files, err := os.ReadDir(s.dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(files))
+
+	assert.NoError(t, small.Close())
+	assert.NoError(t, large.Close())
+}
+
+func TestBufferBudget(t *testing.T) {
+	s := newTestSpool(t, 0, 10)
+
+	b1 := buffer(t, s, "123456")
+	assert.Equal(t, false, b1.Spooled())
+
+	b2 := buffer(t, s, "123456")
+	assert.Equal(t, true, b2.Spooled())
+	assert.Equal(t, int64(6), s.inMemory)
+
+	assert.NoError(t, b1.Close())
+	assert.NoError(t, b2.Close())
+	assert.Equal(t, int64(0), s.inMemory)
+
+	b3 := buffer(t, s, "123456")
+	assert.Equal(t, false, b3.Spooled())
+	assert.NoError(t, b3.Close())
+}
+
+func TestNilSpoolBuffersInMemory(t *testing.T) {
+	var s *Spool
+
+	b := buffer(t, s, "123456")
+	assert.Equal(t, false, b.Spooled())
+	assert.NoError(t, b.Close())
+}
+
+func TestNewRemovesStaleFiles(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, filePrefix+"123")
+	other := filepath.Join(dir, "other")
+	assert.NoError(t, os.WriteFile(stale, []byte("data"), 0o600))
+	assert.NoError(t, os.WriteFile(other, []byte("data"), 0o600))
+
+	_, err := New(&Config{Dir: dir, Threshold: 1, Logger: log.SlogTestLogger(t)})
+	assert.NoError(t, err)
+
+	_, err = os.Stat(stale)
+	assert.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(other)
+	assert.NoError(t, err)
+}
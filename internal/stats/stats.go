@@ -0,0 +1,268 @@
+// Package stats records counters of the processed mails per account and
+// persists them in a JSON file.
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/fsutil"
+)
+
+const (
+	// bucketSize is the time span that the counters are aggregated by.
+	bucketSize = time.Hour
+	// Retention is the duration for which counters are kept.
+	Retention = 31 * 24 * time.Hour
+)
+
+// Counters are the counters of an account.
+type Counters struct {
+	Scanned uint64 `json:"scanned"`
+	Spam    uint64 `json:"spam"`
+	Ham     uint64 `json:"ham"`
+	Learned uint64 `json:"learned"`
+	Errors  uint64 `json:"errors"`
+	// Duplicates is the number of scanned mails, whose scan result was
+	// reused from a copy of the same mail in the scan cycle.
+	Duplicates uint64 `json:"duplicates"`
+	// Bytes is the number of bytes of the mails that were downloaded from
+	// the mail server.
+	Bytes uint64 `json:"bytes"`
+	// Degraded is the number of scan cycles in which messages were not
+	// scanned, because rspamd was unavailable.
+	Degraded uint64 `json:"degraded"`
+}
+
+// Add adds the counters of o to c.
+func (c *Counters) Add(o *Counters) {
+	c.Scanned += o.Scanned
+	c.Spam += o.Spam
+	c.Ham += o.Ham
+	c.Learned += o.Learned
+	c.Errors += o.Errors
+	c.Duplicates += o.Duplicates
+	c.Bytes += o.Bytes
+	c.Degraded += o.Degraded
+}
+
+// Store contains the counters of all accounts, aggregated per hour.
+// Counters are only recorded for one account, the one that the store was
+// opened for. Multiple processes can share the file, the counters that they
+// recorded are merged when the store is saved.
+// A nil *Store is a disabled store, its methods do nothing.
+// It can be used concurrently.
+type Store struct {
+	path    string
+	account string
+
+	mu sync.Mutex
+	// accounts maps account names to the start time (unix seconds) of
+	// buckets and their counters.
+	accounts map[string]map[int64]*Counters
+	// pending are the counters of account that were added since the store
+	// was saved, by bucket.
+	pending map[int64]*Counters
+}
+
+// New returns an empty store that is persisted at path.
+// account is the name of the account that counters are recorded for.
+func New(path, account string) *Store {
+	return &Store{
+		path:     path,
+		account:  account,
+		accounts: map[string]map[int64]*Counters{},
+		pending:  map[int64]*Counters{},
+	}
+}
+
+// Open loads the store from the file at path. If the file does not exist, the
+// store is empty. If it can not be parsed, an error is returned.
+// account is the name of the account that counters are recorded for.
+func Open(path, account string) (*Store, error) {
+	s := New(path, account)
+
+	accounts, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	s.accounts = accounts
+
+	return s, nil
+}
+
+// load reads the counters of all accounts from the file at path.
+func load(path string) (map[string]map[int64]*Counters, error) {
+	accounts := map[string]map[int64]*Counters{}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return accounts, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("decoding %q failed: %w", path, err)
+	}
+
+	return accounts, nil
+}
+
+// addTo adds c to the counters of the bucket for the time now in buckets.
+func addTo(buckets map[int64]*Counters, now time.Time, c *Counters) {
+	key := now.Truncate(bucketSize).Unix()
+	b, exists := buckets[key]
+	if !exists {
+		b = &Counters{}
+		buckets[key] = b
+	}
+
+	b.Add(c)
+}
+
+// Add adds c to the counters of the account for the time now.
+func (s *Store) Add(now time.Time, c *Counters) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buckets, exists := s.accounts[s.account]
+	if !exists {
+		buckets = map[int64]*Counters{}
+		s.accounts[s.account] = buckets
+	}
+
+	addTo(buckets, now, c)
+	addTo(s.pending, now, c)
+}
+
+// Accounts returns the names of the accounts in the store, sorted.
+func (s *Store) Accounts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Sorted(maps.Keys(s.accounts))
+}
+
+// Sum returns the sum of the counters of account that were recorded in the
+// time span [since, now].
+func (s *Store) Sum(account string, since, now time.Time) *Counters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result Counters
+
+	start := since.Truncate(bucketSize).Unix()
+	end := now.Unix()
+	for ts, c := range s.accounts[account] {
+		if ts >= start && ts <= end {
+			result.Add(c)
+		}
+	}
+
+	return &result
+}
+
+// Save writes the counters that were added since the last call to the file.
+// The file is locked and read again, the counters are added to the ones in
+// the file, to not overwrite the counters that other processes recorded.
+// Counters that are older than [Retention] are removed.
+// If the file can not be parsed, an error is returned and it is not
+// overwritten.
+func (s *Store) Save(now time.Time) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	accounts, err := load(s.path)
+	if err != nil {
+		return err
+	}
+
+	modified := len(s.pending) != 0
+	if modified {
+		buckets, exists := accounts[s.account]
+		if !exists {
+			buckets = map[int64]*Counters{}
+			accounts[s.account] = buckets
+		}
+
+		for ts, c := range s.pending {
+			addTo(buckets, time.Unix(ts, 0), c)
+		}
+	}
+
+	oldest := now.Add(-Retention).Unix()
+	for account, buckets := range accounts {
+		for ts := range buckets {
+			if ts < oldest {
+				delete(buckets, ts)
+				modified = true
+			}
+		}
+
+		if len(buckets) == 0 {
+			delete(accounts, account)
+		}
+	}
+
+	s.accounts = accounts
+
+	if !modified {
+		return nil
+	}
+
+	data, err := json.Marshal(accounts)
+	if err != nil {
+		return err
+	}
+
+	if err := fsutil.WriteFileAtomic(s.path, data); err != nil {
+		return err
+	}
+
+	s.pending = map[int64]*Counters{}
+
+	return nil
+}
+
+// lockFile acquires an exclusive lock on the file at path, it is created if
+// it does not exist. The returned function releases the lock.
+func lockFile(path string) (unlock func(), _ error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("locking %q failed: %w", path, err)
+	}
+
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
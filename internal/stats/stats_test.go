@@ -0,0 +1,99 @@
+package stats
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestStoreSumAndPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	now := time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC)
+
+	s, err := Open(path, "user@imap")
+	assert.NoError(t, err)
+
+	s.Add(now.Add(-40*24*time.Hour), &Counters{Scanned: 100})
+	s.Add(now.Add(-3*24*time.Hour), &Counters{Scanned: 3, Spam: 1, Ham: 2, Bytes: 300})
+	s.Add(now.Add(-time.Hour), &Counters{Scanned: 1, Ham: 1, Bytes: 100})
+	s.Add(now, &Counters{Learned: 2, Errors: 1})
+	assert.NoError(t, s.Save(now))
+
+	s, err = Open(path, "user@imap")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(s.Accounts()))
+
+	day := s.Sum("user@imap", now.Add(-24*time.Hour), now)
+	assert.Equal(t, Counters{Scanned: 1, Ham: 1, Learned: 2, Errors: 1, Bytes: 100}, *day)
+
+	week := s.Sum("user@imap", now.Add(-7*24*time.Hour), now)
+	assert.Equal(t, Counters{Scanned: 4, Spam: 1, Ham: 3, Learned: 2, Errors: 1, Bytes: 400}, *week)
+
+	// counters older than the retention were removed
+	all := s.Sum("user@imap", now.Add(-365*24*time.Hour), now)
+	assert.Equal(t, uint64(4), all.Scanned)
+
+	assert.Equal(t, Counters{}, *s.Sum("other", now.Add(-24*time.Hour), now))
+}
+
+func TestStoreSaveMerges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	now := time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC)
+
+	// the stores are opened before any of them saved
+	s1, err := Open(path, "a@imap")
+	assert.NoError(t, err)
+	s2, err := Open(path, "b@imap")
+	assert.NoError(t, err)
+	s3, err := Open(path, "a@imap")
+	assert.NoError(t, err)
+
+	s1.Add(now, &Counters{Scanned: 1})
+	s2.Add(now, &Counters{Scanned: 2})
+	s3.Add(now, &Counters{Scanned: 3})
+	assert.NoError(t, s1.Save(now))
+	assert.NoError(t, s2.Save(now))
+	assert.NoError(t, s3.Save(now))
+
+	// the counters are only added once
+	assert.NoError(t, s1.Save(now))
+
+	s, err := Open(path, "a@imap")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(s.Accounts()))
+	assert.Equal(t, uint64(4), s.Sum("a@imap", now.Add(-time.Hour), now).Scanned)
+	assert.Equal(t, uint64(2), s.Sum("b@imap", now.Add(-time.Hour), now).Scanned)
+
+	// the store contains the counters of the other processes after
+	// saving
+	assert.Equal(t, uint64(2), s1.Sum("b@imap", now.Add(-time.Hour), now).Scanned)
+}
+
+func TestStoreCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	now := time.Now()
+
+	s, err := Open(path, "a@imap")
+	assert.NoError(t, err)
+	s.Add(now, &Counters{Scanned: 1})
+
+	assert.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+
+	_, err = Open(path, "a@imap")
+	assert.Error(t, err)
+
+	// the file is not overwritten
+	assert.Error(t, s.Save(now))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "{", string(data))
+}
+
+func TestNilStore(t *testing.T) {
+	var s *Store
+	s.Add(time.Now(), &Counters{Scanned: 1})
+	assert.NoError(t, s.Save(time.Now()))
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapserver"
 	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
 )
@@ -24,7 +25,15 @@ type Server struct {
 	ch  chan error
 }
 
+// StartServer starts an IMAP4rev1 server without extensions that require
+// backend support, e.g. MOVE and UIDPLUS.
 func StartServer(t *testing.T) *Server {
+	return StartServerWithCaps(t, nil)
+}
+
+// StartServerWithCaps starts a server that advertises caps. If caps is nil,
+// only IMAP4rev1 is advertised.
+func StartServerWithCaps(t *testing.T, caps imap.CapSet) *Server {
 	srv := Server{
 		UserName:          "user",
 		UserPasswd:        "none",
@@ -55,6 +64,7 @@ func StartServer(t *testing.T) *Server {
 		},
 		Logger:       testLoggerAsImapServerLogger(t),
 		InsecureAuth: true,
+		Caps:         caps,
 	})
 
 	t.Cleanup(func() { _ = isrv.Close() })
@@ -0,0 +1,760 @@
+// Package jmapserver provides a minimal in-memory JMAP server for tests.
+// It only implements the subset of RFC 8620 and RFC 8621 that is used by
+// jmapclt.
+package jmapserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const accountID = "a1"
+
+type Server struct {
+	UserName   string
+	UserPasswd string
+	SessionURL string
+
+	BackupMailbox     string
+	HamMailbox        string
+	InboxMailBox      string
+	ScanMailbox       string
+	SpamMailbox       string
+	UndetectedMailbox string
+
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	mailboxes []*mailbox
+	emails    []*email
+	blobs     map[string][]byte
+	nextID    int
+	listeners []chan struct{}
+
+	// state is the Email state, it is incremented on every change.
+	state   int
+	changes []*change
+	// queries are the results of Email/query calls by their queryState.
+	queries map[string][]string
+	calls   map[string]int
+}
+
+// change is a modification of an email, in the Email state.
+type change struct {
+	state     int
+	id        string
+	created   bool
+	destroyed bool
+}
+
+// methodError is returned by API methods to respond with a JMAP method
+// error of the given type.
+type methodError struct {
+	typ         string
+	description string
+}
+
+func (e *methodError) Error() string {
+	return e.typ + ": " + e.description
+}
+
+type mailbox struct {
+	ID   string
+	Name string
+	Role string
+}
+
+type email struct {
+	ID         string
+	BlobID     string
+	MailboxIDs map[string]bool
+	Keywords   map[string]bool
+	ReceivedAt time.Time
+}
+
+// StartServer starts a JMAP server that listens on a random localhost port.
+// It is stopped when the test finishes.
+func StartServer(t *testing.T) *Server {
+	s := Server{
+		UserName:          "user",
+		UserPasswd:        "none",
+		InboxMailBox:      "INBOX",
+		ScanMailbox:       "unscanned",
+		BackupMailbox:     "backup",
+		HamMailbox:        "ham",
+		SpamMailbox:       "spam",
+		UndetectedMailbox: "undetected",
+		blobs:             map[string][]byte{},
+		queries:           map[string][]string{},
+		calls:             map[string]int{},
+	}
+
+	s.mailboxes = append(s.mailboxes, &mailbox{ID: s.newID("mb"), Name: "Inbox", Role: "inbox"})
+	for _, name := range []string{s.ScanMailbox, s.BackupMailbox, s.HamMailbox, s.SpamMailbox, s.UndetectedMailbox} {
+		s.mailboxes = append(s.mailboxes, &mailbox{ID: s.newID("mb"), Name: name})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jmap/session", s.handleSession)
+	mux.HandleFunc("POST /jmap/api", s.handleAPI)
+	mux.HandleFunc("POST /jmap/upload/{account}/", s.handleUpload)
+	mux.HandleFunc("GET /jmap/download/{account}/{blob}/{name}", s.handleDownload)
+	mux.HandleFunc("GET /jmap/eventsource", s.handleEventSource)
+
+	s.srv = httptest.NewServer(s.auth(mux))
+	s.SessionURL = s.srv.URL + "/jmap/session"
+
+	t.Cleanup(func() {
+		s.mu.Lock()
+		for _, l := range s.listeners {
+			close(l)
+		}
+		s.listeners = nil
+		s.mu.Unlock()
+
+		s.srv.Close()
+	})
+
+	return &s
+}
+
+// Calls returns how often the API method was called.
+func (s *Server) Calls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[method]
+}
+
+// changed records a modification of the email with id in a new Email state.
+func (s *Server) changed(id string, created, destroyed bool) {
+	s.state++
+	s.changes = append(s.changes, &change{state: s.state, id: id, created: created, destroyed: destroyed})
+}
+
+func (s *Server) newID(prefix string) string {
+	s.nextID++
+	return prefix + strconv.Itoa(s.nextID)
+}
+
+func (s *Server) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, passwd, ok := r.BasicAuth()
+		if !ok || user != s.UserName || passwd != s.UserPasswd {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AddMessage adds a message to the mailbox with the given name.
+func (s *Server) AddMessage(mailboxName string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mb := s.mailboxByName(mailboxName)
+	if mb == nil {
+		panic("mailbox does not exist: " + mailboxName)
+	}
+
+	blobID := s.newID("b")
+	s.blobs[blobID] = crlf(data)
+	e := email{
+		ID:         s.newID("e"),
+		BlobID:     blobID,
+		MailboxIDs: map[string]bool{mb.ID: true},
+		Keywords:   map[string]bool{},
+		ReceivedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	s.emails = append(s.emails, &e)
+	s.changed(e.ID, true, false)
+	s.notify()
+}
+
+// MessageCount returns the number of messages in the mailbox.
+func (s *Server) MessageCount(mailboxName string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.emailsIn(s.mailboxByName(mailboxName).ID))
+}
+
+// Keywords returns the keywords of the messages in the mailbox.
+func (s *Server) Keywords(mailboxName string) [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result [][]string
+	for _, e := range s.emailsIn(s.mailboxByName(mailboxName).ID) {
+		var kws []string
+		for k, set := range e.Keywords {
+			if set {
+				kws = append(kws, k)
+			}
+		}
+		slices.Sort(kws)
+		result = append(result, kws)
+	}
+
+	return result
+}
+
+// crlf converts bare LF line endings to CRLF, like mail servers do when
+// messages are stored.
+func crlf(data []byte) []byte {
+	return bytes.ReplaceAll(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
+
+func (s *Server) mailboxByName(name string) *mailbox {
+	for _, mb := range s.mailboxes {
+		if mb.Name == name || (mb.Role == "inbox" && name == "INBOX") {
+			return mb
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) emailsIn(mailboxID string) []*email {
+	var result []*email
+	for _, e := range s.emails {
+		if e.MailboxIDs[mailboxID] {
+			result = append(result, e)
+		}
+	}
+
+	return result
+}
+
+// notify sends a state change to all push listeners.
+func (s *Server) notify() {
+	for _, l := range s.listeners {
+		select {
+		case l <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleSession(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, map[string]any{
+		"capabilities": map[string]any{
+			"urn:ietf:params:jmap:core": map[string]any{},
+			"urn:ietf:params:jmap:mail": map[string]any{},
+		},
+		"accounts":        map[string]any{accountID: map[string]any{"name": s.UserName}},
+		"primaryAccounts": map[string]string{"urn:ietf:params:jmap:mail": accountID},
+		"username":        s.UserName,
+		"apiUrl":          s.srv.URL + "/jmap/api",
+		"downloadUrl":     s.srv.URL + "/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+		"uploadUrl":       s.srv.URL + "/jmap/upload/{accountId}/",
+		"eventSourceUrl":  s.srv.URL + "/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+		"state":           "1",
+	})
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	blobID := s.newID("b")
+	s.blobs[blobID] = crlf(data)
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]any{
+		"accountId": accountID,
+		"blobId":    blobID,
+		"type":      r.Header.Get("Content-Type"),
+		"size":      len(data),
+	})
+}
+
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	data, exists := s.blobs[r.PathValue("blob")]
+	s.mu.Unlock()
+
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeContent(w, r, r.PathValue("name"), time.Time{}, bytes.NewReader(data))
+}
+
+func (s *Server) handleEventSource(w http.ResponseWriter, r *http.Request) {
+	ch := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	s.listeners = append(s.listeners, ch)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		if i := slices.Index(s.listeners, ch); i != -1 {
+			s.listeners = slices.Delete(s.listeners, i, i+1)
+		}
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "event: state\ndata: {\"@type\":\"StateChange\",\"changed\":{}}\n\n")
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+type invocation [3]json.RawMessage
+
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MethodCalls []invocation `json:"methodCalls"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var responses []any
+	for _, call := range req.MethodCalls {
+		var name string
+		_ = json.Unmarshal(call[0], &name)
+
+		s.calls[name]++
+
+		result, err := s.call(name, call[1])
+		if err != nil {
+			merr := &methodError{typ: "invalidArguments", description: err.Error()}
+			errors.As(err, &merr)
+
+			responses = append(responses, []any{"error", map[string]string{
+				"type": merr.typ, "description": merr.description,
+			}, call[2]})
+			continue
+		}
+
+		responses = append(responses, []any{name, result, call[2]})
+	}
+
+	writeJSON(w, map[string]any{"methodResponses": responses, "sessionState": "1"})
+}
+
+func (s *Server) call(name string, rawArgs json.RawMessage) (any, error) {
+	var args map[string]json.RawMessage
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "Mailbox/get":
+		return s.mailboxGet(args)
+	case "Email/query":
+		return s.emailQuery(args)
+	case "Email/queryChanges":
+		return s.emailQueryChanges(args)
+	case "Email/changes":
+		return s.emailChanges(args)
+	case "Email/get":
+		return s.emailGet(args)
+	case "Email/set":
+		return s.emailSet(args)
+	case "Email/import":
+		return s.emailImport(args)
+	default:
+		return nil, fmt.Errorf("unsupported method: %s", name)
+	}
+}
+
+func (s *Server) mailboxGet(args map[string]json.RawMessage) (any, error) {
+	var ids []string
+	if err := json.Unmarshal(args["ids"], &ids); err != nil {
+		return nil, err
+	}
+
+	var list []map[string]any
+	for _, mb := range s.mailboxes {
+		if ids != nil && !slices.Contains(ids, mb.ID) {
+			continue
+		}
+
+		var role any
+		if mb.Role != "" {
+			role = mb.Role
+		}
+
+		list = append(list, map[string]any{
+			"id":          mb.ID,
+			"name":        mb.Name,
+			"parentId":    nil,
+			"role":        role,
+			"totalEmails": len(s.emailsIn(mb.ID)),
+		})
+	}
+
+	return map[string]any{"accountId": accountID, "state": "1", "list": list}, nil
+}
+
+type filter struct {
+	Operator   string    `json:"operator"`
+	Conditions []*filter `json:"conditions"`
+	InMailbox  string    `json:"inMailbox"`
+	HasKeyword string    `json:"hasKeyword"`
+	NotKeyword string    `json:"notKeyword"`
+	MinSize    int       `json:"minSize"`
+	MaxSize    int       `json:"maxSize"`
+}
+
+func (s *Server) matches(f *filter, e *email) bool {
+	if f.Operator == "AND" {
+		for _, c := range f.Conditions {
+			if !s.matches(c, e) {
+				return false
+			}
+		}
+		return true
+	}
+
+	size := len(s.blobs[e.BlobID])
+
+	return (f.InMailbox == "" || e.MailboxIDs[f.InMailbox]) &&
+		(f.HasKeyword == "" || e.Keywords[f.HasKeyword]) &&
+		(f.NotKeyword == "" || !e.Keywords[f.NotKeyword]) &&
+		(f.MinSize == 0 || size >= f.MinSize) &&
+		(f.MaxSize == 0 || size < f.MaxSize)
+}
+
+// queryIDs returns the ids of the emails that match the filter in args and
+// the queryState of the result.
+// The emails are sorted by the order in which they were added.
+func (s *Server) queryIDs(args map[string]json.RawMessage) ([]string, string, error) {
+	var f filter
+	if err := json.Unmarshal(args["filter"], &f); err != nil {
+		return nil, "", err
+	}
+
+	ids := []string{}
+	for _, e := range s.emails {
+		if s.matches(&f, e) {
+			ids = append(ids, e.ID)
+		}
+	}
+
+	queryState := strconv.Itoa(s.state) + ":" + string(args["filter"])
+	s.queries[queryState] = ids
+
+	return ids, queryState, nil
+}
+
+func (s *Server) emailQuery(args map[string]json.RawMessage) (any, error) {
+	var position, limit int
+	_ = json.Unmarshal(args["position"], &position)
+	_ = json.Unmarshal(args["limit"], &limit)
+
+	ids, queryState, err := s.queryIDs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	total := len(ids)
+	ids = ids[min(position, len(ids)):]
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	return map[string]any{
+		"accountId": accountID, "queryState": queryState, "canCalculateChanges": true,
+		"ids": ids, "position": position, "total": total,
+	}, nil
+}
+
+func (s *Server) emailQueryChanges(args map[string]json.RawMessage) (any, error) {
+	var since string
+	if err := json.Unmarshal(args["sinceQueryState"], &since); err != nil {
+		return nil, err
+	}
+
+	old, exists := s.queries[since]
+	if !exists {
+		return nil, &methodError{typ: "cannotCalculateChanges", description: "unknown queryState"}
+	}
+
+	ids, queryState, err := s.queryIDs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	for _, id := range old {
+		if !slices.Contains(ids, id) {
+			removed = append(removed, id)
+		}
+	}
+
+	added := []map[string]any{}
+	for i, id := range ids {
+		if !slices.Contains(old, id) {
+			added = append(added, map[string]any{"id": id, "index": i})
+		}
+	}
+
+	return map[string]any{
+		"accountId": accountID, "oldQueryState": since, "newQueryState": queryState,
+		"removed": removed, "added": added,
+	}, nil
+}
+
+func (s *Server) emailChanges(args map[string]json.RawMessage) (any, error) {
+	var sinceState string
+	if err := json.Unmarshal(args["sinceState"], &sinceState); err != nil {
+		return nil, err
+	}
+
+	since, err := strconv.Atoi(sinceState)
+	if err != nil || since > s.state {
+		return nil, &methodError{typ: "cannotCalculateChanges", description: "unknown state"}
+	}
+
+	created, updated, destroyed := []string{}, []string{}, []string{}
+	for _, c := range s.changes {
+		if c.state <= since {
+			continue
+		}
+
+		switch {
+		case c.destroyed:
+			destroyed = append(destroyed, c.id)
+		case c.created:
+			created = append(created, c.id)
+		default:
+			updated = append(updated, c.id)
+		}
+	}
+
+	return map[string]any{
+		"accountId": accountID, "oldState": sinceState, "newState": strconv.Itoa(s.state),
+		"hasMoreChanges": false, "created": created, "updated": updated, "destroyed": destroyed,
+	}, nil
+}
+
+func addressList(h mail.Header, key string) []map[string]string {
+	var result []map[string]string
+
+	addrs, _ := h.AddressList(key)
+	for _, a := range addrs {
+		result = append(result, map[string]string{"name": a.Name, "email": a.Address})
+	}
+
+	return result
+}
+
+func (s *Server) emailGet(args map[string]json.RawMessage) (any, error) {
+	var ids []string
+	if err := json.Unmarshal(args["ids"], &ids); err != nil {
+		return nil, err
+	}
+
+	list := []map[string]any{}
+	notFound := []string{}
+
+	for _, id := range ids {
+		i := slices.IndexFunc(s.emails, func(e *email) bool { return e.ID == id })
+		if i == -1 {
+			notFound = append(notFound, id)
+			continue
+		}
+		e := s.emails[i]
+
+		data := s.blobs[e.BlobID]
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		var headers []map[string]string
+		rawHdr, _, _ := bytes.Cut(data, []byte("\r\n\r\n"))
+		for _, line := range strings.Split(string(rawHdr), "\r\n") {
+			if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(headers) > 0 {
+				headers[len(headers)-1]["value"] += "\r\n" + line
+				continue
+			}
+
+			name, value, _ := strings.Cut(line, ":")
+			headers = append(headers, map[string]string{"name": name, "value": value})
+		}
+
+		result := map[string]any{
+			"id":         e.ID,
+			"blobId":     e.BlobID,
+			"size":       len(data),
+			"receivedAt": e.ReceivedAt.Format(time.RFC3339),
+			"subject":    msg.Header.Get("Subject"),
+			"from":       addressList(msg.Header, "From"),
+			"to":         addressList(msg.Header, "To"),
+			"cc":         addressList(msg.Header, "Cc"),
+			"bcc":        addressList(msg.Header, "Bcc"),
+			"mailboxIds": e.MailboxIDs,
+			"keywords":   e.Keywords,
+			"headers":    headers,
+		}
+
+		if mid := msg.Header.Get("Message-Id"); mid != "" {
+			result["messageId"] = []string{strings.Trim(mid, "<> ")}
+		}
+
+		if date, err := msg.Header.Date(); err == nil {
+			result["sentAt"] = date.Format(time.RFC3339)
+		}
+
+		list = append(list, result)
+	}
+
+	return map[string]any{"accountId": accountID, "state": strconv.Itoa(s.state), "list": list, "notFound": notFound}, nil
+}
+
+func (s *Server) emailSet(args map[string]json.RawMessage) (any, error) {
+	var update map[string]map[string]json.RawMessage
+	if raw, exists := args["update"]; exists {
+		if err := json.Unmarshal(raw, &update); err != nil {
+			return nil, err
+		}
+	}
+
+	var destroy []string
+	if raw, exists := args["destroy"]; exists {
+		if err := json.Unmarshal(raw, &destroy); err != nil {
+			return nil, err
+		}
+	}
+
+	updated := map[string]any{}
+	notUpdated := map[string]any{}
+
+	for id, patch := range update {
+		i := slices.IndexFunc(s.emails, func(e *email) bool { return e.ID == id })
+		if i == -1 {
+			notUpdated[id] = map[string]string{"type": "notFound"}
+			continue
+		}
+		e := s.emails[i]
+
+		for k, v := range patch {
+			switch {
+			case k == "mailboxIds":
+				var ids map[string]bool
+				if err := json.Unmarshal(v, &ids); err != nil {
+					return nil, err
+				}
+				e.MailboxIDs = ids
+			case strings.HasPrefix(k, "keywords/"):
+				var set bool
+				if err := json.Unmarshal(v, &set); err != nil {
+					return nil, err
+				}
+				e.Keywords[strings.TrimPrefix(k, "keywords/")] = set
+			default:
+				return nil, fmt.Errorf("unsupported patch: %s", k)
+			}
+		}
+
+		s.changed(id, false, false)
+		updated[id] = nil
+	}
+
+	destroyed := []string{}
+	notDestroyed := map[string]any{}
+
+	for _, id := range destroy {
+		i := slices.IndexFunc(s.emails, func(e *email) bool { return e.ID == id })
+		if i == -1 {
+			notDestroyed[id] = map[string]string{"type": "notFound"}
+			continue
+		}
+		s.emails = slices.Delete(s.emails, i, i+1)
+		s.changed(id, false, true)
+		destroyed = append(destroyed, id)
+	}
+
+	s.notify()
+
+	return map[string]any{
+		"accountId": accountID, "newState": strconv.Itoa(s.state),
+		"updated": updated, "notUpdated": notUpdated,
+		"destroyed": destroyed, "notDestroyed": notDestroyed,
+	}, nil
+}
+
+func (s *Server) emailImport(args map[string]json.RawMessage) (any, error) {
+	var emails map[string]struct {
+		BlobID     string          `json:"blobId"`
+		MailboxIDs map[string]bool `json:"mailboxIds"`
+		Keywords   map[string]bool `json:"keywords"`
+		ReceivedAt time.Time       `json:"receivedAt"`
+	}
+	if err := json.Unmarshal(args["emails"], &emails); err != nil {
+		return nil, err
+	}
+
+	created := map[string]any{}
+	for k, imp := range emails {
+		if _, exists := s.blobs[imp.BlobID]; !exists {
+			return nil, fmt.Errorf("blob not found: %s", imp.BlobID)
+		}
+
+		e := email{
+			ID:         s.newID("e"),
+			BlobID:     imp.BlobID,
+			MailboxIDs: imp.MailboxIDs,
+			Keywords:   imp.Keywords,
+			ReceivedAt: imp.ReceivedAt,
+		}
+		if e.Keywords == nil {
+			e.Keywords = map[string]bool{}
+		}
+
+		s.emails = append(s.emails, &e)
+		s.changed(e.ID, true, false)
+		created[k] = map[string]string{"id": e.ID, "blobId": e.BlobID}
+	}
+
+	s.notify()
+
+	return map[string]any{"accountId": accountID, "newState": strconv.Itoa(s.state), "created": created}, nil
+}
@@ -3,12 +3,23 @@ package mock
 import (
 	"context"
 	"io"
+	"net/http"
+	"sync"
 
 	"github.com/fho/rspamd-iscan/internal/rspamc"
 )
 
 type Rspamc struct {
 	CheckFn func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error)
+	// SpamFn is optional, it is called by Spam.
+	SpamFn func(context.Context, io.Reader, *rspamc.MailHeaders) error
+	// FuzzyAddFn is optional, it is called by FuzzyAdd.
+	FuzzyAddFn func(ctx context.Context, r io.Reader, hdr *rspamc.MailHeaders, flag, weight int) error
+	// FuzzyDelFn is optional, it is called by FuzzyDel.
+	FuzzyDelFn func(ctx context.Context, r io.Reader, hdr *rspamc.MailHeaders, flag int) error
+
+	mu        sync.Mutex
+	checkHdrs []http.Header
 }
 
 func NewRspamc() *Rspamc {
@@ -41,13 +52,43 @@ func CheckFnDefault(_ context.Context, _ io.Reader, hdr *rspamc.MailHeaders) (
 func (c *Rspamc) Check(ctx context.Context, r io.Reader, hdr *rspamc.MailHeaders) (
 	*rspamc.CheckResult, error,
 ) {
+	c.mu.Lock()
+	c.checkHdrs = append(c.checkHdrs, hdr.Header())
+	c.mu.Unlock()
+
 	return c.CheckFn(ctx, r, hdr)
 }
 
-func (*Rspamc) Spam(context.Context, io.Reader, *rspamc.MailHeaders) error {
+// CheckHeaders returns the HTTP headers of the Check requests, in the order
+// they were made.
+func (c *Rspamc) CheckHeaders() []http.Header {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.checkHdrs
+}
+
+func (c *Rspamc) Spam(ctx context.Context, r io.Reader, hdr *rspamc.MailHeaders) error {
+	if c.SpamFn != nil {
+		return c.SpamFn(ctx, r, hdr)
+	}
 	return nil
 }
 
 func (*Rspamc) Ham(context.Context, io.Reader, *rspamc.MailHeaders) error {
 	return nil
 }
+
+func (c *Rspamc) FuzzyAdd(ctx context.Context, r io.Reader, hdr *rspamc.MailHeaders, flag, weight int) error {
+	if c.FuzzyAddFn != nil {
+		return c.FuzzyAddFn(ctx, r, hdr, flag, weight)
+	}
+	return nil
+}
+
+func (c *Rspamc) FuzzyDel(ctx context.Context, r io.Reader, hdr *rspamc.MailHeaders, flag int) error {
+	if c.FuzzyDelFn != nil {
+		return c.FuzzyDelFn(ctx, r, hdr, flag)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+// Package pop3server provides a minimal in-memory POP3 server for tests.
+package pop3server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type Server struct {
+	UserName   string
+	UserPasswd string
+	ListenAddr string
+
+	ln net.Listener
+
+	mu     sync.Mutex
+	msgs   []*message
+	nextID int
+}
+
+type message struct {
+	uid  string
+	data []byte
+}
+
+// StartServer starts a POP3 server that listens on a random localhost port.
+// It is stopped when the test finishes.
+func StartServer(t *testing.T) *Server {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listening failed: %s", err)
+	}
+
+	srv := Server{
+		UserName:   "user",
+		UserPasswd: "none",
+		ListenAddr: ln.Addr().String(),
+		ln:         ln,
+	}
+
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(t, conn)
+		}
+	}()
+
+	return &srv
+}
+
+// AddMessage adds a message to the maildrop.
+// Lines of data must be terminated with CRLF.
+func (s *Server) AddMessage(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	s.msgs = append(s.msgs, &message{uid: "uid-" + strconv.Itoa(s.nextID), data: data})
+}
+
+// MessageCount returns the number of messages in the maildrop.
+func (s *Server) MessageCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.msgs)
+}
+
+func (s *Server) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+		_ = w.Flush()
+	}
+
+	var authenticated bool
+	var user string
+	var msgs []*message
+	deleted := map[int]bool{}
+
+	// msg returns the message for the 1-based number in arg
+	msg := func(arg string) (int, *message) {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(msgs) || deleted[n] {
+			return 0, nil
+		}
+		return n, msgs[n-1]
+	}
+
+	reply("+OK test server ready")
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			reply("-ERR empty command")
+			continue
+		}
+
+		cmd := strings.ToUpper(fields[0])
+		args := fields[1:]
+
+		if !authenticated {
+			switch {
+			case cmd == "USER" && len(args) == 1:
+				user = args[0]
+				reply("+OK")
+			case cmd == "PASS" && len(args) == 1:
+				if user != s.UserName || args[0] != s.UserPasswd {
+					reply("-ERR invalid credentials")
+					continue
+				}
+				authenticated = true
+				s.mu.Lock()
+				msgs = append([]*message(nil), s.msgs...)
+				s.mu.Unlock()
+				reply("+OK logged in")
+			case cmd == "QUIT":
+				reply("+OK bye")
+				return
+			default:
+				reply("-ERR unsupported command")
+			}
+			continue
+		}
+
+		switch cmd {
+		case "STAT":
+			var size int
+			for i, m := range msgs {
+				if !deleted[i+1] {
+					size += len(m.data)
+				}
+			}
+			reply("+OK %d %d", len(msgs)-len(deleted), size)
+		case "LIST", "UIDL":
+			reply("+OK")
+			for i, m := range msgs {
+				if deleted[i+1] {
+					continue
+				}
+				if cmd == "LIST" {
+					reply("%d %d", i+1, len(m.data))
+				} else {
+					reply("%d %s", i+1, m.uid)
+				}
+			}
+			reply(".")
+		case "RETR", "TOP":
+			if len(args) == 0 {
+				reply("-ERR argument missing")
+				continue
+			}
+
+			_, m := msg(args[0])
+			if m == nil {
+				reply("-ERR no such message")
+				continue
+			}
+
+			data := string(m.data)
+			if cmd == "TOP" {
+				hdr, _, _ := strings.Cut(data, "\r\n\r\n")
+				data = hdr + "\r\n\r\n"
+			}
+
+			reply("+OK")
+			for _, l := range strings.SplitAfter(data, "\r\n") {
+				if l == "" {
+					continue
+				}
+				if strings.HasPrefix(l, ".") {
+					l = "." + l
+				}
+				_, _ = w.WriteString(l)
+			}
+			reply(".")
+		case "DELE":
+			if len(args) == 0 {
+				reply("-ERR argument missing")
+				continue
+			}
+
+			n, m := msg(args[0])
+			if m == nil {
+				reply("-ERR no such message")
+				continue
+			}
+			deleted[n] = true
+			reply("+OK deleted")
+		case "NOOP":
+			reply("+OK")
+		case "QUIT":
+			s.mu.Lock()
+			for i, m := range msgs {
+				if !deleted[i+1] {
+					continue
+				}
+				for j, sm := range s.msgs {
+					if sm == m {
+						s.msgs = append(s.msgs[:j], s.msgs[j+1:]...)
+						break
+					}
+				}
+			}
+			s.mu.Unlock()
+			reply("+OK bye")
+			return
+		default:
+			t.Logf("pop3server: unsupported command: %q", line)
+			reply("-ERR unsupported command")
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Package smtpserver provides a minimal in-memory SMTP and LMTP server for
+// tests.
+package smtpserver
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type Server struct {
+	UserName   string
+	UserPasswd string
+	// ListenAddr is the TCP address or, for LMTP servers, the path of the
+	// unix socket.
+	ListenAddr string
+
+	lmtp bool
+	ln   net.Listener
+
+	mu    sync.Mutex
+	mails []*Mail
+	// rejected are recipients that are rejected by LMTP servers after
+	// the mail data was received.
+	rejected []string
+}
+
+// Mail is a mail that was received by the server.
+type Mail struct {
+	From string
+	To   []string
+	// Data is the received mail, the line endings are converted to LF.
+	Data []byte
+}
+
+// StartServer starts a SMTP server that listens on a random localhost port.
+// It is stopped when the test finishes.
+func StartServer(t *testing.T) *Server {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listening failed: %s", err)
+	}
+
+	return start(t, ln, false)
+}
+
+// StartLMTPServer starts a LMTP server that listens on a unix socket in a
+// temporary directory.
+// It is stopped when the test finishes.
+func StartLMTPServer(t *testing.T) *Server {
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "lmtp.sock"))
+	if err != nil {
+		t.Fatalf("listening failed: %s", err)
+	}
+
+	return start(t, ln, true)
+}
+
+func start(t *testing.T, ln net.Listener, lmtp bool) *Server {
+	srv := Server{
+		UserName:   "user",
+		UserPasswd: "none",
+		ListenAddr: ln.Addr().String(),
+		lmtp:       lmtp,
+		ln:         ln,
+	}
+
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(t, conn)
+		}
+	}()
+
+	return &srv
+}
+
+// RejectRecipient configures a LMTP server to reject the delivery to rcpt.
+func (s *Server) RejectRecipient(rcpt string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rejected = append(s.rejected, rcpt)
+}
+
+// Mails returns the mails that were received.
+func (s *Server) Mails() []*Mail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.mails)
+}
+
+func (s *Server) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	reply := func(format string, args ...any) {
+		if err := tp.PrintfLine(format, args...); err != nil {
+			t.Logf("smtpserver: writing response failed: %s", err)
+		}
+	}
+
+	reply("220 localhost test server")
+
+	var cur *Mail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "LHLO":
+			if (cmd == "LHLO") != s.lmtp {
+				reply("500 wrong protocol")
+				continue
+			}
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+
+		case "AUTH":
+			expected := base64.StdEncoding.EncodeToString(
+				[]byte("\x00" + s.UserName + "\x00" + s.UserPasswd),
+			)
+			if arg != "PLAIN "+expected {
+				reply("535 authentication failed")
+				continue
+			}
+			reply("235 authenticated")
+
+		case "MAIL":
+			from, ok := strings.CutPrefix(strings.ToUpper(arg), "FROM:")
+			if !ok {
+				reply("501 syntax error")
+				continue
+			}
+			cur = &Mail{From: strings.Trim(arg[len(arg)-len(from):], "<>")}
+			reply("250 ok")
+
+		case "RCPT":
+			if cur == nil {
+				reply("503 bad sequence of commands")
+				continue
+			}
+			to, ok := strings.CutPrefix(strings.ToUpper(arg), "TO:")
+			if !ok {
+				reply("501 syntax error")
+				continue
+			}
+			cur.To = append(cur.To, strings.Trim(arg[len(arg)-len(to):], "<>"))
+			reply("250 ok")
+
+		case "DATA":
+			if cur == nil || len(cur.To) == 0 {
+				reply("503 bad sequence of commands")
+				continue
+			}
+			reply("354 send data")
+
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			cur.Data = data
+
+			if !s.lmtp {
+				s.store(cur)
+				reply("250 ok")
+				cur = nil
+				continue
+			}
+
+			accepted := *cur
+			accepted.To = nil
+			var replies []string
+			for _, rcpt := range cur.To {
+				if s.isRejected(rcpt) {
+					replies = append(replies, "550 mailbox unavailable")
+					continue
+				}
+				accepted.To = append(accepted.To, rcpt)
+				replies = append(replies, "250 ok")
+			}
+			if len(accepted.To) > 0 {
+				s.store(&accepted)
+			}
+			for _, r := range replies {
+				reply("%s", r)
+			}
+			cur = nil
+
+		case "RSET":
+			cur = nil
+			reply("250 ok")
+
+		case "NOOP":
+			reply("250 ok")
+
+		case "QUIT":
+			reply("221 bye")
+			return
+
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+func (s *Server) store(m *Mail) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mails = append(s.mails, m)
+}
+
+func (s *Server) isRejected(rcpt string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Contains(s.rejected, rcpt)
+}
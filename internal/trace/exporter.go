@@ -0,0 +1,258 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// exporter batches ended spans and sends them to an OTLP/HTTP receiver.
+type exporter struct {
+	url         string
+	serviceName string
+	logger      *slog.Logger
+	httpClt     *http.Client
+
+	queue     chan *Span
+	stopCh    chan struct{}
+	doneCh    chan struct{}
+	closeOnce sync.Once
+}
+
+func newExporter(url, serviceName string, logger *slog.Logger) *exporter {
+	e := exporter{
+		url:         url,
+		serviceName: serviceName,
+		logger:      logger,
+		httpClt:     &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, defQueueSize),
+		stopCh:      make(chan struct{}),
+		doneCh:      make(chan struct{}),
+	}
+
+	go e.run()
+
+	return &e
+}
+
+func (e *exporter) enqueue(s *Span) {
+	select {
+	case <-e.stopCh:
+		return
+	default:
+	}
+
+	select {
+	case e.queue <- s:
+	default:
+		e.logger.Warn("dropping span, export queue is full", "span", s.name)
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.doneCh)
+
+	batch := make([]*Span, 0, defMaxBatchSize)
+	ticker := time.NewTicker(defFlushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := e.export(batch); err != nil {
+			e.logger.Warn("exporting spans failed", "error", err, "count", len(batch))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= defMaxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stopCh:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *exporter) shutdown(ctx context.Context) error {
+	e.closeOnce.Do(func() { close(e.stopCh) })
+
+	select {
+	case <-e.doneCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *exporter) export(spans []*Span) error {
+	buf, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.httpClt.Post(e.url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("request failed with status: %s, body: %q", resp.Status, body)
+	}
+
+	return nil
+}
+
+// The types below are the subset of the OTLP JSON encoding that is needed
+// to export spans:
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusCodeOK     = 1
+	otlpStatusCodeError  = 2
+)
+
+func (e *exporter) request(spans []*Span) *otlpRequest {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, s.asOTLP())
+	}
+
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{asOTLPKeyValue(String("service.name", e.serviceName))},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/fho/rspamd-iscan"},
+				Spans: otlpSpans,
+			}},
+		}},
+	}
+}
+
+func (s *Span) asOTLP() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        make([]otlpKeyValue, 0, len(s.attrs)),
+		Status:            otlpStatus{Code: otlpStatusCodeOK},
+	}
+
+	for _, a := range s.attrs {
+		result.Attributes = append(result.Attributes, asOTLPKeyValue(a))
+	}
+
+	if s.failed {
+		result.Status = otlpStatus{Code: otlpStatusCodeError, Message: s.errMsg}
+	}
+
+	return result
+}
+
+func asOTLPKeyValue(a Attr) otlpKeyValue {
+	var v otlpValue
+
+	switch val := a.Value.(type) {
+	case string:
+		v.StringValue = &val
+	case int64:
+		s := strconv.FormatInt(val, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &val
+	case bool:
+		v.BoolValue = &val
+	default:
+		s := fmt.Sprint(val)
+		v.StringValue = &s
+	}
+
+	return otlpKeyValue{Key: a.Key, Value: v}
+}
@@ -0,0 +1,174 @@
+// Package trace records spans and exports them to an OpenTelemetry collector
+// via OTLP/HTTP with JSON encoding.
+//
+// A nil [*Tracer] and the spans it returns are valid and do nothing, this
+// allows to instrument code unconditionally.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+)
+
+const (
+	defFlushInterval = 5 * time.Second
+	defMaxBatchSize  = 512
+	defQueueSize     = 4096
+)
+
+type Config struct {
+	// Endpoint is the base URL of the OTLP/HTTP receiver, e.g.
+	// "http://localhost:4318". Spans are sent to Endpoint + "/v1/traces".
+	Endpoint string
+	// ServiceName is sent as service.name resource attribute.
+	ServiceName string
+	Logger      *slog.Logger
+}
+
+type Tracer struct {
+	exp *exporter
+}
+
+// NewTracer creates a tracer that exports spans to cfg.Endpoint.
+// [Tracer.Shutdown] must be called to export pending spans and release
+// resources.
+func NewTracer(cfg *Config) *Tracer {
+	return &Tracer{
+		exp: newExporter(
+			cfg.Endpoint+"/v1/traces",
+			cfg.ServiceName,
+			log.Module(cfg.Logger, "trace"),
+		),
+	}
+}
+
+type spanKey struct{}
+
+// Start creates a new span that is a child of the span in ctx.
+// If ctx does not contain a span, a new trace is started.
+// The returned context contains the new span.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...Attr) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := Span{
+		tracer: t,
+		name:   name,
+		start:  time.Now(),
+		attrs:  attrs,
+		spanID: newID(8),
+	}
+
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.traceID = newID(16)
+	}
+
+	return context.WithValue(ctx, spanKey{}, &s), &s
+}
+
+// Shutdown exports all pending spans.
+// Spans that are ended afterwards are discarded.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	return t.exp.shutdown(ctx)
+}
+
+// Span represents an operation.
+type Span struct {
+	tracer   *Tracer
+	name     string
+	traceID  string
+	spanID   string
+	parentID string
+	start    time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []Attr
+	errMsg string
+	failed bool
+	ended  bool
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed when err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.failed = true
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// End completes the span and queues it for exporting.
+// Calls after the first one have no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.exp.enqueue(s)
+}
+
+// Attr is a key-value pair that describes a span.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+func String(key, value string) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+func Int(key string, value int64) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+func Float(key string, value float64) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+func Bool(key string, value bool) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+func newID(n int) string {
+	buf := make([]byte, n)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
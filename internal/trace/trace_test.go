@@ -0,0 +1,71 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestExportSpans(t *testing.T) {
+	reqCh := make(chan *otlpRequest, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected request path: %q", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request failed: %s", err)
+		}
+		reqCh <- &req
+	}))
+	t.Cleanup(srv.Close)
+
+	tracer := NewTracer(&Config{
+		Endpoint:    srv.URL,
+		ServiceName: "test",
+		Logger:      log.SlogTestLogger(t),
+	})
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	_, child := tracer.Start(ctx, "child", Int("mail.uid", 7))
+	child.SetError(errors.New("failed"))
+	child.End()
+	root.End()
+
+	assert.NoError(t, tracer.Shutdown(context.Background()))
+
+	req := <-reqCh
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "test", *req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+
+	c, r := spans[0], spans[1]
+	assert.Equal(t, "child", c.Name)
+	assert.Equal(t, "root", r.Name)
+	assert.Equal(t, r.TraceID, c.TraceID)
+	assert.Equal(t, r.SpanID, c.ParentSpanID)
+	assert.Equal(t, "", r.ParentSpanID)
+	assert.Equal(t, otlpStatusCodeError, c.Status.Code)
+	assert.Equal(t, otlpStatusCodeOK, r.Status.Code)
+	assert.Equal(t, "mail.uid", c.Attributes[0].Key)
+	assert.Equal(t, "7", *c.Attributes[0].Value.IntValue)
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+
+	ctx, span := tracer.Start(context.Background(), "noop")
+	span.SetAttributes(String("k", "v"))
+	span.SetError(errors.New("err"))
+	span.End()
+
+	assert.Equal(t, context.Background(), ctx)
+	assert.NoError(t, tracer.Shutdown(ctx))
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/fho/rspamd-iscan/internal/admin"
+	"github.com/fho/rspamd-iscan/internal/audit"
+	"github.com/fho/rspamd-iscan/internal/clamav"
 	"github.com/fho/rspamd-iscan/internal/config"
+	"github.com/fho/rspamd-iscan/internal/forward"
 	"github.com/fho/rspamd-iscan/internal/iscan"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/notify"
 	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/stats"
+	"github.com/fho/rspamd-iscan/internal/trace"
 
 	flag "github.com/spf13/pflag"
 )
@@ -21,10 +33,15 @@ var (
 )
 
 type flags struct {
-	cfgPath      string
+	cfgPath string
+	// cfgPathSet is true if the config file path was passed explicitly.
+	cfgPathSet   bool
 	printVersion bool
 	once         bool
 	dryRun       bool
+	// args are the positional arguments, the first one is the name of
+	// the subcommand.
+	args []string
 }
 
 func mustParseFlags() *flags {
@@ -41,8 +58,14 @@ func mustParseFlags() *flags {
 		"simulates modifying operations on the IMAP server, also enables --once",
 	)
 
+	flag.Usage = usage
+	// flags after the subcommand name belong to the subcommand
+	flag.CommandLine.SetInterspersed(false)
 	flag.Parse()
 
+	result.args = flag.Args()
+	result.cfgPathSet = flag.CommandLine.Changed("cfg-file")
+
 	if result.dryRun {
 		result.once = true
 	}
@@ -50,20 +73,79 @@ func mustParseFlags() *flags {
 	return &result
 }
 
-func configureLogger() *slog.Logger {
-	h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-		Level: slog.LevelDebug,
-		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
-			// do not log timestamp, rspamd-iscan is normally run as
-			// daemon, journald/syslog already adds timestamps
-			if a.Key == slog.TimeKey {
-				return slog.Attr{}
-			}
-			return a
-		},
+// configureLogger creates the logger according to the configuration.
+// The log output stays open until the process terminates, it does not
+// buffer data.
+func configureLogger(cfg *config.Config) (*slog.Logger, error) {
+	logger, _, err := log.New(&log.Config{
+		Format:         cfg.LogFormat,
+		Output:         cfg.LogOutput,
+		FileMaxSize:    cfg.LogFileMaxSize,
+		FileMaxBackups: cfg.LogFileMaxBackups,
+		Level:          cfg.LogLevel,
+		ModuleLevels:   cfg.LogLevels,
 	})
 
-	return slog.New(h)
+	return logger, err
+}
+
+// env contains the dependencies of the scanner process and subcommands.
+type env struct {
+	cfg    *config.Config
+	flags  *flags
+	logger *slog.Logger
+	rspamc *rspamc.Client
+	// scanner checks the mails, it is rspamc or a chain of clamd and
+	// rspamc.
+	scanner iscan.RspamdClient
+	tracer  *trace.Tracer
+	// stats is nil when recording statistics is disabled.
+	stats *stats.Store
+	// audit is nil when the audit log is disabled.
+	audit *audit.Log
+	// notifier is nil when no notifiers are configured.
+	notifier *notify.Dispatcher
+	// admin is nil when the admin API is disabled.
+	admin *admin.Server
+}
+
+// scanner processes the mails of an account.
+type scanner interface {
+	RunOnce() error
+	Monitor() error
+	Stop() error
+	ScanNow(ctx context.Context) error
+}
+
+// cycleNotifier returns the notifier that the scanners pass the results of
+// their scan cycles to, nil is returned if there is none.
+func cycleNotifier(env *env) iscan.Notifier {
+	var result cycleNotifiers
+
+	if env.notifier != nil {
+		result = append(result, env.notifier)
+	}
+	if env.admin != nil {
+		result = append(result, env.admin)
+	}
+
+	switch len(result) {
+	case 0:
+		return nil
+	case 1:
+		return result[0]
+	default:
+		return result
+	}
+}
+
+// cycleNotifiers passes the results of scan cycles to multiple notifiers.
+type cycleNotifiers []iscan.Notifier
+
+func (n cycleNotifiers) ScanCycleDone(ctx context.Context, r *notify.CycleResult) {
+	for _, notifier := range n {
+		notifier.ScanCycleDone(ctx, r)
+	}
 }
 
 var handledSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
@@ -72,7 +154,7 @@ func removeSigHandler() {
 	signal.Reset(handledSignals...)
 }
 
-func installSigHandler(logger *slog.Logger, clt *iscan.Client) {
+func installSigHandler(logger *slog.Logger, clt scanner) {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, handledSignals...)
 
@@ -93,98 +175,319 @@ func installSigHandler(logger *slog.Logger, clt *iscan.Client) {
 	}()
 }
 
-func newIscanClient(
-	cfg *config.Config,
-	flags *flags,
-	logger *slog.Logger,
-	rspamc iscan.RspamdClient,
-) (*iscan.Client, error) {
+func newIscanClient(env *env) (*iscan.Client, error) {
+	cfg := env.cfg
+
 	iscanCfg := iscan.Config{
+		Protocol:              iscan.Protocol(cfg.Protocol),
 		ServerAddr:            cfg.ImapAddr,
 		User:                  cfg.ImapUser,
 		Password:              cfg.ImapPassword,
+		IMAPCompression:       cfg.ImapCompress,
+		IMAPPoolSize:          cfg.ImapPoolSize,
+		IMAPNotify:            cfg.ImapNotify,
+		Gmail:                 cfg.Gmail,
+		CreateMailboxes:       cfg.CreateMailboxes,
+		IMAPConnectTimeout:    time.Duration(cfg.ImapConnectTimeout),
+		IMAPSelectTimeout:     time.Duration(cfg.ImapSelectTimeout),
+		IMAPFetchTimeout:      time.Duration(cfg.ImapFetchTimeout),
+		JMAPToken:             cfg.JmapToken,
+		JMAPStateFile:         cfg.JmapStateFile,
 		ScanMailbox:           cfg.ScanMailbox,
 		InboxMailbox:          cfg.InboxMailbox,
 		HamMailbox:            cfg.HamMailbox,
 		SpamMailboxName:       cfg.SpamMailbox,
 		UndetectedMailboxName: cfg.UndetectedMailbox,
 		BackupMailbox:         cfg.BackupMailbox,
+		FuzzyMailbox:          cfg.FuzzyMailbox,
+		FuzzyFlag:             cfg.FuzzyFlag,
+		FuzzyWeight:           cfg.FuzzyWeight,
 		SpamTreshold:          cfg.SpamThreshold,
+		MaxMessageSize:        cfg.MaxMessageSize,
+		OversizedAction:       iscan.OversizedAction(cfg.OversizedAction),
+		TooLargeMailbox:       cfg.TooLargeMailbox,
+		HeaderPreScan:         cfg.HeaderPreScan,
+		ScanResultSecret:      cfg.ScanResultSecret,
+		ScannedKeyword:        cfg.ScannedKeyword,
+		SpamLearnedKeyword:    cfg.SpamLearnedKeyword,
+		SpamFlags:             cfg.SpamFlags,
+		BorderlineFlags:       cfg.BorderlineFlags,
+		BorderlineThreshold:   cfg.BorderlineThreshold,
+		ScanSearch:            cfg.ScanSearch,
+		ScanFailedMailbox:     cfg.ScanFailedMailbox,
+		ScanFailedKeyword:     cfg.ScanFailedKeyword,
+		SpamRetention:         time.Duration(cfg.SpamRetention),
+		ScanFailedRetention:   time.Duration(cfg.ScanFailedRetention),
+		LearnExpiredSpam:      cfg.LearnExpiredSpam,
+		MaxScanAttempts:       cfg.MaxScanAttempts,
+		AllowlistSenders:      cfg.AllowlistSenders,
+		BlocklistSenders:      cfg.BlocklistSenders,
+		DegradedFiltering:     cfg.DegradedFiltering,
+		GreylistDelay:         time.Duration(cfg.GreylistDelay),
+		ScanCacheFile:         cfg.ScanCacheFile,
+		ScanCacheTTL:          time.Duration(cfg.ScanCacheTTL),
+		MinPollInterval:       time.Duration(cfg.MinPollInterval),
+		MaxPollInterval:       time.Duration(cfg.MaxPollInterval),
+		PollJitter:            time.Duration(cfg.PollJitter),
+		ShutdownTimeout:       time.Duration(cfg.ShutdownTimeout),
+		RspamdDeliverTo:       cfg.RspamdDeliverTo,
+		RspamdUser:            cfg.RspamdUser,
+		ScoreOverrides:        cfg.ScoreOverrides,
+		PartFilters:           partFilters(cfg),
+		SubjectTag:            cfg.SubjectTag,
+		SubjectTagThreshold:   cfg.SubjectTagThreshold,
+		ApplyMilterHeaders:    cfg.ApplyMilterHeaders,
+		DeduplicateMessages:   cfg.DeduplicateMessages,
+		BackscatterMailbox:    cfg.BackscatterMailbox,
+		SpamArchiveMailbox:    cfg.SpamArchiveMailbox,
+		BackscatterFuzzy:      cfg.BackscatterFuzzy,
+		OwnSenders:            cfg.OwnSenders,
 		TempDir:               cfg.TempDir,
 		KeepTempFiles:         cfg.KeepTempFiles,
-		Logger:                logger,
-		Rspamc:                rspamc,
-		DryRun:                flags.dryRun,
+		SpoolThreshold:        cfg.SpoolThreshold,
+		MemoryBudget:          cfg.MemoryBudget,
+		Logger:                env.logger,
+		Tracer:                env.tracer,
+		Rspamc:                env.scanner,
+		Stats:                 env.stats,
+		Audit:                 env.audit,
+		DryRun:                env.flags.dryRun,
+	}
+	for _, p := range cfg.FolderPolicies {
+		iscanCfg.FolderPolicies = append(iscanCfg.FolderPolicies, &iscan.FolderPolicy{
+			Mailbox:       p.Mailbox,
+			Action:        iscan.PolicyAction(p.Action),
+			SpamThreshold: p.SpamThreshold,
+			Keywords:      p.Keywords,
+		})
+	}
+	if n := cycleNotifier(env); n != nil {
+		iscanCfg.Notifier = n
+	}
+
+	fwd, err := newForwarder(env)
+	if err != nil {
+		return nil, err
+	}
+	if fwd != nil {
+		iscanCfg.Forwarder = fwd
 	}
 
 	clt, err := iscan.NewClient(&iscanCfg)
 	if err != nil {
-		logger.Error("creating iscan client failed", "error", err)
+		env.logger.Error("creating iscan client failed", "error", err)
 	}
 
 	return clt, err
 }
 
-func runOnceAndTerminate(
-	cfg *config.Config,
-	flags *flags,
-	logger *slog.Logger,
-	rspamc iscan.RspamdClient,
-) {
-	clt, err := newIscanClient(cfg, flags, logger, rspamc)
+// partFilters returns the MIME part filters of cfg.
+func partFilters(cfg *config.Config) []*mail.PartFilter {
+	result := make([]*mail.PartFilter, 0, len(cfg.PartFilters))
+	for _, f := range cfg.PartFilters {
+		result = append(result, &mail.PartFilter{
+			ContentType: f.ContentType,
+			MaxSize:     f.MaxSize,
+			Truncate:    f.Truncate,
+		})
+	}
+
+	return result
+}
+
+// newForwarder returns the configured forwarder, if forwarding is disabled
+// nil is returned.
+func newForwarder(env *env) (*forward.Forwarder, error) {
+	cfg := env.cfg
+
+	if len(cfg.ForwardTo) == 0 {
+		return nil, nil
+	}
+
+	if cfg.ForwardProtocol != "smtp" && cfg.ForwardProtocol != "lmtp" {
+		err := fmt.Errorf("unsupported ForwardProtocol: %q", cfg.ForwardProtocol)
+		env.logger.Error(err.Error())
+		return nil, err
+	}
+
+	fwd, err := forward.New(&forward.Config{
+		Address:       cfg.ForwardAddr,
+		LMTP:          cfg.ForwardProtocol == "lmtp",
+		User:          cfg.ForwardUser,
+		Password:      cfg.ForwardPassword,
+		AllowInsecure: cfg.ForwardAllowInsecure,
+		From:          cfg.ForwardFrom,
+		To:            cfg.ForwardTo,
+		Logger:        env.logger,
+	})
+	if err != nil {
+		env.logger.Error("creating forwarder failed", "error", err)
+	}
+
+	return fwd, err
+}
+
+func newPOP3Scanner(env *env) (*iscan.POP3Scanner, error) {
+	cfg := env.cfg
+
+	pop3Cfg := iscan.POP3Config{
+		ServerAddr:      cfg.ImapAddr,
+		User:            cfg.ImapUser,
+		Password:        cfg.ImapPassword,
+		SpamTreshold:    cfg.SpamThreshold,
+		SpamAction:      iscan.POP3SpamAction(cfg.Pop3SpamAction),
+		MinPollInterval: time.Duration(cfg.MinPollInterval),
+		MaxPollInterval: time.Duration(cfg.MaxPollInterval),
+		PollJitter:      time.Duration(cfg.PollJitter),
+		ShutdownTimeout: time.Duration(cfg.ShutdownTimeout),
+		RspamdDeliverTo: cfg.RspamdDeliverTo,
+		RspamdUser:      cfg.RspamdUser,
+		ScoreOverrides:  cfg.ScoreOverrides,
+		PartFilters:     partFilters(cfg),
+		Logger:          env.logger,
+		Tracer:          env.tracer,
+		Rspamc:          env.scanner,
+		Stats:           env.stats,
+		Audit:           env.audit,
+		DryRun:          env.flags.dryRun,
+	}
+	if n := cycleNotifier(env); n != nil {
+		pop3Cfg.Notifier = n
+	}
+
+	fwd, err := newForwarder(env)
 	if err != nil {
-		os.Exit(1)
+		return nil, err
+	}
+	if fwd != nil {
+		pop3Cfg.Forwarder = fwd
 	}
 
+	s, err := iscan.NewPOP3Scanner(&pop3Cfg)
+	if err != nil {
+		env.logger.Error("creating pop3 scanner failed", "error", err)
+	}
+
+	return s, err
+}
+
+func newMaildirScanner(env *env) (*iscan.MaildirScanner, error) {
+	cfg := env.cfg
+
+	maildirCfg := iscan.MaildirConfig{
+		Path:               cfg.MaildirPath,
+		SpamFolder:         cfg.MaildirSpamFolder,
+		AddHeaders:         cfg.MaildirAddHeaders,
+		StateFile:          cfg.MaildirStateFile,
+		ApplyMilterHeaders: cfg.ApplyMilterHeaders,
+		SpamTreshold:       cfg.SpamThreshold,
+		MinPollInterval:    time.Duration(cfg.MinPollInterval),
+		MaxPollInterval:    time.Duration(cfg.MaxPollInterval),
+		PollJitter:         time.Duration(cfg.PollJitter),
+		ShutdownTimeout:    time.Duration(cfg.ShutdownTimeout),
+		RspamdDeliverTo:    cfg.RspamdDeliverTo,
+		RspamdUser:         cfg.RspamdUser,
+		ScoreOverrides:     cfg.ScoreOverrides,
+		PartFilters:        partFilters(cfg),
+		Logger:             env.logger,
+		Tracer:             env.tracer,
+		Rspamc:             env.scanner,
+		Stats:              env.stats,
+		Audit:              env.audit,
+		DryRun:             env.flags.dryRun,
+	}
+	if n := cycleNotifier(env); n != nil {
+		maildirCfg.Notifier = n
+	}
+
+	s, err := iscan.NewMaildirScanner(&maildirCfg)
+	if err != nil {
+		env.logger.Error("creating maildir scanner failed", "error", err)
+	}
+
+	return s, err
+}
+
+// newScanner creates the scanner for the configured protocol.
+func newScanner(env *env) (scanner, error) {
+	switch env.cfg.Protocol {
+	case "imap", "jmap":
+		return newIscanClient(env)
+	case "pop3":
+		return newPOP3Scanner(env)
+	case "maildir":
+		return newMaildirScanner(env)
+	default:
+		err := fmt.Errorf("unsupported Protocol: %q", env.cfg.Protocol)
+		env.logger.Error(err.Error())
+		return nil, err
+	}
+}
+
+// runOnce processes the mailboxes once and returns the exit code.
+func runOnce(env *env) int {
+	clt, err := newScanner(env)
+	if err != nil {
+		return 1
+	}
+	defer func() { _ = clt.Stop() }()
+
+	installSigHandler(env.logger, clt)
+	defer removeSigHandler()
+
 	if err := clt.RunOnce(); err != nil {
-		logger.Error(err.Error())
-		os.Exit(1)
+		env.logger.Error(err.Error())
+		return 1
 	}
-	os.Exit(0)
+
+	return 0
 }
 
-func mustMonitorUntilFatalError(
-	cfg *config.Config,
-	flags *flags,
-	logger *slog.Logger,
-	rspamc iscan.RspamdClient,
-) {
+// monitorUntilFatalError monitors the mailboxes until a non-retryable error
+// happens or the process is terminated and returns the exit code.
+func monitorUntilFatalError(env *env) int {
 	for {
-		err := monitor(cfg, flags, logger, rspamc)
+		err := monitor(env)
 		if err != nil {
 			rError := &iscan.ErrRetryable{}
 			if !errors.As(err, &rError) {
-				logger.Error("non-retryable error occurred, terminating", "error", err)
-				os.Exit(1)
+				env.logger.Error("non-retryable error occurred, terminating", "error", err)
+				env.notifier.Notify(context.Background(), &notify.Event{
+					Type:    notify.EventErrorStreak,
+					Title:   "rspamd-iscan terminated",
+					Message: fmt.Sprintf("rspamd-iscan terminated because of an error: %s", err),
+					Error:   err.Error(),
+				})
+				return 1
 			}
 
-			logger.Error("retryable error occurred, restarting iscan monitoring process", "error", err)
+			env.logger.Error("retryable error occurred, restarting iscan monitoring process", "error", err)
 			continue
 		}
 
-		logger.Info("iscan process terminated normally, shutting down")
-		os.Exit(0)
+		env.logger.Info("iscan process terminated normally, shutting down")
+		return 0
 	}
 }
 
-func monitor(
-	cfg *config.Config,
-	flags *flags,
-	logger *slog.Logger,
-	rspamc iscan.RspamdClient,
-) error {
-	clt, err := newIscanClient(cfg, flags, logger, rspamc)
+func monitor(env *env) error {
+	clt, err := newScanner(env)
 	if err != nil {
 		return err
 	}
 
-	installSigHandler(logger, clt)
+	installSigHandler(env.logger, clt)
 	defer removeSigHandler()
 
+	if env.admin != nil {
+		env.admin.SetScanner(clt)
+		defer env.admin.SetScanner(nil)
+	}
+
 	err = clt.Monitor()
 	if err != nil {
 		_ = clt.Stop()
-		return fmt.Errorf("monitoring imap mailboxes failed: %w", err)
+		return fmt.Errorf("monitoring mailboxes failed: %w", err)
 	}
 
 	_ = clt.Stop()
@@ -198,30 +501,150 @@ func main() {
 		os.Exit(0)
 	}
 
-	logger := configureLogger()
-
 	cfg, err := config.FromFile(flags.cfgPath)
 	if err != nil {
-		logger.Error("loading config failed", "error", err)
+		// the configuration can be passed completely via environment
+		// variables
+		if !errors.Is(err, fs.ErrNotExist) || flags.cfgPathSet {
+			fmt.Fprintf(os.Stderr, "loading config failed: %s\n", err)
+			os.Exit(1)
+		}
+		cfg = &config.Config{}
+	}
+
+	if err := cfg.ApplyEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "applying environment variables failed: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.ResolveSecrets(); err != nil {
+		fmt.Fprintf(os.Stderr, "loading secrets failed: %s\n", err)
 		os.Exit(1)
 	}
 
 	cfg.SetDefaults()
-	fmt.Print(cfg.String())
+
+	logger, err := configureLogger(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "configuring logger failed: %s\n", err)
+		os.Exit(1)
+	}
 
 	// TODO: allow passing all attrs as single URL to rspamc http client
-	rspamc := rspamc.New(logger, cfg.RspamdURL, cfg.RspamdPassword)
+	rspamc := rspamc.New(&rspamc.Config{
+		URL:                     cfg.RspamdURL,
+		URLs:                    cfg.RspamdURLs,
+		ControllerURLs:          cfg.RspamdControllerURLs,
+		HealthCheckInterval:     time.Duration(cfg.RspamdHealthCheck),
+		Password:                cfg.RspamdPassword,
+		RateLimit:               cfg.RspamdRateLimit,
+		RateBurst:               cfg.RspamdRateBurst,
+		ScanTimeout:             time.Duration(cfg.RspamdScanTimeout),
+		LearnTimeout:            time.Duration(cfg.RspamdLearnTimeout),
+		CircuitBreakerThreshold: cfg.RspamdCircuitBreaker,
+		CircuitBreakerTimeout:   time.Duration(cfg.RspamdCircuitTimeout),
+		Logger:                  logger,
+	})
+
+	env := env{
+		cfg:     cfg,
+		flags:   flags,
+		logger:  logger,
+		rspamc:  rspamc,
+		scanner: rspamc,
+	}
+
+	if cfg.ClamdAddr != "" {
+		env.scanner = iscan.NewChainScanner(rspamc, clamav.New(&clamav.Config{
+			Addr:    cfg.ClamdAddr,
+			Timeout: time.Duration(cfg.ClamdTimeout),
+			Score:   cfg.ClamdScore,
+			Logger:  logger,
+		}))
+	}
+
+	if len(flags.args) != 0 {
+		os.Exit(runCommand(&env, flags.args))
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		env.tracer = trace.NewTracer(&trace.Config{
+			Endpoint:    cfg.OTLPEndpoint,
+			ServiceName: cfg.TraceServiceName,
+			Logger:      logger,
+		})
+	}
+
+	// in dry-run mode mails are processed again on every run
+	if cfg.StatsFile != "" && !flags.dryRun {
+		env.stats, err = stats.Open(cfg.StatsFile, cfg.StatsAccount())
+		if err != nil {
+			// starting with empty statistics would overwrite the
+			// file on the next save
+			logger.Error("loading statistics failed",
+				"error", err, "path", cfg.StatsFile, "event", "stats.load_failed")
+			os.Exit(1)
+		}
+	}
+
+	if cfg.AuditLog != "" && !flags.dryRun {
+		env.audit, err = audit.Open(&audit.Config{
+			Path:     cfg.AuditLog,
+			Account:  cfg.StatsAccount(),
+			MaxSize:  cfg.AuditLogMaxSize,
+			MaxFiles: cfg.AuditLogMaxFiles,
+			Logger:   logger,
+		})
+		if err != nil {
+			logger.Error("opening audit log failed",
+				"error", err, "path", cfg.AuditLog, "event", "audit.open_failed")
+			os.Exit(1)
+		}
+	}
+
+	env.notifier, err = newNotifier(&env)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	// the admin API operates on the monitoring scanner
+	if cfg.AdminToken != "" && !flags.once {
+		env.admin, err = startAdminServer(&env)
+		if err != nil {
+			os.Exit(1)
+		}
+	}
+
+	fmt.Print(cfg.String())
 
 	// TODO: print flag configuration together with config attributes list
 	if flags.dryRun {
 		fmt.Println("--dry-run enabled, IMAP mailboxes are not modified")
 	}
 
+	var exitCode int
 	if flags.once {
 		fmt.Printf("Running 1x and terminating (--once).\n\n")
-		runOnceAndTerminate(cfg, flags, logger, rspamc)
+		exitCode = runOnce(&env)
 	} else {
 		fmt.Printf("Monitoring IMAP mailboxes continuously.\n\n")
-		mustMonitorUntilFatalError(cfg, flags, logger, rspamc)
+		exitCode = monitorUntilFatalError(&env)
+	}
+
+	shutdownAdminServer(&env)
+	shutdownTracer(&env)
+	if err := env.audit.Close(); err != nil {
+		logger.Warn("closing audit log failed", "error", err, "path", cfg.AuditLog)
+	}
+	os.Exit(exitCode)
+}
+
+// shutdownTracer exports pending spans.
+func shutdownTracer(env *env) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := env.tracer.Shutdown(ctx); err != nil {
+		env.logger.Warn("exporting pending trace spans failed", "error", err)
 	}
 }
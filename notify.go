@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/config"
+	"github.com/fho/rspamd-iscan/internal/notify"
+	"github.com/fho/rspamd-iscan/internal/smtpclt"
+)
+
+// newNotifier returns the dispatcher for the configured notifiers, if none are
+// configured nil is returned.
+func newNotifier(env *env) (*notify.Dispatcher, error) {
+	cfg := env.cfg
+
+	if len(cfg.Notifiers) == 0 {
+		return nil, nil
+	}
+
+	targets := make([]*notify.Target, 0, len(cfg.Notifiers))
+	for i, n := range cfg.Notifiers {
+		t, err := newNotifyTarget(env, n)
+		if err != nil {
+			err = fmt.Errorf("invalid Notifiers[%d]: %w", i, err)
+			env.logger.Error(err.Error())
+			return nil, err
+		}
+
+		targets = append(targets, t)
+	}
+
+	return notify.New(&notify.Config{
+		Targets:        targets,
+		Account:        cfg.StatsAccount(),
+		ErrorStreak:    cfg.NotifyErrorStreak,
+		DigestInterval: time.Duration(cfg.NotifyDigestInterval),
+		Logger:         env.logger,
+	}), nil
+}
+
+func newNotifyTarget(env *env, n *config.Notifier) (*notify.Target, error) {
+	t := notify.Target{Name: n.Type}
+
+	for _, e := range n.Events {
+		if !slices.Contains(notify.EventTypes, notify.EventType(e)) {
+			return nil, fmt.Errorf("unsupported event: %q", e)
+		}
+		t.Events = append(t.Events, notify.EventType(e))
+	}
+
+	switch n.Type {
+	case "ntfy":
+		if n.URL == "" {
+			return nil, errors.New("url is empty")
+		}
+		t.Notifier = &notify.Ntfy{URL: n.URL, Token: n.Token}
+
+	case "telegram":
+		if n.Token == "" || n.ChatID == "" {
+			return nil, errors.New("token and chat id must be set")
+		}
+		t.Notifier = &notify.Telegram{Token: n.Token, ChatID: n.ChatID}
+
+	case "email":
+		if n.Addr == "" || len(n.To) == 0 {
+			return nil, errors.New("addr and to must be set")
+		}
+		from := n.From
+		if from == "" {
+			from = n.To[0]
+		}
+		t.Notifier = &notify.Email{
+			Sender: smtpclt.NewClient(&smtpclt.Config{
+				Address:       n.Addr,
+				User:          n.User,
+				Password:      n.Password,
+				AllowInsecure: n.AllowInsecure,
+				Logger:        env.logger,
+			}),
+			From: from,
+			To:   n.To,
+		}
+
+	case "exec":
+		if n.Command == "" {
+			return nil, errors.New("command is empty")
+		}
+		t.Notifier = &notify.Exec{Command: n.Command}
+
+	default:
+		return nil, fmt.Errorf("unsupported type: %q", n.Type)
+	}
+
+	return &t, nil
+}